@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/unklstewy/redbug_dewey/handlers"
+	"github.com/unklstewy/redbug_dewey/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration read from config as a string such as "24h"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Config is the server configuration. LoadConfig reads it from a JSON or
+// YAML file, then applies DEWEY_* environment overrides.
+type Config struct {
+	ListenAddr         string   `json:"listen_addr" yaml:"listen_addr"`
+	DBPath             string   `json:"db_path" yaml:"db_path"`
+	BackupDir          string   `json:"backup_dir" yaml:"backup_dir"`   // where POST /backup writes
+	BackupRoot         string   `json:"backup_root" yaml:"backup_root"` // where scheduled backups go
+	BackupInterval     Duration `json:"backup_interval" yaml:"backup_interval"`
+	MaintenanceStart   string   `json:"maintenance_start" yaml:"maintenance_start"` // HH:MM local time
+	MaintenanceEnd     string   `json:"maintenance_end" yaml:"maintenance_end"`
+	BackupTypes        []string `json:"backup_types" yaml:"backup_types"`
+	BackupPathTemplate string   `json:"backup_path_template" yaml:"backup_path_template"` // utils.DefaultBackupPathTemplate if empty
+	CaptureBufferDir   string   `json:"capture_buffer_dir" yaml:"capture_buffer_dir"`     // working directory if empty
+	ReconnectMin       Duration `json:"reconnect_min" yaml:"reconnect_min"`               // first retry delay while degraded
+	ReconnectMax       Duration `json:"reconnect_max" yaml:"reconnect_max"`
+	// IngestTargets maps capture sources to a typed schema (strace, serial
+	// or dfu); other sources use the generic timeseries table
+	IngestTargets map[string]string `json:"ingest_targets" yaml:"ingest_targets"`
+	// BackupSkipUnchanged skips a scheduled backup when the DB's
+	// fingerprint hasn't changed since the last one
+	BackupSkipUnchanged bool `json:"backup_skip_unchanged" yaml:"backup_skip_unchanged"`
+	// BackupFullFingerprint has BackupSkipUnchanged hash every row, so it
+	// also notices updates, at the cost of reading the whole DB each run
+	BackupFullFingerprint bool `json:"backup_full_fingerprint" yaml:"backup_full_fingerprint"`
+	// BackupRetention maps backup types to how many scheduled backups of
+	// that type to keep; types not listed are kept forever
+	BackupRetention map[string]RetentionConfig `json:"backup_retention" yaml:"backup_retention"`
+	// BackupCompress gzips scheduled full and SQL backups (.db.gz, .sql.gz)
+	BackupCompress bool `json:"backup_compress" yaml:"backup_compress"`
+	// BackupOnDuplicate is what a scheduled backup does when one is already
+	// at its path: "suffix" (the default) numbers it, "skip" skips it
+	BackupOnDuplicate string `json:"backup_on_duplicate" yaml:"backup_on_duplicate"`
+	// RateLimits maps endpoint classes (backup, export) to their per-user
+	// limit; classes not listed keep their DefaultRateLimits entry, and a
+	// burst of 0 turns the class's limit off
+	RateLimits map[string]RateLimit `json:"rate_limits" yaml:"rate_limits"`
+}
+
+// RetentionConfig is the retention policy of one backup type
+type RetentionConfig struct {
+	MaxAge   Duration `json:"max_age" yaml:"max_age"`     // 0 for no age limit
+	MaxCount int      `json:"max_count" yaml:"max_count"` // 0 for no count limit
+}
+
+// DefaultConfig returns the settings used for anything not configured
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:       ":8080",
+		DBPath:           "dewey.db",
+		BackupDir:        ".",
+		BackupRoot:       "backups",
+		BackupInterval:   Duration{24 * time.Hour},
+		MaintenanceStart: "02:00",
+		MaintenanceEnd:   "04:00",
+		BackupTypes:      []string{string(utils.FullBackupType), string(utils.SQLBackupType)},
+		ReconnectMin:     Duration{time.Second},
+		ReconnectMax:     Duration{time.Minute},
+		RateLimits:       maps.Clone(DefaultRateLimits),
+	}
+}
+
+// LoadConfig returns DefaultConfig overlaid with the file at path, if path
+// isn't empty, and then the environment. Files ending in .yaml or .yml are
+// YAML; anything else is JSON. The result is validated.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(data, &cfg)
+		default:
+			err = json.Unmarshal(data, &cfg)
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("config %s: %w", path, err)
+		}
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// applyEnv overrides settings from DEWEY_* variables found by lookup
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	strs := map[string]*string{
+		"DEWEY_LISTEN_ADDR":          &c.ListenAddr,
+		"DEWEY_DB_PATH":              &c.DBPath,
+		"DEWEY_BACKUP_DIR":           &c.BackupDir,
+		"DEWEY_BACKUP_ROOT":          &c.BackupRoot,
+		"DEWEY_MAINTENANCE_START":    &c.MaintenanceStart,
+		"DEWEY_MAINTENANCE_END":      &c.MaintenanceEnd,
+		"DEWEY_BACKUP_PATH_TEMPLATE": &c.BackupPathTemplate,
+		"DEWEY_CAPTURE_BUFFER_DIR":   &c.CaptureBufferDir,
+	}
+	for name, field := range strs {
+		if v, ok := lookup(name); ok {
+			*field = v
+		}
+	}
+	durations := map[string]*Duration{
+		"DEWEY_BACKUP_INTERVAL": &c.BackupInterval,
+		"DEWEY_RECONNECT_MIN":   &c.ReconnectMin,
+		"DEWEY_RECONNECT_MAX":   &c.ReconnectMax,
+	}
+	for name, field := range durations {
+		if v, ok := lookup(name); ok {
+			if err := field.UnmarshalText([]byte(v)); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	if v, ok := lookup("DEWEY_BACKUP_TYPES"); ok {
+		c.BackupTypes = strings.Split(v, ",")
+	}
+	return nil
+}
+
+// Validate reports the first invalid setting
+func (c Config) Validate() error {
+	switch {
+	case c.ListenAddr == "":
+		return fmt.Errorf("listen_addr is empty")
+	case c.DBPath == "":
+		return fmt.Errorf("db_path is empty")
+	case c.BackupInterval.Duration <= 0:
+		return fmt.Errorf("backup_interval must be positive, got %s", c.BackupInterval)
+	case c.ReconnectMin.Duration <= 0 || c.ReconnectMax.Duration < c.ReconnectMin.Duration:
+		return fmt.Errorf("reconnect_min must be positive and no more than reconnect_max")
+	}
+	for _, s := range []string{c.MaintenanceStart, c.MaintenanceEnd} {
+		if _, err := time.Parse("15:04", s); err != nil {
+			return fmt.Errorf("maintenance window time %q must be HH:MM", s)
+		}
+	}
+	for _, t := range c.BackupTypes {
+		if _, err := utils.ParseBackupType(strings.TrimSpace(t)); err != nil {
+			return err
+		}
+	}
+	for t, r := range c.BackupRetention {
+		if _, err := utils.ParseBackupType(t); err != nil {
+			return fmt.Errorf("backup_retention: %w", err)
+		}
+		if r.MaxAge.Duration < 0 || r.MaxCount < 0 {
+			return fmt.Errorf("backup_retention for %s: max_age and max_count must not be negative", t)
+		}
+	}
+	if _, err := utils.ParseDuplicateBackupPolicy(c.BackupOnDuplicate); err != nil {
+		return fmt.Errorf("backup_on_duplicate: %w", err)
+	}
+	for class, l := range c.RateLimits {
+		if _, ok := DefaultRateLimits[class]; !ok {
+			return fmt.Errorf("rate_limits: unknown endpoint class %q", class)
+		}
+		if l.Rate < 0 || l.Burst < 0 {
+			return fmt.Errorf("rate_limits for %s: rate and burst must not be negative", class)
+		}
+	}
+	for source, target := range c.IngestTargets {
+		if _, err := handlers.ParseIngestTarget(target); err != nil {
+			return fmt.Errorf("ingest target for %q: %w", source, err)
+		}
+	}
+	if c.BackupPathTemplate != "" {
+		return utils.ValidateBackupPathTemplate(c.BackupPathTemplate)
+	}
+	return nil
+}
+
+// BackupConfig returns the backup scheduler settings, with the maintenance
+// window on the day of now
+func (c Config) BackupConfig(now time.Time) utils.BackupConfig {
+	at := func(hhmm string) time.Time {
+		t, _ := time.Parse("15:04", hhmm)
+		return time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	}
+	types := make([]utils.BackupType, len(c.BackupTypes))
+	for i, t := range c.BackupTypes {
+		types[i] = utils.BackupType(strings.TrimSpace(t))
+	}
+	retention := make(map[utils.BackupType]utils.RetentionPolicy, len(c.BackupRetention))
+	for t, r := range c.BackupRetention {
+		retention[utils.BackupType(t)] = utils.RetentionPolicy{MaxAge: r.MaxAge.Duration, MaxCount: r.MaxCount}
+	}
+	return utils.BackupConfig{
+		DBPath:           c.DBPath,
+		BackupRoot:       c.BackupRoot,
+		Interval:         c.BackupInterval.Duration,
+		MaintenanceStart: at(c.MaintenanceStart),
+		MaintenanceEnd:   at(c.MaintenanceEnd),
+		BackupTypes:      types,
+		PartialTables:    []string{},
+		PathTemplate:     c.BackupPathTemplate,
+		SkipUnchanged:    c.BackupSkipUnchanged,
+		FullFingerprint:  c.BackupFullFingerprint,
+		Retention:        retention,
+		Compress:         c.BackupCompress,
+		OnDuplicate:      utils.DuplicateBackupPolicy(c.BackupOnDuplicate),
+	}
+}
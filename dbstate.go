@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/unklstewy/redbug_dewey/handlers"
+	"github.com/unklstewy/redbug_dewey/models"
+	"github.com/unklstewy/redbug_dewey/utils"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// DBState holds the application database, which may only become available
+// after the server has started. Until then the server runs degraded: /livez
+// answers and data routes return 503.
+type DBState struct {
+	mu  sync.RWMutex
+	db  *gorm.DB
+	err error
+}
+
+// openAppDB returns an opener for the database at path, including migrations
+func openAppDB(path string) func() (*gorm.DB, error) {
+	return func() (*gorm.DB, error) {
+		db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+		if err != nil {
+			return nil, err
+		}
+		sqldb, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		// Older databases may hold duplicate grants, which would fail the
+		// unique indexes AutoMigrate creates
+		if err := utils.RemoveDuplicateGrants(sqldb); err != nil {
+			sqldb.Close()
+			return nil, err
+		}
+		if err := models.AutoMigrate(db); err != nil {
+			sqldb.Close()
+			return nil, err
+		}
+		// AutoMigrate only adds columns, so report whatever it left behind
+		issues, err := utils.DetectSchemaDrift(sqldb)
+		if err != nil {
+			log.Printf("schema drift check failed: %v", err)
+		}
+		for _, issue := range issues {
+			log.Printf("warning: schema drift: %s", issue)
+		}
+		// Users created before names were normalized may have mixed case
+		if err := utils.FoldUsernames(sqldb); err != nil {
+			sqldb.Close()
+			return nil, err
+		}
+		if err := bootstrapAdmin(sqldb, path+adminPasswordSuffix); err != nil {
+			sqldb.Close()
+			return nil, err
+		}
+		return db, nil
+	}
+}
+
+// adminPasswordSuffix names the file beside the database that a generated
+// admin password is written to
+const adminPasswordSuffix = ".admin-password"
+
+// bootstrapAdmin seeds the default roles and, on a database without users,
+// creates an admin from DEWEY_ADMIN_USER and DEWEY_ADMIN_PASSWORD. A
+// generated password is kept out of the log: it is written to passwordFile,
+// readable by its owner only, or printed once to stderr if that fails.
+func bootstrapAdmin(db *sql.DB, passwordFile string) error {
+	opts := handlers.BootstrapOptions{
+		Username: os.Getenv("DEWEY_ADMIN_USER"),
+		Password: os.Getenv("DEWEY_ADMIN_PASSWORD"),
+	}
+	created, generated, err := handlers.BootstrapAdmin(db, opts)
+	if err != nil {
+		return err
+	}
+	switch {
+	case generated != "":
+		if err := writeSecretFile(passwordFile, generated+"\n"); err != nil {
+			log.Printf("warning: created admin user with a generated password, printed below as %s could not be written (%v); change it now", passwordFile, err)
+			fmt.Fprintf(os.Stderr, "generated admin password: %s\n", generated)
+		} else {
+			log.Printf("warning: created admin user with a generated password, written to %s; change it now and delete the file", passwordFile)
+		}
+	case created:
+		log.Printf("created admin user from DEWEY_ADMIN_USER/DEWEY_ADMIN_PASSWORD")
+	}
+	return nil
+}
+
+// writeSecretFile writes data to path, readable by its owner only even if
+// the file already existed
+func writeSecretFile(path, data string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Chmod(0600); err != nil {
+		return err
+	}
+	if _, err := f.WriteString(data); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// DB returns the database, or nil while it is unavailable
+func (s *DBState) DB() *gorm.DB {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db
+}
+
+// Err returns the error from the last failed connection attempt
+func (s *DBState) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
+}
+
+// TryOpen makes one connection attempt and reports whether the database is up
+func (s *DBState) TryOpen(open func() (*gorm.DB, error)) bool {
+	db, err := open()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db, s.err = db, err
+	return err == nil
+}
+
+// Connect retries open with exponential backoff, from initial up to max
+// between attempts, until it succeeds or stop is closed
+func (s *DBState) Connect(open func() (*gorm.DB, error), initial, max time.Duration, stop <-chan struct{}) {
+	delay := initial
+	for !s.TryOpen(open) {
+		log.Printf("database unavailable, retrying in %s: %v", delay, s.Err())
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > max {
+			delay = max
+		}
+	}
+	log.Printf("database available")
+}
+
+// RequireDB aborts with 503 while the database is unavailable
+func (s *DBState) RequireDB() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.DB() == nil {
+			body := gin.H{"error": "database unavailable"}
+			if err := s.Err(); err != nil {
+				body["detail"] = err.Error()
+			}
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, body)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Livez reports that the process is up, and whether it has its database
+func (s *DBState) Livez(c *gin.Context) {
+	status := gin.H{"status": "ok", "db": "available"}
+	if s.DB() == nil {
+		status["status"] = "degraded"
+		status["db"] = "unavailable"
+		if err := s.Err(); err != nil {
+			status["error"] = err.Error()
+		}
+	}
+	c.JSON(http.StatusOK, status)
+}
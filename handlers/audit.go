@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/unklstewy/redbug_dewey/models"
+)
+
+// RecordAudit appends an entry to the audit log
+func RecordAudit(db *sql.DB, actor, action, detail string) (int64, error) {
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	res, err := execRetry(db, "INSERT INTO audit_log (timestamp, actor, action, detail) VALUES (?, ?, ?, ?)", timestamp, actor, action, detail)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ListAuditEntries returns the audit entries recorded in [start, end], oldest first
+func ListAuditEntries(db *sql.DB, start, end time.Time) ([]models.AuditEntry, error) {
+	rows, err := db.Query("SELECT id, timestamp, actor, action, detail FROM audit_log WHERE timestamp BETWEEN ? AND ? ORDER BY timestamp, id",
+		start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []models.AuditEntry
+	for rows.Next() {
+		var e models.AuditEntry
+		if err := rows.Scan(&e.ID, &e.Timestamp, &e.Actor, &e.Action, &e.Detail); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
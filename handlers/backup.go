@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/unklstewy/redbug_dewey/models"
+	"github.com/unklstewy/redbug_dewey/utils"
+)
+
+// RecordBackup stores metadata for a completed backup. The checksum is
+// computed from the backup file if m.Checksum is empty.
+func RecordBackup(db *sql.DB, m *models.BackupMetadata) (int64, error) {
+	if m.Checksum == "" {
+		sum, err := utils.FileChecksum(m.FilePath)
+		if err != nil {
+			return 0, err
+		}
+		m.Checksum = sum
+	}
+	res, err := execRetry(db, "INSERT INTO backup_metadata (backup_type, timestamp, file_path, size, duration, status, checksum, fingerprint) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		m.BackupType, m.Timestamp, m.FilePath, m.Size, m.Duration, m.Status, m.Checksum, m.Fingerprint)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err == nil {
+		m.ID = int(id)
+	}
+	return id, err
+}
+
+// GetBackup returns the metadata for backup id, or sql.ErrNoRows if unknown
+func GetBackup(db *sql.DB, id int) (*models.BackupMetadata, error) {
+	row := db.QueryRow("SELECT id, backup_type, timestamp, file_path, size, duration, status, checksum, fingerprint FROM backup_metadata WHERE id = ?", id)
+	var m models.BackupMetadata
+	var checksum, fingerprint sql.NullString
+	if err := row.Scan(&m.ID, &m.BackupType, &m.Timestamp, &m.FilePath, &m.Size, &m.Duration, &m.Status, &checksum, &fingerprint); err != nil {
+		return nil, err
+	}
+	m.Checksum = checksum.String
+	m.Fingerprint = fingerprint.String
+	return &m, nil
+}
+
+// ServeBackupDownload streams backup id to w after verifying its stored
+// checksum. Unknown ids get 404 and backups whose file is gone get 410.
+func ServeBackupDownload(w http.ResponseWriter, r *http.Request, db *sql.DB, id int) {
+	m, err := GetBackup(db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "backup not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Open(m.FilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "backup file no longer exists", http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if m.Checksum != "" {
+		sum, err := utils.FileChecksum(m.FilePath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if sum != m.Checksum {
+			http.Error(w, "backup checksum mismatch", http.StatusInternalServerError)
+			return
+		}
+	}
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := filepath.Base(m.FilePath)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if m.Checksum != "" {
+		w.Header().Set("X-Checksum-Sha256", m.Checksum)
+	}
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// ListBackups returns the backups taken in [start, end], oldest first
+func ListBackups(db *sql.DB, start, end time.Time) ([]models.BackupMetadata, error) {
+	rows, err := db.Query("SELECT id, backup_type, timestamp, file_path, size, duration, status, checksum, fingerprint FROM backup_metadata WHERE timestamp BETWEEN ? AND ? ORDER BY timestamp, id",
+		start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var backups []models.BackupMetadata
+	for rows.Next() {
+		var m models.BackupMetadata
+		var checksum, fingerprint sql.NullString
+		if err := rows.Scan(&m.ID, &m.BackupType, &m.Timestamp, &m.FilePath, &m.Size, &m.Duration, &m.Status, &checksum, &fingerprint); err != nil {
+			return nil, err
+		}
+		m.Checksum = checksum.String
+		m.Fingerprint = fingerprint.String
+		backups = append(backups, m)
+	}
+	return backups, rows.Err()
+}
+
+// ErrBackupInProgress is returned when a backup or restore is started while
+// another is running
+var ErrBackupInProgress = errors.New("a backup or restore is already in progress")
+
+// ErrNoBackupInProgress is returned by CancelBackup when there is nothing to
+// cancel
+var ErrNoBackupInProgress = errors.New("no backup or restore in progress")
+
+// BackupOperation describes the running backup or restore
+type BackupOperation struct {
+	Kind    string    `json:"kind"` // "backup" or "restore"
+	Path    string    `json:"path"` // the backup file written or read
+	Started time.Time `json:"started"`
+	cancel  context.CancelFunc
+}
+
+var (
+	backupOpMu sync.Mutex
+	backupOp   *BackupOperation
+)
+
+// beginBackupOp registers a backup or restore as the running operation. The
+// returned context is canceled by CancelBackup; done must be called when the
+// operation finishes.
+func beginBackupOp(kind, path string) (ctx context.Context, done func(), err error) {
+	backupOpMu.Lock()
+	defer backupOpMu.Unlock()
+	if backupOp != nil {
+		return nil, nil, ErrBackupInProgress
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	op := &BackupOperation{Kind: kind, Path: path, Started: time.Now(), cancel: cancel}
+	backupOp = op
+	return ctx, func() {
+		cancel()
+		backupOpMu.Lock()
+		if backupOp == op {
+			backupOp = nil
+		}
+		backupOpMu.Unlock()
+	}, nil
+}
+
+// CancelBackup cancels the running backup or restore and returns it. The
+// operation removes its partial files; a canceled restore leaves the live DB
+// as it was.
+func CancelBackup() (BackupOperation, error) {
+	backupOpMu.Lock()
+	defer backupOpMu.Unlock()
+	if backupOp == nil {
+		return BackupOperation{}, ErrNoBackupInProgress
+	}
+	backupOp.cancel()
+	return *backupOp, nil
+}
+
+// RunBackup takes a backup of btype of the DB at dbPath into backupPath and
+// records its metadata in db. It fails with ErrBackupInProgress while another
+// backup or restore runs, and with context.Canceled if CancelBackup stops it.
+func RunBackup(db *sql.DB, dbPath string, btype utils.BackupType, backupPath string) (utils.BackupResult, *models.BackupMetadata, error) {
+	ctx, done, err := beginBackupOp("backup", backupPath)
+	if err != nil {
+		return utils.BackupResult{}, nil, err
+	}
+	defer done()
+	start := time.Now()
+	// Taken first, so writes during the backup make the next one differ
+	fingerprint, err := utils.LiveDBFingerprint(db)
+	if err != nil {
+		return utils.BackupResult{}, nil, err
+	}
+	var result utils.BackupResult
+	switch btype {
+	case utils.FullBackupType:
+		result, err = utils.FullBackupContext(ctx, dbPath, backupPath)
+	case utils.SQLBackupType:
+		result, err = utils.SQLDumpContext(ctx, dbPath, backupPath, utils.DumpOptions{})
+	case utils.DeltaBackupType:
+		err = utils.DeltaBackup(dbPath, dbPath+"-wal", backupPath)
+	default:
+		_, err = utils.ParseBackupType(string(btype))
+	}
+	if err != nil {
+		return result, nil, err
+	}
+	meta := &models.BackupMetadata{
+		BackupType:  string(btype),
+		Timestamp:   start.UTC().Format(time.RFC3339),
+		FilePath:    result.Path,
+		Size:        result.Size,
+		Duration:    result.Duration.Milliseconds(),
+		Status:      "completed",
+		Checksum:    result.Checksum,
+		Fingerprint: fingerprint,
+	}
+	if _, err := RecordBackup(db, meta); err != nil {
+		return result, nil, err
+	}
+	return result, meta, nil
+}
+
+// RunRestore restores dbPath from the backup at backupPath like
+// utils.RestoreBackupWithOptions, as the running operation CancelBackup can
+// stop
+func RunRestore(backupPath, dbPath string, btype utils.BackupType, opts utils.RestoreOptions) error {
+	ctx, done, err := beginBackupOp("restore", backupPath)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return utils.RestoreBackupContext(ctx, backupPath, dbPath, btype, opts)
+}
+
+// ArchiveBackups archives the backup day directories under root older than
+// olderThan with utils.ArchiveOldBackupsWithOptions, recording each monthly
+// archive in db as an "archive" backup. A month archived again keeps its row,
+// updated for the rewritten file.
+func ArchiveBackups(db *sql.DB, root string, olderThan time.Duration, archivePath string) ([]models.BackupMetadata, error) {
+	var recorded []models.BackupMetadata
+	err := utils.ArchiveOldBackupsWithOptions(root, olderThan, archivePath, utils.ArchiveOptions{
+		OnArchive: func(a utils.BackupArchive) error {
+			sum, err := utils.FileChecksum(a.Path)
+			if err != nil {
+				return err
+			}
+			meta := models.BackupMetadata{
+				BackupType: "archive",
+				Timestamp:  time.Now().UTC().Format(time.RFC3339),
+				FilePath:   a.Path,
+				Size:       a.Size,
+				Status:     "completed",
+				Checksum:   sum,
+			}
+			res, err := execRetry(db, "UPDATE backup_metadata SET timestamp = ?, size = ?, status = ?, checksum = ? WHERE backup_type = ? AND file_path = ?",
+				meta.Timestamp, meta.Size, meta.Status, meta.Checksum, meta.BackupType, meta.FilePath)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				if _, err := RecordBackup(db, &meta); err != nil {
+					return err
+				}
+			} else if err := db.QueryRow("SELECT id FROM backup_metadata WHERE backup_type = ? AND file_path = ?", meta.BackupType, meta.FilePath).Scan(&meta.ID); err != nil {
+				return err
+			}
+			recorded = append(recorded, meta)
+			return nil
+		},
+	})
+	return recorded, err
+}
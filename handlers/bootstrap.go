@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+
+	"github.com/unklstewy/redbug_dewey/models"
+)
+
+// DefaultRoles are the roles seeded by BootstrapAdmin. Their ids are the ones
+// the role checks in main expect: 1 is admin and 2 team leader.
+var DefaultRoles = []models.Role{
+	{ID: 1, Name: "admin"},
+	{ID: 2, Name: "team_leader"},
+	{ID: 3, Name: "member"},
+}
+
+// BootstrapOptions configures BootstrapAdmin
+type BootstrapOptions struct {
+	Username string        // "admin" if empty
+	Password string        // generated if empty
+	RoleID   int           // the admin's role; 1 if zero
+	Roles    []models.Role // roles to seed; DefaultRoles if nil
+}
+
+// BootstrapAdmin seeds the roles and, if the user table is empty, creates an
+// admin so a fresh database has someone who can administer it. It does
+// nothing to a database that already has users. When it generated the
+// admin's password it returns it, so the caller can show it once.
+func BootstrapAdmin(db *sql.DB, opts BootstrapOptions) (created bool, generated string, err error) {
+	if opts.Username == "" {
+		opts.Username = "admin"
+	}
+	if opts.Username, err = NormalizeUsername(opts.Username); err != nil {
+		return false, "", err
+	}
+	if opts.RoleID == 0 {
+		opts.RoleID = 1
+	}
+	if opts.Roles == nil {
+		opts.Roles = DefaultRoles
+	}
+	if opts.Password == "" {
+		if generated, err = generatePassword(); err != nil {
+			return false, "", err
+		}
+		opts.Password = generated
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return false, "", err
+	}
+	defer tx.Rollback()
+	for _, r := range opts.Roles {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO role (id, name) VALUES (?, ?)", r.ID, r.Name); err != nil {
+			return false, "", err
+		}
+	}
+	var users int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM user").Scan(&users); err != nil {
+		return false, "", err
+	}
+	if users > 0 {
+		return false, "", tx.Commit()
+	}
+	hash, err := passwordHasher.Hash(opts.Password)
+	if err != nil {
+		return false, "", err
+	}
+	if _, err := tx.Exec("INSERT INTO user (username, password_hash, role_id) VALUES (?, ?, ?)", opts.Username, hash, opts.RoleID); err != nil {
+		return false, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, "", err
+	}
+	return true, generated, nil
+}
+
+// generatePassword returns a random 24-character password
+func generatePassword() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
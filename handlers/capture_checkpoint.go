@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// captureCheckpoint is the log read position and capture sequence covered
+// by an ingested batch
+type captureCheckpoint struct {
+	logPath string
+	offset  int64
+	seq     int64
+}
+
+// CreateCaptureCheckpointTable creates the capture_checkpoint table if it does not exist.
+func CreateCaptureCheckpointTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS capture_checkpoint (
+			log_path TEXT PRIMARY KEY,
+			offset INTEGER NOT NULL,
+			sequence INTEGER NOT NULL DEFAULT 0,
+			updated_at DATETIME NOT NULL
+		);
+	`)
+	if err != nil {
+		return err
+	}
+	cols, err := tableColumns(db, "capture_checkpoint")
+	if err != nil {
+		return err
+	}
+	if !cols["sequence"] {
+		_, err = db.Exec(`ALTER TABLE capture_checkpoint ADD COLUMN sequence INTEGER NOT NULL DEFAULT 0`)
+	}
+	return err
+}
+
+// saveCheckpoint records the checkpoint in tx, alongside the batch it covers
+func saveCheckpoint(tx *sql.Tx, cp captureCheckpoint) error {
+	_, err := tx.Exec(
+		`INSERT INTO capture_checkpoint (log_path, offset, sequence, updated_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT(log_path) DO UPDATE SET offset = excluded.offset, sequence = excluded.sequence, updated_at = excluded.updated_at`,
+		cp.logPath, cp.offset, cp.seq, time.Now().UTC(),
+	)
+	return err
+}
+
+// checkpointKey identifies a log in capture_checkpoint
+func checkpointKey(logPath string) string {
+	if abs, err := filepath.Abs(logPath); err == nil {
+		return abs
+	}
+	return logPath
+}
+
+// CaptureCheckpoint returns the byte offset in logPath up to which lines have
+// been ingested into db, or 0 if the log has no checkpoint.
+func CaptureCheckpoint(db *sql.DB, logPath string) (int64, error) {
+	offset, _, err := loadCheckpoint(db, logPath)
+	return offset, err
+}
+
+// loadCheckpoint returns the checkpointed offset and last ingested sequence
+// for logPath, or zeros if it has none
+func loadCheckpoint(db *sql.DB, logPath string) (offset, seq int64, err error) {
+	if err := CreateCaptureCheckpointTable(db); err != nil {
+		return 0, 0, err
+	}
+	err = db.QueryRow(`SELECT offset, sequence FROM capture_checkpoint WHERE log_path = ?`, checkpointKey(logPath)).Scan(&offset, &seq)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	return offset, seq, err
+}
+
+// ResumeSimulatedCapture starts a capture of logPath from its checkpoint, so
+// lines ingested by an earlier run are neither re-ingested nor skipped, and
+// sequences continue from the last ingested line. Records left in the disk
+// buffer are discarded, since the checkpoint only covers committed lines and
+// the rest will be read again from the log.
+func (cm *CaptureManager) ResumeSimulatedCapture(logPath string) error {
+	return cm.startCapture(CaptureConfig{LogPath: logPath, Resume: true})
+}
+
+// resumePosition returns the checkpointed offset and sequence to resume the
+// log from, seeks file to it and discards the stale disk buffer. Called with
+// cm.mu held.
+func (cm *CaptureManager) resumePosition(db *sql.DB, file *os.File) (offset, seq int64, err error) {
+	if db == nil {
+		return 0, 0, fmt.Errorf("cannot resume %s: captureDB not set", file.Name())
+	}
+	if offset, seq, err = loadCheckpoint(db, file.Name()); err != nil {
+		return 0, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if offset > info.Size() {
+		return 0, 0, fmt.Errorf("checkpoint for %s is past the end of the log (%d > %d bytes)", file.Name(), offset, info.Size())
+	}
+	if _, err := file.Seek(offset, 0); err != nil {
+		return 0, 0, err
+	}
+	if err := os.Remove(cm.bufferPath()); err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	return offset, seq, nil
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+)
+
+// CompactResult reports what a buffer compaction reclaimed
+type CompactResult struct {
+	ID             string `json:"id"`
+	BytesReclaimed int64  `json:"bytes_reclaimed"`
+	SizeBytes      int64  `json:"size_bytes"` // buffer file size afterwards
+}
+
+// CompactBuffer reclaims the disk space of records already removed from the
+// manager's buffer. It is safe during a capture: the buffer copies its
+// pending records without blocking appends or status, though it is cheapest
+// with ingestion paused. A stopped capture's buffer file is compacted in
+// place, holding off a new start until done; if there is none nothing is
+// reclaimed.
+func (cm *CaptureManager) CompactBuffer() (CompactResult, error) {
+	cm.mu.Lock()
+	res := CompactResult{ID: cm.id}
+	buf := cm.bufferImpl
+	if buf == nil {
+		cm.compactMu.Lock()
+		defer cm.compactMu.Unlock()
+		fifo, err := openIdleBuffer(cm.bufferPath())
+		if err != nil || fifo == nil {
+			cm.mu.Unlock()
+			return res, err
+		}
+		defer fifo.Close()
+		buf = fifo
+	}
+	cm.mu.Unlock()
+	before := buf.SizeBytes()
+	if err := buf.Compact(); err != nil {
+		return res, err
+	}
+	res.SizeBytes = buf.SizeBytes()
+	res.BytesReclaimed = max(before-res.SizeBytes, 0)
+	return res, nil
+}
+
+// openIdleBuffer opens the buffer file at path, or returns nil if there is
+// none
+func openIdleBuffer(path string) (*FIFOBuffer, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return NewFIFOBuffer(path)
+}
+
+// CaptureCompactHandler compacts the named capture's buffer and reports the
+// bytes reclaimed as JSON
+func CaptureCompactHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := requestCaptureID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := CompactCaptureBuffer(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
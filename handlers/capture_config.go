@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrLogOutsideRoot is returned for capture log paths outside the allow-root
+var ErrLogOutsideRoot = errors.New("log path is outside the capture log root")
+
+// CaptureConfig holds the validated parameters of a capture start request
+type CaptureConfig struct {
+	LogPath  string          // absolute path of the log, inside the capture log root
+	Resume   bool            // continue from the log's checkpoint
+	Strategy BufferStrategy  // buffer strategy; unchanged when empty
+	FirstSeq int64           // sequence of the first line of a fresh capture; 1 when zero
+	Framing  *CaptureFraming // record boundaries; unchanged when nil
+	StoreRaw bool            // keep each record's raw bytes in raw_capture
+	Speed    *float64        // replay speed multiplier; unchanged when nil
+	ReadBuf  *int            // source read buffer size in bytes; unchanged when nil
+	DiskFull *DiskFullPolicy // what to do when the disk buffer is full; unchanged when nil
+	// WallClock turns wall-clock replay on, with WallClockReplay's
+	// settings, or off; unchanged when nil
+	WallClock       *bool
+	WallClockReplay WallClockReplay
+}
+
+var (
+	captureLogRootMu sync.RWMutex
+	captureLogRoot   = "."
+)
+
+// SetCaptureLogRoot sets the directory capture logs must be inside. The
+// default is the working directory.
+func SetCaptureLogRoot(dir string) {
+	captureLogRootMu.Lock()
+	captureLogRoot = dir
+	captureLogRootMu.Unlock()
+}
+
+// resolvePath returns the absolute form of path with symlinks resolved where
+// the path exists
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		return real, nil
+	}
+	return abs, nil
+}
+
+// resolveCaptureLog resolves a log path relative to the capture log root and
+// rejects anything that escapes it
+func resolveCaptureLog(logPath string) (string, error) {
+	captureLogRootMu.RLock()
+	root := captureLogRoot
+	captureLogRootMu.RUnlock()
+	root, err := resolvePath(root)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(logPath) {
+		logPath = filepath.Join(root, logPath)
+	}
+	path, err := resolvePath(logPath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrLogOutsideRoot
+	}
+	return path, nil
+}
+
+// ParseCaptureConfig validates the query parameters of a capture start
+// request: log (required), resume (bool), first_seq (positive integer),
+// raw (bool), speed (replay multiplier, 0 for no pacing), read_buf (source
+// read buffer size in bytes), strategy (fifo or red), on_disk_full (drop, red
+// or pause), wall_clock (bool) with replay_start (RFC 3339) and max_wait (a
+// duration such as 30s), and framing: frame (lines, delimited or fixed) with
+// delim (a hex byte such as 7e) or frame_len.
+func ParseCaptureConfig(r *http.Request) (CaptureConfig, error) {
+	q := r.URL.Query()
+	var cfg CaptureConfig
+	logPath := q.Get("log")
+	if logPath == "" {
+		return cfg, errors.New("missing required parameter: log")
+	}
+	path, err := resolveCaptureLog(logPath)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid log %q: %w", logPath, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid log %q: file not found", logPath)
+	}
+	if !info.Mode().IsRegular() {
+		return cfg, fmt.Errorf("invalid log %q: not a regular file", logPath)
+	}
+	cfg.LogPath = path
+	if v := q.Get("resume"); v != "" {
+		if cfg.Resume, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid resume %q: must be true or false", v)
+		}
+	}
+	if v := q.Get("first_seq"); v != "" {
+		if cfg.FirstSeq, err = strconv.ParseInt(v, 10, 64); err != nil || cfg.FirstSeq < 1 {
+			return cfg, fmt.Errorf("invalid first_seq %q: must be a positive integer", v)
+		}
+	}
+	if v := q.Get("raw"); v != "" {
+		if cfg.StoreRaw, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid raw %q: must be true or false", v)
+		}
+	}
+	if v := q.Get("speed"); v != "" {
+		speed, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(speed >= 0) || math.IsInf(speed, 0) {
+			return cfg, fmt.Errorf("invalid speed %q: must be a non-negative number", v)
+		}
+		cfg.Speed = &speed
+	}
+	if v := q.Get("read_buf"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxCaptureReadBufferSize {
+			return cfg, fmt.Errorf("invalid read_buf %q: must be between 1 and %d", v, MaxCaptureReadBufferSize)
+		}
+		cfg.ReadBuf = &n
+	}
+	if v := q.Get("on_disk_full"); v != "" {
+		p, err := ParseDiskFullPolicy(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.DiskFull = &p
+	}
+	if v := q.Get("wall_clock"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid wall_clock %q: must be true or false", v)
+		}
+		cfg.WallClock = &on
+	}
+	if v := q.Get("replay_start"); v != "" {
+		if cfg.WallClockReplay.Start, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return cfg, fmt.Errorf("invalid replay_start %q: must be an RFC 3339 time", v)
+		}
+	}
+	if v := q.Get("max_wait"); v != "" {
+		if cfg.WallClockReplay.MaxWait, err = time.ParseDuration(v); err != nil || cfg.WallClockReplay.MaxWait <= 0 {
+			return cfg, fmt.Errorf("invalid max_wait %q: must be a positive duration", v)
+		}
+	}
+	switch s := BufferStrategy(q.Get("strategy")); s {
+	case "", BufferFIFO, BufferRED:
+		cfg.Strategy = s
+	default:
+		return cfg, fmt.Errorf("invalid strategy %q: must be %s or %s", s, BufferFIFO, BufferRED)
+	}
+	if cfg.Framing, err = parseFraming(q); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// parseFraming reads the frame, delim and frame_len parameters; nil when
+// frame is absent
+func parseFraming(q url.Values) (*CaptureFraming, error) {
+	var f CaptureFraming
+	switch mode := q.Get("frame"); mode {
+	case "":
+		return nil, nil
+	case "lines":
+	case string(FrameDelimited):
+		f.Mode = FrameDelimited
+		d, err := strconv.ParseUint(strings.TrimPrefix(q.Get("delim"), "0x"), 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delim %q: must be a hex byte", q.Get("delim"))
+		}
+		f.Delimiter = byte(d)
+	case string(FrameFixed):
+		f.Mode = FrameFixed
+		n, err := strconv.Atoi(q.Get("frame_len"))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid frame_len %q: must be a positive integer", q.Get("frame_len"))
+		}
+		f.Length = n
+	default:
+		return nil, fmt.Errorf("invalid frame %q: must be lines, %s or %s", mode, FrameDelimited, FrameFixed)
+	}
+	return &f, nil
+}
+
+// StartCapture starts a capture described by cfg
+func (cm *CaptureManager) StartCapture(cfg CaptureConfig) error {
+	if cfg.Strategy != "" {
+		cm.mu.Lock()
+		if !cm.ingesting {
+			cm.bufferStrategy = cfg.Strategy
+		}
+		cm.mu.Unlock()
+	}
+	if cfg.Framing != nil {
+		if err := cm.SetFraming(*cfg.Framing); err != nil {
+			return err
+		}
+	}
+	if cfg.Speed != nil {
+		cm.mu.Lock()
+		if !cm.ingesting {
+			cm.speed = *cfg.Speed
+		}
+		cm.mu.Unlock()
+	}
+	if cfg.ReadBuf != nil {
+		cm.mu.Lock()
+		if !cm.ingesting {
+			cm.readBufSize = *cfg.ReadBuf
+		}
+		cm.mu.Unlock()
+	}
+	if cfg.DiskFull != nil {
+		cm.mu.Lock()
+		if !cm.ingesting {
+			cm.diskFullPolicy = *cfg.DiskFull
+		}
+		cm.mu.Unlock()
+	}
+	if cfg.WallClock != nil {
+		cm.mu.Lock()
+		if !cm.ingesting {
+			cm.wallClock = nil
+			if *cfg.WallClock {
+				replay := cfg.WallClockReplay
+				cm.wallClock = &replay
+			}
+		}
+		cm.mu.Unlock()
+	}
+	return cm.startCapture(cfg)
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// DiskFullPolicy is what a capture does with records its disk buffer fails
+// to store, typically because the buffer's disk is full. Every record that
+// is not buffered is counted in CaptureStatus.Dropped.
+type DiskFullPolicy string
+
+const (
+	// DiskFullDrop drops each record that fails to buffer and keeps reading
+	DiskFullDrop DiskFullPolicy = "drop"
+	// DiskFullRED drops records early once a write has failed, with a
+	// probability that falls as ingest drains the buffer, so writes are
+	// retried gradually instead of failing on every record
+	DiskFullRED DiskFullPolicy = "red"
+	// DiskFullPause stops reading the source until the record can be
+	// buffered, dropping nothing unless the capture is stopped meanwhile
+	DiskFullPause DiskFullPolicy = "pause"
+)
+
+// diskFullRetryInterval is how often a paused capture retries its write
+const diskFullRetryInterval = 50 * time.Millisecond
+
+// ParseDiskFullPolicy parses a policy name; empty means DiskFullDrop
+func ParseDiskFullPolicy(s string) (DiskFullPolicy, error) {
+	switch p := DiskFullPolicy(s); p {
+	case "":
+		return DiskFullDrop, nil
+	case DiskFullDrop, DiskFullRED, DiskFullPause:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid disk full policy %q: must be %s, %s or %s", s, DiskFullDrop, DiskFullRED, DiskFullPause)
+}
+
+// SetDiskFullPolicy sets what this manager does when its disk buffer fails
+// to store a record. It applies to captures started afterwards.
+func (cm *CaptureManager) SetDiskFullPolicy(p DiskFullPolicy) error {
+	p, err := ParseDiskFullPolicy(string(p))
+	if err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	cm.diskFullPolicy = p
+	cm.mu.Unlock()
+	return nil
+}
+
+// bufferRecord appends a record to the disk buffer under cm.mu, applying
+// policy when the append fails, and reports whether it was buffered. A
+// paused capture releases cm.mu while it waits, and gives up if stopCh is
+// closed.
+func (cm *CaptureManager) bufferRecord(line []byte, policy DiskFullPolicy, stopCh chan struct{}) bool {
+	if policy == DiskFullRED && cm.redFullAt > 0 {
+		// Drop with the probability that the buffer is still as full as
+		// when the write failed
+		if len(cm.pending) == 0 {
+			cm.redFullAt = 0
+		} else if rand.Float64() < float64(len(cm.pending))/float64(cm.redFullAt) {
+			cm.lastStatus.Dropped++
+			return false
+		}
+	}
+	for {
+		err := cm.bufferImpl.Append(line)
+		if err == nil {
+			cm.lastStatus.DiskFull = false
+			cm.lastStatus.Paused = false
+			return true
+		}
+		cm.lastStatus.DiskFull = true
+		cm.lastStatus.LastError = "capture buffer: " + err.Error()
+		switch policy {
+		case DiskFullRED:
+			cm.redFullAt = max(len(cm.pending), 1)
+		case DiskFullPause:
+			cm.lastStatus.Paused = true
+			cm.mu.Unlock()
+			select {
+			case <-time.After(diskFullRetryInterval):
+				cm.mu.Lock()
+				continue
+			case <-stopCh:
+				cm.mu.Lock()
+			}
+			cm.lastStatus.Paused = false
+		}
+		cm.lastStatus.Dropped++
+		return false
+	}
+}
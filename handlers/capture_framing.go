@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// FramingMode selects how a capture log is split into records
+type FramingMode string
+
+const (
+	FrameLines     FramingMode = ""          // newline-terminated lines (the default)
+	FrameDelimited FramingMode = "delimited" // records separated by Delimiter
+	FrameFixed     FramingMode = "fixed"     // records of exactly Length bytes
+)
+
+// CaptureFraming describes the record boundaries of a capture source, so
+// framed serial/DFU streams become one event per frame
+type CaptureFraming struct {
+	Mode      FramingMode
+	Delimiter byte // FrameDelimited: frame marker, e.g. 0x7E
+	Length    int  // FrameFixed: frame size in bytes
+}
+
+// ErrInvalidFraming is returned for framing settings that cannot split a stream
+var ErrInvalidFraming = errors.New("invalid capture framing")
+
+// validate checks that f describes a usable split
+func (f CaptureFraming) validate() error {
+	switch f.Mode {
+	case FrameLines, FrameDelimited:
+		return nil
+	case FrameFixed:
+		if f.Length <= 0 {
+			return fmt.Errorf("%w: fixed frames need a positive length", ErrInvalidFraming)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unknown mode %q", ErrInvalidFraming, f.Mode)
+}
+
+// splitFunc returns the scanner split function for f
+func (f CaptureFraming) splitFunc() bufio.SplitFunc {
+	switch f.Mode {
+	case FrameDelimited:
+		return scanDelimited(f.Delimiter)
+	case FrameFixed:
+		return scanFixed(f.Length)
+	}
+	return bufio.ScanLines
+}
+
+// scanDelimited splits on delim. Empty frames, such as back-to-back markers
+// closing one frame and opening the next, are skipped.
+func scanDelimited(delim byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		skip := 0
+		for skip < len(data) && data[skip] == delim {
+			skip++
+		}
+		if i := bytes.IndexByte(data[skip:], delim); i >= 0 {
+			return skip + i + 1, data[skip : skip+i], nil
+		}
+		if atEOF && skip < len(data) {
+			return len(data), data[skip:], nil
+		}
+		// Consume leading markers now; at EOF a nil token ends the scan
+		return skip, nil, nil
+	}
+}
+
+// scanFixed splits into frames of n bytes; a short trailing frame is returned as is
+func scanFixed(n int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) >= n {
+			return n, data[:n], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// SetCaptureFraming sets how the next capture splits its log into records
+func SetCaptureFraming(f CaptureFraming) error {
+	return captureManager.SetFraming(f)
+}
+
+// SetFraming sets how this manager's next capture splits its log into records
+func (cm *CaptureManager) SetFraming(f CaptureFraming) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	cm.framing = f
+	cm.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+)
+
+// A FIFO buffer removes records by moving its head offset past them rather
+// than rewriting the file. The head is kept in a sidecar file next to the
+// buffer so a reopened buffer resumes where removal left off.
+
+// setHead records a new head offset in memory and in the head file, so a
+// reopened buffer doesn't return removed records. Called with b.mu held.
+func (b *FIFOBuffer) setHead(head int64) error {
+	if head == b.head {
+		return nil
+	}
+	b.head = head
+	return saveBufferHead(b.path, head)
+}
+
+// bufferHeadPath is the file holding the head offset of the buffer at path
+func bufferHeadPath(path string) string {
+	return path + ".head"
+}
+
+// loadBufferHead returns the head offset saved for the buffer at path, or
+// the end of the header if none is saved or it doesn't fit a file of size
+// bytes
+func loadBufferHead(path string, size int64) int64 {
+	raw, err := os.ReadFile(bufferHeadPath(path))
+	if err != nil || len(raw) != 8 {
+		return bufferHeaderSize
+	}
+	head := int64(binary.BigEndian.Uint64(raw))
+	if head < bufferHeaderSize || head > size {
+		return bufferHeaderSize
+	}
+	return head
+}
+
+// saveBufferHead writes the head offset of the buffer at path. A head at the
+// end of the header is the default, so its file is removed instead.
+func saveBufferHead(path string, head int64) error {
+	if head == bufferHeaderSize {
+		if err := os.Remove(bufferHeadPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], uint64(head))
+	return os.WriteFile(bufferHeadPath(path), raw[:], 0644)
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"math/bits"
+	"time"
+)
+
+// latencyBuckets is the number of ingest latency histogram buckets. Bucket i
+// holds latencies up to 100µs<<i, so the last covers about 28 minutes and
+// anything slower.
+const latencyBuckets = 25
+
+const latencyResolution = 100 * time.Microsecond
+
+// latencyHistogram is a fixed-size log-scale histogram of capture-to-commit
+// latencies. Adding is O(1); percentiles are exact to within a factor of two.
+type latencyHistogram struct {
+	counts [latencyBuckets]int64
+	total  int64
+}
+
+func (h *latencyHistogram) add(d time.Duration) {
+	i := 0
+	if d > latencyResolution {
+		i = bits.Len64(uint64((d - 1) / latencyResolution))
+	}
+	h.counts[min(i, latencyBuckets-1)]++
+	h.total++
+}
+
+// percentile returns the upper bound of the bucket holding the p-th
+// percentile (0 < p <= 100), or 0 if nothing has been recorded
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := int64(p / 100 * float64(h.total))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range h.counts {
+		if seen += n; seen >= rank {
+			return latencyResolution << i
+		}
+	}
+	return latencyResolution << (latencyBuckets - 1)
+}
+
+// recordLatency adds the capture-to-commit latency of each record in meta
+// committed at now. Records without a read time are skipped. Called with
+// cm.mu held.
+func (cm *CaptureManager) recordLatency(meta []pendingRecord, now time.Time) {
+	for _, m := range meta {
+		if !m.readAt.IsZero() {
+			cm.latency.add(now.Sub(m.readAt))
+		}
+	}
+}
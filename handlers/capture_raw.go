@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// rawCaptureTable holds the raw bytes of captured records, for captures
+// started with CaptureConfig.StoreRaw
+const rawCaptureTable = "raw_capture"
+
+const insertRawCaptureSQL = `INSERT INTO raw_capture (event_table, event_id, raw) VALUES (?, ?, ?)`
+
+// CreateRawCaptureTable creates the raw_capture table if it does not exist.
+// Rows are keyed by the timeseries table and id of the event parsed from them,
+// since each partition numbers its events separately.
+func CreateRawCaptureTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS raw_capture (
+			event_table TEXT NOT NULL,
+			event_id INTEGER NOT NULL,
+			raw BLOB NOT NULL,
+			PRIMARY KEY (event_table, event_id)
+		);
+	`)
+	return err
+}
+
+// RawCaptureEvent is a parsed event with the raw record it came from
+type RawCaptureEvent struct {
+	TimeseriesEvent
+	Raw []byte // nil if the record's raw bytes weren't kept
+}
+
+// QueryEventsWithRaw retrieves a source's events in [start, end] together
+// with their raw records, ordered by timestamp
+func QueryEventsWithRaw(db *sql.DB, source string, start, end time.Time) ([]RawCaptureEvent, error) {
+	tables, err := sourceTables(db, source)
+	if err != nil || len(tables) == 0 {
+		return nil, err
+	}
+	haveRaw, err := existingTables(db, []string{rawCaptureTable})
+	if err != nil {
+		return nil, err
+	}
+	var events []RawCaptureEvent
+	for _, table := range tables {
+		raw := "NULL"
+		if len(haveRaw) > 0 {
+			raw = `(SELECT raw FROM raw_capture WHERE event_table = ? AND event_id = e.id)`
+		}
+		query := `SELECT ` + eventColumns + `, ` + raw + ` FROM "` + table + `" e WHERE source = ? AND timestamp BETWEEN ? AND ?`
+		args := []interface{}{source, start, end}
+		if len(haveRaw) > 0 {
+			args = append([]interface{}{table}, args...)
+		}
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var e RawCaptureEvent
+			if e.TimeseriesEvent, err = scanEvent(rows, &e.Raw); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			events = append(events, e)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+	return events, nil
+}
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// activeCaptures tracks every CaptureManager with a capture running
+var activeCaptures = struct {
+	sync.Mutex
+	m map[*CaptureManager]struct{}
+}{m: make(map[*CaptureManager]struct{})}
+
+// NewCaptureManager returns a manager for an independent capture. Its disk
+// buffer is capture_buffer_<id>.dat so concurrent captures don't share one.
+// Lines are typed by StraceSyscallType until SetClassifier says otherwise.
+func NewCaptureManager(id string) *CaptureManager {
+	return &CaptureManager{id: id, classifier: StraceSyscallType, speed: 1}
+}
+
+// captureManagers holds the manager of each named capture, created on first
+// use; "default" is captureManager. Other managers are evicted once they
+// have sat idle, with no caller holding them, for captureManagerTTL, so
+// stopped captures don't pile up but their final status can still be read.
+var captureManagers = struct {
+	sync.Mutex
+	m map[string]*CaptureManager
+}{m: map[string]*CaptureManager{defaultCaptureID: captureManager}}
+
+// defaultCaptureID names the capture used when no id is given
+const defaultCaptureID = "default"
+
+// ErrInvalidCaptureID is returned for capture ids that can't name a buffer file
+var ErrInvalidCaptureID = errors.New("invalid capture id")
+
+// validCaptureID matches ids safe to use in capture_buffer_<id>.dat
+var validCaptureID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// captureID returns id, or the default capture's id if it is empty, after
+// checking it can name a buffer file
+func captureID(id string) (string, error) {
+	if id == "" {
+		return defaultCaptureID, nil
+	}
+	if !validCaptureID.MatchString(id) {
+		return "", fmt.Errorf("%w %q: use up to 64 letters, digits, '_' or '-'", ErrInvalidCaptureID, id)
+	}
+	return id, nil
+}
+
+// captureManagerTTL is how long an idle named capture's manager, and so its
+// final status, is kept after it was last stopped or used; tests may
+// replace it
+var captureManagerTTL = 10 * time.Minute
+
+// CaptureManagerFor returns the manager of the named capture, creating it on
+// first use. An empty id is the default capture. The manager is kept for the
+// life of the process, like the default one, so settings made on it (tee,
+// labels, error budget, classifier) apply to every run of that capture.
+func CaptureManagerFor(id string) (*CaptureManager, error) {
+	cm, err := acquireCaptureManager(id)
+	if err != nil {
+		return nil, err
+	}
+	captureManagers.Lock()
+	cm.pinned = true
+	cm.refs--
+	captureManagers.Unlock()
+	return cm, nil
+}
+
+// lookupCaptureManager returns the named capture's manager, or nil if it
+// has never been used or was evicted
+func lookupCaptureManager(id string) *CaptureManager {
+	if id == "" {
+		id = defaultCaptureID
+	}
+	captureManagers.Lock()
+	defer captureManagers.Unlock()
+	sweepCaptureManagers(time.Now())
+	return captureManagers.m[id]
+}
+
+// acquireCaptureManager returns the named capture's manager, creating it on
+// first use, and holds it in the registry until releaseCaptureManager
+func acquireCaptureManager(id string) (*CaptureManager, error) {
+	id, err := captureID(id)
+	if err != nil {
+		return nil, err
+	}
+	captureManagers.Lock()
+	defer captureManagers.Unlock()
+	sweepCaptureManagers(time.Now())
+	cm, ok := captureManagers.m[id]
+	if !ok {
+		cm = NewCaptureManager(id)
+		captureManagers.m[id] = cm
+	}
+	cm.refs++
+	return cm, nil
+}
+
+// releaseCaptureManager lets go of a manager from acquireCaptureManager
+func releaseCaptureManager(cm *CaptureManager) {
+	captureManagers.Lock()
+	cm.refs--
+	cm.idleSince = time.Now()
+	captureManagers.Unlock()
+}
+
+// touchCaptureManager restarts cm's idle time, e.g. when its capture stops
+func touchCaptureManager(cm *CaptureManager) {
+	captureManagers.Lock()
+	cm.idleSince = time.Now()
+	captureManagers.Unlock()
+}
+
+// sweepCaptureManagers evicts the managers idle and unheld for
+// captureManagerTTL as of now. A running manager stays, so it can be
+// stopped by id. Called with captureManagers locked.
+func sweepCaptureManagers(now time.Time) {
+	for id, cm := range captureManagers.m {
+		if id == defaultCaptureID || cm.pinned || cm.refs > 0 || now.Sub(cm.idleSince) < captureManagerTTL {
+			continue
+		}
+		cm.mu.Lock()
+		idle := !cm.ingesting
+		cm.mu.Unlock()
+		if idle {
+			delete(captureManagers.m, id)
+		}
+	}
+}
+
+// StartSimulatedCapture starts the named capture of logPath. Captures with
+// different ids run concurrently, each with its own buffer file and loops.
+func StartSimulatedCapture(id, logPath string) error {
+	return StartCapture(id, CaptureConfig{LogPath: logPath})
+}
+
+// StartCapture starts the named capture with cfg, like
+// CaptureManager.StartCapture
+func StartCapture(id string, cfg CaptureConfig) error {
+	cm, err := acquireCaptureManager(id)
+	if err != nil {
+		return err
+	}
+	defer releaseCaptureManager(cm)
+	return cm.StartCapture(cfg)
+}
+
+// StopSimulatedCapture stops the named capture, if it is running
+func StopSimulatedCapture(id string) {
+	if _, err := captureID(id); err != nil {
+		return
+	}
+	cm, _ := acquireCaptureManager(id)
+	defer releaseCaptureManager(cm)
+	cm.StopSimulatedCapture()
+}
+
+// CompactCaptureBuffer compacts the named capture's buffer, like
+// CaptureManager.CompactBuffer
+func CompactCaptureBuffer(id string) (CompactResult, error) {
+	cm, err := acquireCaptureManager(id)
+	if err != nil {
+		return CompactResult{}, err
+	}
+	defer releaseCaptureManager(cm)
+	return cm.CompactBuffer()
+}
+
+// GetCaptureStatus returns the named capture's status, final counts
+// included once it has stopped; a capture never started, or evicted after
+// captureManagerTTL, reports only its id
+func GetCaptureStatus(id string) CaptureStatus {
+	if cm := lookupCaptureManager(id); cm != nil {
+		return cm.GetCaptureStatus()
+	}
+	if id == "" {
+		id = defaultCaptureID
+	}
+	return CaptureStatus{ID: id}
+}
+
+// requestCaptureID returns the capture named by the request's id query
+// parameter, the default capture if there is none
+func requestCaptureID(r *http.Request) (string, error) {
+	return captureID(r.URL.Query().Get("id"))
+}
+
+var (
+	captureBufferDirMu sync.RWMutex
+	captureBufferDir   string
+)
+
+// SetCaptureBufferDir sets the directory disk buffers are kept in, e.g. a
+// tmpfs mount when the working directory is on slow storage. Pass "" for the
+// working directory (the default). It applies to captures started afterwards.
+func SetCaptureBufferDir(dir string) {
+	captureBufferDirMu.Lock()
+	captureBufferDir = dir
+	captureBufferDirMu.Unlock()
+}
+
+// bufferPath returns the disk buffer file for the manager's capture
+func (cm *CaptureManager) bufferPath() string {
+	name := captureBufferPath
+	if cm.id != "" && cm.id != defaultCaptureID {
+		name = "capture_buffer_" + cm.id + ".dat"
+	}
+	captureBufferDirMu.RLock()
+	dir := captureBufferDir
+	captureBufferDirMu.RUnlock()
+	return filepath.Join(dir, name)
+}
+
+// heartbeatName returns the utils heartbeat name of one of the manager's loops
+func (cm *CaptureManager) heartbeatName(loop string) string {
+	return "capture:" + cm.id + ":" + loop
+}
+
+// checkWritableDir returns an error unless a file can be created in dir
+func checkWritableDir(dir string) error {
+	f, err := os.CreateTemp(dir, ".capture_buffer_check_*")
+	if err != nil {
+		return fmt.Errorf("capture buffer directory %s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func registerActiveCapture(cm *CaptureManager) {
+	activeCaptures.Lock()
+	activeCaptures.m[cm] = struct{}{}
+	activeCaptures.Unlock()
+}
+
+func unregisterActiveCapture(cm *CaptureManager) {
+	activeCaptures.Lock()
+	delete(activeCaptures.m, cm)
+	activeCaptures.Unlock()
+}
+
+// ListActiveCaptures returns the status of every running capture, ordered by id
+func ListActiveCaptures() []CaptureStatus {
+	activeCaptures.Lock()
+	managers := make([]*CaptureManager, 0, len(activeCaptures.m))
+	for cm := range activeCaptures.m {
+		managers = append(managers, cm)
+	}
+	activeCaptures.Unlock()
+	statuses := make([]CaptureStatus, 0, len(managers))
+	for _, cm := range managers {
+		statuses = append(statuses, cm.GetCaptureStatus())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// CaptureListHandler serves the running captures as JSON
+func CaptureListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ListActiveCaptures())
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import "time"
+
+// DefaultWallClockMaxWait is the longest a wall-clock replay waits for one
+// record unless WallClockReplay.MaxWait says otherwise
+const DefaultWallClockMaxWait = 10 * time.Second
+
+// WallClockReplay replays a capture so each timestamped record is read at
+// the same clock time it was logged, shifted to start at Start, rather than
+// just with the same gaps between records
+type WallClockReplay struct {
+	// Start is when the first timestamped record is replayed. When zero it
+	// is that record's time of day, today.
+	Start time.Time
+	// MaxWait caps a single wait. A longer one is cut short and the rest of
+	// the schedule moved earlier by the difference, so later records keep
+	// their offsets from each other. DefaultWallClockMaxWait when zero.
+	MaxWait time.Duration
+}
+
+// SetWallClockReplay makes captures started afterwards replay at the wall
+// clock times r schedules, in place of the speed multiplier's pacing; nil
+// goes back to pacing by speed
+func (cm *CaptureManager) SetWallClockReplay(r *WallClockReplay) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if r == nil {
+		cm.wallClock = nil
+		return
+	}
+	replay := *r
+	cm.wallClock = &replay
+}
+
+// ShiftToToday returns the time on now's date, in t's location, with t's
+// time of day
+func ShiftToToday(t, now time.Time) time.Time {
+	now = now.In(t.Location())
+	return time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+// wallClockSchedule maps the event times of one replay to the wall clock
+// times their records are read at
+type wallClockSchedule struct {
+	replay WallClockReplay
+	origin time.Time // event time of the first timestamped record
+	start  time.Time // when origin is replayed
+}
+
+// wait returns how long to wait at now before reading the record logged at
+// eventTime; records already due are read at once
+func (s *wallClockSchedule) wait(eventTime, now time.Time) time.Duration {
+	if s.origin.IsZero() {
+		s.origin = eventTime
+		s.start = s.replay.Start
+		if s.start.IsZero() {
+			s.start = ShiftToToday(eventTime, now)
+		}
+	}
+	maxWait := s.replay.MaxWait
+	if maxWait <= 0 {
+		maxWait = DefaultWallClockMaxWait
+	}
+	wait := s.start.Add(eventTime.Sub(s.origin)).Sub(now)
+	if wait > maxWait {
+		s.start = s.start.Add(maxWait - wait)
+		wait = maxWait
+	}
+	return max(wait, 0)
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Capture session statuses recorded in capture_session
+const (
+	CaptureSessionRunning   = "running"
+	CaptureSessionStopped   = "stopped"
+	CaptureSessionCompleted = "completed"
+	CaptureSessionFailed    = "failed"
+)
+
+// CaptureSession is the persistent record of a single capture run.
+type CaptureSession struct {
+	ID         int64      `json:"id"`
+	SessionID  string     `json:"session_id"`
+	Source     string     `json:"source"`
+	StartedAt  time.Time  `json:"started_at"`
+	EndedAt    *time.Time `json:"ended_at,omitempty"`
+	Status     string     `json:"status"`
+	Ingested   int        `json:"ingested"`
+	ErrorCount int        `json:"error_count"`
+	LastError  string     `json:"last_error"`
+}
+
+// CaptureSessionFilter narrows ListCaptureSessions results. Zero values are ignored.
+type CaptureSessionFilter struct {
+	Source string
+	Status string
+	Since  time.Time
+	Until  time.Time
+	Limit  int // defaults to 50
+	Offset int
+}
+
+// CreateCaptureSessionTable creates the capture_session table if it does not exist.
+func CreateCaptureSessionTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS capture_session (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			session_id TEXT NOT NULL UNIQUE,
+			source TEXT NOT NULL,
+			started_at DATETIME NOT NULL,
+			ended_at DATETIME,
+			status TEXT NOT NULL,
+			ingested INTEGER NOT NULL DEFAULT 0,
+			error_count INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT ''
+		);
+	`)
+	return err
+}
+
+// newSessionID returns a random identifier for a capture session
+func newSessionID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// startCaptureSession records a running session and returns its id
+func startCaptureSession(db *sql.DB, source string) (string, error) {
+	if err := CreateCaptureSessionTable(db); err != nil {
+		return "", err
+	}
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(
+		`INSERT INTO capture_session (session_id, source, started_at, status) VALUES (?, ?, ?, ?)`,
+		id, source, time.Now().UTC(), CaptureSessionRunning,
+	)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// finishCaptureSession stores the final stats of a session
+func finishCaptureSession(db *sql.DB, sessionID string, status CaptureStatus) error {
+	final := CaptureSessionStopped
+	switch {
+	case status.Failed:
+		final = CaptureSessionFailed
+	case status.SourceDone:
+		final = CaptureSessionCompleted
+	}
+	_, err := db.Exec(
+		`UPDATE capture_session SET ended_at = ?, status = ?, ingested = ?, error_count = ?, last_error = ? WHERE session_id = ?`,
+		time.Now().UTC(), final, status.Ingested, status.ErrorCount, status.LastError, sessionID,
+	)
+	return err
+}
+
+// ListCaptureSessions returns capture sessions, newest first, matching the filter.
+func ListCaptureSessions(db *sql.DB, filter CaptureSessionFilter) ([]CaptureSession, error) {
+	var where []string
+	var args []interface{}
+	if filter.Source != "" {
+		where = append(where, "source = ?")
+		args = append(args, filter.Source)
+	}
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "started_at >= ?")
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "started_at <= ?")
+		args = append(args, filter.Until.UTC())
+	}
+	q := `SELECT id, session_id, source, started_at, ended_at, status, ingested, error_count, last_error FROM capture_session`
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	q += " ORDER BY started_at DESC, id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, filter.Offset)
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []CaptureSession
+	for rows.Next() {
+		var s CaptureSession
+		var ended sql.NullTime
+		if err := rows.Scan(&s.ID, &s.SessionID, &s.Source, &s.StartedAt, &ended, &s.Status, &s.Ingested, &s.ErrorCount, &s.LastError); err != nil {
+			return nil, err
+		}
+		if ended.Valid {
+			s.EndedAt = &ended.Time
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// CaptureHistoryHandler lists recorded capture sessions as JSON. since and
+// until are RFC 3339 times bounding when the sessions started.
+func CaptureHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := CaptureSessionFilter{
+		Source: q.Get("source"),
+		Status: q.Get("status"),
+	}
+	for name, dst := range map[string]*int{"limit": &filter.Limit, "offset": &filter.Offset} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*dst = n
+		}
+	}
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "invalid "+name+": must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
+	if captureDB == nil {
+		http.Error(w, "captureDB not set", http.StatusServiceUnavailable)
+		return
+	}
+	if err := CreateCaptureSessionTable(captureDB); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sessions, err := ListCaptureSessions(captureDB, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// QueryBySession returns the events ingested by a capture session, in
+// timestamp order, across all partitions. limit <= 0 returns every event.
+func QueryBySession(db *sql.DB, sessionID string, limit int) ([]TimeseriesEvent, error) {
+	tables, err := allTimeseriesTables(db)
+	if err != nil || len(tables) == 0 {
+		return nil, err
+	}
+	query, args := unionSelect(tables, eventColumns, "session_id = ?", sessionID)
+	query += " ORDER BY timestamp, seq"
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+	return queryEvents(db, query, args...)
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// SecondarySink receives a copy of every batch of captured events once it is
+// committed to the primary database, so a lost database doesn't lose the
+// capture. Errors are logged and never fail ingestion.
+type SecondarySink interface {
+	WriteBatch(events []TimeseriesEvent) error
+}
+
+// SetSecondarySink mirrors the default manager's ingested events to sink
+func SetSecondarySink(sink SecondarySink) {
+	captureManager.SetSecondarySink(sink)
+}
+
+// SetSecondarySink mirrors this manager's ingested events to sink. Pass nil
+// to stop mirroring.
+func (cm *CaptureManager) SetSecondarySink(sink SecondarySink) {
+	cm.mu.Lock()
+	cm.secondary = sink
+	cm.mu.Unlock()
+}
+
+// mirrorBatch sends the records of a committed batch that were inserted to
+// the secondary sink, if any
+func (cm *CaptureManager) mirrorBatch(records []captureRecord, committed time.Time) {
+	cm.mu.Lock()
+	sink, labels, session := cm.secondary, cm.labels, cm.sessionID
+	cm.mu.Unlock()
+	if sink == nil {
+		return
+	}
+	events := make([]TimeseriesEvent, 0, len(records))
+	for _, r := range records {
+		if r.failed {
+			continue
+		}
+		ts := r.timestamp
+		if ts.IsZero() {
+			ts = committed.UTC()
+		}
+		events = append(events, TimeseriesEvent{
+			Timestamp: ts,
+			Source:    r.source,
+			Type:      r.eventType,
+			Payload:   r.payload,
+			Labels:    labels,
+			Seq:       r.seq,
+			SessionID: session,
+		})
+	}
+	if len(events) == 0 {
+		return
+	}
+	if err := sink.WriteBatch(events); err != nil {
+		log.Printf("capture %s: secondary sink: %v", cm.id, err)
+	}
+}
+
+// FileSink is a SecondarySink appending events to a file as JSON lines
+type FileSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFileSink opens path for appending, creating it if needed
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f}, nil
+}
+
+// WriteBatch appends events and syncs the file
+func (s *FileSink) WriteBatch(events []TimeseriesEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := bufio.NewWriter(s.f)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// Close closes the file
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"database/sql"
+	"time"
+)
+
+// lifetimeStatsFlushInterval is how often ingestLoop persists lifetime totals
+const lifetimeStatsFlushInterval = 5 * time.Second
+
+// LifetimeStats are a capture manager's ingest totals across every session
+type LifetimeStats struct {
+	Ingested  int64     `json:"ingested"`
+	Errors    int64     `json:"errors"`
+	Bytes     int64     `json:"bytes"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CreateCaptureStatsTable creates the capture_stats table if it does not exist.
+func CreateCaptureStatsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS capture_stats (
+			capture_id TEXT PRIMARY KEY,
+			ingested INTEGER NOT NULL DEFAULT 0,
+			errors INTEGER NOT NULL DEFAULT 0,
+			bytes INTEGER NOT NULL DEFAULT 0,
+			updated_at DATETIME NOT NULL
+		);
+	`)
+	return err
+}
+
+// CaptureLifetimeStats returns the persisted totals for a capture manager id,
+// or zeros if it has none. Counts from a running session are flushed every
+// few seconds and when it stops.
+func CaptureLifetimeStats(db *sql.DB, captureID string) (LifetimeStats, error) {
+	var s LifetimeStats
+	if err := CreateCaptureStatsTable(db); err != nil {
+		return s, err
+	}
+	err := db.QueryRow(`SELECT ingested, errors, bytes, updated_at FROM capture_stats WHERE capture_id = ?`, captureID).
+		Scan(&s.Ingested, &s.Errors, &s.Bytes, &s.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return LifetimeStats{}, nil
+	}
+	return s, err
+}
+
+// addLifetimeStats adds delta to the persisted totals for captureID
+func addLifetimeStats(db *sql.DB, captureID string, delta LifetimeStats) error {
+	if err := CreateCaptureStatsTable(db); err != nil {
+		return err
+	}
+	_, err := db.Exec(
+		`INSERT INTO capture_stats (capture_id, ingested, errors, bytes, updated_at) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT(capture_id) DO UPDATE SET ingested = ingested + excluded.ingested,
+		   errors = errors + excluded.errors, bytes = bytes + excluded.bytes, updated_at = excluded.updated_at`,
+		captureID, delta.Ingested, delta.Errors, delta.Bytes, time.Now().UTC(),
+	)
+	return err
+}
+
+// sessionTotals returns the current session's counters. Called with cm.mu held.
+func (cm *CaptureManager) sessionTotals() LifetimeStats {
+	return LifetimeStats{
+		Ingested: int64(cm.lastStatus.Ingested),
+		Errors:   int64(cm.lastStatus.ErrorCount),
+		Bytes:    cm.lastStatus.BytesIngested,
+	}
+}
+
+// flushLifetimeStats persists the session counts not yet added to capture_stats
+func (cm *CaptureManager) flushLifetimeStats() error {
+	cm.flushMu.Lock()
+	defer cm.flushMu.Unlock()
+	db := captureDB
+	if db == nil {
+		return nil
+	}
+	cm.mu.Lock()
+	cur := cm.sessionTotals()
+	delta := LifetimeStats{
+		Ingested: cur.Ingested - cm.lifetimeSaved.Ingested,
+		Errors:   cur.Errors - cm.lifetimeSaved.Errors,
+		Bytes:    cur.Bytes - cm.lifetimeSaved.Bytes,
+	}
+	cm.mu.Unlock()
+	if delta == (LifetimeStats{}) {
+		return nil
+	}
+	if err := addLifetimeStats(db, cm.id, delta); err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	cm.lifetimeSaved = cur
+	cm.mu.Unlock()
+	return nil
+}
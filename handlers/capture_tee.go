@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"os"
+	"time"
+)
+
+// CaptureTee writes every captured record to a rotating file as it is read,
+// independently of ingestion, so the stream survives database failures and
+// can be re-processed later. Records are written as read, before redaction,
+// so the file may hold values the redaction rules keep out of the buffer
+// and DB; it is created readable by its owner only. Each record is followed
+// by its frame terminator, so the file can be captured again with the same
+// framing.
+type CaptureTee struct {
+	Path    string        // the current file; rotated files get a timestamp suffix
+	MaxSize int64         // rotate before a write would grow the file past this; no limit if zero
+	MaxAge  time.Duration // rotate files opened longer ago than this; no limit if zero
+}
+
+// SetCaptureTee tees the default manager's next capture; nil disables it
+func SetCaptureTee(t *CaptureTee) {
+	captureManager.SetTee(t)
+}
+
+// SetTee tees this manager's next capture to t; nil disables it
+func (cm *CaptureManager) SetTee(t *CaptureTee) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.tee = nil
+	if t != nil {
+		copied := *t
+		cm.tee = &copied
+	}
+}
+
+// teeFile is an open CaptureTee, owned by captureLoop
+type teeFile struct {
+	cfg    CaptureTee
+	term   []byte // frame terminator appended to each record
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// openTee opens cfg.Path for appending
+func openTee(cfg CaptureTee, framing CaptureFraming) (*teeFile, error) {
+	t := &teeFile{cfg: cfg}
+	switch framing.Mode {
+	case FrameLines:
+		t.term = []byte{'\n'}
+	case FrameDelimited:
+		t.term = []byte{framing.Delimiter}
+	}
+	return t, t.open(time.Now())
+}
+
+func (t *teeFile) open(now time.Time) error {
+	f, err := os.OpenFile(t.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.f, t.size, t.opened = f, info.Size(), now
+	return nil
+}
+
+// write appends rec, rotating first if the file is too big or too old
+func (t *teeFile) write(rec []byte, now time.Time) error {
+	n := int64(len(rec) + len(t.term))
+	full := t.cfg.MaxSize > 0 && t.size > 0 && t.size+n > t.cfg.MaxSize
+	old := t.cfg.MaxAge > 0 && now.Sub(t.opened) >= t.cfg.MaxAge
+	if full || old {
+		if err := t.rotate(now); err != nil {
+			return err
+		}
+	}
+	if _, err := t.f.Write(append(rec[:len(rec):len(rec)], t.term...)); err != nil {
+		return err
+	}
+	t.size += n
+	return nil
+}
+
+// rotate moves the current file aside and starts a new one
+func (t *teeFile) rotate(now time.Time) error {
+	if err := t.f.Close(); err != nil {
+		return err
+	}
+	// If the rename fails keep appending to the same file
+	renameErr := os.Rename(t.cfg.Path, t.cfg.Path+"."+now.UTC().Format("20060102T150405.000000000"))
+	if err := t.open(now); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+func (t *teeFile) close() error {
+	return t.f.Close()
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/unklstewy/redbug_dewey/utils"
+)
+
+// ManufacturerCatalog is the JSON form of a manufacturer and its radio
+// models. Ids are left out: they are reassigned on import.
+type ManufacturerCatalog struct {
+	Manufacturer string         `json:"manufacturer"`
+	Models       []CatalogModel `json:"models"`
+}
+
+// CatalogModel is a radio model and its codeplug supported settings
+type CatalogModel struct {
+	Name              string           `json:"name"`
+	SupportedSettings []CatalogFeature `json:"supported_settings"`
+}
+
+// CatalogFeature is one codeplug_supported_setting row
+type CatalogFeature struct {
+	Feature   string `json:"feature"`
+	Supported bool   `json:"supported"`
+}
+
+// ErrInvalidCatalog is returned by ImportManufacturerCatalog for a document
+// without a manufacturer name or with an unnamed model or feature
+var ErrInvalidCatalog = errors.New("invalid manufacturer catalog")
+
+// ExportManufacturerCatalog serializes a manufacturer, its radio models and
+// their codeplug supported settings as a ManufacturerCatalog JSON document.
+// It returns sql.ErrNoRows if the manufacturer doesn't exist.
+func ExportManufacturerCatalog(db *sql.DB, manufacturerID int) ([]byte, error) {
+	var catalog ManufacturerCatalog
+	var name sql.NullString
+	if err := db.QueryRow("SELECT name FROM manufacturer WHERE id = ?", manufacturerID).Scan(&name); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("manufacturer %d: %w", manufacturerID, err)
+		}
+		return nil, err
+	}
+	catalog.Manufacturer = name.String
+	rows, err := db.Query(`
+		SELECT m.id, m.name, f.feature, f.supported
+		FROM radio_model m LEFT JOIN codeplug_supported_setting f ON f.radio_model_id = m.id
+		WHERE m.manufacturer_id = ?
+		ORDER BY m.id, f.id`, manufacturerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	catalog.Models = []CatalogModel{}
+	lastModel := -1
+	for rows.Next() {
+		var modelID int
+		var modelName, feature sql.NullString
+		var supported sql.NullBool
+		if err := rows.Scan(&modelID, &modelName, &feature, &supported); err != nil {
+			return nil, err
+		}
+		if modelID != lastModel {
+			catalog.Models = append(catalog.Models, CatalogModel{Name: modelName.String, SupportedSettings: []CatalogFeature{}})
+			lastModel = modelID
+		}
+		if feature.Valid {
+			m := &catalog.Models[len(catalog.Models)-1]
+			m.SupportedSettings = append(m.SupportedSettings, CatalogFeature{Feature: feature.String, Supported: supported.Bool})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(catalog, "", "  ")
+}
+
+// ImportManufacturerCatalog recreates an exported catalog in one transaction
+// and returns the manufacturer's id. Names resolve collisions: an existing
+// manufacturer of the same name is reused, as are its models of the same
+// name, and a model's existing feature takes the imported supported flag.
+func ImportManufacturerCatalog(db *sql.DB, data []byte) (int64, error) {
+	var catalog ManufacturerCatalog
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidCatalog, err)
+	}
+	if catalog.Manufacturer == "" {
+		return 0, fmt.Errorf("%w: manufacturer name is required", ErrInvalidCatalog)
+	}
+	for _, m := range catalog.Models {
+		if m.Name == "" {
+			return 0, fmt.Errorf("%w: model name is required", ErrInvalidCatalog)
+		}
+		for _, f := range m.SupportedSettings {
+			if f.Feature == "" {
+				return 0, fmt.Errorf("%w: model %q has a feature without a name", ErrInvalidCatalog, m.Name)
+			}
+		}
+	}
+	var id int64
+	err := utils.RetryOnBusy(func() error {
+		var err error
+		id, err = importManufacturerCatalog(db, catalog)
+		return err
+	})
+	return id, err
+}
+
+func importManufacturerCatalog(db *sql.DB, catalog ManufacturerCatalog) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	mfrID, err := findOrInsert(tx,
+		"SELECT id FROM manufacturer WHERE name = ? ORDER BY id LIMIT 1",
+		"INSERT INTO manufacturer (name) VALUES (?)", catalog.Manufacturer)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range catalog.Models {
+		modelID, err := findOrInsert(tx,
+			"SELECT id FROM radio_model WHERE manufacturer_id = ? AND name = ? ORDER BY id LIMIT 1",
+			"INSERT INTO radio_model (manufacturer_id, name) VALUES (?, ?)", mfrID, m.Name)
+		if err != nil {
+			return 0, err
+		}
+		for _, f := range m.SupportedSettings {
+			res, err := tx.Exec("UPDATE codeplug_supported_setting SET supported = ? WHERE radio_model_id = ? AND feature = ?", f.Supported, modelID, f.Feature)
+			if err != nil {
+				return 0, err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				continue
+			}
+			if _, err := tx.Exec("INSERT INTO codeplug_supported_setting (radio_model_id, feature, supported) VALUES (?, ?, ?)", modelID, f.Feature, f.Supported); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return mfrID, nil
+}
+
+// findOrInsert returns the id selected by find, or inserts a row with insert
+// when there is none. Both statements take args.
+func findOrInsert(tx *sql.Tx, find, insert string, args ...interface{}) (int64, error) {
+	var id int64
+	err := tx.QueryRow(find, args...).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+	res, err := tx.Exec(insert, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
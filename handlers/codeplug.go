@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// codeplugChecksum hashes a radio model's settings in canonical (name-sorted) order
+func codeplugChecksum(db *sql.DB, radioModelID int) (string, error) {
+	rows, err := db.Query("SELECT setting, value FROM codeplug_setting WHERE radio_model = ? ORDER BY setting, value", radioModelID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	settings := [][2]string{}
+	for rows.Next() {
+		var name, value sql.NullString
+		if err := rows.Scan(&name, &value); err != nil {
+			return "", err
+		}
+		settings = append(settings, [2]string{name.String, value.String})
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	// JSON keeps names and values unambiguous regardless of their content
+	canonical, err := json.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ComputeCodeplugChecksum hashes a radio model's codeplug settings and stores
+// the result in codeplug_checksum for later verification.
+func ComputeCodeplugChecksum(db *sql.DB, radioModelID int) (string, error) {
+	sum, err := codeplugChecksum(db, radioModelID)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(
+		"INSERT OR REPLACE INTO codeplug_checksum (radio_model, checksum, computed_at) VALUES (?, ?, ?)",
+		radioModelID, sum, time.Now().UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return "", err
+	}
+	return sum, nil
+}
+
+// VerifyCodeplugChecksum recomputes a radio model's checksum and reports whether
+// it still matches the stored one. It returns sql.ErrNoRows if none is stored.
+func VerifyCodeplugChecksum(db *sql.DB, radioModelID int) (bool, error) {
+	var stored string
+	if err := db.QueryRow("SELECT checksum FROM codeplug_checksum WHERE radio_model = ?", radioModelID).Scan(&stored); err != nil {
+		return false, err
+	}
+	current, err := codeplugChecksum(db, radioModelID)
+	if err != nil {
+		return false, err
+	}
+	return current == stored, nil
+}
+
+// CodeplugCompleteness returns the fraction of a radio model's supported
+// features that have a non-empty codeplug_setting value, and the features
+// that don't, sorted by name. A model with no supported features is complete.
+func CodeplugCompleteness(db *sql.DB, radioModelID int) (float64, []string, error) {
+	rows, err := db.Query(`
+		SELECT DISTINCT f.feature, EXISTS (
+			SELECT 1 FROM codeplug_setting s
+			WHERE s.radio_model = f.radio_model_id AND s.setting = f.feature
+			  AND s.value IS NOT NULL AND s.value != ''
+		)
+		FROM codeplug_supported_setting f
+		WHERE f.radio_model_id = ? AND f.supported
+		ORDER BY f.feature`, radioModelID)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	total := 0
+	missing := []string{}
+	for rows.Next() {
+		var feature string
+		var set bool
+		if err := rows.Scan(&feature, &set); err != nil {
+			return 0, nil, err
+		}
+		total++
+		if !set {
+			missing = append(missing, feature)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	if total == 0 {
+		return 1, missing, nil
+	}
+	return float64(total-len(missing)) / float64(total), missing, nil
+}
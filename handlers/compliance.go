@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/unklstewy/redbug_dewey/models"
+)
+
+var (
+	ErrNoReportKey            = errors.New("report signing key not configured")
+	ErrReportSignatureInvalid = errors.New("report signature does not match its contents")
+)
+
+// reportKey signs compliance reports; see SetReportSigningKey
+var reportKey []byte
+
+// SetReportSigningKey sets the HMAC key used to sign and verify reports
+func SetReportSigningKey(key []byte) {
+	reportKey = append([]byte(nil), key...)
+}
+
+// Report is a tamper-evident summary of audit and backup history
+type Report struct {
+	GeneratedAt  time.Time               `json:"generated_at"`
+	Start        time.Time               `json:"start"`
+	End          time.Time               `json:"end"`
+	AuditEntries []models.AuditEntry     `json:"audit_entries"`
+	Backups      []models.BackupMetadata `json:"backups"`
+	Signature    string                  `json:"signature"` // hex HMAC-SHA256 of the report without Signature
+}
+
+// sign returns the HMAC of the report's JSON form with Signature cleared
+func (r Report) sign(key []byte) (string, error) {
+	r.Signature = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// GenerateComplianceReport collects the audit entries and backups recorded
+// in [start, end] and signs the result with the configured key.
+func GenerateComplianceReport(db *sql.DB, start, end time.Time) (Report, error) {
+	if len(reportKey) == 0 {
+		return Report{}, ErrNoReportKey
+	}
+	r := Report{
+		GeneratedAt: time.Now().UTC().Truncate(time.Second),
+		Start:       start.UTC(),
+		End:         end.UTC(),
+	}
+	var err error
+	if r.AuditEntries, err = ListAuditEntries(db, start, end); err != nil {
+		return Report{}, err
+	}
+	if r.Backups, err = ListBackups(db, start, end); err != nil {
+		return Report{}, err
+	}
+	if r.Signature, err = r.sign(reportKey); err != nil {
+		return Report{}, err
+	}
+	return r, nil
+}
+
+// VerifyReport checks the report's signature against the configured key,
+// returning ErrReportSignatureInvalid if the report was altered.
+func VerifyReport(r Report) error {
+	if len(reportKey) == 0 {
+		return ErrNoReportKey
+	}
+	want, err := r.sign(reportKey)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(want), []byte(r.Signature)) {
+		return ErrReportSignatureInvalid
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+)
+
+// IngestErrorBudget fails a capture once more than MaxErrors ingest errors
+// occur within Window. The zero value disables the budget.
+type IngestErrorBudget struct {
+	MaxErrors int
+	Window    time.Duration
+}
+
+func (b IngestErrorBudget) enabled() bool {
+	return b.MaxErrors > 0 && b.Window > 0
+}
+
+// SetIngestErrorBudget sets the error budget for the next capture
+func SetIngestErrorBudget(b IngestErrorBudget) {
+	captureManager.SetErrorBudget(b)
+}
+
+// SetErrorBudget sets the error budget for this manager's next capture
+func (cm *CaptureManager) SetErrorBudget(b IngestErrorBudget) {
+	cm.mu.Lock()
+	cm.errorBudget = b
+	cm.mu.Unlock()
+}
+
+// errorWindow counts errors over a sliding window
+type errorWindow struct {
+	budget IngestErrorBudget
+	events []errorEvent
+	total  int
+}
+
+type errorEvent struct {
+	at time.Time
+	n  int
+}
+
+// add records n errors at now and reports whether the budget is exceeded
+func (w *errorWindow) add(now time.Time, n int) bool {
+	if !w.budget.enabled() || n == 0 {
+		return false
+	}
+	w.events = append(w.events, errorEvent{now, n})
+	w.total += n
+	cutoff := now.Add(-w.budget.Window)
+	for len(w.events) > 0 && !w.events[0].at.After(cutoff) {
+		w.total -= w.events[0].n
+		w.events = w.events[1:]
+	}
+	return w.total > w.budget.MaxErrors
+}
+
+// failCapture marks the capture failed and stops it. Called from ingestLoop,
+// which must return afterwards so the stop can complete.
+func (cm *CaptureManager) failCapture(b IngestErrorBudget) {
+	cm.mu.Lock()
+	cm.lastStatus.Failed = true
+	cm.lastStatus.LastError = fmt.Sprintf("ingest error budget exceeded: more than %d errors in %s", b.MaxErrors, b.Window)
+	cm.mu.Unlock()
+	go cm.StopSimulatedCapture()
+}
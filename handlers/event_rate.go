@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// EventRate returns a source's events per second over the trailing window
+func EventRate(db *sql.DB, source string, window time.Duration) (float64, error) {
+	return eventRateAt(db, source, window, time.Now().UTC())
+}
+
+// eventRateAt is EventRate for the window ending at now
+func eventRateAt(db *sql.DB, source string, window time.Duration, now time.Time) (float64, error) {
+	if window <= 0 {
+		return 0, nil
+	}
+	tables, err := sourceTables(db, source)
+	if err != nil || len(tables) == 0 {
+		return 0, err
+	}
+	inner, args := unionSelect(tables, "1", "source = ? AND timestamp > ? AND timestamp <= ?", source, now.Add(-window), now)
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM (`+inner+`)`, args...).Scan(&n); err != nil {
+		return 0, err
+	}
+	return float64(n) / window.Seconds(), nil
+}
+
+// RateThreshold bounds a source's event rate, in events per second. Set Min
+// to a small positive rate to be alerted when the source goes quiet.
+type RateThreshold struct {
+	Source string
+	Min    float64 // low below Min
+	Max    float64 // high above Max; no upper bound if zero
+}
+
+// RateState is a source's event rate relative to its threshold
+type RateState string
+
+const (
+	RateOK   RateState = "ok"
+	RateLow  RateState = "low"
+	RateHigh RateState = "high"
+)
+
+// state classifies rate against t
+func (t RateThreshold) state(rate float64) RateState {
+	switch {
+	case rate < t.Min:
+		return RateLow
+	case t.Max > 0 && rate > t.Max:
+		return RateHigh
+	}
+	return RateOK
+}
+
+// RateAlert reports a source whose event rate moved to a new state
+type RateAlert struct {
+	Threshold RateThreshold
+	Rate      float64
+	State     RateState
+	At        time.Time
+}
+
+// RateWatchOptions configures WatchEventRates. Window must be positive.
+type RateWatchOptions struct {
+	Window     time.Duration // the trailing window rates are computed over
+	Interval   time.Duration // how often rates are checked; Window if zero
+	Thresholds []RateThreshold
+	// OnAlert is called when a source crosses its threshold, and again when
+	// it returns to RateOK. Sources start out assumed OK.
+	OnAlert func(RateAlert)
+}
+
+// rateWatcher tracks each threshold's last state between checks
+type rateWatcher struct {
+	db     *sql.DB
+	opts   RateWatchOptions
+	states []RateState
+}
+
+// check computes every source's rate at now and reports state changes
+func (w *rateWatcher) check(now time.Time) {
+	for i, t := range w.opts.Thresholds {
+		rate, err := eventRateAt(w.db, t.Source, w.opts.Window, now)
+		if err != nil {
+			log.Printf("event rate of %s: %v", t.Source, err)
+			continue
+		}
+		state := t.state(rate)
+		if state == w.states[i] {
+			continue
+		}
+		w.states[i] = state
+		if w.opts.OnAlert != nil {
+			w.opts.OnAlert(RateAlert{Threshold: t, Rate: rate, State: state, At: now})
+		}
+	}
+}
+
+// WatchEventRates checks the event rate of each thresholded source every
+// Interval in the background until stopCh is closed
+func WatchEventRates(db *sql.DB, opts RateWatchOptions, stopCh <-chan struct{}) {
+	if opts.Interval <= 0 {
+		opts.Interval = opts.Window
+	}
+	w := &rateWatcher{db: db, opts: opts, states: make([]RateState, len(opts.Thresholds))}
+	for i := range w.states {
+		w.states[i] = RateOK
+	}
+	go func() {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				w.check(now.UTC())
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
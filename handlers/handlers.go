@@ -4,16 +4,23 @@ package handlers
 import (
 	"bufio"
 	"database/sql"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/unklstewy/redbug_dewey/models"
+	"github.com/unklstewy/redbug_dewey/utils"
 )
 
 // Add a global DB handle for ingestion (for demo; in production, use a proper pool or context)
@@ -24,9 +31,29 @@ func SetCaptureDB(db *sql.DB) {
 	captureDB = db
 }
 
+// SetCaptureIngestDB directs captured events into db instead of captureDB,
+// e.g. a scratch database for bulk re-ingest that is merged into the live
+// store afterwards with MergeTimeseriesDBs. Session history is still recorded
+// in captureDB. Pass nil to ingest into captureDB again.
+func SetCaptureIngestDB(db *sql.DB) {
+	captureManager.mu.Lock()
+	captureManager.ingestDB = db
+	captureManager.mu.Unlock()
+}
+
+// execRetry runs a write statement, retrying while the database is busy
+func execRetry(db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := utils.RetryOnBusy(func() (err error) {
+		res, err = db.Exec(query, args...)
+		return err
+	})
+	return res, err
+}
+
 // Manufacturer CRUD
 func CreateManufacturer(db *sql.DB, name string) (int64, error) {
-	res, err := db.Exec("INSERT INTO manufacturer (name) VALUES (?)", name)
+	res, err := execRetry(db, "INSERT INTO manufacturer (name) VALUES (?)", name)
 	if err != nil {
 		return 0, err
 	}
@@ -43,22 +70,62 @@ func GetManufacturer(db *sql.DB, id int) (*models.Manufacturer, error) {
 }
 
 func UpdateManufacturer(db *sql.DB, id int, name string) error {
-	_, err := db.Exec("UPDATE manufacturer SET name = ? WHERE id = ?", name, id)
+	_, err := execRetry(db, "UPDATE manufacturer SET name = ? WHERE id = ?", name, id)
 	return err
 }
 
 func DeleteManufacturer(db *sql.DB, id int) error {
-	_, err := db.Exec("DELETE FROM manufacturer WHERE id = ?", id)
+	_, err := execRetry(db, "DELETE FROM manufacturer WHERE id = ?", id)
 	return err
 }
 
-// User CRUD with bcrypt password hashing
+// ErrMergeIntoSelf is returned when a manufacturer is merged into itself
+var ErrMergeIntoSelf = errors.New("cannot merge a manufacturer into itself")
+
+// MergeManufacturers repoints mergeID's radio models to keepID and deletes
+// mergeID, in one transaction. Both manufacturers must exist.
+func MergeManufacturers(db *sql.DB, keepID, mergeID int) error {
+	if keepID == mergeID {
+		return ErrMergeIntoSelf
+	}
+	return utils.RetryOnBusy(func() error { return mergeManufacturers(db, keepID, mergeID) })
+}
+
+func mergeManufacturers(db *sql.DB, keepID, mergeID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range []int{keepID, mergeID} {
+		var exists int
+		if err := tx.QueryRow("SELECT 1 FROM manufacturer WHERE id = ?", id).Scan(&exists); err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("manufacturer %d: %w", id, err)
+			}
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE radio_model SET manufacturer_id = ? WHERE manufacturer_id = ?", keepID, mergeID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM manufacturer WHERE id = ?", mergeID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// User CRUD, hashing passwords with the configured PasswordHasher (bcrypt by default)
 func CreateUser(db *sql.DB, username, password string, roleID int) (int64, error) {
-	hash, err := models.HashPassword(password)
+	username, err := NormalizeUsername(username)
+	if err != nil {
+		return 0, err
+	}
+	hash, err := passwordHasher.Hash(password)
 	if err != nil {
 		return 0, err
 	}
-	res, err := db.Exec("INSERT INTO user (username, password_hash, role_id) VALUES (?, ?, ?)", username, hash, roleID)
+	res, err := execRetry(db, "INSERT INTO user (username, password_hash, role_id) VALUES (?, ?, ?)", username, hash, roleID)
 	if err != nil {
 		return 0, err
 	}
@@ -66,59 +133,104 @@ func CreateUser(db *sql.DB, username, password string, roleID int) (int64, error
 }
 
 func AuthenticateUser(db *sql.DB, username, password string) (bool, error) {
+	username = normalizeUsername(username)
 	row := db.QueryRow("SELECT password_hash FROM user WHERE username = ?", username)
 	var hash string
 	if err := row.Scan(&hash); err != nil {
 		return false, err
 	}
-	return models.CheckPasswordHash(password, hash), nil
+	return passwordHasher.Compare(password, hash), nil
+}
+
+// Authentication errors returned by AuthenticateUserDetailed
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrUserLocked         = errors.New("user is locked")
+	ErrUserRevoked        = errors.New("user is revoked")
+)
+
+// AuthenticateUserDetailed verifies the credentials and returns the user
+// (without the password hash) so callers don't need a second lookup.
+func AuthenticateUserDetailed(db *sql.DB, username, password string) (*models.User, error) {
+	username = normalizeUsername(username)
+	row := db.QueryRow("SELECT id, username, password_hash, role_id, locked, revoked, last_login FROM user WHERE username = ?", username)
+	var u models.User
+	var hash string
+	var locked, revoked sql.NullBool
+	var lastLogin sql.NullString
+	if err := row.Scan(&u.ID, &u.Username, &hash, &u.RoleID, &locked, &revoked, &lastLogin); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	if !passwordHasher.Compare(password, hash) {
+		return nil, ErrInvalidCredentials
+	}
+	u.Locked = locked.Bool
+	u.Revoked = revoked.Bool
+	u.LastLogin = lastLogin.String
+	if u.Revoked {
+		return nil, ErrUserRevoked
+	}
+	if u.Locked {
+		return nil, ErrUserLocked
+	}
+	return &u, nil
 }
 
 // Administrative functions for user management
 func LockUser(db *sql.DB, username string) error {
-	_, err := db.Exec("UPDATE user SET locked = 1 WHERE username = ?", username)
+	username = normalizeUsername(username)
+	_, err := execRetry(db, "UPDATE user SET locked = 1 WHERE username = ?", username)
 	return err
 }
 
 func UnlockUser(db *sql.DB, username string) error {
-	_, err := db.Exec("UPDATE user SET locked = 0 WHERE username = ?", username)
+	username = normalizeUsername(username)
+	_, err := execRetry(db, "UPDATE user SET locked = 0 WHERE username = ?", username)
 	return err
 }
 
 func RevokeUser(db *sql.DB, username string) error {
-	_, err := db.Exec("UPDATE user SET revoked = 1 WHERE username = ?", username)
+	username = normalizeUsername(username)
+	_, err := execRetry(db, "UPDATE user SET revoked = 1 WHERE username = ?", username)
 	return err
 }
 
 func UnrevokeUser(db *sql.DB, username string) error {
-	_, err := db.Exec("UPDATE user SET revoked = 0 WHERE username = ?", username)
+	username = normalizeUsername(username)
+	_, err := execRetry(db, "UPDATE user SET revoked = 0 WHERE username = ?", username)
 	return err
 }
 
 func RemoveUser(db *sql.DB, username string) error {
-	_, err := db.Exec("DELETE FROM user WHERE username = ?", username)
+	username = normalizeUsername(username)
+	_, err := execRetry(db, "DELETE FROM user WHERE username = ?", username)
 	return err
 }
 
 func ResetUserPassword(db *sql.DB, username, newPassword string) error {
-	hash, err := models.HashPassword(newPassword)
+	username = normalizeUsername(username)
+	hash, err := passwordHasher.Hash(newPassword)
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec("UPDATE user SET password_hash = ? WHERE username = ?", hash, username)
+	_, err = execRetry(db, "UPDATE user SET password_hash = ? WHERE username = ?", hash, username)
 	return err
 }
 
 // Update last login timestamp
 func UpdateLastLogin(db *sql.DB, username string) error {
+	username = normalizeUsername(username)
 	timestamp := time.Now().UTC().Format(time.RFC3339)
-	_, err := db.Exec("UPDATE user SET last_login = ? WHERE username = ?", timestamp, username)
+	_, err := execRetry(db, "UPDATE user SET last_login = ? WHERE username = ?", timestamp, username)
 	return err
 }
 
 // Team CRUD
 func CreateTeam(db *sql.DB, name string, leaderID int) (int64, error) {
-	res, err := db.Exec("INSERT INTO team (name, leader_id) VALUES (?, ?)", name, leaderID)
+	res, err := execRetry(db, "INSERT INTO team (name, leader_id) VALUES (?, ?)", name, leaderID)
 	if err != nil {
 		return 0, err
 	}
@@ -126,92 +238,111 @@ func CreateTeam(db *sql.DB, name string, leaderID int) (int64, error) {
 }
 
 func AddTeamMember(db *sql.DB, teamID, userID, roleID int) (int64, error) {
-	res, err := db.Exec("INSERT INTO team_member (team_id, user_id, role_id) VALUES (?, ?, ?)", teamID, userID, roleID)
+	res, err := execRetry(db, "INSERT INTO team_member (team_id, user_id, role_id) VALUES (?, ?, ?)", teamID, userID, roleID)
 	if err != nil {
 		return 0, err
 	}
 	return res.LastInsertId()
 }
 
+// SetTeamPermission grants a permission to a team. Granting an existing
+// permission is a no-op that returns the id of the existing row.
 func SetTeamPermission(db *sql.DB, teamID, permissionID int) (int64, error) {
-	res, err := db.Exec("INSERT INTO team_permission (team_id, permission_id) VALUES (?, ?)", teamID, permissionID)
+	res, err := execRetry(db,
+		`INSERT OR IGNORE INTO team_permission (team_id, permission_id)
+		 SELECT ?, ? WHERE NOT EXISTS (SELECT 1 FROM team_permission WHERE team_id = ? AND permission_id = ?)`,
+		teamID, permissionID, teamID, permissionID,
+	)
 	if err != nil {
 		return 0, err
 	}
-	return res.LastInsertId()
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return res.LastInsertId()
+	}
+	var id int64
+	err = db.QueryRow("SELECT id FROM team_permission WHERE team_id = ? AND permission_id = ? ORDER BY id LIMIT 1", teamID, permissionID).Scan(&id)
+	return id, err
 }
 
+// ErrRemoveTeamLeader is returned when removing a team's leader from its
+// members; ChangeTeamLeader must hand the team to someone else first
+var ErrRemoveTeamLeader = errors.New("cannot remove the team leader; change the leader first")
+
+// RemoveTeamMember removes a user from a team, unless the user leads it
 func RemoveTeamMember(db *sql.DB, teamID, userID int) error {
-	_, err := db.Exec("DELETE FROM team_member WHERE team_id = ? AND user_id = ?", teamID, userID)
-	return err
+	res, err := execRetry(db,
+		`DELETE FROM team_member WHERE team_id = ? AND user_id = ?
+		 AND NOT EXISTS (SELECT 1 FROM team WHERE id = ? AND leader_id = ?)`,
+		teamID, userID, teamID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	var leads int
+	if err := db.QueryRow("SELECT COUNT(*) FROM team WHERE id = ? AND leader_id = ?", teamID, userID).Scan(&leads); err != nil {
+		return err
+	}
+	if leads > 0 {
+		return fmt.Errorf("team %d, user %d: %w", teamID, userID, ErrRemoveTeamLeader)
+	}
+	return nil
 }
 
 func RemoveTeamPermission(db *sql.DB, teamID, permissionID int) error {
-	_, err := db.Exec("DELETE FROM team_permission WHERE team_id = ? AND permission_id = ?", teamID, permissionID)
+	_, err := execRetry(db, "DELETE FROM team_permission WHERE team_id = ? AND permission_id = ?", teamID, permissionID)
 	return err
 }
 
 func ChangeTeamLeader(db *sql.DB, teamID, newLeaderID int) error {
-	_, err := db.Exec("UPDATE team SET leader_id = ? WHERE id = ?", newLeaderID, teamID)
+	_, err := execRetry(db, "UPDATE team SET leader_id = ? WHERE id = ?", newLeaderID, teamID)
 	return err
 }
 
 // TimeseriesEvent represents a single event in the timeseries database.
 type TimeseriesEvent struct {
-	ID        int64     `db:"id"`
-	Timestamp time.Time `db:"timestamp"`
-	Source    string    `db:"source"`  // e.g., "strace", "serial", "dfu"
-	Type      string    `db:"type"`    // e.g., "read", "write", "event"
-	Payload   string    `db:"payload"` // JSON, text, or base64-encoded binary
+	ID        int64             `db:"id"`
+	Timestamp time.Time         `db:"timestamp"`
+	Source    string            `db:"source"`     // e.g., "strace", "serial", "dfu"
+	Type      string            `db:"type"`       // e.g., "read", "write", "event"
+	Payload   string            `db:"payload"`    // JSON, text, or base64-encoded binary
+	Labels    map[string]string `db:"labels"`     // optional free-form tags, stored as JSON
+	Seq       int64             `db:"seq"`        // capture record sequence; 0 for events not from a capture
+	SessionID string            `db:"session_id"` // capture session that ingested the event, if any
 }
 
-// CreateTimeseriesTable creates the timeseries table if it does not exist.
+// CreateTimeseriesTable creates the timeseries table if it does not exist,
+// and adds optional columns missing from tables created by older versions.
 func CreateTimeseriesTable(db *sql.DB) error {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS timeseries_event (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			timestamp DATETIME NOT NULL,
-			source TEXT NOT NULL,
-			type TEXT NOT NULL,
-			payload TEXT NOT NULL
-		);
-	`)
-	return err
+	return createTimeseriesTableNamed(db, timeseriesBaseTable)
 }
 
-// InsertTimeseriesEvent inserts a new event into the timeseries table.
+// InsertTimeseriesEvent inserts a new event into the timeseries table, into
+// the source's partition when partitioning is enabled, or into the typed
+// table set with SetIngestTarget.
 func InsertTimeseriesEvent(db *sql.DB, event TimeseriesEvent) (int64, error) {
-	res, err := db.Exec(
-		`INSERT INTO timeseries_event (timestamp, source, type, payload) VALUES (?, ?, ?, ?)`,
-		event.Timestamp, event.Source, event.Type, event.Payload,
-	)
+	target, err := timeseriesTable(db, event.Source)
+	if err != nil {
+		return 0, err
+	}
+	labels, err := encodeLabels(event.Labels)
+	if err != nil {
+		return 0, err
+	}
+	payload, compressed := encodePayload(event.Payload)
+	res, err := execRetry(db, target.insertSQL(), target.args(event.Payload, event.Timestamp, event.Source, event.Type, payload, labels, compressed, seqValue(event.Seq), sessionValue(event.SessionID))...)
 	if err != nil {
 		return 0, err
 	}
 	return res.LastInsertId()
 }
 
-// QueryTimeseriesEvents retrieves events by source/type/time range.
+// QueryTimeseriesEvents retrieves events by source/type/time range, oldest
+// first. See QueryTimeseriesEventsWithOptions for other orders.
 func QueryTimeseriesEvents(db *sql.DB, source, eventType string, start, end time.Time) ([]TimeseriesEvent, error) {
-	rows, err := db.Query(
-		`SELECT id, timestamp, source, type, payload FROM timeseries_event WHERE source = ? AND type = ? AND timestamp BETWEEN ? AND ? ORDER BY timestamp`,
-		source, eventType, start, end,
-	)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	var events []TimeseriesEvent
-	for rows.Next() {
-		var e TimeseriesEvent
-		var ts string
-		if err := rows.Scan(&e.ID, &ts, &e.Source, &e.Type, &e.Payload); err != nil {
-			return nil, err
-		}
-		e.Timestamp, _ = time.Parse(time.RFC3339Nano, ts)
-		events = append(events, e)
-	}
-	return events, nil
+	return QueryTimeseriesEventsWithOptions(db, source, eventType, start, end, QueryOptions{})
 }
 
 // Handler for recording a timeseries event (for use in HTTP API, CLI, or internal calls)
@@ -228,54 +359,221 @@ func RecordTimeseriesEvent(db *sql.DB, source, eventType, payload string) (int64
 // (FIFO, RED, etc.)
 type CaptureBuffer interface {
 	Append([]byte) error
+	// ReadBatch returns up to max records from the head without removing
+	// them; max is capped at MaxReadBatch
 	ReadBatch(max int) ([][]byte, error)
 	RemoveBatch(n int) error
 	Len() int
 	SizeBytes() int64
+	// Compact reclaims the disk space of records already removed
+	Compact() error
 	Close() error
 }
 
 // FIFOBuffer implements a file-backed FIFO queue
 // (current logic, refactored)
 type FIFOBuffer struct {
+	mu   sync.Mutex
 	path string
 	file *os.File
+	// head is the file offset of the first pending record. RemoveBatch
+	// advances it; the records before it are reclaimed by Compact, which
+	// RemoveBatch runs itself once they take compactAt bytes.
+	head      int64
+	compactAt int64
+	// readEnd is the offset just past the readCount records the last
+	// ReadBatch returned from head, so removing them needn't walk the file
+	readEnd   int64
+	readCount int
+	// size is the logical file size, kept as a counter so it stays right
+	// while Compact swaps the file and can be read without b.mu
+	size atomic.Int64
+	// gen counts the times the file was truncated or replaced, so Compact
+	// can tell whether the copy it made without b.mu is still current
+	gen        int
+	compacting bool
+	closed     bool
 }
 
+// DefaultBufferCompactThreshold is the space removed records may take up at
+// the start of a buffer file before RemoveBatch compacts it
+const DefaultBufferCompactThreshold = 4 << 20
+
 func NewFIFOBuffer(path string) (*FIFOBuffer, error) {
+	if err := prepareBufferFile(path); err != nil {
+		return nil, err
+	}
 	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, err
 	}
-	return &FIFOBuffer{path: path, file: file}, nil
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	b := &FIFOBuffer{path: path, file: file, head: loadBufferHead(path, fi.Size()), compactAt: DefaultBufferCompactThreshold}
+	b.size.Store(fi.Size())
+	return b, nil
 }
 
+// SetCompactThreshold sets the space removed records may take up before
+// RemoveBatch compacts the file; 1 compacts on every removal, and 0 or less
+// leaves compaction to Compact
+func (b *FIFOBuffer) SetCompactThreshold(n int64) {
+	b.mu.Lock()
+	b.compactAt = n
+	b.mu.Unlock()
+}
+
+// Append adds a record to the end of the buffer. A failed write, such as on
+// a full disk, is truncated away so it leaves no partial record behind.
 func (b *FIFOBuffer) Append(data []byte) error {
-	return writeLengthPrefixed(b.file, data)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := writeLengthPrefixed(b.file, data); err != nil {
+		b.file.Truncate(b.size.Load())
+		b.resyncSize()
+		return err
+	}
+	b.size.Add(4 + int64(len(data)))
+	return nil
 }
 
 func (b *FIFOBuffer) ReadBatch(max int) ([][]byte, error) {
-	return readBatchFromDisk(b.path, max)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	batch, end, err := readBatchFromDisk(b.path, b.head, max)
+	if err != nil {
+		return nil, err
+	}
+	b.readEnd, b.readCount = end, len(batch)
+	return batch, nil
 }
 
+// RemoveBatch drops the first n records by moving the head past them,
+// without rewriting the file. Once every record is removed the file is
+// truncated back to its header, and once the removed records take up the
+// compact threshold the file is compacted.
 func (b *FIFOBuffer) RemoveBatch(n int) error {
-	return removeBatchFromDisk(b.path, n)
+	compact, err := b.removeBatch(n)
+	if err != nil || !compact {
+		return err
+	}
+	return b.Compact()
 }
 
-func (b *FIFOBuffer) Len() int {
-	batch, _ := b.ReadBatch(1000000)
-	return len(batch)
+// removeBatch is RemoveBatch up to compaction, reporting whether it is due
+func (b *FIFOBuffer) removeBatch(n int) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	head := b.readEnd
+	if n != b.readCount || b.readCount == 0 {
+		var err error
+		if head, err = removeBatchFromDisk(b.path, b.head, n); err != nil {
+			return false, err
+		}
+	}
+	b.readCount = 0
+	if head >= b.size.Load() {
+		// Appends are serialized by b.mu, so the file ends at size
+		if err := b.file.Truncate(bufferHeaderSize); err != nil {
+			b.resyncSize()
+			return false, err
+		}
+		b.gen++
+		b.size.Store(bufferHeaderSize)
+		head = bufferHeaderSize
+	}
+	if err := b.setHead(head); err != nil {
+		return false, err
+	}
+	return b.compactAt > 0 && b.head-bufferHeaderSize >= b.compactAt, nil
 }
 
-func (b *FIFOBuffer) SizeBytes() int64 {
-	fi, err := b.file.Stat()
+// Compact rewrites the file without the records before the head. The
+// pending records are copied without holding b.mu, so appends, reads and
+// removals carry on meanwhile; records appended during the copy are added
+// and the new file swapped in under b.mu. If the file was truncated or the
+// buffer closed during the copy, the copy is dropped.
+func (b *FIFOBuffer) Compact() error {
+	b.mu.Lock()
+	if b.closed || b.compacting || b.head <= bufferHeaderSize {
+		b.mu.Unlock()
+		return nil
+	}
+	b.compacting = true
+	head, end, gen := b.head, b.size.Load(), b.gen
+	b.mu.Unlock()
+
+	tmpPath := b.path + ".tmp"
+	err := compactBufferFile(b.path, tmpPath, head, end)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.compacting = false
+	if err == nil {
+		err = b.swapCompacted(tmpPath, head, end, gen)
+	}
 	if err != nil {
-		return 0
+		os.Remove(tmpPath)
 	}
-	return fi.Size()
+	return err
+}
+
+// swapCompacted replaces the file with the copy Compact made of its records
+// from head to end, once the records appended since are added to it. Called
+// with b.mu held.
+func (b *FIFOBuffer) swapCompacted(tmpPath string, head, end int64, gen int) error {
+	if b.closed || b.gen != gen {
+		os.Remove(tmpPath)
+		return nil
+	}
+	if err := appendFileFrom(tmpPath, b.path, end); err != nil {
+		return err
+	}
+	defer b.resyncSize()
+	if err := os.Rename(tmpPath, b.path); err != nil {
+		return err
+	}
+	b.gen++
+	file, err := os.OpenFile(b.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	b.file.Close()
+	b.file = file
+	// Removals during the copy moved the head on from where it was copied
+	shift := head - bufferHeaderSize
+	b.readEnd -= shift
+	return b.setHead(b.head - shift)
+}
+
+// resyncSize resets the size counter from the file at b.path, after a
+// rewrite or a failed write. Called with b.mu held.
+func (b *FIFOBuffer) resyncSize() {
+	if fi, err := os.Stat(b.path); err == nil {
+		b.size.Store(fi.Size())
+	}
+}
+
+// Len counts the buffered records by walking their length prefixes, without
+// reading the payloads
+func (b *FIFOBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, _ := countRecordsOnDisk(b.path, b.head)
+	return n
+}
+
+func (b *FIFOBuffer) SizeBytes() int64 {
+	return b.size.Load()
 }
 
 func (b *FIFOBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
 	return b.file.Close()
 }
 
@@ -309,6 +607,9 @@ func (b *REDBuffer) Len() int {
 func (b *REDBuffer) SizeBytes() int64 {
 	return b.fifo.SizeBytes()
 }
+func (b *REDBuffer) Compact() error {
+	return b.fifo.Compact()
+}
 func (b *REDBuffer) Close() error {
 	return b.fifo.Close()
 }
@@ -321,11 +622,24 @@ const (
 	BufferRED  BufferStrategy = "red"
 )
 
+// newCaptureBuffer opens the disk buffer of a capture with strategy; tests
+// may replace it
+var newCaptureBuffer = func(strategy BufferStrategy, path string) (CaptureBuffer, error) {
+	if strategy == BufferRED {
+		return NewREDBuffer(path)
+	}
+	return NewFIFOBuffer(path)
+}
+
+// captureBufferPath is the on-disk buffer used by captures
+const captureBufferPath = "capture_buffer.dat"
+
 // CaptureManager manages simulated stream capture and async ingestion
-var captureManager = &CaptureManager{}
+var captureManager = NewCaptureManager(defaultCaptureID)
 
 type CaptureManager struct {
 	mu             sync.Mutex
+	id             string
 	buffer         [][]byte // fallback in-memory buffer (for bursts)
 	file           *os.File // input log file
 	bufferFilePath string   // path to buffer file
@@ -334,65 +648,224 @@ type CaptureManager struct {
 	stopCh         chan struct{}
 	stopped        bool
 	ingesting      bool
+	sourceDone     bool
+	sessionID      string         // capture_session row for this run, if recorded
+	ingestWG       sync.WaitGroup // tracks ingestLoop so Stop can wait for final stats
+	captureWG      sync.WaitGroup // tracks captureLoop so Stop can close its file
+	ingestDB       *sql.DB        // optional ingest target overriding captureDB
+	redactions     []RedactionRule
+	labels         map[string]string // stamped on every ingested event
+	prefixParser   *LinePrefixParser // optional source/type extraction
+	classifier     LineClassifier    // type of lines the prefix parser doesn't handle
+	speed          float64           // replay speed multiplier; <= 0 disables pacing
+	wallClock      *WallClockReplay  // replay at wall-clock times instead of by speed; nil if off
+	readBufSize    int               // bytes read from the source at a time
+	diskFullPolicy DiskFullPolicy    // what to do when the disk buffer can't store a record
+	redFullAt      int               // buffered records when a DiskFullRED write last failed; 0 once drained
+	framing        CaptureFraming    // record boundaries in the log
+	logKey         string            // checkpoint key of the log being captured
+	startOffset    int64             // log offset the capture started reading at
+	pending        []pendingRecord   // position and sequence of each buffered line, in buffer order
+	lastSeq        int64             // sequence issued to the last buffered line
+	errorBudget    IngestErrorBudget
 	lastStatus     CaptureStatus
+	lifetimeBase   LifetimeStats    // persisted totals when this session started
+	lifetimeSaved  LifetimeStats    // session counts already added to capture_stats
+	flushMu        sync.Mutex       // serializes flushLifetimeStats
+	latency        latencyHistogram // capture-to-commit latency this session
+	secondary      SecondarySink    // optional mirror of ingested records
+	storeRaw       bool             // keep raw records in raw_capture this capture
+	tee            *CaptureTee      // optional file every record is also written to
+	compactMu      sync.Mutex       // held while CompactBuffer works on an idle buffer file
+	// Registry state, guarded by captureManagers' lock
+	refs      int       // callers holding it in captureManagers
+	pinned    bool      // handed out by CaptureManagerFor, so never evicted
+	idleSince time.Time // when it was last stopped or released
+}
+
+// targetDB returns the database captured events are ingested into
+func (cm *CaptureManager) targetDB() *sql.DB {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.ingestDB != nil {
+		return cm.ingestDB
+	}
+	return captureDB
 }
 
 type CaptureStatus struct {
-	BufferLen       int
-	DiskBufferBytes int64
-	Ingesting       bool
-	Stopped         bool
-	LastError       string
-	Ingested        int
-	LastUpdated     time.Time
-	IngestRateEPS   float64 // events per second
-	ErrorCount      int
+	ID              string    `json:"id"`     // capture manager id
+	Source          string    `json:"source"` // log path being captured
+	SessionID       string    `json:"session_id"`
+	BufferLen       int       `json:"buffer_len"`     // records pending ingest, on disk and in memory
+	MemBufferLen    int       `json:"mem_buffer_len"` // records pending in the in-memory fallback buffer
+	DiskBufferBytes int64     `json:"disk_buffer_bytes"`
+	Ingesting       bool      `json:"ingesting"`
+	Stopped         bool      `json:"stopped"`
+	SourceDone      bool      `json:"source_done"` // the capture source has been fully read
+	LastError       string    `json:"last_error"`
+	Ingested        int       `json:"ingested"`
+	LastUpdated     time.Time `json:"last_updated"`
+	IngestRateEPS   float64   `json:"ingest_rate_eps"` // events per second
+	BytesIngested   int64     `json:"bytes_ingested"`  // payload bytes committed to the DB
+	IngestRateBps   float64   `json:"ingest_rate_bps"` // payload bytes per second
+	ErrorCount      int       `json:"error_count"`
+	Redactions      int       `json:"redactions"` // redaction rule matches replaced before buffering
+	Failed          bool      `json:"failed"`     // stopped because the ingest error budget was exceeded
+	Dropped         int       `json:"dropped"`    // records the disk buffer failed to store
+	DiskFull        bool      `json:"disk_full"`  // the last disk buffer write failed
+	Paused          bool      `json:"paused"`     // waiting for the disk buffer to take a record
+	// Totals across every session of this capture id, including this one
+	LifetimeIngested int64 `json:"lifetime_ingested"`
+	LifetimeErrors   int64 `json:"lifetime_errors"`
+	LifetimeBytes    int64 `json:"lifetime_bytes"`
+	// Capture-to-commit latency percentiles for this session, in nanoseconds
+	// in JSON
+	IngestLatencyP50 time.Duration `json:"ingest_latency_p50"`
+	IngestLatencyP95 time.Duration `json:"ingest_latency_p95"`
+	IngestLatencyP99 time.Duration `json:"ingest_latency_p99"`
 }
 
 // StartSimulatedCapture starts reading from a log file and buffering events
 func (cm *CaptureManager) StartSimulatedCapture(logPath string) error {
+	return cm.startCapture(CaptureConfig{LogPath: logPath})
+}
+
+// ErrCaptureRunning is returned when starting a capture that is running
+var ErrCaptureRunning = errors.New("capture already running")
+
+// ErrCaptureStopping is returned when starting a capture whose stop hasn't
+// finished; retry once StopSimulatedCapture returns
+var ErrCaptureStopping = errors.New("capture is stopping")
+
+// startCapture starts a capture of cfg.LogPath, from its checkpoint if
+// cfg.Resume is set. cfg.Strategy is applied by StartCapture.
+//
+// A manager is idle, running (ingesting), or stopping (ingesting and
+// stopped) until StopSimulatedCapture has waited for both loops and released
+// the run's files; only an idle manager can start.
+func (cm *CaptureManager) startCapture(cfg CaptureConfig) error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 	if cm.ingesting {
-		return errors.New("capture already running")
+		if cm.stopped {
+			return ErrCaptureStopping
+		}
+		return ErrCaptureRunning
 	}
+	logPath := cfg.LogPath
 	file, err := os.Open(logPath)
 	if err != nil {
 		return err
 	}
+	bufferDir := filepath.Dir(cm.bufferPath())
+	if err := checkWritableDir(bufferDir); err != nil {
+		file.Close()
+		return err
+	}
+	// The whole log may end up in the disk buffer if ingest falls behind
+	if info, err := file.Stat(); err == nil {
+		if err := utils.CheckDiskSpace(bufferDir, uint64(info.Size())); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	db := cm.ingestDB
+	if db == nil {
+		db = captureDB
+	}
+	cm.startOffset = 0
+	cm.lastSeq = cfg.FirstSeq - 1
+	if cfg.FirstSeq <= 0 {
+		cm.lastSeq = 0
+	}
+	if cfg.Resume {
+		if cm.startOffset, cm.lastSeq, err = cm.resumePosition(db, file); err != nil {
+			file.Close()
+			return err
+		}
+	} else if db != nil {
+		if err := CreateCaptureCheckpointTable(db); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if cfg.StoreRaw && db != nil {
+		if err := CreateRawCaptureTable(db); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	cm.storeRaw = cfg.StoreRaw
+	cm.logKey = checkpointKey(logPath)
 	cm.file = file
 	cm.buffer = make([][]byte, 0, 4096)
 	cm.stopCh = make(chan struct{})
 	cm.stopped = false
 	cm.ingesting = true
-	cm.lastStatus = CaptureStatus{Ingesting: true, Stopped: false, LastUpdated: time.Now()}
-	// Select buffer strategy
-	cm.bufferFilePath = "capture_buffer.dat"
-	if cm.bufferStrategy == "red" {
-		cm.bufferImpl, err = NewREDBuffer(cm.bufferFilePath)
-	} else {
-		cm.bufferImpl, err = NewFIFOBuffer(cm.bufferFilePath)
-	}
+	cm.sourceDone = false
+	cm.redFullAt = 0
+	cm.lastStatus = CaptureStatus{ID: cm.id, Source: logPath, Ingesting: true, Stopped: false, LastUpdated: time.Now()}
+	// Select buffer strategy, once any compaction of the idle buffer file
+	// is done with it
+	cm.compactMu.Lock()
+	cm.compactMu.Unlock()
+	cm.bufferFilePath = cm.bufferPath()
+	cm.bufferImpl, err = newCaptureBuffer(cm.bufferStrategy, cm.bufferFilePath)
 	if err != nil {
 		cm.file.Close()
 		return err
 	}
+	// Records left over from an earlier run have no known position or sequence
+	cm.pending = make([]pendingRecord, cm.bufferImpl.Len())
+	for i := range cm.pending {
+		cm.pending[i] = pendingRecord{offset: -1}
+	}
+	cm.sessionID = ""
+	cm.latency = latencyHistogram{}
+	cm.lifetimeBase = LifetimeStats{}
+	cm.lifetimeSaved = LifetimeStats{}
+	if captureDB != nil {
+		if id, err := startCaptureSession(captureDB, logPath); err != nil {
+			cm.lastStatus.LastError = err.Error()
+		} else {
+			cm.sessionID = id
+		}
+		if cm.lifetimeBase, err = CaptureLifetimeStats(captureDB, cm.id); err != nil {
+			cm.lastStatus.LastError = err.Error()
+		}
+	}
+	cm.lastStatus.SessionID = cm.sessionID
+	cm.ingestWG.Add(1)
+	cm.captureWG.Add(1)
 	go cm.captureLoop()
 	go cm.ingestLoop()
+	registerActiveCapture(cm)
 	return nil
 }
 
-// StopSimulatedCapture signals the capture to stop
+// StopSimulatedCapture stops the capture and returns once both of its loops
+// have exited. Stopping an idle or already stopping capture does nothing.
 func (cm *CaptureManager) StopSimulatedCapture() {
 	cm.mu.Lock()
-	if cm.stopped {
+	if cm.stopped || !cm.ingesting {
 		cm.mu.Unlock()
 		return
 	}
 	cm.stopped = true
-	if cm.stopCh != nil {
-		close(cm.stopCh)
+	close(cm.stopCh)
+	cm.mu.Unlock()
+	// Let the in-flight batch finish so the session records final counts
+	cm.ingestWG.Wait()
+	cm.captureWG.Wait()
+	flushErr := cm.flushLifetimeStats()
+	cm.mu.Lock()
+	if flushErr != nil {
+		cm.lastStatus.LastError = flushErr.Error()
 	}
+	sessionID := cm.sessionID
+	final := cm.lastStatus
+	final.SourceDone = cm.sourceDone
 	if cm.file != nil {
 		cm.file.Close()
 		cm.file = nil
@@ -403,6 +876,11 @@ func (cm *CaptureManager) StopSimulatedCapture() {
 	}
 	cm.ingesting = false
 	cm.mu.Unlock()
+	unregisterActiveCapture(cm)
+	touchCaptureManager(cm)
+	if sessionID != "" && captureDB != nil {
+		finishCaptureSession(captureDB, sessionID, final)
+	}
 }
 
 // GetCaptureStatus returns the current status
@@ -410,11 +888,21 @@ func (cm *CaptureManager) GetCaptureStatus() CaptureStatus {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 	status := cm.lastStatus
-	status.BufferLen = len(cm.buffer)
+	status.ID = cm.id
+	status.MemBufferLen = len(cm.buffer)
+	status.BufferLen = status.MemBufferLen
 	status.Ingesting = cm.ingesting
 	status.Stopped = cm.stopped
+	status.SourceDone = cm.sourceDone
 	status.LastUpdated = time.Now()
+	status.LifetimeIngested = cm.lifetimeBase.Ingested + int64(status.Ingested)
+	status.LifetimeErrors = cm.lifetimeBase.Errors + int64(status.ErrorCount)
+	status.LifetimeBytes = cm.lifetimeBase.Bytes + status.BytesIngested
+	status.IngestLatencyP50 = cm.latency.percentile(50)
+	status.IngestLatencyP95 = cm.latency.percentile(95)
+	status.IngestLatencyP99 = cm.latency.percentile(99)
 	if cm.bufferImpl != nil {
+		status.BufferLen += cm.bufferImpl.Len()
 		status.DiskBufferBytes = cm.bufferImpl.SizeBytes()
 	}
 	return status
@@ -422,64 +910,155 @@ func (cm *CaptureManager) GetCaptureStatus() CaptureStatus {
 
 // captureLoop reads lines from the file and appends to buffer
 func (cm *CaptureManager) captureLoop() {
+	defer cm.captureWG.Done()
+	cm.mu.Lock()
+	if cm.file == nil { // already stopped
+		cm.mu.Unlock()
+		return
+	}
 	scanner := bufio.NewScanner(cm.file)
-	var lastTimestamp float64
-	var first bool = true
-	for scanner.Scan() {
+	rules := cm.redactions
+	framing := cm.framing
+	teeCfg := cm.tee
+	speed := cm.speed
+	var schedule *wallClockSchedule
+	if cm.wallClock != nil {
+		schedule = &wallClockSchedule{replay: *cm.wallClock}
+	}
+	readBufSize := cm.readBufSize
+	diskFull := cm.diskFullPolicy
+	pos := cm.startOffset
+	// Bind this run's stop channel: after a stop the scanner may still hold
+	// buffered lines, which must not leak into a later run
+	stopCh := cm.stopCh
+	cm.mu.Unlock()
+	stopped := func() bool {
 		select {
-		case <-cm.stopCh:
-			return
+		case <-stopCh:
+			return true
 		default:
+			return false
+		}
+	}
+	heartbeat := cm.heartbeatName("read")
+	utils.StartHeartbeat(heartbeat, 0)
+	defer utils.StopHeartbeat(heartbeat)
+	// The tee belongs to this loop; its failures never stop the capture
+	var tee *teeFile
+	if teeCfg != nil {
+		var err error
+		if tee, err = openTee(*teeCfg, framing); err != nil {
+			cm.mu.Lock()
+			cm.lastStatus.LastError = "capture tee: " + err.Error()
+			cm.mu.Unlock()
+			tee = nil
+		} else {
+			defer tee.close()
 		}
+	}
+	if readBufSize <= 0 {
+		readBufSize = DefaultCaptureReadBufferSize
+	}
+	// Records may grow the buffer past its initial size, up to the largest
+	// of the scanner default, a fixed frame and the read size
+	scanner.Buffer(make([]byte, readBufSize), max(bufio.MaxScanTokenSize, framing.Length, readBufSize))
+	// Track the log offset just past each record for checkpoints
+	split := framing.splitFunc()
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := split(data, atEOF)
+		pos += int64(advance)
+		return advance, token, err
+	})
+	var lastTimestamp time.Time
+	for scanner.Scan() {
+		if stopped() {
+			return
+		}
+		utils.Beat(heartbeat)
 		line := scanner.Bytes()
-		// Attempt to parse a leading timestamp (float, e.g., 1655141234.123456)
-		ts := 0.0
-		parsed := false
-		for i, b := range line {
-			if b == ' ' || b == '\t' {
-				tsStr := string(line[:i])
-				if t, err := strconv.ParseFloat(tsStr, 64); err == nil {
-					ts = t
-					parsed = true
+		// A leading timestamp paces replay and becomes the event's time
+		eventTime, parsed := parseLineTimestamp(line)
+		if parsed {
+			var delta time.Duration
+			if schedule != nil {
+				delta = schedule.wait(eventTime, time.Now())
+			} else if !lastTimestamp.IsZero() && speed > 0 {
+				delta = time.Duration(float64(eventTime.Sub(lastTimestamp)) / speed)
+				if delta >= 10*time.Second {
+					delta = 0
 				}
-				break
 			}
-		}
-		if parsed {
-			if first {
-				lastTimestamp = ts
-				first = false
-			} else {
-				delta := ts - lastTimestamp
-				if delta > 0 && delta < 10 {
-					time.Sleep(time.Duration(delta * float64(time.Second)))
+			if delta > 0 {
+				select {
+				case <-time.After(delta):
+				case <-stopCh:
+					return
 				}
-				lastTimestamp = ts
 			}
+			lastTimestamp = eventTime
+		}
+		if tee != nil {
+			if err := tee.write(line, time.Now()); err != nil {
+				cm.mu.Lock()
+				cm.lastStatus.LastError = "capture tee: " + err.Error()
+				cm.mu.Unlock()
+			}
+		}
+		redactions := 0
+		if len(rules) > 0 {
+			line, redactions = redact(rules, line)
 		}
 		cm.mu.Lock()
+		if stopped() {
+			cm.mu.Unlock()
+			return
+		}
+		cm.lastStatus.Redactions += redactions
+		// Sequences are issued under the same lock as the append, so they
+		// follow buffer order; a dropped record leaves a gap
+		cm.lastSeq++
 		if cm.bufferImpl != nil {
-			cm.bufferImpl.Append(line)
+			if !cm.bufferRecord(line, diskFull, stopCh) {
+				cm.mu.Unlock()
+				continue
+			}
 		} else {
 			cm.buffer = append(cm.buffer, append([]byte(nil), line...))
 		}
+		cm.pending = append(cm.pending, pendingRecord{offset: pos, seq: cm.lastSeq, readAt: time.Now(), eventTime: eventTime})
 		cm.mu.Unlock()
 	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if stopped() {
+		return
+	}
 	if err := scanner.Err(); err != nil {
-		cm.mu.Lock()
 		cm.lastStatus.LastError = err.Error()
-		cm.mu.Unlock()
+		return
 	}
+	cm.sourceDone = true
 }
 
 // ingestLoop asynchronously ingests buffered events from disk into the DB
 func (cm *CaptureManager) ingestLoop() {
+	defer cm.ingestWG.Done()
+	cm.mu.Lock()
+	labels, _ := encodeLabels(cm.labels)
+	session := sessionValue(cm.sessionID)
+	budget := errorWindow{budget: cm.errorBudget}
+	cm.mu.Unlock()
+	heartbeat := cm.heartbeatName("ingest")
+	utils.StartHeartbeat(heartbeat, 0)
+	defer utils.StopHeartbeat(heartbeat)
 	var lastIngested int
+	var lastBytes int64
 	var lastTime = time.Now()
+	lastFlush := lastTime
 	for {
+		utils.Beat(heartbeat)
 		cm.mu.Lock()
 		if cm.stopped {
-			cm.ingesting = false
 			cm.mu.Unlock()
 			return
 		}
@@ -507,63 +1086,311 @@ func (cm *CaptureManager) ingestLoop() {
 			continue
 		}
 		// Ingest batch
-		ingested := 0
-		errs := 0
-		if captureDB == nil {
+		db := cm.targetDB()
+		if db == nil {
 			cm.mu.Lock()
 			cm.lastStatus.LastError = "captureDB not set"
 			cm.mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
 			continue
 		}
-		tx, err := captureDB.Begin()
-		if err != nil {
-			cm.mu.Lock()
-			cm.lastStatus.LastError = err.Error()
-			cm.mu.Unlock()
-			continue
-		}
-		stmt, err := tx.Prepare("INSERT INTO timeseries_event (timestamp, source, type, payload) VALUES (?, ?, ?, ?)")
+		meta := cm.pendingBatch(len(batch))
+		records := cm.parseBatch(batch, meta)
+		ingested, errs, bytesIngested, err := writeCaptureBatch(db, records, labels, session, cm.batchCheckpoint(meta))
 		if err != nil {
-			tx.Rollback()
 			cm.mu.Lock()
 			cm.lastStatus.LastError = err.Error()
 			cm.mu.Unlock()
-			continue
-		}
-		for _, line := range batch {
-			_, err := stmt.Exec(time.Now().UTC(), "capture", "stream", string(line))
-			if err != nil {
-				errs++
-				continue
+			// A failed batch write counts as one error; it is retried
+			if budget.add(time.Now(), 1) {
+				cm.failCapture(budget.budget)
+				return
 			}
-			ingested++
-		}
-		stmt.Close()
-		err = tx.Commit()
-		if err != nil {
-			cm.mu.Lock()
-			cm.lastStatus.LastError = err.Error()
-			cm.mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
 			continue
 		}
 		if cm.bufferImpl != nil {
 			cm.bufferImpl.RemoveBatch(len(batch))
 		}
+		committed := time.Now()
+		cm.mirrorBatch(records, committed)
 		cm.mu.Lock()
+		cm.pending = cm.pending[min(len(batch), len(cm.pending)):]
+		cm.recordLatency(meta, committed)
 		cm.lastStatus.Ingested += ingested
 		cm.lastStatus.ErrorCount += errs
+		cm.lastStatus.BytesIngested += bytesIngested
 		// Calculate ingestion rate
 		elapsed := time.Since(lastTime).Seconds()
 		if elapsed > 0 {
 			cm.lastStatus.IngestRateEPS = float64(cm.lastStatus.Ingested-lastIngested) / elapsed
+			cm.lastStatus.IngestRateBps = float64(cm.lastStatus.BytesIngested-lastBytes) / elapsed
 			lastIngested = cm.lastStatus.Ingested
+			lastBytes = cm.lastStatus.BytesIngested
 			lastTime = time.Now()
 		}
 		if errs > 0 {
 			cm.lastStatus.LastError = fmt.Sprintf("%d ingestion errors", errs)
 		}
 		cm.mu.Unlock()
+		if budget.add(time.Now(), errs) {
+			cm.failCapture(budget.budget)
+			return
+		}
+		if time.Since(lastFlush) >= lifetimeStatsFlushInterval {
+			lastFlush = time.Now()
+			if err := cm.flushLifetimeStats(); err != nil {
+				cm.mu.Lock()
+				cm.lastStatus.LastError = err.Error()
+				cm.mu.Unlock()
+			}
+		}
+	}
+}
+
+// parseLineTimestamp parses a leading Unix time in seconds with an optional
+// fraction, such as "1655141234.123456", ended by a space or tab
+func parseLineTimestamp(line []byte) (time.Time, bool) {
+	end, dot := -1, -1
+	for i, b := range line {
+		if b == ' ' || b == '\t' {
+			end = i
+			break
+		}
+		if b == '.' && dot < 0 {
+			dot = i
+		} else if b < '0' || b > '9' {
+			return time.Time{}, false
+		}
+	}
+	if end <= 0 || dot == 0 {
+		return time.Time{}, false
+	}
+	secs, frac := line[:end], []byte(nil)
+	if dot > 0 {
+		secs, frac = line[:dot], line[dot+1:end]
+	}
+	sec, err := strconv.ParseInt(string(secs), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	// Nanoseconds from the first nine fraction digits
+	var nsec int64
+	for i := 0; i < 9; i++ {
+		nsec *= 10
+		if i < len(frac) {
+			nsec += int64(frac[i] - '0')
+		}
+	}
+	return time.Unix(sec, nsec).UTC(), true
+}
+
+// LineClassifier returns the event type of a captured line, or "" to keep
+// the default type ("stream")
+type LineClassifier func(line string) string
+
+// straceCall matches the syscall name of a strace line, after any pid and
+// timestamp prefixes: "read(3, ...", "1234 openat(...", "[pid 7] 12:00:01.5
+// write(...", or the "<... read resumed>" half of an interrupted call
+var straceCall = regexp.MustCompile(`^(?:\[pid\s+\d+\]\s*|[\d.:]+\s+)*(?:<\.\.\.\s+([a-z_][a-z0-9_]*)\s+resumed>|([a-z_][a-z0-9_]*)\()`)
+
+// StraceSyscallType is the default LineClassifier: the syscall name of
+// strace lines, and "" for anything else, such as serial or DFU traffic
+func StraceSyscallType(line string) string {
+	m := straceCall.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	return m[1] + m[2]
+}
+
+// SetClassifier sets how this manager types lines when no prefix parser is
+// set. Pass nil to type every line "stream".
+func (cm *CaptureManager) SetClassifier(c LineClassifier) {
+	cm.mu.Lock()
+	cm.classifier = c
+	cm.mu.Unlock()
+}
+
+// SetSpeedMultiplier sets how fast timestamped logs are replayed: 2 sleeps
+// half the gap between lines, and 0 or less ingests without pacing. The
+// default is 1. It applies to captures started afterwards.
+func (cm *CaptureManager) SetSpeedMultiplier(m float64) {
+	cm.mu.Lock()
+	cm.speed = m
+	cm.mu.Unlock()
+}
+
+// DefaultCaptureReadBufferSize is how many bytes a capture reads from its
+// source at a time unless SetReadBufferSize says otherwise. It is larger than
+// the bufio.Scanner default so fast sources take fewer read calls.
+const DefaultCaptureReadBufferSize = 256 << 10
+
+// MaxCaptureReadBufferSize caps the read buffer size of a capture
+const MaxCaptureReadBufferSize = 64 << 20
+
+// SetReadBufferSize sets how many bytes this manager reads from the source
+// at a time, between 1 and MaxCaptureReadBufferSize; 0 restores
+// DefaultCaptureReadBufferSize. It applies to captures started afterwards.
+func (cm *CaptureManager) SetReadBufferSize(n int) error {
+	if n < 0 || n > MaxCaptureReadBufferSize {
+		return fmt.Errorf("read buffer size %d: must be between 0 and %d", n, MaxCaptureReadBufferSize)
+	}
+	cm.mu.Lock()
+	cm.readBufSize = n
+	cm.mu.Unlock()
+	return nil
+}
+
+// SetCaptureClassifier sets the default capture's LineClassifier
+func SetCaptureClassifier(c LineClassifier) {
+	captureManager.SetClassifier(c)
+}
+
+// pendingRecord is the log position and sequence of a buffered line
+type pendingRecord struct {
+	offset    int64     // log offset just past the line; -1 if unknown
+	seq       int64     // capture sequence; 0 if unknown
+	readAt    time.Time // when the line was read; zero if unknown
+	eventTime time.Time // timestamp parsed from the line; zero if it had none
+}
+
+// captureRecord is a buffered line ready to be inserted
+type captureRecord struct {
+	source, eventType, payload string
+	size                       int       // raw line length
+	seq                        int64     // capture sequence; 0 if unknown
+	timestamp                  time.Time // event time from the line; zero to use the insert time
+	raw                        []byte    // the record as read, if it is to be kept
+	failed                     bool      // set by writeCaptureBatch if the insert failed
+}
+
+// pendingBatch returns the positions of the next n buffered lines
+func (cm *CaptureManager) pendingBatch(n int) []pendingRecord {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return append([]pendingRecord(nil), cm.pending[:min(n, len(cm.pending))]...)
+}
+
+// parseBatch assigns each buffered line its source, type and sequence
+func (cm *CaptureManager) parseBatch(batch [][]byte, meta []pendingRecord) []captureRecord {
+	cm.mu.Lock()
+	parser, classify, storeRaw := cm.prefixParser, cm.classifier, cm.storeRaw
+	cm.mu.Unlock()
+	records := make([]captureRecord, len(batch))
+	for i, line := range batch {
+		r := captureRecord{source: defaultCaptureSource, eventType: defaultCaptureType, payload: string(line), size: len(line)}
+		if storeRaw {
+			r.raw = line
+		}
+		if parser != nil {
+			r.source, r.eventType, r.payload = parser.Parse(r.payload)
+		} else if classify != nil {
+			if t := classify(r.payload); t != "" {
+				r.eventType = t
+			}
+		}
+		if i < len(meta) {
+			r.seq = meta[i].seq
+			r.timestamp = meta[i].eventTime
+		}
+		records[i] = r
+	}
+	return records
+}
+
+// batchCheckpoint returns the log position and sequence covered once the
+// lines in meta are ingested, or nil if none of them has a known offset.
+func (cm *CaptureManager) batchCheckpoint(meta []pendingRecord) *captureCheckpoint {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for i := len(meta) - 1; i >= 0; i-- {
+		if meta[i].offset >= 0 {
+			return &captureCheckpoint{logPath: cm.logKey, offset: meta[i].offset, seq: meta[i].seq}
+		}
 	}
+	return nil
+}
+
+// writeCaptureBatch inserts records in one transaction, routing each to its
+// source's table or typed table, and records cp (if set) in the same transaction. Records
+// with raw bytes get a linked raw_capture row. Individual insert failures are
+// counted, not fatal.
+func writeCaptureBatch(db *sql.DB, records []captureRecord, labels, session interface{}, cp *captureCheckpoint) (ingested, errs int, bytesIngested int64, err error) {
+	// Partitions must exist before the transaction takes the write lock
+	targets := make(map[string]eventTarget)
+	for _, r := range records {
+		if _, ok := targets[r.source]; ok {
+			continue
+		}
+		if targets[r.source], err = timeseriesTable(db, r.source); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	stmts := make(map[string]*sql.Stmt)
+	defer func() {
+		for _, stmt := range stmts {
+			stmt.Close()
+		}
+	}()
+	var rawStmt *sql.Stmt
+	for i, r := range records {
+		target := targets[r.source]
+		table := target.table
+		stmt, ok := stmts[table]
+		if !ok {
+			stmt, err = tx.Prepare(target.insertSQL())
+			if err != nil {
+				tx.Rollback()
+				return 0, 0, 0, err
+			}
+			stmts[table] = stmt
+		}
+		payload, compressed := encodePayload(r.payload)
+		ts := r.timestamp
+		if ts.IsZero() {
+			ts = time.Now().UTC()
+		}
+		res, err := stmt.Exec(target.args(r.payload, ts, r.source, r.eventType, payload, labels, compressed, seqValue(r.seq), session)...)
+		if err != nil {
+			records[i].failed = true
+			errs++
+			continue
+		}
+		if r.raw != nil {
+			if rawStmt == nil {
+				if rawStmt, err = tx.Prepare(insertRawCaptureSQL); err != nil {
+					tx.Rollback()
+					return 0, 0, 0, err
+				}
+				stmts[rawCaptureTable] = rawStmt
+			}
+			id, err := res.LastInsertId()
+			if err == nil {
+				_, err = rawStmt.Exec(table, id, r.raw)
+			}
+			if err != nil {
+				tx.Rollback()
+				return 0, 0, 0, err
+			}
+		}
+		ingested++
+		bytesIngested += int64(r.size)
+	}
+	if cp != nil {
+		if err := saveCheckpoint(tx, *cp); err != nil {
+			tx.Rollback()
+			return 0, 0, 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, 0, err
+	}
+	return ingested, errs, bytesIngested, nil
 }
 
 // Helper: write a length-prefixed record to file
@@ -581,118 +1408,326 @@ func writeLengthPrefixed(f *os.File, data []byte) error {
 	return err
 }
 
-// Helper: read a batch of length-prefixed records from file
-func readBatchFromDisk(path string, max int) ([][]byte, error) {
+// Helper: read a batch of length-prefixed records from file, starting at
+// the head offset. It also returns the offset just past the batch.
+func readBatchFromDisk(path string, head int64, max int) ([][]byte, int64, error) {
+	if max > MaxReadBatch {
+		max = MaxReadBatch
+	}
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, head, err
 	}
 	defer f.Close()
+	if _, err := f.Seek(head, io.SeekStart); err != nil {
+		return nil, head, err
+	}
+	r := bufio.NewReader(f)
+	end := head
 	var batch [][]byte
 	for i := 0; i < max; i++ {
 		var lenBuf [4]byte
-		_, err := f.Read(lenBuf[:])
-		if err != nil {
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
 			break
 		}
-		l := (uint32(lenBuf[0]) << 24) | (uint32(lenBuf[1]) << 16) | (uint32(lenBuf[2]) << 8) | uint32(lenBuf[3])
-		buf := make([]byte, l)
-		_, err = f.Read(buf)
-		if err != nil {
+		buf := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			// A torn record at the tail isn't returned
 			break
 		}
 		batch = append(batch, buf)
+		end += 4 + int64(len(buf))
 	}
-	return batch, nil
+	return batch, end, nil
 }
 
-// Helper: remove N records from the start of the file
-func removeBatchFromDisk(path string, n int) error {
+// MaxReadBatch caps the records one ReadBatch returns, and so the payloads
+// held in memory at once. Use Len to count a buffer.
+const MaxReadBatch = 65536
+
+// countRecordsOnDisk counts the complete records from the head offset of the
+// buffer file at path, skipping over their payloads. Memory use doesn't grow
+// with the file.
+func countRecordsOnDisk(path string, head int64) (int, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(head, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(f)
+	lenBuf := make([]byte, 4)
+	n := 0
+	for {
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			return n, nil
+		}
+		l := int(binary.BigEndian.Uint32(lenBuf))
+		if skipped, err := r.Discard(l); err != nil || skipped < l {
+			// A torn record at the tail isn't counted
+			return n, nil
+		}
+		n++
+	}
+}
+
+// Helper: return the offset just past the N records at the head offset
+func removeBatchFromDisk(path string, head int64, n int) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return head, err
 	}
 	defer f.Close()
-	var offset int64
+	offset, err := f.Seek(head, io.SeekStart)
+	if err != nil {
+		return head, err
+	}
+	r := bufio.NewReader(f)
+	lenBuf := make([]byte, 4)
 	for i := 0; i < n; i++ {
-		var lenBuf [4]byte
-		_, err := f.Read(lenBuf[:])
-		if err != nil {
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
 			break
 		}
-		l := (uint32(lenBuf[0]) << 24) | (uint32(lenBuf[1]) << 16) | (uint32(lenBuf[2]) << 8) | uint32(lenBuf[3])
-		offset += 4 + int64(l)
-		_, err = f.Seek(int64(l), 1)
-		if err != nil {
+		l := int(binary.BigEndian.Uint32(lenBuf))
+		if skipped, err := r.Discard(l); err != nil || skipped < l {
 			break
 		}
+		offset += 4 + int64(l)
+	}
+	return offset, nil
+}
+
+// compactBufferFile writes a buffer file at tmpPath holding the header and
+// the records between the head and end offsets of the buffer file at path
+func compactBufferFile(path, tmpPath string, head, end int64) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := src.Seek(head, io.SeekStart); err != nil {
+		return err
+	}
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	if err := writeBufferHeader(tmp); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tmp, src, end-head); err != nil {
+		return err
+	}
+	return tmp.Close()
+}
+
+// appendFileFrom appends the contents of the file at src from offset on to
+// the file at dst
+func appendFileFrom(dst, src string, offset int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// Capture buffer files start with a magic string and a big-endian format
+// version. Version 1 files predate the header and are a bare record stream.
+const (
+	bufferMagic         = "DWYB"
+	bufferHeaderSize    = 8
+	bufferFormatVersion = 2
+)
+
+// ErrUnsupportedBufferVersion is returned when a buffer file has an unknown format version
+var ErrUnsupportedBufferVersion = errors.New("unsupported capture buffer format version")
+
+// Helper: write the buffer file header for the current format version
+func writeBufferHeader(w io.Writer) error {
+	var hdr [bufferHeaderSize]byte
+	copy(hdr[:4], bufferMagic)
+	binary.BigEndian.PutUint32(hdr[4:], bufferFormatVersion)
+	_, err := w.Write(hdr[:])
+	return err
+}
+
+// prepareBufferFile writes the header to a new buffer file, validates the
+// header of an existing one, and migrates recognized older versions in place.
+func prepareBufferFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
 	}
-	// Truncate file by copying remaining data to a new file
-	fi, err := os.Stat(path)
+	defer f.Close()
+	fi, err := f.Stat()
 	if err != nil {
 		return err
 	}
-	if offset >= fi.Size() {
-		// All data consumed, just truncate
-		return os.Truncate(path, 0)
+	if fi.Size() == 0 {
+		return writeBufferHeader(f)
+	}
+	var hdr [bufferHeaderSize]byte
+	n, err := io.ReadFull(f, hdr[:])
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	if n < len(bufferMagic) || string(hdr[:len(bufferMagic)]) != bufferMagic {
+		// No magic: a version 1 (headerless) buffer
+		f.Close()
+		return migrateBufferV1(path)
+	}
+	if n < bufferHeaderSize {
+		return fmt.Errorf("capture buffer %s: truncated header", path)
+	}
+	if v := binary.BigEndian.Uint32(hdr[4:]); v != bufferFormatVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedBufferVersion, v)
 	}
-	// Copy remaining data
-	f.Seek(offset, 0)
-	rem, err := io.ReadAll(f)
+	return nil
+}
+
+// migrateBufferV1 rewrites a headerless buffer file with the current header,
+// preserving its pending records.
+func migrateBufferV1(path string) error {
+	src, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer src.Close()
 	tmpPath := path + ".tmp"
 	tmp, err := os.Create(tmpPath)
 	if err != nil {
 		return err
 	}
 	defer tmp.Close()
-	_, err = tmp.Write(rem)
-	if err != nil {
+	if err := writeBufferHeader(tmp); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, src); err != nil {
 		return err
 	}
-	tmp.Close()
-	f.Close()
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	src.Close()
 	return os.Rename(tmpPath, path)
 }
 
-// HTTP Handlers
+// HTTP Handlers. Each takes an optional id query parameter naming the
+// capture, "default" if absent.
 func CaptureStartHandler(w http.ResponseWriter, r *http.Request) {
-	logPath := r.URL.Query().Get("log")
-	if logPath == "" {
-		logPath = "testdata/logs/dmr_cps_read_capture.log"
+	id, err := requestCaptureID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	err := captureManager.StartSimulatedCapture(logPath)
+	cfg, err := ParseCaptureConfig(r)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := StartCapture(id, cfg); err != nil {
 		w.WriteHeader(http.StatusConflict)
 		w.Write([]byte("Failed to start capture: " + err.Error()))
 		return
 	}
-	w.Write([]byte("Capture started from " + logPath + "\n"))
+	w.Write([]byte("Capture started from " + cfg.LogPath + "\n"))
 }
 
 func CaptureStopHandler(w http.ResponseWriter, r *http.Request) {
-	captureManager.StopSimulatedCapture()
+	id, err := requestCaptureID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	StopSimulatedCapture(id)
 	w.Write([]byte("Capture stopped\n"))
 }
 
+// CaptureStatusHandler writes the capture status as plain text, or as JSON
+// if the request accepts application/json or is for /capture/status.json
 func CaptureStatusHandler(w http.ResponseWriter, r *http.Request) {
-	status := captureManager.GetCaptureStatus()
-	fmt.Fprintf(w, "BufferLen: %d\nIngesting: %v\nStopped: %v\nIngested: %d\nLastError: %s\nLastUpdated: %s\nIngestRateEPS: %.2f\nErrorCount: %d\n",
-		status.BufferLen, status.Ingesting, status.Stopped, status.Ingested, status.LastError, status.LastUpdated.Format(time.RFC3339), status.IngestRateEPS, status.ErrorCount)
+	id, err := requestCaptureID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status := GetCaptureStatus(id)
+	if strings.HasSuffix(r.URL.Path, ".json") || acceptsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+	fmt.Fprintf(w, "BufferLen: %d\nIngesting: %v\nStopped: %v\nIngested: %d\nLastError: %s\nLastUpdated: %s\nIngestRateEPS: %.2f\nBytesIngested: %d\nIngestRateBps: %.2f\nErrorCount: %d\nRedactions: %d\nFailed: %v\nDropped: %d\nDiskFull: %v\nPaused: %v\nLifetimeIngested: %d\nLifetimeErrors: %d\nLifetimeBytes: %d\nIngestLatencyP50: %s\nIngestLatencyP95: %s\nIngestLatencyP99: %s\n",
+		status.BufferLen, status.Ingesting, status.Stopped, status.Ingested, status.LastError, status.LastUpdated.Format(time.RFC3339), status.IngestRateEPS, status.BytesIngested, status.IngestRateBps, status.ErrorCount, status.Redactions, status.Failed, status.Dropped, status.DiskFull, status.Paused,
+		status.LifetimeIngested, status.LifetimeErrors, status.LifetimeBytes, status.IngestLatencyP50, status.IngestLatencyP95, status.IngestLatencyP99)
 }
 
-// RegisterCaptureEndpoints registers the HTTP handlers for capture
+// acceptsJSON reports whether the request's Accept header lists
+// application/json
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, t := range strings.Split(accept, ",") {
+			if mt, _, _ := strings.Cut(strings.TrimSpace(t), ";"); mt == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RegisterCaptureEndpoints registers the HTTP handlers for capture and
+// timeseries queries. If no capture DB is set, events go to a new in-memory
+// one; see RegisterCaptureEndpointsWithDB to use a real database.
 func RegisterCaptureEndpoints(mux *http.ServeMux) {
 	if captureDB == nil {
 		db, err := sql.Open("sqlite3", ":memory:")
 		if err == nil {
+			// Each connection to :memory: is a separate database
+			db.SetMaxOpenConns(1)
 			CreateTimeseriesTable(db)
 			SetCaptureDB(db)
 		}
 	}
+	registerCaptureRoutes(mux)
+}
+
+// RegisterCaptureEndpointsWithDB is RegisterCaptureEndpoints with db as the
+// capture DB, so what captures ingest can be queried through db. It creates
+// the timeseries and capture session tables if they don't exist.
+func RegisterCaptureEndpointsWithDB(mux *http.ServeMux, db *sql.DB) error {
+	if err := CreateTimeseriesTable(db); err != nil {
+		return err
+	}
+	if err := CreateCaptureSessionTable(db); err != nil {
+		return err
+	}
+	SetCaptureDB(db)
+	registerCaptureRoutes(mux)
+	return nil
+}
+
+func registerCaptureRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/capture/start", CaptureStartHandler)
 	mux.HandleFunc("/capture/stop", CaptureStopHandler)
 	mux.HandleFunc("/capture/status", CaptureStatusHandler)
+	mux.HandleFunc("/capture/status.json", CaptureStatusHandler)
+	mux.HandleFunc("/capture/history", CaptureHistoryHandler)
+	mux.HandleFunc("/capture/list", CaptureListHandler)
+	mux.HandleFunc("/capture/compact", CaptureCompactHandler)
+	mux.HandleFunc("/timeseries/query", TimeseriesQueryHandler)
 }
@@ -1,23 +1,76 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
 	"database/sql"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/unklstewy/redbug_dewey/models"
 	"github.com/unklstewy/redbug_dewey/utils"
+	gormsqlite "gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
+// sampleLogs holds the recorded CPS captures used by the capture tests
+//
+//go:embed testdata/logs/*.log
+var sampleLogs embed.FS
+
+// sampleLog writes an embedded sample log to a temp dir, makes that dir the
+// capture log root for the test and returns the log's path
+func sampleLog(t *testing.T, name string) string {
+	t.Helper()
+	data, err := sampleLogs.ReadFile("testdata/logs/" + name)
+	if err != nil {
+		t.Fatalf("missing sample log %s: %v", name, err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write sample log: %v", err)
+	}
+	captureLogRootMu.RLock()
+	prev := captureLogRoot
+	captureLogRootMu.RUnlock()
+	SetCaptureLogRoot(dir)
+	t.Cleanup(func() { SetCaptureLogRoot(prev) })
+	return path
+}
+
+// ingestedAll reports whether a capture status shows every line of logPath
+// ingested; captures keep tailing their log, so they never stop on their own
+func ingestedAll(t *testing.T, status, logPath string) bool {
+	t.Helper()
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("failed to read log: %v", err)
+	}
+	want := fmt.Sprintf("Ingested: %d\n", bytes.Count(data, []byte("\n")))
+	return strings.Contains(status, "BufferLen: 0") && strings.Contains(status, want)
+}
+
 func TestManufacturerCRUD(t *testing.T) {
 	// Sequential for reliability
 	db := utils.InitDB(":memory:")
@@ -57,6 +110,134 @@ func TestManufacturerCRUD(t *testing.T) {
 	}
 }
 
+func TestAutoMigrateSchemaUsableByHandlers(t *testing.T) {
+	for _, preexisting := range []bool{false, true} {
+		t.Run(fmt.Sprintf("preexisting=%v", preexisting), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "gorm.db")
+			if preexisting {
+				// Migrating over the hand-written schema must be a no-op for the handlers
+				raw := utils.InitDB(path)
+				utils.CreateTables(raw)
+				raw.Close()
+			}
+			gdb, err := gorm.Open(gormsqlite.Open(path), &gorm.Config{})
+			if err != nil {
+				t.Fatalf("failed to open gorm db: %v", err)
+			}
+			if err := models.AutoMigrate(gdb); err != nil {
+				t.Fatalf("AutoMigrate failed: %v", err)
+			}
+			db, _ := gdb.DB()
+			defer db.Close()
+
+			uid, err := CreateUser(db, "admin", "secret", 1)
+			if err != nil {
+				t.Fatalf("CreateUser failed: %v", err)
+			}
+			if _, err := CreateUser(db, "admin", "again", 1); err == nil {
+				t.Error("expected duplicate username to be rejected")
+			}
+			LockUser(db, "admin")
+			UpdateLastLogin(db, "admin")
+			if _, err := AuthenticateUserDetailed(db, "admin", "secret"); !errors.Is(err, ErrUserLocked) {
+				t.Errorf("expected ErrUserLocked, got %v", err)
+			}
+			var viaGorm models.User
+			if err := gdb.First(&viaGorm, uid).Error; err != nil || !viaGorm.Locked || viaGorm.LastLogin == "" {
+				t.Errorf("unexpected user via gorm: %+v (err %v)", viaGorm, err)
+			}
+
+			mid, err := CreateManufacturer(db, "Motorola")
+			if err != nil {
+				t.Fatalf("CreateManufacturer failed: %v", err)
+			}
+			tid, err := CreateTeam(db, "Team", int(uid))
+			if err != nil {
+				t.Fatalf("CreateTeam failed: %v", err)
+			}
+			if _, err := AddTeamMember(db, int(tid), int(uid), 1); err != nil {
+				t.Errorf("AddTeamMember failed: %v", err)
+			}
+			if _, err := SetTeamPermission(db, int(tid), 1); err != nil {
+				t.Errorf("SetTeamPermission failed: %v", err)
+			}
+			db.Exec("INSERT INTO codeplug_setting (radio_model, setting, value) VALUES (?, 'power', 'high')", mid)
+			if _, err := ComputeCodeplugChecksum(db, int(mid)); err != nil {
+				t.Errorf("ComputeCodeplugChecksum failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestCodeplugChecksum(t *testing.T) {
+	db := utils.InitDB(":memory:")
+	defer db.Close()
+	utils.CreateTables(db)
+	for _, s := range [][2]string{{"squelch", "3"}, {"power", "high"}} {
+		if _, err := db.Exec("INSERT INTO codeplug_setting (radio_model, setting, value) VALUES (?, ?, ?)", 1, s[0], s[1]); err != nil {
+			t.Fatalf("failed to insert setting: %v", err)
+		}
+	}
+	// Settings for another model must not affect the checksum
+	db.Exec("INSERT INTO codeplug_setting (radio_model, setting, value) VALUES (2, 'power', 'low')")
+
+	sum, err := ComputeCodeplugChecksum(db, 1)
+	if err != nil {
+		t.Fatalf("ComputeCodeplugChecksum failed: %v", err)
+	}
+	again, _ := ComputeCodeplugChecksum(db, 1)
+	if sum != again {
+		t.Errorf("checksum not stable: %s vs %s", sum, again)
+	}
+	ok, err := VerifyCodeplugChecksum(db, 1)
+	if err != nil || !ok {
+		t.Fatalf("expected checksum to verify, got %v (err %v)", ok, err)
+	}
+
+	db.Exec("UPDATE codeplug_setting SET value = 'low' WHERE radio_model = 1 AND setting = 'power'")
+	ok, err = VerifyCodeplugChecksum(db, 1)
+	if err != nil || ok {
+		t.Fatalf("expected drift to be detected, got %v (err %v)", ok, err)
+	}
+	changed, _ := ComputeCodeplugChecksum(db, 1)
+	if changed == sum {
+		t.Error("expected checksum to change after a setting changed")
+	}
+}
+
+func TestCodeplugCompleteness(t *testing.T) {
+	db := utils.InitDB(":memory:")
+	defer db.Close()
+	utils.CreateTables(db)
+	for _, f := range []struct {
+		feature   string
+		supported bool
+	}{{"power", true}, {"squelch", true}, {"scan", true}, {"vox", true}, {"gps", false}} {
+		db.Exec("INSERT INTO codeplug_supported_setting (radio_model_id, feature, supported) VALUES (1, ?, ?)", f.feature, f.supported)
+	}
+	db.Exec("INSERT INTO codeplug_setting (radio_model, setting, value) VALUES (1, 'power', 'high')")
+	db.Exec("INSERT INTO codeplug_setting (radio_model, setting, value) VALUES (1, 'squelch', '3')")
+	// Empty values, unsupported features and other models don't count
+	db.Exec("INSERT INTO codeplug_setting (radio_model, setting, value) VALUES (1, 'scan', '')")
+	db.Exec("INSERT INTO codeplug_setting (radio_model, setting, value) VALUES (1, 'gps', 'on')")
+	db.Exec("INSERT INTO codeplug_setting (radio_model, setting, value) VALUES (2, 'vox', 'on')")
+
+	pct, missing, err := CodeplugCompleteness(db, 1)
+	if err != nil {
+		t.Fatalf("CodeplugCompleteness failed: %v", err)
+	}
+	if pct != 0.5 {
+		t.Errorf("expected 0.5 complete, got %v", pct)
+	}
+	if strings.Join(missing, ",") != "scan,vox" {
+		t.Errorf("expected scan and vox missing, got %v", missing)
+	}
+
+	if pct, missing, _ := CodeplugCompleteness(db, 3); pct != 1 || len(missing) != 0 {
+		t.Errorf("expected a model without features to be complete, got %v %v", pct, missing)
+	}
+}
+
 func TestUserAdminFunctions(t *testing.T) {
 	// Sequential for reliability
 	db, err := sql.Open("sqlite3", ":memory:")
@@ -109,6 +290,129 @@ func TestUserAdminFunctions(t *testing.T) {
 	}
 }
 
+func TestCreateUserNormalizesUsernames(t *testing.T) {
+	db := utils.InitDB(filepath.Join(t.TempDir(), "dewey.db"))
+	defer db.Close()
+	utils.CreateTables(db)
+
+	for _, bad := range []string{"", "   ", "ab", "has space", "-dash", "semi;colon", strings.Repeat("x", 65)} {
+		if _, err := CreateUser(db, bad, "secret", 3); !errors.Is(err, ErrInvalidUsername) {
+			t.Errorf("expected ErrInvalidUsername for %q, got %v", bad, err)
+		}
+	}
+
+	if _, err := CreateUser(db, "  Alice.Smith  ", "secret", 3); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	var stored string
+	db.QueryRow("SELECT username FROM user").Scan(&stored)
+	if stored != "alice.smith" {
+		t.Errorf("expected the normalized name to be stored, got %q", stored)
+	}
+	if _, err := CreateUser(db, "ALICE.SMITH", "other", 3); err == nil {
+		t.Error("expected a case variant to collide with the existing user")
+	}
+	if ok, err := AuthenticateUser(db, "Alice.Smith", "secret"); err != nil || !ok {
+		t.Errorf("expected lookups to normalize the name (err %v)", err)
+	}
+
+	// A custom policy that keeps case and allows short names
+	SetUsernamePolicy(UsernamePolicy{MinLen: 1, MaxLen: 8})
+	defer SetUsernamePolicy(DefaultUsernamePolicy)
+	if _, err := CreateUser(db, " Bo ", "secret", 3); err != nil {
+		t.Fatalf("CreateUser with a custom policy failed: %v", err)
+	}
+	if err := db.QueryRow("SELECT username FROM user WHERE username = 'Bo'").Scan(&stored); err != nil {
+		t.Errorf("expected the trimmed, case-preserved name to be stored: %v", err)
+	}
+	if _, err := CreateUser(db, "toolongname", "secret", 3); !errors.Is(err, ErrInvalidUsername) {
+		t.Errorf("expected the custom max length to apply, got %v", err)
+	}
+}
+
+func TestBootstrapAdminOnlyOnEmptyDB(t *testing.T) {
+	db := utils.InitDB(filepath.Join(t.TempDir(), "dewey.db"))
+	defer db.Close()
+	utils.CreateTables(db)
+
+	created, generated, err := BootstrapAdmin(db, BootstrapOptions{})
+	if err != nil || !created || generated == "" {
+		t.Fatalf("expected an admin with a generated password, got created=%v password=%q (err %v)", created, generated, err)
+	}
+	u, err := AuthenticateUserDetailed(db, "admin", generated)
+	if err != nil || u.RoleID != 1 {
+		t.Fatalf("expected the admin to log in with role 1, got %+v (err %v)", u, err)
+	}
+	var roles int
+	db.QueryRow("SELECT COUNT(*) FROM role").Scan(&roles)
+	if roles != len(DefaultRoles) {
+		t.Errorf("expected %d seeded roles, got %d", len(DefaultRoles), roles)
+	}
+
+	// Users exist now, so bootstrapping again is a no-op
+	created, generated, err = BootstrapAdmin(db, BootstrapOptions{Username: "root", Password: "configured"})
+	if err != nil || created || generated != "" {
+		t.Errorf("expected no bootstrap on a populated DB, got created=%v password=%q (err %v)", created, generated, err)
+	}
+	var users int
+	db.QueryRow("SELECT COUNT(*) FROM user").Scan(&users)
+	if users != 1 {
+		t.Errorf("expected only the first admin, got %d users", users)
+	}
+
+	// A fresh DB takes the configured credentials
+	fresh := utils.InitDB(filepath.Join(t.TempDir(), "fresh.db"))
+	defer fresh.Close()
+	utils.CreateTables(fresh)
+	if created, generated, err := BootstrapAdmin(fresh, BootstrapOptions{Username: "root", Password: "configured"}); err != nil || !created || generated != "" {
+		t.Fatalf("expected the configured admin, got created=%v password=%q (err %v)", created, generated, err)
+	}
+	if ok, err := AuthenticateUser(fresh, "root", "configured"); err != nil || !ok {
+		t.Errorf("expected the configured admin to log in (err %v)", err)
+	}
+}
+
+func TestAuthenticateUserDetailed(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE user (id INTEGER PRIMARY KEY, username TEXT, password_hash TEXT, role_id INTEGER, locked BOOLEAN, revoked BOOLEAN, last_login TEXT);`)
+	if err != nil {
+		t.Fatalf("failed to create user table: %v", err)
+	}
+	uid, err := CreateUser(db, "leader", "secret", 2)
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	u, err := AuthenticateUserDetailed(db, "leader", "secret")
+	if err != nil {
+		t.Fatalf("authentication failed: %v", err)
+	}
+	if u.ID != int(uid) || u.RoleID != 2 {
+		t.Errorf("unexpected user: %+v", u)
+	}
+	if u.PasswordHash != "" {
+		t.Error("expected password hash to be omitted")
+	}
+	if _, err := AuthenticateUserDetailed(db, "leader", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := AuthenticateUserDetailed(db, "nobody", "secret"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials for unknown user, got %v", err)
+	}
+	LockUser(db, "leader")
+	if _, err := AuthenticateUserDetailed(db, "leader", "secret"); !errors.Is(err, ErrUserLocked) {
+		t.Errorf("expected ErrUserLocked, got %v", err)
+	}
+	UnlockUser(db, "leader")
+	RevokeUser(db, "leader")
+	if _, err := AuthenticateUserDetailed(db, "leader", "secret"); !errors.Is(err, ErrUserRevoked) {
+		t.Errorf("expected ErrUserRevoked, got %v", err)
+	}
+}
+
 func TestUserAdminFunctionsIterative(t *testing.T) {
 	t.Parallel() // This test is performance-bound and safe to parallelize
 	for i := 0; i < 100; i++ {
@@ -210,11 +514,26 @@ func TestTeamFunctions(t *testing.T) {
 	if pid == 0 {
 		t.Error("expected non-zero team permission id")
 	}
-	// Remove team member
-	err = RemoveTeamMember(db, int(tid), int(uid))
+	// The leader can't be removed while leading the team
+	if err := RemoveTeamMember(db, int(tid), int(uid)); !errors.Is(err, ErrRemoveTeamLeader) {
+		t.Errorf("expected ErrRemoveTeamLeader, got %v", err)
+	}
+	var members int
+	db.QueryRow("SELECT COUNT(*) FROM team_member WHERE team_id = ? AND user_id = ?", tid, uid).Scan(&members)
+	if members != 1 {
+		t.Errorf("expected the leader to stay a member, got %d rows", members)
+	}
+	// Remove a team member who isn't the leader
+	other, _ := CreateUser(db, "member", "pass", 1)
+	AddTeamMember(db, int(tid), int(other), 1)
+	err = RemoveTeamMember(db, int(tid), int(other))
 	if err != nil {
 		t.Errorf("failed to remove team member: %v", err)
 	}
+	db.QueryRow("SELECT COUNT(*) FROM team_member WHERE team_id = ? AND user_id = ?", tid, other).Scan(&members)
+	if members != 0 {
+		t.Errorf("expected the member to be removed, got %d rows", members)
+	}
 	// Remove team permission
 	err = RemoveTeamPermission(db, int(tid), 1)
 	if err != nil {
@@ -227,6 +546,223 @@ func TestTeamFunctions(t *testing.T) {
 	}
 }
 
+func TestSetTeamPermissionIdempotent(t *testing.T) {
+	db := utils.InitDB(":memory:")
+	defer db.Close()
+	utils.CreateTables(db)
+	first, err := SetTeamPermission(db, 1, 7)
+	if err != nil {
+		t.Fatalf("first grant failed: %v", err)
+	}
+	second, err := SetTeamPermission(db, 1, 7)
+	if err != nil {
+		t.Fatalf("second grant failed: %v", err)
+	}
+	if first == 0 || first != second {
+		t.Errorf("expected the existing id %d on regrant, got %d", first, second)
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM team_permission WHERE team_id = 1 AND permission_id = 7").Scan(&count)
+	if count != 1 {
+		t.Errorf("expected a single team_permission row, got %d", count)
+	}
+	if _, err := db.Exec("INSERT INTO team_permission (team_id, permission_id) VALUES (1, 7)"); err == nil {
+		t.Error("expected the unique index to reject a duplicate grant")
+	}
+	if err := RemoveTeamPermission(db, 1, 7); err != nil {
+		t.Fatalf("RemoveTeamPermission failed: %v", err)
+	}
+	db.QueryRow("SELECT COUNT(*) FROM team_permission").Scan(&count)
+	if count != 0 {
+		t.Errorf("expected no grants after removal, got %d", count)
+	}
+}
+
+func TestGrantPermissionsToRole(t *testing.T) {
+	db := utils.InitDB(filepath.Join(t.TempDir(), "dewey.db"))
+	defer db.Close()
+	utils.CreateTables(db)
+	db.Exec("INSERT INTO role (id, name) VALUES (2, 'leader')")
+	db.Exec("INSERT INTO permission (id, name) VALUES (1, 'view'), (2, 'edit'), (3, 'delete')")
+
+	// One unknown id means none of the valid ones are granted either
+	err := GrantPermissionsToRole(db, 2, []int{1, 99, 3, 100})
+	if !errors.Is(err, ErrUnknownPermission) {
+		t.Fatalf("expected ErrUnknownPermission, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "99") || !strings.Contains(err.Error(), "100") {
+		t.Errorf("expected the error to name both unknown ids, got %v", err)
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM role_permission").Scan(&count)
+	if count != 0 {
+		t.Fatalf("expected no grants after a failed grant, got %d", count)
+	}
+	if err := GrantPermissionsToRole(db, 42, []int{1}); !errors.Is(err, ErrUnknownRole) {
+		t.Errorf("expected ErrUnknownRole, got %v", err)
+	}
+
+	if err := GrantPermissionToRole(db, 2, 2); err != nil {
+		t.Fatalf("GrantPermissionToRole failed: %v", err)
+	}
+	// Regranting is a no-op, including an id repeated in one call
+	if err := GrantPermissionsToRole(db, 2, []int{1, 2, 3, 3}); err != nil {
+		t.Fatalf("GrantPermissionsToRole failed: %v", err)
+	}
+	db.QueryRow("SELECT COUNT(*) FROM role_permission WHERE role_id = 2").Scan(&count)
+	if count != 3 {
+		t.Errorf("expected 3 role_permission rows, got %d", count)
+	}
+	ids, err := RolePermissionIDs(db, 2)
+	if err != nil || fmt.Sprint(ids) != "[1 2 3]" {
+		t.Errorf("expected permissions [1 2 3], got %v (%v)", ids, err)
+	}
+}
+
+func TestTeamMetadataDetail(t *testing.T) {
+	db := utils.InitDB(filepath.Join(t.TempDir(), "dewey.db"))
+	defer db.Close()
+	utils.CreateTables(db)
+	db.Exec("INSERT INTO permission (id, name) VALUES (1, 'view'), (2, 'edit')")
+	leader, _ := CreateUser(db, "leader", "pass", 2)
+	member, _ := CreateUser(db, "member", "pass", 3)
+	team, _ := CreateTeam(db, "ops", int(leader))
+	other, _ := CreateTeam(db, "other", int(leader))
+	AddTeamMember(db, int(team), int(member), 3)
+	SetTeamPermission(db, int(team), 2)
+
+	if err := SetTeamDescription(db, int(team), "Handles the repeaters"); err != nil {
+		t.Fatalf("SetTeamDescription failed: %v", err)
+	}
+	for key, value := range map[string]string{"region": "north", "contact.email": "ops@example.com", "on_call": "alice"} {
+		if err := SetTeamMetadata(db, int(team), key, value); err != nil {
+			t.Fatalf("SetTeamMetadata(%s) failed: %v", key, err)
+		}
+	}
+	// Setting a key again replaces its value; other teams are separate
+	SetTeamMetadata(db, int(team), "region", "south")
+	SetTeamMetadata(db, int(other), "region", "west")
+	SetTeamMetadata(db, int(team), "temp", "x")
+	DeleteTeamMetadata(db, int(team), "temp")
+
+	d, err := GetTeamDetail(db, int(team))
+	if err != nil {
+		t.Fatalf("GetTeamDetail failed: %v", err)
+	}
+	want := map[string]string{"region": "south", "contact.email": "ops@example.com", "on_call": "alice"}
+	if len(d.Metadata) != len(want) {
+		t.Errorf("expected metadata %v, got %v", want, d.Metadata)
+	}
+	for k, v := range want {
+		if d.Metadata[k] != v {
+			t.Errorf("metadata %s: expected %q, got %q", k, v, d.Metadata[k])
+		}
+	}
+	if d.Name != "ops" || d.Description != "Handles the repeaters" || d.Leader != "leader" ||
+		len(d.Members) != 1 || d.Members[0].UserID != int(member) ||
+		len(d.Permissions) != 1 || d.Permissions[0].Name != "edit" {
+		t.Errorf("unexpected detail %+v", d)
+	}
+
+	for _, tc := range []struct{ key, value string }{
+		{"Region", "x"}, {"", "x"}, {"1st", "x"}, {"has space", "x"},
+		{strings.Repeat("k", MaxTeamMetadataKeyLen+1), "x"},
+		{"notes", strings.Repeat("v", MaxTeamMetadataValueLen+1)},
+	} {
+		if err := SetTeamMetadata(db, int(team), tc.key, tc.value); !errors.Is(err, ErrInvalidTeamMetadata) {
+			t.Errorf("key %q: expected ErrInvalidTeamMetadata, got %v", tc.key, err)
+		}
+	}
+	if err := SetTeamDescription(db, int(team), strings.Repeat("d", MaxTeamDescriptionLen+1)); !errors.Is(err, ErrInvalidTeamMetadata) {
+		t.Errorf("expected an overlong description to be rejected, got %v", err)
+	}
+	if err := SetTeamMetadata(db, 999, "region", "x"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for an unknown team, got %v", err)
+	}
+	if _, err := GetTeamDetail(db, 999); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for an unknown team, got %v", err)
+	}
+}
+
+func TestTeamPartialBackup(t *testing.T) {
+	dir := t.TempDir()
+	db := utils.InitDB(filepath.Join(dir, "dewey.db"))
+	defer db.Close()
+	utils.CreateTables(db)
+	db.Exec("INSERT INTO role (id, name) VALUES (1, 'admin'), (2, 'leader'), (3, 'member')")
+	db.Exec("INSERT INTO permission (id, name) VALUES (1, 'backup:pulitzer'), (2, 'backup:dasm'), (3, 'view')")
+	db.Exec("INSERT INTO pulitzer (id) VALUES (11), (12)")
+	db.Exec("INSERT INTO dasm (id) VALUES (21)")
+	leaderA, _ := CreateUser(db, "leader-a", "pass", 2)
+	leaderB, _ := CreateUser(db, "leader-b", "pass", 2)
+	memberA, _ := CreateUser(db, "member-a", "pass", 3)
+	memberB, _ := CreateUser(db, "member-b", "pass", 3)
+	teamA, _ := CreateTeam(db, "team-alpha", int(leaderA))
+	teamB, _ := CreateTeam(db, "team-bravo", int(leaderB))
+	AddTeamMember(db, int(teamA), int(memberA), 3)
+	AddTeamMember(db, int(teamB), int(memberB), 3)
+	SetTeamPermission(db, int(teamA), 1)
+	SetTeamPermission(db, int(teamA), 3)
+	SetTeamPermission(db, int(teamB), 2)
+
+	path := filepath.Join(dir, "team.sql")
+	result, meta, err := RunPartialBackup(db, int(leaderA), path)
+	if err != nil {
+		t.Fatalf("partial backup failed: %v", err)
+	}
+	if meta.BackupType != PartialBackupType || result.Size == 0 {
+		t.Errorf("unexpected backup %+v %+v", meta, result)
+	}
+	data, _ := os.ReadFile(path)
+	dump := string(data)
+	for _, want := range []string{
+		`CREATE TABLE pulitzer`, `INSERT INTO "pulitzer" VALUES(11);`, `INSERT INTO "pulitzer" VALUES(12);`,
+		"'team-alpha'", "'leader-a'", "'member-a'", "'member'", "'backup:pulitzer'", "'view'",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("dump is missing %s", want)
+		}
+	}
+	for _, unwanted := range []string{
+		"dasm", "team-bravo", "leader-b", "member-b", "'admin'", "backup_metadata", "audit_log", "authentication", "$2a$",
+	} {
+		if strings.Contains(dump, unwanted) {
+			t.Errorf("dump should not contain %s", unwanted)
+		}
+	}
+
+	// The dump restores on its own
+	restored, _ := sql.Open("sqlite3", ":memory:")
+	defer restored.Close()
+	if _, err := restored.Exec(dump); err != nil {
+		t.Fatalf("restoring the dump failed: %v", err)
+	}
+	var members int
+	restored.QueryRow("SELECT COUNT(*) FROM user WHERE password_hash IS NULL").Scan(&members)
+	if members != 2 {
+		t.Errorf("expected 2 users with redacted passwords, got %d", members)
+	}
+
+	if _, _, err := RunPartialBackup(db, int(memberA), filepath.Join(dir, "none.sql")); !errors.Is(err, ErrNoTeamScope) {
+		t.Errorf("expected ErrNoTeamScope for a non-leader, got %v", err)
+	}
+
+	// PartialBackup follows declared foreign keys to referenced rows
+	path = filepath.Join(dir, "members.sql")
+	if err := utils.PartialBackup(db, path, []string{"team_member"}); err != nil {
+		t.Fatalf("PartialBackup failed: %v", err)
+	}
+	data, _ = os.ReadFile(path)
+	for _, want := range []string{"'team-alpha'", "'team-bravo'", "'member-b'", "'leader-b'", "'member'"} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("member dump is missing referenced row %s", want)
+		}
+	}
+	if bytes.Contains(data, []byte("pulitzer")) || bytes.Contains(data, []byte("'view'")) {
+		t.Errorf("member dump contains unreferenced data:\n%s", data)
+	}
+}
+
 func TestParallelModuleAccess(t *testing.T) {
 	t.Parallel() // This test is performance-bound and safe to parallelize
 	workers := runtime.NumCPU()
@@ -480,64 +1016,396 @@ func TestTimeseriesEventInsertAndQuery(t *testing.T) {
 	}
 }
 
-func TestTimeseriesEventStress(t *testing.T) {
-	const (
-		initialEPS      = 500 // events per second
-		maxDuration     = 2 * time.Second
-		stabilityTrials = 3
-	)
-	dbPath := "timeseries_stress_benchmark.db"
-	defer os.Remove(dbPath)
-	db, err := sql.Open("sqlite3", dbPath)
+func TestQueryGroupedByType(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
 		t.Fatalf("failed to open db: %v", err)
 	}
 	defer db.Close()
-	_, err = db.Exec(`PRAGMA journal_mode=WAL;`)
+	if err := CreateTimeseriesTable(db); err != nil {
+		t.Fatalf("failed to create timeseries_event table: %v", err)
+	}
+	base := time.Now().UTC().Truncate(time.Second)
+	for i, typ := range []string{"read", "write", "read", "open", "write", "read"} {
+		InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: base.Add(time.Duration(i) * time.Second), Source: "strace", Type: typ, Payload: fmt.Sprint(i)})
+	}
+	InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: base, Source: "other", Type: "read", Payload: "x"})
+
+	grouped, err := QueryGroupedByType(db, "strace", []string{"read", "write", "close"}, base, base.Add(time.Minute))
 	if err != nil {
-		t.Fatalf("failed to enable WAL mode: %v", err)
+		t.Fatalf("QueryGroupedByType failed: %v", err)
+	}
+	payloads := func(events []TimeseriesEvent) string {
+		var p []string
+		for _, e := range events {
+			p = append(p, e.Payload)
+		}
+		return strings.Join(p, ",")
+	}
+	if got := payloads(grouped["read"]); got != "0,2,5" {
+		t.Errorf("expected read events 0,2,5, got %s", got)
+	}
+	if got := payloads(grouped["write"]); got != "1,4" {
+		t.Errorf("expected write events 1,4, got %s", got)
 	}
+	if events, ok := grouped["close"]; !ok || len(events) != 0 {
+		t.Errorf("expected an empty close series, got %v", events)
+	}
+	if _, ok := grouped["open"]; ok {
+		t.Error("expected unrequested types to be left out")
+	}
+
+	SetGroupedQueryRowCap(4)
+	defer SetGroupedQueryRowCap(100000)
+	if _, err := QueryGroupedByType(db, "strace", []string{"read", "write"}, base, base.Add(time.Minute)); !errors.Is(err, ErrRowCapExceeded) {
+		t.Errorf("expected ErrRowCapExceeded, got %v", err)
+	}
+}
+
+func TestQueryTimeseriesEventsOrderAndLatestPerType(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
 	if err := CreateTimeseriesTable(db); err != nil {
 		t.Fatalf("failed to create timeseries_event table: %v", err)
 	}
-
-	eps := initialEPS
-	var lastGoodEPS int
-	var stableEPS int
-	fineBackoffRatio := 0.95
-	var epsLog []struct {
-		EPS     int
-		Elapsed time.Duration
-		Errors  int
+	base := time.Now().UTC().Truncate(time.Second)
+	for i, typ := range []string{"read", "write", "read", "open", "write", "read"} {
+		InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: base.Add(time.Duration(i) * time.Second), Source: "strace", Type: typ, Payload: fmt.Sprint(i)})
 	}
-	for {
-		fail := false
-		start := time.Now()
-		var wg sync.WaitGroup
-		var mu sync.Mutex
-		errs := 0
-		for i := 0; i < eps; i++ {
-			wg.Add(1)
-			go func(i int) {
-				defer wg.Done()
-				event := TimeseriesEvent{
-					Timestamp: time.Now().UTC(),
-					Source:    "stress",
-					Type:      "test",
-					Payload:   fmt.Sprintf(`{"seq":%d,"data":"payload"}`, i),
-				}
-				_, err := InsertTimeseriesEvent(db, event)
-				if err != nil {
-					mu.Lock()
-					errs++
-					mu.Unlock()
-				}
-			}(i)
+	// Same timestamp as the last write: the later insert is the latest
+	InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: base.Add(4 * time.Second), Source: "strace", Type: "write", Payload: "4b"})
+	InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: base.Add(time.Hour), Source: "other", Type: "read", Payload: "x"})
+
+	payloads := func(events []TimeseriesEvent) string {
+		var p []string
+		for _, e := range events {
+			p = append(p, e.Payload)
 		}
-		wg.Wait()
-		elapsed := time.Since(start)
-		epsLog = append(epsLog, struct {
-			EPS     int
+		return strings.Join(p, ",")
+	}
+	desc, err := QueryTimeseriesEventsWithOptions(db, "strace", "read", base, base.Add(time.Minute), QueryOptions{Order: Descending})
+	if err != nil {
+		t.Fatalf("descending query failed: %v", err)
+	}
+	if got := payloads(desc); got != "5,2,0" {
+		t.Errorf("expected read events 5,2,0 newest first, got %s", got)
+	}
+	newest, _ := QueryTimeseriesEventsWithOptions(db, "strace", "write", base, base.Add(time.Minute), QueryOptions{Order: Descending, Limit: 2})
+	if got := payloads(newest); got != "4b,4" {
+		t.Errorf("expected the two newest writes 4b,4, got %s", got)
+	}
+	asc, _ := QueryTimeseriesEvents(db, "strace", "read", base, base.Add(time.Minute))
+	if got := payloads(asc); got != "0,2,5" {
+		t.Errorf("expected read events 0,2,5 by default, got %s", got)
+	}
+	if _, err := QueryTimeseriesEventsWithOptions(db, "strace", "read", base, base, QueryOptions{Order: "sideways"}); !errors.Is(err, ErrInvalidOrder) {
+		t.Errorf("expected ErrInvalidOrder, got %v", err)
+	}
+
+	latest, err := LatestPerType(db, "strace", []string{"read", "write", "close"})
+	if err != nil {
+		t.Fatalf("LatestPerType failed: %v", err)
+	}
+	if len(latest) != 2 {
+		t.Fatalf("expected latest events for read and write only, got %v", latest)
+	}
+	if e := latest["read"]; e.Payload != "5" {
+		t.Errorf("expected latest read 5, got %q", e.Payload)
+	}
+	if e := latest["write"]; e.Payload != "4b" {
+		t.Errorf("expected latest write 4b, got %q", e.Payload)
+	}
+}
+
+func TestQueryDecodedEvents(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	if err := CreateTimeseriesTable(db); err != nil {
+		t.Fatalf("failed to create timeseries_event table: %v", err)
+	}
+	SetPayloadCompression(64)
+	defer SetPayloadCompression(0)
+	long := strings.Repeat("frame ok; ", 20)
+	base := time.Now().UTC().Truncate(time.Second)
+	rows := []struct {
+		payload, encoding string
+	}{
+		{"plain text", ""},
+		{base64.StdEncoding.EncodeToString([]byte("hello radio")), "base64"},
+		{base64.StdEncoding.EncodeToString([]byte{0x00, 0x7e, 0xff}), "base64"},
+		{"deadbeef", "HEX"},
+		{long, ""}, // stored compressed
+		{base64.StdEncoding.EncodeToString([]byte(long)), "base64"}, // compressed and base64
+		{"not base64!", "base64"},
+		{"secret", "aes"},
+	}
+	for i, r := range rows {
+		var labels map[string]string
+		if r.encoding != "" {
+			labels = map[string]string{PayloadEncodingLabel: r.encoding}
+		}
+		InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: base.Add(time.Duration(i) * time.Second), Source: "serial", Type: "read", Payload: r.payload, Labels: labels})
+	}
+
+	events, err := QueryDecodedEvents(db, "serial", "read", base, base.Add(time.Minute), QueryOptions{})
+	if err != nil {
+		t.Fatalf("QueryDecodedEvents failed: %v", err)
+	}
+	want := []struct {
+		decoded    string
+		encoding   PayloadEncoding
+		compressed bool
+		binary     bool
+		failed     bool
+	}{
+		{"plain text", EncodingText, false, false, false},
+		{"hello radio", EncodingBase64, false, false, false},
+		{"00 7e ff", EncodingBase64, false, true, false},
+		{"de ad be ef", EncodingHex, false, true, false},
+		{long, EncodingText, true, false, false},
+		{long, EncodingBase64, true, false, false},
+		{"not base64!", EncodingBase64, false, false, true},
+		{"secret", "aes", false, false, true},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %d", len(want), len(events))
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.Decoded != w.decoded || e.Encoding != w.encoding || e.Compressed != w.compressed || e.Binary != w.binary || (e.DecodeError != "") != w.failed {
+			t.Errorf("event %d: expected %+v, got decoded=%q encoding=%s compressed=%v binary=%v error=%q", i+1, w, e.Decoded, e.Encoding, e.Compressed, e.Binary, e.DecodeError)
+		}
+	}
+}
+
+func TestDetectPayloadEncoding(t *testing.T) {
+	for payload, want := range map[string]PayloadEncoding{
+		`{"rssi": -72, "slot": 1}`: EncodingJSON,
+		` [1, 2, 3] `:              EncodingJSON,
+		base64.StdEncoding.EncodeToString([]byte("hello radio")): EncodingBase64,
+		"deadbeef":            EncodingHex,
+		"0A0B0C":              EncodingHex,
+		"plain text":          EncodingText,
+		"read(3, buf, 5) = 5": EncodingText,
+		"{not json":           EncodingText,
+		"3.5":                 EncodingText, // bare JSON values read as text
+		"abc":                 EncodingText, // odd-length hex
+		"":                    EncodingText,
+		// Decodes as base64, but only to binary, so it's taken as hex
+		"00ff00ff": EncodingHex,
+	} {
+		if got := DetectPayloadEncoding(payload); got != want {
+			t.Errorf("DetectPayloadEncoding(%q) = %s, want %s", payload, got, want)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	if err := CreateTimeseriesTable(db); err != nil {
+		t.Fatalf("failed to create timeseries_event table: %v", err)
+	}
+	base := time.Now().UTC().Truncate(time.Second)
+	encoded := base64.StdEncoding.EncodeToString([]byte("hello radio"))
+	InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: base, Source: "serial", Type: "read", Payload: encoded})
+	InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: base.Add(time.Second), Source: "serial", Type: "read", Payload: encoded,
+		Labels: map[string]string{PayloadEncodingLabel: "text"}})
+	events, err := QueryDecodedEvents(db, "serial", "read", base, base.Add(time.Minute), QueryOptions{})
+	if err != nil || len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d (%v)", len(events), err)
+	}
+	if e := events[0]; e.Decoded != "hello radio" || e.Encoding != EncodingBase64 || !e.Detected {
+		t.Errorf("expected the unlabeled payload detected as base64, got %+v", e)
+	}
+	// A label always wins over detection
+	if e := events[1]; e.Decoded != encoded || e.Encoding != EncodingText || e.Detected {
+		t.Errorf("expected the labeled payload shown as text, got %+v", e)
+	}
+	// Detection is for display only
+	stored, _ := QueryTimeseriesEvents(db, "serial", "read", base, base.Add(time.Minute))
+	if len(stored) != 2 || stored[0].Payload != encoded || stored[0].Labels[PayloadEncodingLabel] != "" {
+		t.Errorf("expected the stored row unchanged, got %+v", stored)
+	}
+}
+
+func TestQueryTimeseriesEventsMatching(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	if err := CreateTimeseriesTable(db); err != nil {
+		t.Fatalf("failed to create timeseries_event table: %v", err)
+	}
+	SetPayloadCompression(64)
+	defer SetPayloadCompression(0)
+	base := time.Now().UTC().Truncate(time.Second)
+	for i, p := range []string{
+		"rx 0xABCD ok",
+		"rx 0x1234",
+		"tx 0xabcd lower",
+		"50% done_x",
+		strings.Repeat("ff ", 40) + "0xABCD", // stored compressed
+		"50x done",
+	} {
+		InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: base.Add(time.Duration(i) * time.Second), Source: "serial", Type: "read", Payload: p})
+	}
+	InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: base.Add(-time.Hour), Source: "serial", Type: "read", Payload: "0xABCD before the window"})
+	InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: base, Source: "serial", Type: "write", Payload: "0xABCD other type"})
+	var compressed bool
+	if db.QueryRow("SELECT compressed FROM timeseries_event WHERE id = 5").Scan(&compressed); !compressed {
+		t.Fatal("expected event 5 to be stored compressed")
+	}
+
+	match := func(contains string, limit int) []int64 {
+		events, err := QueryTimeseriesEventsMatching(db, "serial", "read", contains, base, base.Add(time.Minute), limit)
+		if err != nil {
+			t.Fatalf("QueryTimeseriesEventsMatching(%q) failed: %v", contains, err)
+		}
+		var ids []int64
+		for _, e := range events {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+	if got := fmt.Sprint(match("0xABCD", 0)); got != "[1 3 5]" {
+		t.Errorf("expected events 1, 3 and 5 to match 0xABCD, got %s", got)
+	}
+	if got := fmt.Sprint(match("0xABCD", 2)); got != "[1 3]" {
+		t.Errorf("expected the limit to keep the first two matches, got %s", got)
+	}
+	// Wildcards in the input match literally
+	if got := fmt.Sprint(match("50%", 0)); got != "[4]" {
+		t.Errorf("expected only the literal 50%% payload, got %s", got)
+	}
+	if got := fmt.Sprint(match("e_x", 0)); got != "[4]" {
+		t.Errorf("expected _ to match literally, got %s", got)
+	}
+	if got := match("0xFFFF", 0); len(got) != 0 {
+		t.Errorf("expected no matches, got %v", got)
+	}
+}
+
+func TestTimeseriesQueryFieldProjection(t *testing.T) {
+	db := useTestCaptureDB(t)
+	base := time.Now().UTC().Truncate(time.Second)
+	for i := 0; i < 2; i++ {
+		InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: base.Add(time.Duration(i) * time.Second), Source: "serial", Type: "read", Payload: fmt.Sprintf("payload-%d", i)})
+	}
+	mux := http.NewServeMux()
+	RegisterCaptureEndpoints(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	query := func(fields string) (int, []map[string]interface{}) {
+		resp, err := http.Get(ts.URL + "/timeseries/query?source=serial&type=read&fields=" + fields)
+		if err != nil {
+			t.Fatalf("query request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var events []map[string]interface{}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+				t.Fatalf("failed to decode events: %v", err)
+			}
+		}
+		return resp.StatusCode, events
+	}
+
+	code, events := query("timestamp,type")
+	if code != http.StatusOK || len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d (status %d)", len(events), code)
+	}
+	for _, e := range events {
+		if _, ok := e["payload"]; ok {
+			t.Errorf("expected no payload when not projected, got %v", e)
+		}
+		if e["type"] != "read" || e["timestamp"] == nil {
+			t.Errorf("expected projected timestamp and type, got %v", e)
+		}
+	}
+
+	_, events = query("type,payload")
+	if len(events) != 2 || events[0]["payload"] != "payload-0" || events[1]["payload"] != "payload-1" {
+		t.Errorf("expected payloads when projected, got %v", events)
+	}
+	if _, ok := events[0]["timestamp"]; ok {
+		t.Errorf("expected timestamp left out when not projected, got %v", events[0])
+	}
+
+	if code, _ := query("type,bogus"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown field, got %d", code)
+	}
+	if _, err := QueryTimeseriesEventFields(db, "serial", "read", base, base, []string{"bogus"}); !errors.Is(err, ErrUnknownField) {
+		t.Errorf("expected ErrUnknownField, got %v", err)
+	}
+}
+
+func TestTimeseriesEventStress(t *testing.T) {
+	const (
+		initialEPS      = 500 // events per second
+		maxDuration     = 2 * time.Second
+		stabilityTrials = 3
+	)
+	dbPath := "timeseries_stress_benchmark.db"
+	defer os.Remove(dbPath)
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`PRAGMA journal_mode=WAL;`)
+	if err != nil {
+		t.Fatalf("failed to enable WAL mode: %v", err)
+	}
+	if err := CreateTimeseriesTable(db); err != nil {
+		t.Fatalf("failed to create timeseries_event table: %v", err)
+	}
+
+	eps := initialEPS
+	var lastGoodEPS int
+	var stableEPS int
+	fineBackoffRatio := 0.95
+	var epsLog []struct {
+		EPS     int
+		Elapsed time.Duration
+		Errors  int
+	}
+	for {
+		fail := false
+		start := time.Now()
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		errs := 0
+		for i := 0; i < eps; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				event := TimeseriesEvent{
+					Timestamp: time.Now().UTC(),
+					Source:    "stress",
+					Type:      "test",
+					Payload:   fmt.Sprintf(`{"seq":%d,"data":"payload"}`, i),
+				}
+				_, err := InsertTimeseriesEvent(db, event)
+				if err != nil {
+					mu.Lock()
+					errs++
+					mu.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+		elapsed := time.Since(start)
+		epsLog = append(epsLog, struct {
+			EPS     int
 			Elapsed time.Duration
 			Errors  int
 		}{eps, elapsed, errs})
@@ -609,56 +1477,123 @@ func TestTimeseriesEventStress(t *testing.T) {
 	}
 }
 
-func TestSimulatedCaptureIntegration(t *testing.T) {
-	// Start a test HTTP server with the capture endpoints
+// captureHarness runs captures through the HTTP capture endpoints against a
+// file-backed DB the test can query directly
+type captureHarness struct {
+	t      *testing.T
+	db     *sql.DB
+	dir    string // capture log root
+	server *httptest.Server
+}
+
+func newCaptureHarness(t *testing.T) *captureHarness {
+	t.Helper()
+	h := &captureHarness{t: t, dir: t.TempDir()}
+	h.db = utils.InitDB(filepath.Join(t.TempDir(), "capture.db"))
+	prev := captureDB
 	mux := http.NewServeMux()
-	RegisterCaptureEndpoints(mux)
-	ts := httptest.NewServer(mux)
-	defer ts.Close()
+	if err := RegisterCaptureEndpointsWithDB(mux, h.db); err != nil {
+		t.Fatalf("failed to register capture endpoints: %v", err)
+	}
+	SetCaptureLogRoot(h.dir)
+	SetCaptureBufferDir(t.TempDir())
+	h.server = httptest.NewServer(mux)
+	t.Cleanup(func() {
+		h.server.Close()
+		SetCaptureLogRoot(".")
+		SetCaptureBufferDir("")
+		SetCaptureDB(prev)
+		h.db.Close()
+	})
+	return h
+}
 
-	logPath := "testdata/logs/dmr_cps_read_capture.log"
-	startURL := ts.URL + "/capture/start?log=" + logPath
-	statusURL := ts.URL + "/capture/status"
-	stopURL := ts.URL + "/capture/stop"
+// writeLog writes a log under the capture log root and returns its path
+func (h *captureHarness) writeLog(name string, data []byte) string {
+	h.t.Helper()
+	path := filepath.Join(h.dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		h.t.Fatalf("failed to write log: %v", err)
+	}
+	return path
+}
 
-	// Start capture
-	resp, err := http.Get(startURL)
+func (h *captureHarness) get(path string) []byte {
+	h.t.Helper()
+	resp, err := http.Get(h.server.URL + path)
 	if err != nil {
-		t.Fatalf("Failed to start capture: %v", err)
+		h.t.Fatalf("GET %s failed: %v", path, err)
 	}
-	resp.Body.Close()
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		h.t.Fatalf("GET %s: %d %s", path, resp.StatusCode, body)
+	}
+	return body
+}
 
-	// Monitor status until buffer is empty and ingestion is done
-	var lastStatus string
-	for i := 0; i < 100; i++ { // up to 10s
-		resp, err := http.Get(statusURL)
-		if err != nil {
-			t.Fatalf("Failed to get status: %v", err)
+// capture starts capturing logPath, waits until the whole log is read and
+// want events are ingested, then stops the capture and returns its status
+func (h *captureHarness) capture(logPath string, want int) CaptureStatus {
+	h.t.Helper()
+	h.get("/capture/start?log=" + url.QueryEscape(logPath))
+	var status CaptureStatus
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := json.Unmarshal(h.get("/capture/status.json"), &status); err != nil {
+			h.t.Fatalf("bad status: %v", err)
 		}
-		body, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		lastStatus = string(body)
-		if strings.Contains(lastStatus, "BufferLen: 0") && strings.Contains(lastStatus, "Ingesting: false") {
+		if status.SourceDone && status.BufferLen == 0 && status.Ingested >= want {
 			break
 		}
-		t.Logf("Status: %s", lastStatus)
-		time.Sleep(100 * time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+	}
+	h.get("/capture/stop")
+	if !status.SourceDone || status.Ingested != want {
+		h.t.Fatalf("expected %d events ingested from the whole log, got %+v", want, status)
+	}
+	return status
+}
+
+func TestSimulatedCaptureIntegration(t *testing.T) {
+	h := newCaptureHarness(t)
+	data, err := sampleLogs.ReadFile("testdata/logs/dmr_cps_read_capture.log")
+	if err != nil {
+		t.Fatal(err)
 	}
+	logPath := h.writeLog("dmr_cps_read_capture.log", data)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	h.capture(logPath, len(lines))
 
-	// Stop capture
-	resp, err = http.Get(stopURL)
+	start, end := time.Unix(0, 0), time.Now().Add(time.Hour)
+	if n, err := CountTimeseriesEvents(h.db, "capture", "stream", start, end); err != nil || n != len(lines) {
+		t.Fatalf("expected %d events stored, got %d (%v)", len(lines), n, err)
+	}
+	events, err := QueryTimeseriesEvents(h.db, "capture", "stream", start, end)
 	if err != nil {
-		t.Fatalf("Failed to stop capture: %v", err)
+		t.Fatalf("query failed: %v", err)
+	}
+	for i, e := range events {
+		if e.Payload != lines[i] || e.SessionID == "" {
+			t.Errorf("event %d: expected %q in a session, got %+v", i, lines[i], e)
+		}
+	}
+	if n, _ := CountTimeseriesEvents(h.db, "capture", "other", start, end); n != 0 {
+		t.Errorf("expected no events of another type, got %d", n)
 	}
-	resp.Body.Close()
 
-	t.Logf("Final status: %s", lastStatus)
+	// A second capture adds to the same DB
+	more := h.writeLog("more.log", []byte("1655141300.1 TX 01\n1655141300.2 RX 02\n"))
+	h.capture(more, 2)
+	if n, _ := CountTimeseriesEvents(h.db, "capture", "stream", start, end); n != len(lines)+2 {
+		t.Errorf("expected %d events after the second capture, got %d", len(lines)+2, n)
+	}
 }
 
 func TestSimulatedCaptureBufferStrategies(t *testing.T) {
 	logFiles := []string{
-		"testdata/logs/dmr_cps_read_capture.log",
-		"testdata/logs/dmr_cps_write_capture.log",
+		"dmr_cps_read_capture.log",
+		"dmr_cps_write_capture.log",
 	}
 	strategies := []struct {
 		name     string
@@ -669,7 +1604,7 @@ func TestSimulatedCaptureBufferStrategies(t *testing.T) {
 	}
 	for _, logFile := range logFiles {
 		for _, strat := range strategies {
-			t.Run(strat.name+"/"+filepath.Base(logFile), func(t *testing.T) {
+			t.Run(strat.name+"/"+logFile, func(t *testing.T) {
 				// Clean up buffer file before test
 				os.Remove("capture_buffer.dat")
 				mux := http.NewServeMux()
@@ -678,7 +1613,8 @@ func TestSimulatedCaptureBufferStrategies(t *testing.T) {
 				ts := httptest.NewServer(mux)
 				defer ts.Close()
 
-				startURL := ts.URL + "/capture/start?log=" + logFile
+				logPath := sampleLog(t, logFile)
+				startURL := ts.URL + "/capture/start?log=" + logPath
 				statusURL := ts.URL + "/capture/status"
 				stopURL := ts.URL + "/capture/stop"
 
@@ -697,7 +1633,7 @@ func TestSimulatedCaptureBufferStrategies(t *testing.T) {
 					body, _ := io.ReadAll(resp.Body)
 					resp.Body.Close()
 					lastStatus = string(body)
-					if strings.Contains(lastStatus, "BufferLen: 0") && strings.Contains(lastStatus, "Ingesting: false") {
+					if ingestedAll(t, lastStatus, logPath) {
 						break
 					}
 					t.Logf("Status: %s", lastStatus)
@@ -710,11 +1646,2830 @@ func TestSimulatedCaptureBufferStrategies(t *testing.T) {
 				}
 				resp.Body.Close()
 
-				t.Logf("Final status for %s/%s: %s", strat.name, filepath.Base(logFile), lastStatus)
+				t.Logf("Final status for %s/%s: %s", strat.name, logFile, lastStatus)
 			})
 		}
 	}
 }
 
-// Handler for recording a timeseries event (could be used in an HTTP API or CLI)
-// (Removed: use the implementation in handlers.go)
+func TestEmbeddedSampleLogCapture(t *testing.T) {
+	db := useTestCaptureDB(t)
+	logPath := sampleLog(t, "dmr_cps_read_capture.log")
+	mux := http.NewServeMux()
+	RegisterCaptureEndpoints(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/capture/start?log=" + logPath)
+	if err != nil {
+		t.Fatalf("Failed to start capture: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 starting from embedded sample, got %d", resp.StatusCode)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for captureManager.GetCaptureStatus().Ingested < 16 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	captureManager.StopSimulatedCapture()
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM timeseries_event`).Scan(&n); err != nil {
+		t.Fatalf("failed to count events: %v", err)
+	}
+	if n != 16 {
+		t.Errorf("expected 16 events from the sample log, got %d", n)
+	}
+}
+
+func TestFIFOBufferMigratesV1File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture_buffer.dat")
+	// Version 1 files are a bare stream of length-prefixed records
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create v1 buffer: %v", err)
+	}
+	for _, rec := range []string{"first", "second"} {
+		if err := writeLengthPrefixed(f, []byte(rec)); err != nil {
+			t.Fatalf("failed to write v1 record: %v", err)
+		}
+	}
+	f.Close()
+
+	buf, err := NewFIFOBuffer(path)
+	if err != nil {
+		t.Fatalf("failed to open v1 buffer: %v", err)
+	}
+	defer buf.Close()
+	if err := buf.Append([]byte("third")); err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	batch, err := buf.ReadBatch(10)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if len(batch) != 3 || string(batch[0]) != "first" || string(batch[2]) != "third" {
+		t.Fatalf("unexpected records after migration: %q", batch)
+	}
+	raw, _ := os.ReadFile(path)
+	if !strings.HasPrefix(string(raw), bufferMagic) {
+		t.Error("expected migrated file to start with the buffer header")
+	}
+}
+
+func TestFIFOBufferRejectsUnknownVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture_buffer.dat")
+	hdr := []byte(bufferMagic + "\x00\x00\x00\x63")
+	if err := os.WriteFile(path, hdr, 0644); err != nil {
+		t.Fatalf("failed to write buffer: %v", err)
+	}
+	if _, err := NewFIFOBuffer(path); !errors.Is(err, ErrUnsupportedBufferVersion) {
+		t.Fatalf("expected ErrUnsupportedBufferVersion, got %v", err)
+	}
+}
+
+func TestFIFOBufferSizeAfterRemoveBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture_buffer.dat")
+	buf, err := NewFIFOBuffer(path)
+	if err != nil {
+		t.Fatalf("failed to open buffer: %v", err)
+	}
+	defer buf.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if size := buf.SizeBytes(); size < bufferHeaderSize {
+				t.Errorf("size %d below the header size during compaction", size)
+				return
+			}
+		}
+	}()
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 5; i++ {
+			buf.Append([]byte(fmt.Sprintf("record-%d-%d", round, i)))
+		}
+		if err := buf.RemoveBatch(2); err != nil {
+			t.Fatalf("remove failed: %v", err)
+		}
+		fi, _ := os.Stat(path)
+		if got := buf.SizeBytes(); got != fi.Size() {
+			t.Fatalf("round %d: SizeBytes %d, file is %d bytes", round, got, fi.Size())
+		}
+	}
+	<-done
+
+	buf.RemoveBatch(1000)
+	if got := buf.SizeBytes(); got != bufferHeaderSize {
+		t.Errorf("expected only the header after draining, got %d bytes", got)
+	}
+}
+
+func TestFIFOBufferCompact(t *testing.T) {
+	dir := t.TempDir()
+	SetCaptureBufferDir(dir)
+	defer SetCaptureBufferDir("")
+	cm := NewCaptureManager("compact")
+	path := cm.bufferPath()
+	buf, err := NewFIFOBuffer(path)
+	if err != nil {
+		t.Fatalf("failed to open buffer: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		buf.Append([]byte(fmt.Sprintf("record-%03d", i)))
+	}
+	if err := buf.RemoveBatch(60); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	before, _ := os.Stat(path)
+	if err := buf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compaction of a stopped capture works on its buffer file
+	res, err := cm.CompactBuffer()
+	if err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Fatalf("expected compaction to shrink the buffer, %d -> %d bytes", before.Size(), after.Size())
+	}
+	if res.BytesReclaimed != before.Size()-after.Size() || res.SizeBytes != after.Size() {
+		t.Errorf("expected %d bytes reclaimed leaving %d, got %+v", before.Size()-after.Size(), after.Size(), res)
+	}
+	buf, err = NewFIFOBuffer(path)
+	if err != nil {
+		t.Fatalf("failed to reopen buffer: %v", err)
+	}
+	defer buf.Close()
+	batch, err := buf.ReadBatch(100)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if len(batch) != 40 || string(batch[0]) != "record-060" || string(batch[39]) != "record-099" {
+		t.Fatalf("expected the 40 pending records after compaction, got %d: %q", len(batch), batch)
+	}
+	if res, err := cm.CompactBuffer(); err != nil || res.BytesReclaimed != 0 {
+		t.Errorf("expected nothing left to reclaim, got %+v (%v)", res, err)
+	}
+}
+
+func TestFIFOBufferCompactDuringAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture_buffer.dat")
+	buf, err := NewFIFOBuffer(path)
+	if err != nil {
+		t.Fatalf("failed to open buffer: %v", err)
+	}
+	defer buf.Close()
+	const total = 500
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < total; i++ {
+			if err := buf.Append([]byte(fmt.Sprintf("record-%03d", i))); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// Records drained while compacting alongside the appends come out once
+	// each and in order
+	var got []string
+	appending := true
+	for appending || buf.Len() > 0 {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("append failed: %v", err)
+			}
+			appending = false
+		default:
+		}
+		batch, err := buf.ReadBatch(7)
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		for _, rec := range batch {
+			got = append(got, string(rec))
+		}
+		if err := buf.RemoveBatch(len(batch)); err != nil {
+			t.Fatalf("remove failed: %v", err)
+		}
+		if err := buf.Compact(); err != nil {
+			t.Fatalf("compact failed: %v", err)
+		}
+	}
+	if len(got) != total {
+		t.Fatalf("expected %d records, got %d", total, len(got))
+	}
+	for i, rec := range got {
+		if want := fmt.Sprintf("record-%03d", i); rec != want {
+			t.Fatalf("record %d: expected %q, got %q", i, want, rec)
+		}
+	}
+}
+
+func TestFIFOBufferRemoveBatchSeeksPastRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture_buffer.dat")
+	buf, err := NewFIFOBuffer(path)
+	if err != nil {
+		t.Fatalf("failed to open buffer: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		buf.Append([]byte(fmt.Sprintf("record-%d", i)))
+	}
+	full := buf.SizeBytes()
+	batch, _ := buf.ReadBatch(3)
+	if err := buf.RemoveBatch(len(batch)); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if err := buf.RemoveBatch(2); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if fi, _ := os.Stat(path); fi.Size() != full {
+		t.Errorf("expected removal to leave the file at %d bytes, got %d", full, fi.Size())
+	}
+	batch, _ = buf.ReadBatch(1)
+	if len(batch) != 1 || string(batch[0]) != "record-5" {
+		t.Fatalf("expected the next read to resume at record-5, got %q", batch)
+	}
+	buf.Close()
+
+	// The head survives a reopen
+	buf, err = NewFIFOBuffer(path)
+	if err != nil {
+		t.Fatalf("failed to reopen buffer: %v", err)
+	}
+	defer buf.Close()
+	if n := buf.Len(); n != 5 {
+		t.Errorf("expected 5 pending records after reopening, got %d", n)
+	}
+	// Crossing the threshold compacts
+	buf.SetCompactThreshold(20)
+	if err := buf.RemoveBatch(2); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	batch, _ = buf.ReadBatch(10)
+	if fi, _ := os.Stat(path); fi.Size() >= full || len(batch) != 3 || string(batch[0]) != "record-7" {
+		t.Errorf("expected a compacted file holding record-7 on, got %d bytes and %q", fi.Size(), batch)
+	}
+	if _, err := os.Stat(bufferHeadPath(path)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no head file once the head is back at the header, got %v", err)
+	}
+}
+
+// BenchmarkFIFOBufferDrain drains a few hundred thousand records in
+// ingest-sized batches, rewriting the file on every removal (threshold 1, as
+// removeBatchFromDisk used to) and seeking past removed records (the
+// default threshold)
+func BenchmarkFIFOBufferDrain(b *testing.B) {
+	const records, batchSize = 200000, 256
+	for _, c := range []struct {
+		name      string
+		threshold int64
+	}{{"rewrite", 1}, {"offset", DefaultBufferCompactThreshold}} {
+		b.Run(c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				buf, err := NewFIFOBuffer(filepath.Join(b.TempDir(), "capture_buffer.dat"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				buf.SetCompactThreshold(c.threshold)
+				for j := 0; j < records; j++ {
+					buf.Append([]byte(fmt.Sprintf("read(3, \"frame %06d\", 16) = 16", j)))
+				}
+				b.StartTimer()
+				for {
+					batch, err := buf.ReadBatch(batchSize)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if len(batch) == 0 {
+						break
+					}
+					if err := buf.RemoveBatch(len(batch)); err != nil {
+						b.Fatal(err)
+					}
+				}
+				buf.Close()
+			}
+		})
+	}
+}
+
+// writeTestLog writes a capture log fixture and returns its path
+func writeTestLog(t *testing.T, lines []string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "capture.log")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write log fixture: %v", err)
+	}
+	return path
+}
+
+// useTestCaptureDB points the capture pipeline at a fresh file-backed DB
+func useTestCaptureDB(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "capture.db"))
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	if err := CreateTimeseriesTable(db); err != nil {
+		t.Fatalf("failed to create timeseries_event table: %v", err)
+	}
+	prev := captureDB
+	SetCaptureDB(db)
+	t.Cleanup(func() {
+		SetCaptureDB(prev)
+		db.Close()
+		os.Remove("capture_buffer.dat")
+	})
+	return db
+}
+
+// runCapture runs a capture of logPath until want events are ingested, then stops it
+func runCapture(t *testing.T, logPath string, want int) CaptureStatus {
+	t.Helper()
+	if err := captureManager.StartSimulatedCapture(logPath); err != nil {
+		t.Fatalf("failed to start capture: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for captureManager.GetCaptureStatus().Ingested < want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	captureManager.StopSimulatedCapture()
+	status := captureManager.GetCaptureStatus()
+	if status.Ingested != want {
+		t.Fatalf("expected %d ingested events, got %d (last error: %s)", want, status.Ingested, status.LastError)
+	}
+	return status
+}
+
+// BenchmarkCaptureReadBufferSize ingests a large log at several source read
+// buffer sizes; compare the events/s metric
+func BenchmarkCaptureReadBufferSize(b *testing.B) {
+	db := useTestCaptureDB(b)
+	SetCaptureBufferDir(b.TempDir())
+	defer SetCaptureBufferDir("")
+	const lines = 100000
+	var log bytes.Buffer
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&log, "read(3, \"serial frame %06d\", 64) = 64\n", i)
+	}
+	logPath := filepath.Join(b.TempDir(), "large.log")
+	if err := os.WriteFile(logPath, log.Bytes(), 0644); err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []int{4 << 10, 64 << 10, DefaultCaptureReadBufferSize, 4 << 20} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			cm := NewCaptureManager("bench")
+			cm.ingestDB = db
+			cm.SetSpeedMultiplier(0)
+			if err := cm.SetReadBufferSize(size); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(log.Len()))
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				if err := cm.StartSimulatedCapture(logPath); err != nil {
+					b.Fatal(err)
+				}
+				for cm.GetCaptureStatus().Ingested < lines {
+					time.Sleep(time.Millisecond)
+				}
+				cm.StopSimulatedCapture()
+			}
+			b.ReportMetric(float64(lines*b.N)/time.Since(start).Seconds(), "events/s")
+		})
+	}
+}
+
+func TestCaptureSessionHistory(t *testing.T) {
+	db := useTestCaptureDB(t)
+	first := runCapture(t, writeTestLog(t, []string{"a", "b", "c"}), 3)
+	second := runCapture(t, writeTestLog(t, []string{"d", "e"}), 2)
+	if first.SessionID == "" || first.SessionID == second.SessionID {
+		t.Fatalf("expected distinct session ids, got %q and %q", first.SessionID, second.SessionID)
+	}
+
+	sessions, err := ListCaptureSessions(db, CaptureSessionFilter{})
+	if err != nil {
+		t.Fatalf("ListCaptureSessions failed: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+	// Newest first
+	if sessions[0].SessionID != second.SessionID || sessions[0].Ingested != 2 {
+		t.Errorf("unexpected newest session: %+v", sessions[0])
+	}
+	if sessions[1].SessionID != first.SessionID || sessions[1].Ingested != 3 {
+		t.Errorf("unexpected oldest session: %+v", sessions[1])
+	}
+	for _, s := range sessions {
+		if s.Status != CaptureSessionCompleted || s.EndedAt == nil {
+			t.Errorf("expected completed session with end time, got %+v", s)
+		}
+	}
+
+	page, err := ListCaptureSessions(db, CaptureSessionFilter{Limit: 1, Offset: 1})
+	if err != nil || len(page) != 1 || page[0].SessionID != first.SessionID {
+		t.Errorf("unexpected second page: %+v (err %v)", page, err)
+	}
+
+	mux := http.NewServeMux()
+	RegisterCaptureEndpoints(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/capture/history?limit=1")
+	if err != nil {
+		t.Fatalf("history request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var listed []CaptureSession
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		t.Fatalf("failed to decode history: %v", err)
+	}
+	if len(listed) != 1 || listed[0].SessionID != second.SessionID {
+		t.Errorf("unexpected history response: %+v", listed)
+	}
+
+	// since and until bound the start time
+	history := func(query string) (int, []CaptureSession) {
+		resp, err := http.Get(ts.URL + "/capture/history?" + query)
+		if err != nil {
+			t.Fatalf("history request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var listed []CaptureSession
+		if resp.StatusCode == http.StatusOK {
+			json.NewDecoder(resp.Body).Decode(&listed)
+		}
+		return resp.StatusCode, listed
+	}
+	at := func(s CaptureSession) string { return url.QueryEscape(s.StartedAt.Format(time.RFC3339Nano)) }
+	if code, got := history("since=" + at(sessions[0])); code != http.StatusOK || len(got) != 1 || got[0].SessionID != second.SessionID {
+		t.Errorf("expected only the second session since it started, got %d %+v", code, got)
+	}
+	if code, got := history("until=" + at(sessions[1])); code != http.StatusOK || len(got) != 1 || got[0].SessionID != first.SessionID {
+		t.Errorf("expected only the first session until it started, got %d %+v", code, got)
+	}
+	for _, query := range []string{"since=yesterday", "until=2025-06-13"} {
+		if code, _ := history(query); code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", query, code)
+		}
+	}
+}
+
+func TestQueryBySession(t *testing.T) {
+	db := useTestCaptureDB(t)
+	first := runCapture(t, writeTestLog(t, []string{"a", "b", "c"}), 3)
+	second := runCapture(t, writeTestLog(t, []string{"d", "e"}), 2)
+
+	events, err := QueryBySession(db, first.SessionID, 0)
+	if err != nil {
+		t.Fatalf("QueryBySession failed: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events for first session, got %d", len(events))
+	}
+	for i, want := range []string{"a", "b", "c"} {
+		if events[i].Payload != want || events[i].SessionID != first.SessionID {
+			t.Errorf("unexpected event %d: %+v", i, events[i])
+		}
+	}
+
+	limited, err := QueryBySession(db, second.SessionID, 1)
+	if err != nil || len(limited) != 1 || limited[0].Payload != "d" {
+		t.Errorf("unexpected limited result: %+v (err %v)", limited, err)
+	}
+
+	none, err := QueryBySession(db, "no-such-session", 0)
+	if err != nil || len(none) != 0 {
+		t.Errorf("expected no events for unknown session, got %+v (err %v)", none, err)
+	}
+}
+
+func TestCaptureIntoScratchDBAndMerge(t *testing.T) {
+	mainDB := useTestCaptureDB(t)
+	if _, err := RecordTimeseriesEvent(mainDB, "live", "event", "existing"); err != nil {
+		t.Fatalf("failed to insert live event: %v", err)
+	}
+	scratch, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "scratch.db"))
+	if err != nil {
+		t.Fatalf("failed to open scratch db: %v", err)
+	}
+	defer scratch.Close()
+	if err := CreateTimeseriesTable(scratch); err != nil {
+		t.Fatalf("failed to create scratch table: %v", err)
+	}
+	SetCaptureIngestDB(scratch)
+	defer SetCaptureIngestDB(nil)
+
+	runCapture(t, writeTestLog(t, []string{"one", "two", "three"}), 3)
+	var liveCount int
+	mainDB.QueryRow("SELECT COUNT(*) FROM timeseries_event").Scan(&liveCount)
+	if liveCount != 1 {
+		t.Fatalf("expected capture to bypass the live DB, found %d rows", liveCount)
+	}
+
+	merged, err := MergeTimeseriesDBs(mainDB, scratch)
+	if err != nil {
+		t.Fatalf("MergeTimeseriesDBs failed: %v", err)
+	}
+	if merged != 3 {
+		t.Fatalf("expected 3 merged rows, got %d", merged)
+	}
+	rows, err := mainDB.Query("SELECT id, payload FROM timeseries_event ORDER BY id")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer rows.Close()
+	ids := map[int64]bool{}
+	var payloads []string
+	for rows.Next() {
+		var id int64
+		var payload string
+		rows.Scan(&id, &payload)
+		ids[id] = true
+		payloads = append(payloads, payload)
+	}
+	if len(ids) != 4 || strings.Join(payloads, ",") != "existing,one,two,three" {
+		t.Errorf("unexpected merged rows: ids=%v payloads=%v", ids, payloads)
+	}
+}
+
+func TestMergeTimeseriesDBsReadsEveryTable(t *testing.T) {
+	open := func(name string) *sql.DB {
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), name))
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", name, err)
+		}
+		t.Cleanup(func() { CloseTimeseriesDB(db) })
+		if err := CreateTimeseriesTable(db); err != nil {
+			t.Fatalf("failed to create timeseries_event table: %v", err)
+		}
+		return db
+	}
+	// A scratch DB with a source ingested into its typed table
+	typed := open("typed.db")
+	if err := SetIngestTarget("serial", SerialTarget); err != nil {
+		t.Fatal(err)
+	}
+	defer SetIngestTarget("serial", GenericTarget)
+	RecordTimeseriesEvent(typed, "serial", "read", "0a 0b")
+	RecordTimeseriesEvent(typed, "strace", "read", "shared")
+	// And a partitioned one
+	partitioned := open("partitioned.db")
+	SetTimeseriesPartitioning(partitioned, true)
+	RecordTimeseriesEvent(partitioned, "bench", "read", "partitioned-0")
+	RecordTimeseriesEvent(partitioned, "bench", "read", "partitioned-1")
+
+	dst := open("main.db")
+	for name, src := range map[string]*sql.DB{"typed": typed, "partitioned": partitioned} {
+		if merged, err := MergeTimeseriesDBs(dst, src); err != nil || merged != 2 {
+			t.Errorf("%s: expected 2 merged rows, got %d (%v)", name, merged, err)
+		}
+	}
+	counts, err := CountTimeseriesEventsBySource(dst, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err != nil || counts["serial"] != 1 || counts["strace"] != 1 || counts["bench"] != 2 {
+		t.Errorf("expected every scratch event in the merged DB, got %v (err %v)", counts, err)
+	}
+}
+
+func TestMergeTimeseriesOrdered(t *testing.T) {
+	open := func(name string) *sql.DB {
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), name))
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", name, err)
+		}
+		t.Cleanup(func() { db.Close() })
+		if err := CreateTimeseriesTable(db); err != nil {
+			t.Fatalf("failed to create timeseries_event table: %v", err)
+		}
+		return db
+	}
+	base := time.Date(2025, 6, 13, 17, 0, 0, 0, time.UTC)
+	insert := func(db *sql.DB, source string, seconds ...int) {
+		for _, sec := range seconds {
+			e := TimeseriesEvent{Timestamp: base.Add(time.Duration(sec) * time.Second), Source: source, Type: "read", Payload: fmt.Sprintf("%s@%d", source, sec)}
+			if _, err := InsertTimeseriesEvent(db, e); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Interleaved captures from two machines, one logged out of order, with
+	// a tie at 6s
+	a, b := open("a.db"), open("b.db")
+	insert(a, "bench-a", 0, 2, 4, 6, 8)
+	insert(b, "bench-b", 5, 1, 3, 6, 9)
+	// Rows stored at other offsets and in partition and typed tables
+	raw := func(db *sql.DB, table, ts, payload string) {
+		if err := createTimeseriesTableNamed(db, table); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(insertEventSQL(table), ts, "raw", "read", payload, nil, false, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw(a, timeseriesBaseTable, "2025-06-13T18:00:03.5+01:00", "bench-a@3.5")
+	raw(a, partitionTable("bench-a"), "2025-06-13T19:00:07+02:00", "bench-a@7")
+	raw(b, "serial_event", "2025-06-13 17:00:10", "bench-b@10")
+	dst := open("merged.db")
+	insert(dst, "existing", 100)
+
+	merged, err := MergeTimeseriesOrdered(dst, []*sql.DB{a, b, open("empty.db")})
+	if err != nil || merged != 13 {
+		t.Fatalf("expected 13 merged rows, got %d (%v)", merged, err)
+	}
+	rows, err := dst.Query("SELECT payload FROM timeseries_event WHERE source != 'existing' ORDER BY id")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer rows.Close()
+	var payloads []string
+	for rows.Next() {
+		var payload string
+		rows.Scan(&payload)
+		payloads = append(payloads, payload)
+	}
+	want := "bench-a@0,bench-b@1,bench-a@2,bench-b@3,bench-a@3.5,bench-a@4,bench-b@5,bench-a@6,bench-b@6,bench-a@7,bench-a@8,bench-b@9,bench-b@10"
+	if got := strings.Join(payloads, ","); got != want {
+		t.Errorf("expected ids in time order %s, got %s", want, got)
+	}
+	events, err := QueryTimeseriesEvents(dst, "bench-b", "read", base, base.Add(time.Minute))
+	if err != nil || len(events) != 5 || !events[0].Timestamp.Equal(base.Add(time.Second)) {
+		t.Errorf("expected bench-b's events queryable with their timestamps, got %+v (%v)", events, err)
+	}
+}
+
+func TestCaptureBytesIngested(t *testing.T) {
+	useTestCaptureDB(t)
+	lines := []string{"a", strings.Repeat("b", 10), strings.Repeat("c", 100)}
+	status := runCapture(t, writeTestLog(t, lines), len(lines))
+	if status.BytesIngested != 111 {
+		t.Errorf("expected 111 bytes ingested, got %d", status.BytesIngested)
+	}
+	if status.IngestRateBps <= 0 {
+		t.Errorf("expected a positive byte rate, got %f", status.IngestRateBps)
+	}
+
+	// A second run with payloads ten times larger accumulates ten times the bytes
+	var big []string
+	for _, l := range lines {
+		big = append(big, strings.Repeat(l, 10))
+	}
+	status = runCapture(t, writeTestLog(t, big), len(big))
+	if status.BytesIngested != 1110 {
+		t.Errorf("expected 1110 bytes ingested, got %d", status.BytesIngested)
+	}
+}
+
+func TestCaptureRedaction(t *testing.T) {
+	db := useTestCaptureDB(t)
+	key := "deadbeefcafebabe0123456789abcdef"
+	SetCaptureRedactions([]RedactionRule{
+		{Pattern: regexp.MustCompile(`key=[0-9a-f]{32}`), Replacement: "key=[REDACTED]"},
+	})
+	defer SetCaptureRedactions(nil)
+
+	status := runCapture(t, writeTestLog(t, []string{
+		"open(\"/dev/ttyUSB0\") key=" + key,
+		"write(3, \"no secrets here\")",
+		"auth key=" + key + " retry key=" + key,
+	}), 3)
+	if status.Redactions != 3 {
+		t.Errorf("expected 3 redactions, got %d", status.Redactions)
+	}
+
+	var leaked, redacted int
+	if err := db.QueryRow("SELECT COUNT(*) FROM timeseries_event WHERE payload LIKE ?", "%"+key+"%").Scan(&leaked); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if leaked != 0 {
+		t.Errorf("raw key reached the DB in %d rows", leaked)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM timeseries_event WHERE payload LIKE '%key=[REDACTED]%'").Scan(&redacted); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if redacted != 2 {
+		t.Errorf("expected 2 redacted rows, got %d", redacted)
+	}
+}
+
+func TestBackupDownload(t *testing.T) {
+	dir := t.TempDir()
+	db := utils.InitDB(filepath.Join(dir, "dewey.db"))
+	defer db.Close()
+	utils.CreateTables(db)
+	CreateManufacturer(db, "Motorola")
+
+	backupPath := filepath.Join(dir, "backup.db")
+	if _, err := utils.FullBackup(filepath.Join(dir, "dewey.db"), backupPath); err != nil {
+		t.Fatalf("FullBackup failed: %v", err)
+	}
+	meta := models.BackupMetadata{BackupType: "full", Timestamp: time.Now().UTC().Format(time.RFC3339), FilePath: backupPath, Status: "completed"}
+	id, err := RecordBackup(db, &meta)
+	if err != nil {
+		t.Fatalf("RecordBackup failed: %v", err)
+	}
+	got, err := GetBackup(db, int(id))
+	if err != nil || got.FilePath != backupPath || got.Checksum == "" {
+		t.Fatalf("unexpected backup metadata: %+v (err %v)", got, err)
+	}
+
+	download := func(id int) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ServeBackupDownload(w, httptest.NewRequest("GET", fmt.Sprintf("/backups/%d/download", id), nil), db, id)
+		return w
+	}
+	w := download(int(id))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	want, _ := os.ReadFile(backupPath)
+	if !bytes.Equal(w.Body.Bytes(), want) {
+		t.Error("downloaded content does not match the backup file")
+	}
+	if w.Header().Get("X-Checksum-Sha256") != got.Checksum {
+		t.Errorf("expected checksum header %s, got %s", got.Checksum, w.Header().Get("X-Checksum-Sha256"))
+	}
+
+	if w := download(int(id) + 100); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown id, got %d", w.Code)
+	}
+	os.WriteFile(backupPath, []byte("tampered"), 0644)
+	if w := download(int(id)); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected checksum mismatch to be refused, got %d", w.Code)
+	}
+	os.Remove(backupPath)
+	if w := download(int(id)); w.Code != http.StatusGone {
+		t.Errorf("expected 410 for missing file, got %d", w.Code)
+	}
+}
+
+func TestArchiveBackupsRecordsMetadata(t *testing.T) {
+	dir := t.TempDir()
+	db := utils.InitDB(filepath.Join(dir, "dewey.db"))
+	defer db.Close()
+	utils.CreateTables(db)
+	root := filepath.Join(dir, "backups")
+	old := time.Now().AddDate(-1, 0, 0)
+	mkday := func(day time.Time) {
+		d := filepath.Join(root, day.Format("2006/01/02"), "full")
+		os.MkdirAll(d, 0755)
+		os.WriteFile(filepath.Join(d, "backup_120000.db"), []byte(day.String()), 0644)
+	}
+	mkday(time.Date(old.Year(), old.Month(), 1, 0, 0, 0, 0, time.Local))
+	mkday(time.Now())
+
+	archived, err := ArchiveBackups(db, root, 30*24*time.Hour, filepath.Join(dir, "archive"))
+	if err != nil || len(archived) != 1 || archived[0].BackupType != "archive" {
+		t.Fatalf("expected one recorded archive, got %+v (err %v)", archived, err)
+	}
+	first := archived[0]
+
+	// Archiving more of the same month updates its row
+	mkday(time.Date(old.Year(), old.Month(), 2, 0, 0, 0, 0, time.Local))
+	archived, err = ArchiveBackups(db, root, 30*24*time.Hour, filepath.Join(dir, "archive"))
+	if err != nil || len(archived) != 1 {
+		t.Fatalf("expected one recorded archive, got %+v (err %v)", archived, err)
+	}
+	got, err := GetBackup(db, first.ID)
+	if err != nil || got.ID != archived[0].ID || got.Checksum == first.Checksum {
+		t.Errorf("expected the archive row to be updated in place, got %+v (err %v)", got, err)
+	}
+	if sum, _ := utils.FileChecksum(got.FilePath); sum != got.Checksum {
+		t.Errorf("recorded checksum %s does not match the archive (%s)", got.Checksum, sum)
+	}
+}
+
+func TestTimeseriesPartitioning(t *testing.T) {
+	dir := t.TempDir()
+	db := utils.InitDB(filepath.Join(dir, "partitioned.db"))
+	if err := CreateTimeseriesTable(db); err != nil {
+		t.Fatalf("failed to create timeseries table: %v", err)
+	}
+	// A row written before partitioning was enabled must stay queryable
+	RecordTimeseriesEvent(db, "serial", "read", "legacy")
+	SetTimeseriesPartitioning(db, true)
+	// Partitioning is set per database
+	other := utils.InitDB(filepath.Join(dir, "shared.db"))
+	defer other.Close()
+	if err := CreateTimeseriesTable(other); err != nil {
+		t.Fatalf("failed to create timeseries table: %v", err)
+	}
+	RecordTimeseriesEvent(other, "strace", "read", "shared")
+	if partitions, err := TimeseriesPartitions(other); err != nil || len(partitions) != 0 {
+		t.Errorf("expected no partitions in the other database, got %v (err %v)", partitions, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		RecordTimeseriesEvent(db, "strace", "read", fmt.Sprintf("strace-%d", i))
+	}
+	RecordTimeseriesEvent(db, "serial", "read", "serial-0")
+
+	partitions, err := TimeseriesPartitions(db)
+	if err != nil {
+		t.Fatalf("TimeseriesPartitions failed: %v", err)
+	}
+	if want := partitionTable("serial") + "," + partitionTable("strace"); strings.Join(partitions, ",") != want {
+		t.Fatalf("expected partitions %s, got %v", want, partitions)
+	}
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM "` + partitionTable("strace") + `"`).Scan(&n)
+	if n != 3 {
+		t.Errorf("expected 3 rows in strace partition, got %d", n)
+	}
+	if a, b := partitionTable("a-b"), partitionTable("a_b"); a == b {
+		t.Errorf("expected sources sanitized alike to get separate partitions, both got %s", a)
+	}
+	// SQLite capabilities are cached with the rest of the database's state
+	requireSQLiteFeature(db, "json1")
+	if timeseriesState(db).caps.Load() == nil {
+		t.Error("expected the capabilities cached in the timeseries state")
+	}
+	defer func() {
+		if err := CloseTimeseriesDB(db); err != nil {
+			t.Error(err)
+		}
+		if _, ok := timeseriesDBs.Load(db); ok {
+			t.Error("expected closing the database to drop its partitioning state and capabilities")
+		}
+	}()
+
+	start, end := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	strace, err := QueryTimeseriesEvents(db, "strace", "read", start, end)
+	if err != nil || len(strace) != 3 {
+		t.Fatalf("expected 3 strace events, got %d (err %v)", len(strace), err)
+	}
+	serial, err := QueryTimeseriesEvents(db, "serial", "read", start, end)
+	if err != nil || len(serial) != 2 {
+		t.Fatalf("expected 2 serial events including the legacy row, got %d (err %v)", len(serial), err)
+	}
+	all, err := QueryTimeseriesEventsAllSources(db, "read", start, end)
+	if err != nil || len(all) != 5 {
+		t.Fatalf("expected 5 events across partitions, got %d (err %v)", len(all), err)
+	}
+	counts, err := CountTimeseriesEventsBySource(db, start, end)
+	if err != nil || counts["strace"] != 3 || counts["serial"] != 2 {
+		t.Errorf("unexpected counts by source: %v (err %v)", counts, err)
+	}
+}
+
+func TestCaptureRefusedWhenDiskLow(t *testing.T) {
+	useTestCaptureDB(t)
+	prevFree, prevMin := utils.DiskFree, utils.MinFreeDiskBytes
+	defer func() { utils.DiskFree, utils.MinFreeDiskBytes = prevFree, prevMin }()
+	utils.MinFreeDiskBytes = 1
+	utils.DiskFree = func(string) (uint64, error) { return 8, nil }
+
+	err := captureManager.StartSimulatedCapture(writeTestLog(t, []string{"a line longer than the free space"}))
+	if !errors.Is(err, utils.ErrInsufficientDiskSpace) {
+		captureManager.StopSimulatedCapture()
+		t.Fatalf("expected ErrInsufficientDiskSpace, got %v", err)
+	}
+	if captureManager.GetCaptureStatus().Ingesting {
+		t.Error("capture should not be running after a refused start")
+	}
+}
+
+func TestReprocessEvents(t *testing.T) {
+	db := utils.InitDB(filepath.Join(t.TempDir(), "reprocess.db"))
+	defer db.Close()
+	if err := CreateTimeseriesTable(db); err != nil {
+		t.Fatalf("failed to create timeseries table: %v", err)
+	}
+	raw := []string{`read(3, "abc", 3) = 3`, `write(4, "xy", 2) = 2`, `garbage`}
+	for _, line := range raw {
+		RecordTimeseriesEvent(db, "capture", "stream", line)
+	}
+	RecordTimeseriesEvent(db, "serial", "stream", `read(5, "zz", 2) = 2`)
+
+	parse := func(e TimeseriesEvent) ([]TimeseriesEvent, error) {
+		i := strings.IndexByte(e.Payload, '(')
+		if i <= 0 {
+			return nil, nil // not a syscall line; nothing to derive
+		}
+		return []TimeseriesEvent{{Source: "strace", Type: e.Payload[:i], Payload: e.Payload[i:]}}, nil
+	}
+	start, end := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	n, err := ReprocessEvents(db, "capture", parse, start, end)
+	if err != nil {
+		t.Fatalf("ReprocessEvents failed: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 derived events, got %d", n)
+	}
+	reads, _ := QueryTimeseriesEvents(db, "strace", "read", start, end)
+	writes, _ := QueryTimeseriesEvents(db, "strace", "write", start, end)
+	if len(reads) != 1 || len(writes) != 1 || reads[0].Payload != `(3, "abc", 3) = 3` {
+		t.Fatalf("unexpected derived events: reads=%+v writes=%+v", reads, writes)
+	}
+	originals, _ := QueryTimeseriesEvents(db, "capture", "stream", start, end)
+	if len(originals) != len(raw) {
+		t.Errorf("expected originals to be left intact, got %d", len(originals))
+	}
+
+	// A transform error must leave nothing behind
+	fail := func(TimeseriesEvent) ([]TimeseriesEvent, error) {
+		return []TimeseriesEvent{{Source: "strace", Type: "partial"}}, errors.New("parser bug")
+	}
+	if _, err := ReprocessEvents(db, "capture", fail, start, end); err == nil {
+		t.Fatal("expected transform error to be returned")
+	}
+	if partial, _ := QueryTimeseriesEvents(db, "strace", "partial", start, end); len(partial) != 0 {
+		t.Errorf("expected failed reprocess to be rolled back, found %d rows", len(partial))
+	}
+}
+
+func TestCaptureStatusBufferLenCountsDisk(t *testing.T) {
+	buf, err := NewFIFOBuffer(filepath.Join(t.TempDir(), "status_buffer.dat"))
+	if err != nil {
+		t.Fatalf("failed to create buffer: %v", err)
+	}
+	cm := &CaptureManager{bufferImpl: buf}
+	defer buf.Close()
+	for i := 0; i < 1500; i++ {
+		buf.Append([]byte(fmt.Sprintf("record %d", i)))
+	}
+	status := cm.GetCaptureStatus()
+	if status.BufferLen != 1500 || status.MemBufferLen != 0 {
+		t.Fatalf("expected 1500 pending on disk and none in memory, got BufferLen=%d MemBufferLen=%d", status.BufferLen, status.MemBufferLen)
+	}
+	if err := buf.RemoveBatch(500); err != nil {
+		t.Fatalf("RemoveBatch failed: %v", err)
+	}
+	if got := cm.GetCaptureStatus().BufferLen; got != 1000 {
+		t.Errorf("expected 1000 pending after removing a batch, got %d", got)
+	}
+}
+
+// plainHasher is a fast, insecure PasswordHasher for tests
+type plainHasher struct{}
+
+func (plainHasher) Hash(password string) (string, error) { return "plain:" + password, nil }
+func (plainHasher) Compare(password, hash string) bool   { return hash == "plain:"+password }
+
+func TestStubPasswordHasher(t *testing.T) {
+	createUsers := func(n int) time.Duration {
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "users.db"))
+		if err != nil {
+			t.Fatalf("failed to open db: %v", err)
+		}
+		defer db.Close()
+		utils.CreateTables(db)
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if _, err := CreateUser(db, fmt.Sprintf("user%d", i), "secret", 1); err != nil {
+				t.Fatalf("CreateUser failed: %v", err)
+			}
+		}
+		if _, err := AuthenticateUserDetailed(db, "user0", "secret"); err != nil {
+			t.Fatalf("authentication failed: %v", err)
+		}
+		if _, err := AuthenticateUserDetailed(db, "user0", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+		}
+		return time.Since(start)
+	}
+
+	bcryptTime := createUsers(5)
+	SetPasswordHasher(plainHasher{})
+	defer SetPasswordHasher(nil)
+	stubTime := createUsers(5)
+	if stubTime*5 > bcryptTime {
+		t.Errorf("expected stub hasher to be markedly faster: stub %v, bcrypt %v", stubTime, bcryptTime)
+	}
+}
+
+func TestListActiveCaptures(t *testing.T) {
+	useTestCaptureDB(t)
+	a, b := NewCaptureManager("list_a"), NewCaptureManager("list_b")
+	defer os.Remove(a.bufferPath())
+	defer os.Remove(b.bufferPath())
+	logA := writeTestLog(t, []string{"a1", "a2"})
+	logB := writeTestLog(t, []string{"b1", "b2", "b3"})
+	if err := a.StartSimulatedCapture(logA); err != nil {
+		t.Fatalf("failed to start capture a: %v", err)
+	}
+	defer a.StopSimulatedCapture()
+	if err := b.StartSimulatedCapture(logB); err != nil {
+		t.Fatalf("failed to start capture b: %v", err)
+	}
+	defer b.StopSimulatedCapture()
+	if a.bufferPath() == b.bufferPath() {
+		t.Fatalf("captures share buffer file %s", a.bufferPath())
+	}
+
+	w := httptest.NewRecorder()
+	CaptureListHandler(w, httptest.NewRequest("GET", "/capture/list", nil))
+	var listed []CaptureStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("failed to decode listing: %v", err)
+	}
+	if len(listed) != 2 || listed[0].ID != "list_a" || listed[1].ID != "list_b" {
+		t.Fatalf("expected captures list_a and list_b, got %+v", listed)
+	}
+	if listed[0].Source != logA || listed[1].Source != logB || !listed[0].Ingesting {
+		t.Errorf("unexpected capture details: %+v", listed)
+	}
+
+	a.StopSimulatedCapture()
+	if remaining := ListActiveCaptures(); len(remaining) != 1 || remaining[0].ID != "list_b" {
+		t.Errorf("expected only list_b after stopping list_a, got %+v", remaining)
+	}
+}
+
+func TestCaptureStatusJSON(t *testing.T) {
+	useTestCaptureDB(t)
+	cm, _ := CaptureManagerFor("status_json")
+	defer os.Remove(cm.bufferPath())
+	if err := cm.StartSimulatedCapture(writeTestLog(t, []string{"a", "b"})); err != nil {
+		t.Fatalf("failed to start capture: %v", err)
+	}
+	defer cm.StopSimulatedCapture()
+	mux := http.NewServeMux()
+	RegisterCaptureEndpoints(mux)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/capture/status.json?id=status_json", nil),
+		httptest.NewRequest("GET", "/capture/status?id=status_json", nil),
+	} {
+		if req.URL.Path == "/capture/status" {
+			req.Header.Set("Accept", "text/html, application/json;q=0.9")
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("%s: expected JSON, got %q: %s", req.URL.Path, ct, w.Body.String())
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+			t.Fatalf("%s: failed to decode status: %v", req.URL.Path, err)
+		}
+		if ingesting, ok := fields["ingesting"].(bool); !ok || !ingesting {
+			t.Errorf("%s: expected ingesting to be the bool true, got %#v", req.URL.Path, fields["ingesting"])
+		}
+		for _, key := range []string{"ingest_rate_eps", "error_count", "buffer_len", "lifetime_ingested"} {
+			if _, ok := fields[key].(float64); !ok {
+				t.Errorf("%s: expected numeric %s, got %#v", req.URL.Path, key, fields[key])
+			}
+		}
+		var status CaptureStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || status.ID != "status_json" || !status.Ingesting {
+			t.Errorf("%s: expected to decode the capture's status, got %+v (%v)", req.URL.Path, status, err)
+		}
+	}
+
+	// Plain text stays the default
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/capture/status?id=status_json", nil))
+	if !strings.Contains(w.Body.String(), "Ingesting: true") {
+		t.Errorf("expected the plaintext status, got %q", w.Body.String())
+	}
+}
+
+func TestCaptureWallClockReplay(t *testing.T) {
+	useTestCaptureDB(t)
+	cm, _ := CaptureManagerFor("wall_clock")
+	defer os.Remove(cm.bufferPath())
+	offsets := []time.Duration{0, 150 * time.Millisecond, 400 * time.Millisecond}
+	logPath := writeTestLog(t, []string{
+		"1700000000.000000 read(3) = 1",
+		"1700000000.150000 read(3) = 2",
+		"1700000000.400000 read(3) = 3",
+	})
+	start := time.Now().Add(200 * time.Millisecond)
+	on := true
+	cfg := CaptureConfig{LogPath: logPath, WallClock: &on, WallClockReplay: WallClockReplay{Start: start}}
+	if err := cm.StartCapture(cfg); err != nil {
+		t.Fatalf("failed to start capture: %v", err)
+	}
+	defer cm.StopSimulatedCapture()
+	var ingestedAt []time.Time
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ingestedAt) < len(offsets) && time.Now().Before(deadline) {
+		for n := cm.GetCaptureStatus().Ingested; len(ingestedAt) < n; {
+			ingestedAt = append(ingestedAt, time.Now())
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if len(ingestedAt) != len(offsets) {
+		t.Fatalf("expected %d ingested events, got %d", len(offsets), len(ingestedAt))
+	}
+	for i, at := range ingestedAt {
+		due := start.Add(offsets[i])
+		if at.Before(due) || at.Sub(due) > 150*time.Millisecond {
+			t.Errorf("event %d: scheduled at +%s, ingested at +%s", i, offsets[i], at.Sub(start))
+		}
+	}
+}
+
+func TestWallClockScheduleClampsWaits(t *testing.T) {
+	now := time.Date(2025, 6, 13, 9, 0, 0, 0, time.UTC)
+	logged := time.Date(2024, 1, 2, 17, 30, 0, 0, time.UTC)
+	if got := ShiftToToday(logged, now); !got.Equal(time.Date(2025, 6, 13, 17, 30, 0, 0, time.UTC)) {
+		t.Errorf("expected 17:30 today, got %s", got)
+	}
+
+	// By default the first record waits for its time of day, clamped
+	s := &wallClockSchedule{replay: WallClockReplay{MaxWait: time.Minute}}
+	if wait := s.wait(logged, now); wait != time.Minute {
+		t.Errorf("expected the first wait clamped to 1m, got %s", wait)
+	}
+	// The clamp moves the schedule, so later records keep their offsets
+	if wait := s.wait(logged.Add(10*time.Second), now.Add(time.Minute)); wait != 10*time.Second {
+		t.Errorf("expected a 10s wait after the clamp, got %s", wait)
+	}
+	// Records already due are read at once
+	if wait := s.wait(logged.Add(5*time.Second), now.Add(2*time.Minute)); wait != 0 {
+		t.Errorf("expected no wait for a past-due record, got %s", wait)
+	}
+}
+
+// failingBuffer is a FIFOBuffer whose nth Append fails when fail(n) says so
+type failingBuffer struct {
+	*FIFOBuffer
+	mu      sync.Mutex
+	appends int
+	fail    func(n int) bool
+}
+
+func (b *failingBuffer) Append(data []byte) error {
+	b.mu.Lock()
+	b.appends++
+	n := b.appends
+	b.mu.Unlock()
+	if b.fail(n) {
+		return errors.New("write capture buffer: no space left on device")
+	}
+	return b.FIFOBuffer.Append(data)
+}
+
+func TestCaptureDiskFullDropsAreCounted(t *testing.T) {
+	db := useTestCaptureDB(t)
+	prev := newCaptureBuffer
+	defer func() { newCaptureBuffer = prev }()
+	var fail func(n int) bool
+	newCaptureBuffer = func(strategy BufferStrategy, path string) (CaptureBuffer, error) {
+		fifo, err := NewFIFOBuffer(path)
+		if err != nil {
+			return nil, err
+		}
+		return &failingBuffer{FIFOBuffer: fifo, fail: fail}, nil
+	}
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	logPath := writeTestLog(t, lines)
+
+	for _, tc := range []struct {
+		policy            DiskFullPolicy
+		fail              func(n int) bool
+		ingested, dropped int
+	}{
+		// Writes 3 to 5 fail: their records are dropped, the rest ingested
+		{DiskFullDrop, func(n int) bool { return n >= 3 && n <= 5 }, 7, 3},
+		// The first 3 attempts fail: the capture waits and loses nothing
+		{DiskFullPause, func(n int) bool { return n <= 3 }, 10, 0},
+	} {
+		db.Exec("DELETE FROM timeseries_event")
+		fail = tc.fail
+		cm, _ := CaptureManagerFor("disk_full_" + string(tc.policy))
+		os.Remove(cm.bufferPath())
+		defer os.Remove(cm.bufferPath())
+		policy := tc.policy
+		if err := cm.StartCapture(CaptureConfig{LogPath: logPath, DiskFull: &policy}); err != nil {
+			t.Fatalf("%s: failed to start capture: %v", tc.policy, err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if s := cm.GetCaptureStatus(); s.SourceDone && s.BufferLen == 0 && s.Ingested+s.Dropped >= len(lines) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cm.StopSimulatedCapture()
+		status := cm.GetCaptureStatus()
+		if status.Ingested != tc.ingested || status.Dropped != tc.dropped {
+			t.Errorf("%s: expected %d ingested and %d dropped, got %d and %d", tc.policy, tc.ingested, tc.dropped, status.Ingested, status.Dropped)
+		}
+		if !strings.Contains(status.LastError, "no space left") || status.DiskFull || status.Paused {
+			t.Errorf("%s: expected the failure reported and recovered from, got %+v", tc.policy, status)
+		}
+		var stored int
+		db.QueryRow("SELECT COUNT(*) FROM timeseries_event").Scan(&stored)
+		if stored != tc.ingested {
+			t.Errorf("%s: expected %d stored events, got %d", tc.policy, tc.ingested, stored)
+		}
+	}
+}
+
+func TestCaptureStartStopHammer(t *testing.T) {
+	useTestCaptureDB(t)
+	cm := NewCaptureManager("hammer")
+	defer os.Remove(cm.bufferPath())
+	lines := make([]string, 200)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i)
+	}
+	logPath := writeTestLog(t, lines)
+	baseline := runtime.NumGoroutine()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				err := cm.StartSimulatedCapture(logPath)
+				if err != nil && !errors.Is(err, ErrCaptureRunning) && !errors.Is(err, ErrCaptureStopping) {
+					t.Errorf("unexpected start error: %v", err)
+					return
+				}
+				cm.StopSimulatedCapture()
+				cm.StopSimulatedCapture()
+			}
+		}()
+	}
+	wg.Wait()
+	cm.StopSimulatedCapture()
+
+	status := cm.GetCaptureStatus()
+	if status.Ingesting {
+		t.Errorf("expected the capture to be stopped, got %+v", status)
+	}
+	// A clean stop leaves the manager startable
+	if err := cm.StartSimulatedCapture(logPath); err != nil {
+		t.Fatalf("failed to restart after the hammering: %v", err)
+	}
+	if err := cm.StartSimulatedCapture(logPath); !errors.Is(err, ErrCaptureRunning) {
+		t.Errorf("expected ErrCaptureRunning for a second start, got %v", err)
+	}
+	cm.StopSimulatedCapture()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Errorf("expected capture goroutines to exit, %d running against %d before", n, baseline)
+	}
+}
+
+func TestConcurrentNamedCaptures(t *testing.T) {
+	db := useTestCaptureDB(t)
+	readLog := sampleLog(t, "dmr_cps_read_capture.log")
+	writeLog := sampleLog(t, "dmr_cps_write_capture.log")
+	SetCaptureLogRoot("/")
+	t.Cleanup(func() { SetCaptureLogRoot(".") })
+	mux := http.NewServeMux()
+	RegisterCaptureEndpoints(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	get := func(path string) (int, string) {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	for id, logPath := range map[string]string{"cps_read": readLog, "cps_write": writeLog} {
+		defer os.Remove(NewCaptureManager(id).bufferPath())
+		defer StopSimulatedCapture(id)
+		if code, body := get("/capture/start?id=" + id + "&log=" + logPath); code != http.StatusOK {
+			t.Fatalf("failed to start capture %s: %d %s", id, code, body)
+		}
+	}
+	if code, _ := get("/capture/start?id=cps_read&log=" + readLog); code != http.StatusConflict {
+		t.Errorf("expected a second start of cps_read to conflict, got %d", code)
+	}
+	if err := StartSimulatedCapture("../escape", readLog); !errors.Is(err, ErrInvalidCaptureID) {
+		t.Errorf("expected ErrInvalidCaptureID, got %v", err)
+	}
+	if code, _ := get("/capture/status?id=../escape"); code != http.StatusBadRequest {
+		t.Errorf("expected an invalid id to be rejected, got %d", code)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	var readStatus, writeStatus string
+	for time.Now().Before(deadline) {
+		_, readStatus = get("/capture/status?id=cps_read")
+		_, writeStatus = get("/capture/status?id=cps_write")
+		if ingestedAll(t, readStatus, readLog) && ingestedAll(t, writeStatus, writeLog) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !ingestedAll(t, readStatus, readLog) || !ingestedAll(t, writeStatus, writeLog) {
+		t.Fatalf("captures did not ingest independently:\n%s\n%s", readStatus, writeStatus)
+	}
+	if a, b := GetCaptureStatus("cps_read"), GetCaptureStatus("cps_write"); a.Source != readLog || b.Source != writeLog {
+		t.Errorf("unexpected capture sources %q and %q", a.Source, b.Source)
+	}
+	if status := GetCaptureStatus(""); status.ID != "default" || status.Ingesting {
+		t.Errorf("expected the idle default capture, got %+v", status)
+	}
+
+	get("/capture/stop?id=cps_read")
+	if read, write := GetCaptureStatus("cps_read"), GetCaptureStatus("cps_write"); !read.Stopped || write.Stopped {
+		t.Errorf("expected only cps_read to stop, got stopped %v and %v", read.Stopped, write.Stopped)
+	}
+	// A stopped capture keeps its final status until its manager is evicted
+	if _, body := get("/capture/status?id=cps_read"); !ingestedAll(t, body, readLog) {
+		t.Errorf("expected the final status of cps_read after stop, got %s", body)
+	}
+	prevTTL := captureManagerTTL
+	captureManagerTTL = 0
+	defer func() { captureManagerTTL = prevTTL }()
+	if lookupCaptureManager("cps_read") != nil || lookupCaptureManager("cps_write") == nil {
+		t.Errorf("expected only the stopped capture's manager to be evicted")
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM timeseries_event").Scan(&n)
+	if n != 28 {
+		t.Errorf("expected 28 events from both logs, got %d", n)
+	}
+}
+
+func TestRemoveUsersByFilter(t *testing.T) {
+	db := utils.InitDB(":memory:")
+	defer db.Close()
+	utils.CreateTables(db)
+	for _, u := range []struct {
+		name string
+		role int
+	}{{"root", 1}, {"alice", 3}, {"bob", 3}, {"carol", 2}} {
+		CreateUser(db, u.name, "pass", u.role)
+	}
+	RevokeUser(db, "root")
+	RevokeUser(db, "alice")
+	RevokeUser(db, "carol")
+
+	if _, err := RemoveUsersByFilter(db, UserFilter{IncludeAdmins: true}); !errors.Is(err, ErrEmptyUserFilter) {
+		t.Errorf("expected ErrEmptyUserFilter, got %v", err)
+	}
+	n, err := RemoveUsersByFilter(db, UserFilter{Revoked: true, Actor: "admin"})
+	if err != nil {
+		t.Fatalf("RemoveUsersByFilter failed: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 revoked non-admins removed, got %d", n)
+	}
+	deleted := func(name string) bool {
+		var at sql.NullString
+		db.QueryRow("SELECT deleted_at FROM user WHERE username = ?", name).Scan(&at)
+		return at.Valid
+	}
+	for name, want := range map[string]bool{"root": false, "alice": true, "bob": false, "carol": true} {
+		if deleted(name) != want {
+			t.Errorf("%s: expected deleted %v", name, want)
+		}
+	}
+	if _, err := AuthenticateUserDetailed(db, "alice", "pass"); !errors.Is(err, ErrUserRevoked) {
+		t.Errorf("expected a removed user to be refused, got %v", err)
+	}
+	entries, _ := ListAuditEntries(db, time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+	if len(entries) != 1 || entries[0].Actor != "admin" || entries[0].Action != "remove_users" || entries[0].Detail != "2 users (revoked): alice, carol" {
+		t.Errorf("expected one audit entry for the batch, got %+v", entries)
+	}
+
+	// Already removed users don't match again, and no-op batches aren't audited
+	if n, err := RemoveUsersByFilter(db, UserFilter{Revoked: true}); n != 0 || err != nil {
+		t.Errorf("expected nothing left to remove, got %d (%v)", n, err)
+	}
+	if entries, _ := ListAuditEntries(db, time.Now().Add(-time.Minute), time.Now().Add(time.Minute)); len(entries) != 1 {
+		t.Errorf("expected no audit entry for an empty batch, got %d entries", len(entries))
+	}
+	if n, _ := RemoveUsersByFilter(db, UserFilter{Revoked: true, IncludeAdmins: true}); n != 1 || !deleted("root") {
+		t.Errorf("expected the admin removed once included, got %d", n)
+	}
+	UpdateLastLogin(db, "bob")
+	if n, _ := RemoveUsersByFilter(db, UserFilter{InactiveSince: time.Now().Add(-time.Hour)}); n != 0 {
+		t.Errorf("expected a recently active user to be kept, got %d removed", n)
+	}
+}
+
+func TestComplianceReport(t *testing.T) {
+	db := utils.InitDB(filepath.Join(t.TempDir(), "compliance.db"))
+	defer db.Close()
+	utils.CreateTables(db)
+	if _, err := GenerateComplianceReport(db, time.Now(), time.Now()); !errors.Is(err, ErrNoReportKey) {
+		t.Fatalf("expected ErrNoReportKey, got %v", err)
+	}
+	SetReportSigningKey([]byte("test-key"))
+	defer SetReportSigningKey(nil)
+
+	RecordAudit(db, "admin", "lock_user", "bob")
+	RecordAudit(db, "admin", "backup", "full")
+	now := time.Now().UTC()
+	db.Exec("INSERT INTO backup_metadata (backup_type, timestamp, file_path, size, duration, status, checksum) VALUES ('full', ?, 'b1.db', 10, 5, 'completed', 'abc')", now.Format(time.RFC3339))
+	db.Exec("INSERT INTO backup_metadata (backup_type, timestamp, file_path, size, duration, status, checksum) VALUES ('full', ?, 'old.db', 10, 5, 'completed', 'def')", now.AddDate(0, -1, 0).Format(time.RFC3339))
+
+	report, err := GenerateComplianceReport(db, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("GenerateComplianceReport failed: %v", err)
+	}
+	if len(report.AuditEntries) != 2 || len(report.Backups) != 1 || report.Backups[0].FilePath != "b1.db" {
+		t.Fatalf("unexpected report contents: %+v", report)
+	}
+	if err := VerifyReport(report); err != nil {
+		t.Fatalf("expected fresh report to verify: %v", err)
+	}
+
+	// The signature must survive a round trip through its serialized form
+	data, _ := json.Marshal(report)
+	var decoded Report
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to decode report: %v", err)
+	}
+	if err := VerifyReport(decoded); err != nil {
+		t.Errorf("expected decoded report to verify: %v", err)
+	}
+
+	decoded.Backups[0].Checksum = "forged"
+	if err := VerifyReport(decoded); !errors.Is(err, ErrReportSignatureInvalid) {
+		t.Errorf("expected tampering to be detected, got %v", err)
+	}
+	SetReportSigningKey([]byte("other-key"))
+	if err := VerifyReport(report); !errors.Is(err, ErrReportSignatureInvalid) {
+		t.Errorf("expected a different key to fail verification, got %v", err)
+	}
+}
+
+func TestCaptureLabels(t *testing.T) {
+	db := useTestCaptureDB(t)
+	SetCaptureLabels(map[string]string{"session": "cps-read-42", "ticket": "OPS-7"})
+	runCapture(t, writeTestLog(t, []string{"one", "two"}), 2)
+	SetCaptureLabels(nil)
+	runCapture(t, writeTestLog(t, []string{"unlabelled"}), 1)
+	InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: time.Now().UTC(), Source: "serial", Type: "read", Payload: "x",
+		Labels: map[string]string{"session": "other"}})
+
+	events, err := QueryByLabel(db, "session", "cps-read-42")
+	if err != nil {
+		t.Fatalf("QueryByLabel failed: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 labelled events, got %d", len(events))
+	}
+	for _, e := range events {
+		if e.Labels["ticket"] != "OPS-7" || e.Source != "capture" {
+			t.Errorf("unexpected labelled event: %+v", e)
+		}
+	}
+	if other, _ := QueryByLabel(db, "session", "other"); len(other) != 1 || other[0].Source != "serial" {
+		t.Errorf("expected 1 event labelled session=other, got %+v", other)
+	}
+	if none, _ := QueryByLabel(db, "missing", "x"); len(none) != 0 {
+		t.Errorf("expected no events for an unknown label, got %d", len(none))
+	}
+}
+
+func TestCreateTimeseriesTableAddsLabels(t *testing.T) {
+	db := utils.InitDB(filepath.Join(t.TempDir(), "legacy.db"))
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE timeseries_event (id INTEGER PRIMARY KEY AUTOINCREMENT, timestamp DATETIME NOT NULL, source TEXT NOT NULL, type TEXT NOT NULL, payload TEXT NOT NULL)`); err != nil {
+		t.Fatalf("failed to create legacy table: %v", err)
+	}
+	if err := CreateTimeseriesTable(db); err != nil {
+		t.Fatalf("CreateTimeseriesTable failed on a legacy table: %v", err)
+	}
+	if _, err := InsertTimeseriesEvent(db, TimeseriesEvent{Source: "s", Type: "t", Labels: map[string]string{"k": "v"}}); err != nil {
+		t.Fatalf("insert with labels failed after upgrade: %v", err)
+	}
+}
+
+func TestCapturePrefixParser(t *testing.T) {
+	db := useTestCaptureDB(t)
+	SetCapturePrefixParser(&LinePrefixParser{Sources: []string{"serial", "strace"}, DefaultType: "raw"})
+	defer SetCapturePrefixParser(nil)
+	runCapture(t, writeTestLog(t, []string{
+		"serial read 0a 0b 0c",
+		"strace write(3, \"x\", 1) = 1",
+		"usb read not a configured source",
+		"1655141234.5 open(\"/dev/ttyUSB0\")",
+		"serial open",
+	}), 5)
+
+	rows, err := db.Query("SELECT source, type, payload FROM timeseries_event ORDER BY id")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var source, eventType, payload string
+		rows.Scan(&source, &eventType, &payload)
+		got = append(got, source+"|"+eventType+"|"+payload)
+	}
+	want := []string{
+		"serial|read|0a 0b 0c",
+		"capture|raw|strace write(3, \"x\", 1) = 1", // not a well-formed type token
+		"capture|raw|usb read not a configured source",
+		"capture|raw|1655141234.5 open(\"/dev/ttyUSB0\")",
+		"serial|open|",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected parsed events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCapturePreservesLineTimestamps(t *testing.T) {
+	db := useTestCaptureDB(t)
+	logPath := sampleLog(t, "dmr_cps_write_capture.log")
+	data, _ := os.ReadFile(logPath)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	untimed := writeTestLog(t, []string{"no timestamp here", "12abc TX 01"})
+	before := time.Now().UTC()
+	runCapture(t, logPath, len(lines))
+
+	events, err := QueryTimeseriesEvents(db, "capture", "stream", time.Unix(0, 0), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if len(events) != len(lines) {
+		t.Fatalf("expected %d events, got %d", len(lines), len(events))
+	}
+	for i, e := range events {
+		// The sample logs have microsecond timestamps
+		sec, frac, _ := strings.Cut(strings.Fields(lines[i])[0], ".")
+		n, _ := strconv.ParseInt(sec, 10, 64)
+		us, _ := strconv.ParseInt(frac, 10, 64)
+		want := time.Unix(n, us*1000).UTC()
+		if !e.Timestamp.Equal(want) || e.Payload != lines[i] {
+			t.Errorf("event %d: expected %s at %s, got %q at %s", i, lines[i], want, e.Payload, e.Timestamp)
+		}
+	}
+
+	// Lines without a well-formed timestamp fall back to the ingest time
+	runCapture(t, untimed, 2)
+	events, _ = QueryTimeseriesEvents(db, "capture", "stream", before, time.Now().Add(time.Second))
+	if len(events) != 2 || events[0].Payload != "no timestamp here" || events[1].Payload != "12abc TX 01" {
+		t.Errorf("expected the untimed lines stamped at ingest, got %+v", events)
+	}
+
+	for _, tc := range []struct {
+		line string
+		want time.Time
+		ok   bool
+	}{
+		{"1655141300.1 TX", time.Unix(1655141300, 100000000), true},
+		{"1655141300\tRX", time.Unix(1655141300, 0), true},
+		{"1655141300.123456789999 TX", time.Unix(1655141300, 123456789), true},
+		{"1e9 TX", time.Time{}, false},
+		{".5 TX", time.Time{}, false},
+		{"1655141300", time.Time{}, false},
+	} {
+		got, ok := parseLineTimestamp([]byte(tc.line))
+		if ok != tc.ok || !got.Equal(tc.want) {
+			t.Errorf("parseLineTimestamp(%q) = %s, %v; want %s, %v", tc.line, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestCaptureClassifiesStraceSyscalls(t *testing.T) {
+	db := useTestCaptureDB(t)
+	lines := []string{
+		`read(3, "\x01\x02", 2) = 2`,
+		`[pid 1234] write(4, "PROGRAM", 7) = 7`,
+		`12:00:01.500 openat(AT_FDCWD, "/dev/ttyUSB0", O_RDWR) = 5`,
+		`<... read resumed>"ok", 2) = 2`,
+		`+++ exited with 0 +++`,
+	}
+	runCapture(t, writeTestLog(t, lines), len(lines))
+	events, err := QueryEventsWithRaw(db, "capture", time.Unix(0, 0), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	want := []string{"read", "write", "openat", "read", "stream"}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %d", len(want), len(events))
+	}
+	for i, e := range events {
+		if e.Type != want[i] || e.Payload != lines[i] {
+			t.Errorf("event %d: expected %s %q, got %s %q", i, want[i], lines[i], e.Type, e.Payload)
+		}
+	}
+
+	// pid and timestamp prefixes are skipped
+	for _, line := range []string{"1234 ioctl(3, TCGETS, {...}) = 0", "[pid 7] 1655141300.250000 ioctl(3, TCGETS) = 0"} {
+		if got := StraceSyscallType(line); got != "ioctl" {
+			t.Errorf("expected ioctl for %q, got %q", line, got)
+		}
+	}
+
+	// Serial traffic isn't strace output and stays "stream"
+	logPath := sampleLog(t, "dmr_cps_read_capture.log")
+	data, _ := os.ReadFile(logPath)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if got := StraceSyscallType(line); got != "" {
+			t.Errorf("expected %q unclassified, got %q", line, got)
+		}
+	}
+
+	// A custom classifier replaces the strace one; nil types every line "stream"
+	SetCaptureClassifier(func(line string) string {
+		if strings.HasPrefix(line, "write(") {
+			return "tx"
+		}
+		return ""
+	})
+	t.Cleanup(func() { SetCaptureClassifier(StraceSyscallType) })
+	before := time.Now().UTC()
+	runCapture(t, writeTestLog(t, []string{`write(4, "A", 1) = 1`, `read(3, "B", 1) = 1`}), 2)
+	events, _ = QueryEventsWithRaw(db, "capture", before, time.Now().Add(time.Second))
+	if len(events) != 2 || events[0].Type != "tx" || events[1].Type != "stream" {
+		t.Errorf("expected tx and stream from the custom classifier, got %+v", events)
+	}
+	SetCaptureClassifier(nil)
+	before = time.Now().UTC()
+	runCapture(t, writeTestLog(t, []string{`openat(AT_FDCWD, "x", O_RDONLY) = 3`}), 1)
+	events, _ = QueryEventsWithRaw(db, "capture", before, time.Now().Add(time.Second))
+	if len(events) != 1 || events[0].Type != "stream" {
+		t.Errorf("expected stream without a classifier, got %+v", events)
+	}
+}
+
+func TestCaptureSpeedMultiplier(t *testing.T) {
+	useTestCaptureDB(t)
+	// Ten 200ms gaps take 2s at real speed, and a 200s gap is past the 10s
+	// cap even at 10x
+	var lines []string
+	for i := 0; i <= 10; i++ {
+		lines = append(lines, fmt.Sprintf("%d.%06d TX %02x", 1655141300+i/5, i%5*200000, i))
+	}
+	lines = append(lines, "1655141502.000000 TX ff")
+	logPath := writeTestLog(t, lines)
+	t.Cleanup(func() { captureManager.SetSpeedMultiplier(1) })
+
+	captureManager.SetSpeedMultiplier(10)
+	start := time.Now()
+	runCapture(t, logPath, len(lines))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected a 10x replay well under 2s, took %s", elapsed)
+	} else if elapsed < 150*time.Millisecond {
+		t.Errorf("expected a 10x replay to still be paced, took %s", elapsed)
+	}
+
+	captureManager.SetSpeedMultiplier(0)
+	start = time.Now()
+	runCapture(t, logPath, len(lines))
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected no pacing at speed 0, took %s", elapsed)
+	}
+}
+
+func TestImportTimeseriesStreamBoundedMemory(t *testing.T) {
+	db := useTestCaptureDB(t)
+	const total = 200000
+	pr, pw := io.Pipe()
+	go func() {
+		base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		payload := strings.Repeat("ab", 50)
+		w := bufio.NewWriter(pw)
+		for i := 0; i < total; i++ {
+			if i%10000 == 0 {
+				fmt.Fprintln(w, `{"timestamp": "not a time", "source": "serial", "type": "read"}`)
+				fmt.Fprintln(w, `{broken json`)
+			}
+			fmt.Fprintf(w, `{"timestamp":%q,"source":"serial","type":"read","payload":"%s-%d"}`+"\n",
+				base.Add(time.Duration(i)*time.Millisecond).Format(time.RFC3339Nano), payload, i)
+		}
+		w.Flush()
+		pw.Close()
+	}()
+
+	runtime.GC()
+	var before, ms runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var peak uint64
+	skips := 0
+	n, err := ImportTimeseriesStreamWithOptions(db, pr, "ndjson", ImportOptions{
+		BatchSize: 2000,
+		Progress: func(imported, skipped int) {
+			runtime.ReadMemStats(&ms)
+			if ms.HeapAlloc > peak {
+				peak = ms.HeapAlloc
+			}
+		},
+		OnSkip: func(record int, err error) { skips++ },
+	})
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if n != total || skips != 2*total/10000 {
+		t.Errorf("expected %d imported and %d skipped, got %d and %d", total, 2*total/10000, n, skips)
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM timeseries_event").Scan(&count)
+	if count != total {
+		t.Errorf("expected %d rows, got %d", total, count)
+	}
+	// The stream is ~30MB; the importer should only ever hold one batch
+	if peak > before.HeapAlloc && peak-before.HeapAlloc > 16<<20 {
+		t.Errorf("heap grew by %d bytes during import", peak-before.HeapAlloc)
+	}
+}
+
+func TestImportTimeseriesStreamCSV(t *testing.T) {
+	db := useTestCaptureDB(t)
+	input := "timestamp,source,type,payload,labels\n" +
+		"2024-01-01T00:00:00Z,serial,read,\"0a,0b\",\"{\"\"session\"\":\"\"s1\"\"}\"\n" +
+		"2024-01-01T00:00:01Z,,read,missing source,\n" +
+		"yesterday,serial,read,bad time,\n" +
+		"2024-01-01T00:00:02Z,serial,write,0c,\n"
+	var skipped []int
+	n, err := ImportTimeseriesStreamWithOptions(db, strings.NewReader(input), "csv", ImportOptions{
+		OnSkip: func(record int, err error) { skipped = append(skipped, record) },
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 imported, got %d (%v)", n, err)
+	}
+	if fmt.Sprint(skipped) != "[2 3]" {
+		t.Errorf("expected records 2 and 3 to be skipped, got %v", skipped)
+	}
+	events, _ := QueryByLabel(db, "session", "s1")
+	if len(events) != 1 || events[0].Payload != "0a,0b" {
+		t.Errorf("expected the labelled CSV row to round-trip, got %+v", events)
+	}
+	if _, err := ImportTimeseriesStream(db, strings.NewReader("source,type\n"), "csv"); err == nil {
+		t.Error("expected an error for a CSV header without required columns")
+	}
+	if _, err := ImportTimeseriesStream(db, strings.NewReader(""), "xml"); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
+
+func TestBulkImportRestoresDurability(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "bulk.db")+"?_journal_mode=WAL")
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	// One connection, so the bulk import's connection is the one checked after
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("PRAGMA synchronous = FULL;"); err != nil {
+		t.Fatalf("failed to set synchronous: %v", err)
+	}
+	if err := CreateTimeseriesTable(db); err != nil {
+		t.Fatalf("failed to create timeseries_event table: %v", err)
+	}
+	synchronous := func() int {
+		var v int
+		if err := db.QueryRow("PRAGMA synchronous;").Scan(&v); err != nil {
+			t.Fatalf("failed to read synchronous: %v", err)
+		}
+		return v
+	}
+
+	var input strings.Builder
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(&input, `{"timestamp":"2024-01-01T00:00:0%dZ","source":"bulk","type":"read","payload":"p%d"}`+"\n", i, i)
+	}
+	n, err := ImportTimeseriesStreamWithOptions(db, strings.NewReader(input.String()), "ndjson", ImportOptions{BatchSize: 2, Bulk: true})
+	if err != nil || n != 5 {
+		t.Fatalf("expected 5 imported, got %d (%v)", n, err)
+	}
+	if v := synchronous(); v != 2 {
+		t.Errorf("expected synchronous restored to FULL (2), got %d", v)
+	}
+
+	// A failing stream still restores the setting
+	failing := io.MultiReader(strings.NewReader(input.String()), iotest.ErrReader(errors.New("stream broke")))
+	if _, err := ImportTimeseriesStreamWithOptions(db, failing, "ndjson", ImportOptions{Bulk: true}); err == nil {
+		t.Fatal("expected the stream error to be returned")
+	}
+	if v := synchronous(); v != 2 {
+		t.Errorf("expected synchronous restored to FULL (2) after an error, got %d", v)
+	}
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM timeseries_event").Scan(&total); err != nil || total != 10 {
+		t.Errorf("expected 10 events after both imports, got %d (%v)", total, err)
+	}
+}
+
+func TestResumeCaptureFromCheckpoint(t *testing.T) {
+	db := useTestCaptureDB(t)
+	var lines []string
+	for i := 0; i < 40; i++ {
+		lines = append(lines, fmt.Sprintf("%d.%02d line-%02d", 1000+i/20, (i%20)*5, i))
+	}
+	logPath := writeTestLog(t, lines)
+
+	// Replay is paced by the timestamps (50ms apart); stop part way through
+	if err := captureManager.StartSimulatedCapture(logPath); err != nil {
+		t.Fatalf("failed to start capture: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for captureManager.GetCaptureStatus().Ingested < 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	captureManager.StopSimulatedCapture()
+	first := captureManager.GetCaptureStatus().Ingested
+	if first == 0 || first >= len(lines) {
+		t.Fatalf("expected the first run to stop mid-replay, ingested %d", first)
+	}
+	offset, err := CaptureCheckpoint(db, logPath)
+	if err != nil || offset == 0 {
+		t.Fatalf("expected a checkpoint after the first run, got %d (%v)", offset, err)
+	}
+
+	if err := captureManager.ResumeSimulatedCapture(logPath); err != nil {
+		t.Fatalf("failed to resume capture: %v", err)
+	}
+	deadline = time.Now().Add(10 * time.Second)
+	for captureManager.GetCaptureStatus().Ingested < len(lines)-first && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	captureManager.StopSimulatedCapture()
+
+	rows, err := db.Query("SELECT payload FROM timeseries_event ORDER BY id")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var payload string
+		rows.Scan(&payload)
+		got = append(got, payload)
+	}
+	if strings.Join(got, "\n") != strings.Join(lines, "\n") {
+		t.Errorf("expected each line exactly once across both runs, got %d events:\n%s", len(got), strings.Join(got, "\n"))
+	}
+	if offset, _ := CaptureCheckpoint(db, logPath); offset != int64(len(strings.Join(lines, "\n"))+1) {
+		t.Errorf("expected the checkpoint at the end of the log, got %d", offset)
+	}
+}
+
+func TestCaptureSequenceAcrossResume(t *testing.T) {
+	db := useTestCaptureDB(t)
+	var lines []string
+	for i := 0; i < 30; i++ {
+		lines = append(lines, fmt.Sprintf("%d.%02d line-%02d", 1000+i/20, (i%20)*5, i))
+	}
+	logPath := writeTestLog(t, lines)
+
+	if err := captureManager.StartCapture(CaptureConfig{LogPath: logPath, FirstSeq: 100}); err != nil {
+		t.Fatalf("failed to start capture: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for captureManager.GetCaptureStatus().Ingested < 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	captureManager.StopSimulatedCapture()
+	first := captureManager.GetCaptureStatus().Ingested
+	if first == 0 || first >= len(lines) {
+		t.Fatalf("expected the first run to stop mid-replay, ingested %d", first)
+	}
+
+	if err := captureManager.ResumeSimulatedCapture(logPath); err != nil {
+		t.Fatalf("failed to resume capture: %v", err)
+	}
+	deadline = time.Now().Add(10 * time.Second)
+	for captureManager.GetCaptureStatus().Ingested < len(lines)-first && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	captureManager.StopSimulatedCapture()
+
+	rows, err := db.Query("SELECT seq FROM timeseries_event ORDER BY id")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer rows.Close()
+	var got []int64
+	for rows.Next() {
+		var seq int64
+		rows.Scan(&seq)
+		got = append(got, seq)
+	}
+	if len(got) != len(lines) {
+		t.Fatalf("expected %d events, got %d", len(lines), len(got))
+	}
+	for i, seq := range got {
+		if seq != int64(100+i) {
+			t.Fatalf("expected gap-free sequences from 100, event %d has seq %d", i, seq)
+		}
+	}
+}
+
+func TestCaptureStartValidation(t *testing.T) {
+	useTestCaptureDB(t)
+	root := t.TempDir()
+	SetCaptureLogRoot(root)
+	defer SetCaptureLogRoot(".")
+	os.WriteFile(filepath.Join(root, "ok.log"), []byte("a\n"), 0644)
+	outside := writeTestLog(t, []string{"secret"})
+	os.Symlink(outside, filepath.Join(root, "link.log"))
+
+	cases := []struct {
+		query, wantErr string
+	}{
+		{"", "missing required parameter: log"},
+		{"log=../../etc/passwd", "outside the capture log root"},
+		{"log=" + outside, "outside the capture log root"},
+		{"log=link.log", "outside the capture log root"},
+		{"log=missing.log", "file not found"},
+		{"log=ok.log&resume=maybe", "invalid resume"},
+		{"log=ok.log&strategy=lifo", "invalid strategy"},
+		{"log=ok.log&speed=-1", "invalid speed"},
+		{"log=ok.log&speed=NaN", "invalid speed"},
+		{"log=ok.log&read_buf=0", "invalid read_buf"},
+		{"log=ok.log&read_buf=1e6", "invalid read_buf"},
+		{"log=ok.log&on_disk_full=block", "invalid disk full policy"},
+		{"log=ok.log&wall_clock=maybe", "invalid wall_clock"},
+		{"log=ok.log&wall_clock=true&replay_start=09:00", "invalid replay_start"},
+		{"log=ok.log&wall_clock=true&max_wait=-1s", "invalid max_wait"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		CaptureStartHandler(w, httptest.NewRequest("GET", "/capture/start?"+c.query, nil))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), c.wantErr) {
+			t.Errorf("%q: expected 400 containing %q, got %d %q", c.query, c.wantErr, w.Code, w.Body.String())
+		}
+	}
+
+	cfg, err := ParseCaptureConfig(httptest.NewRequest("GET", "/capture/start?log=ok.log&resume=true&strategy=red&speed=2.5&read_buf=1048576&on_disk_full=pause", nil))
+	if err != nil {
+		t.Fatalf("expected a valid config, got %v", err)
+	}
+	if want, _ := filepath.EvalSymlinks(filepath.Join(root, "ok.log")); cfg.LogPath != want || !cfg.Resume || cfg.Strategy != BufferRED || cfg.Speed == nil || *cfg.Speed != 2.5 || cfg.ReadBuf == nil || *cfg.ReadBuf != 1<<20 || cfg.DiskFull == nil || *cfg.DiskFull != DiskFullPause {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+
+	cfg, err = ParseCaptureConfig(httptest.NewRequest("GET", "/capture/start?log=ok.log&wall_clock=true&replay_start=2025-06-13T09:00:00Z&max_wait=30s", nil))
+	if err != nil || cfg.WallClock == nil || !*cfg.WallClock || !cfg.WallClockReplay.Start.Equal(time.Date(2025, 6, 13, 9, 0, 0, 0, time.UTC)) || cfg.WallClockReplay.MaxWait != 30*time.Second {
+		t.Errorf("unexpected wall clock config %+v (%v)", cfg, err)
+	}
+}
+
+func TestMergeManufacturers(t *testing.T) {
+	db := utils.InitDB(":memory:")
+	defer db.Close()
+	utils.CreateTables(db)
+
+	keep, _ := CreateManufacturer(db, "Motorola")
+	dup, _ := CreateManufacturer(db, "motorola")
+	other, _ := CreateManufacturer(db, "Kenwood")
+	for _, m := range []struct {
+		mfr  int64
+		name string
+	}{{keep, "XPR 7550"}, {dup, "XPR 3300"}, {dup, "CP200d"}, {other, "NX-1300"}} {
+		db.Exec("INSERT INTO radio_model (manufacturer_id, name) VALUES (?, ?)", m.mfr, m.name)
+	}
+
+	if err := MergeManufacturers(db, int(keep), int(keep)); !errors.Is(err, ErrMergeIntoSelf) {
+		t.Errorf("expected ErrMergeIntoSelf, got %v", err)
+	}
+	if err := MergeManufacturers(db, int(keep), 999); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected an error for an unknown manufacturer, got %v", err)
+	}
+	if err := MergeManufacturers(db, int(keep), int(dup)); err != nil {
+		t.Fatalf("MergeManufacturers failed: %v", err)
+	}
+
+	var kept, orphaned, others int
+	db.QueryRow("SELECT COUNT(*) FROM radio_model WHERE manufacturer_id = ?", keep).Scan(&kept)
+	db.QueryRow("SELECT COUNT(*) FROM radio_model WHERE manufacturer_id = ?", dup).Scan(&orphaned)
+	db.QueryRow("SELECT COUNT(*) FROM radio_model WHERE manufacturer_id = ?", other).Scan(&others)
+	if kept != 3 || orphaned != 0 || others != 1 {
+		t.Errorf("expected 3/0/1 models for kept/merged/other, got %d/%d/%d", kept, orphaned, others)
+	}
+	if _, err := GetManufacturer(db, int(dup)); err != sql.ErrNoRows {
+		t.Errorf("expected the merged manufacturer to be deleted, got %v", err)
+	}
+}
+
+func TestManufacturerCatalogRoundTrip(t *testing.T) {
+	src := utils.InitDB(":memory:")
+	defer src.Close()
+	utils.CreateTables(src)
+	CreateManufacturer(src, "Filler")
+	mfr, _ := CreateManufacturer(src, "Motorola")
+	for _, m := range []string{"XPR 7550", "CP200d"} {
+		src.Exec("INSERT INTO radio_model (manufacturer_id, name) VALUES (?, ?)", mfr, m)
+	}
+	src.Exec("INSERT INTO codeplug_supported_setting (radio_model_id, feature, supported) VALUES (1, 'gps', 1), (1, 'vox', 0), (2, 'scan', 1)")
+
+	data, err := ExportManufacturerCatalog(src, int(mfr))
+	if err != nil {
+		t.Fatalf("ExportManufacturerCatalog failed: %v", err)
+	}
+	if _, err := ExportManufacturerCatalog(src, 999); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for an unknown manufacturer, got %v", err)
+	}
+
+	dst := utils.InitDB(":memory:")
+	defer dst.Close()
+	utils.CreateTables(dst)
+	// A colliding model whose feature is updated rather than duplicated
+	existing, _ := CreateManufacturer(dst, "Motorola")
+	dst.Exec("INSERT INTO radio_model (id, manufacturer_id, name) VALUES (7, ?, 'CP200d')", existing)
+	dst.Exec("INSERT INTO codeplug_supported_setting (radio_model_id, feature, supported) VALUES (7, 'scan', 0)")
+
+	id, err := ImportManufacturerCatalog(dst, data)
+	if err != nil {
+		t.Fatalf("ImportManufacturerCatalog failed: %v", err)
+	}
+	if id != existing {
+		t.Errorf("expected the existing manufacturer %d to be reused, got %d", existing, id)
+	}
+	roundTrip, err := ExportManufacturerCatalog(dst, int(id))
+	if err != nil {
+		t.Fatalf("ExportManufacturerCatalog after import failed: %v", err)
+	}
+	var got, want ManufacturerCatalog
+	json.Unmarshal(data, &want)
+	json.Unmarshal(roundTrip, &got)
+	sort.Slice(got.Models, func(i, j int) bool { return got.Models[i].Name > got.Models[j].Name })
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("round trip mismatch:\n got %s\nwant %s", gotJSON, wantJSON)
+	}
+	var models, features int
+	dst.QueryRow("SELECT COUNT(*) FROM radio_model").Scan(&models)
+	dst.QueryRow("SELECT COUNT(*) FROM codeplug_supported_setting").Scan(&features)
+	if models != 2 || features != 3 {
+		t.Errorf("expected 2 models and 3 features after import, got %d and %d", models, features)
+	}
+
+	// Importing again changes nothing
+	if again, err := ImportManufacturerCatalog(dst, data); err != nil || again != id {
+		t.Errorf("expected a repeat import to reuse manufacturer %d, got %d (err %v)", id, again, err)
+	}
+	dst.QueryRow("SELECT COUNT(*) FROM codeplug_supported_setting").Scan(&features)
+	if features != 3 {
+		t.Errorf("expected 3 features after a repeat import, got %d", features)
+	}
+	if _, err := ImportManufacturerCatalog(dst, []byte(`{"models":[]}`)); !errors.Is(err, ErrInvalidCatalog) {
+		t.Errorf("expected ErrInvalidCatalog, got %v", err)
+	}
+}
+
+func TestWritesRetryWhileDatabaseBusy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "busy.db")
+	// No busy timeout, so contention surfaces as SQLITE_BUSY straight away
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=0")
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	utils.CreateTables(db)
+	locker, err := sql.Open("sqlite3", path+"?_busy_timeout=0")
+	if err != nil {
+		t.Fatalf("failed to open locking connection: %v", err)
+	}
+	defer locker.Close()
+	lock := func() *sql.Tx {
+		tx, err := locker.Begin()
+		if err != nil {
+			t.Fatalf("failed to begin: %v", err)
+		}
+		if _, err := tx.Exec("INSERT INTO manufacturer (name) VALUES ('holder')"); err != nil {
+			t.Fatalf("failed to take the write lock: %v", err)
+		}
+		return tx
+	}
+	defer utils.SetBusyRetryPolicy(utils.DefaultBusyRetryPolicy)
+
+	utils.SetBusyRetryPolicy(utils.BusyRetryPolicy{Attempts: 1})
+	tx := lock()
+	if _, err := CreateManufacturer(db, "Motorola"); !utils.IsBusy(err) {
+		t.Fatalf("expected a busy error without retries, got %v", err)
+	}
+	tx.Rollback()
+
+	utils.SetBusyRetryPolicy(utils.BusyRetryPolicy{Attempts: 20, Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond})
+	tx = lock()
+	time.AfterFunc(100*time.Millisecond, func() { tx.Commit() })
+	if _, err := CreateManufacturer(db, "Motorola"); err != nil {
+		t.Fatalf("expected the write to succeed once the lock was released, got %v", err)
+	}
+	if _, err := CreateUser(db, "alice", "secret", 1); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM manufacturer").Scan(&n)
+	if n != 2 {
+		t.Errorf("expected the holder and retried rows, got %d", n)
+	}
+}
+
+// TestBusyRetryRaisesContendedTPS measures the writes per second that
+// succeed while another connection holds the write lock at the start of a
+// burst, with and without retries
+func TestBusyRetryRaisesContendedTPS(t *testing.T) {
+	const writers = 30
+	path := filepath.Join(t.TempDir(), "contended.db")
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=0&_journal_mode=WAL")
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	utils.CreateTables(db)
+	defer utils.SetBusyRetryPolicy(utils.DefaultBusyRetryPolicy)
+
+	burst := func(name string, p utils.BusyRetryPolicy) (ok int, tps float64) {
+		utils.SetBusyRetryPolicy(p)
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatalf("failed to begin: %v", err)
+		}
+		if _, err := tx.Exec("INSERT INTO manufacturer (name) VALUES ('holder')"); err != nil {
+			t.Fatalf("failed to take the write lock: %v", err)
+		}
+		released := make(chan struct{})
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			tx.Rollback()
+			close(released)
+		}()
+		start := time.Now()
+		var wg sync.WaitGroup
+		var succeeded int32
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, err := CreateManufacturer(db, fmt.Sprintf("%s%d", name, i)); err == nil {
+					atomic.AddInt32(&succeeded, 1)
+				}
+			}(i)
+		}
+		wg.Wait()
+		ok = int(atomic.LoadInt32(&succeeded))
+		tps = float64(ok) / time.Since(start).Seconds()
+		<-released
+		t.Logf("%s: %d of %d writes succeeded, %.0f TPS", name, ok, writers, tps)
+		return ok, tps
+	}
+	without, withoutTPS := burst("noretry", utils.BusyRetryPolicy{Attempts: 1})
+	with, withTPS := burst("retry", utils.BusyRetryPolicy{Attempts: 100, Backoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	if with != writers {
+		t.Errorf("expected every write to succeed with retries, got %d of %d", with, writers)
+	}
+	if without >= writers || withTPS <= withoutTPS {
+		t.Errorf("expected retries to raise the contended TPS, got %.0f without and %.0f with", withoutTPS, withTPS)
+	}
+}
+
+func TestIngestErrorBudgetStopsCapture(t *testing.T) {
+	db := useTestCaptureDB(t)
+	// Every insert into this ingest DB violates a constraint
+	broken, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "broken.db"))
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer broken.Close()
+	broken.Exec(`CREATE TABLE timeseries_event (id INTEGER PRIMARY KEY AUTOINCREMENT, timestamp DATETIME NOT NULL, source TEXT NOT NULL, type TEXT NOT NULL, payload TEXT NOT NULL CHECK (payload = ''), labels TEXT)`)
+	CreateTimeseriesTable(broken) // adds the remaining columns
+	CreateCaptureCheckpointTable(broken)
+	SetCaptureIngestDB(broken)
+	defer SetCaptureIngestDB(nil)
+	SetIngestErrorBudget(IngestErrorBudget{MaxErrors: 5, Window: time.Minute})
+	defer SetIngestErrorBudget(IngestErrorBudget{})
+
+	var lines []string
+	for i := 0; i < 50; i++ {
+		lines = append(lines, fmt.Sprintf("%d.%02d line-%d", 1000, i*2, i)) // paced 20ms apart
+	}
+	if err := captureManager.StartSimulatedCapture(writeTestLog(t, lines)); err != nil {
+		t.Fatalf("failed to start capture: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if s := captureManager.GetCaptureStatus(); s.Stopped && !s.Ingesting {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := captureManager.GetCaptureStatus()
+	if !status.Stopped || !status.Failed || !strings.Contains(status.LastError, "error budget exceeded") {
+		t.Fatalf("expected the capture to fail on its error budget, got %+v", status)
+	}
+	if status.ErrorCount <= 5 || status.ErrorCount >= len(lines) || status.Ingested != 0 {
+		t.Errorf("expected the capture to stop soon after 5 errors, got %d errors and %d ingested", status.ErrorCount, status.Ingested)
+	}
+	sessions, _ := ListCaptureSessions(db, CaptureSessionFilter{})
+	if len(sessions) != 1 || sessions[0].Status != CaptureSessionFailed {
+		t.Errorf("expected a failed capture session, got %+v", sessions)
+	}
+}
+
+func TestNamedCaptureKeepsFailedStatus(t *testing.T) {
+	useTestCaptureDB(t)
+	broken, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "broken.db"))
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer broken.Close()
+	broken.Exec(`CREATE TABLE timeseries_event (id INTEGER PRIMARY KEY AUTOINCREMENT, timestamp DATETIME NOT NULL, source TEXT NOT NULL, type TEXT NOT NULL, payload TEXT NOT NULL CHECK (payload = ''), labels TEXT)`)
+	CreateTimeseriesTable(broken)
+	CreateCaptureCheckpointTable(broken)
+	SetCaptureBufferDir(t.TempDir())
+	defer SetCaptureBufferDir("")
+
+	// Configured through the registry without pinning it, like the HTTP
+	// handlers do
+	cm, _ := acquireCaptureManager("budget")
+	cm.mu.Lock()
+	cm.ingestDB = broken
+	cm.mu.Unlock()
+	cm.SetErrorBudget(IngestErrorBudget{MaxErrors: 2, Window: time.Minute})
+	releaseCaptureManager(cm)
+	var lines []string
+	for i := 0; i < 50; i++ {
+		lines = append(lines, fmt.Sprintf("%d.%02d line-%d", 1000, i*2, i))
+	}
+	if err := StartSimulatedCapture("budget", writeTestLog(t, lines)); err != nil {
+		t.Fatalf("failed to start capture: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if s := GetCaptureStatus("budget"); s.Stopped && !s.Ingesting {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := GetCaptureStatus("budget"); !status.Failed || !status.Stopped || status.ErrorCount <= 2 {
+		t.Fatalf("expected the named capture's failed status after it stopped, got %+v", status)
+	}
+}
+
+func TestCaptureBufferDir(t *testing.T) {
+	useTestCaptureDB(t)
+	dir := t.TempDir()
+	SetCaptureBufferDir(dir)
+	defer SetCaptureBufferDir("")
+
+	cm := NewCaptureManager("tmpfs")
+	if err := cm.StartSimulatedCapture(writeTestLog(t, []string{"a", "b"})); err != nil {
+		t.Fatalf("failed to start capture: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cm.GetCaptureStatus().Ingested < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cm.StopSimulatedCapture()
+	if _, err := os.Stat(filepath.Join(dir, "capture_buffer_tmpfs.dat")); err != nil {
+		t.Errorf("expected the buffer in the custom dir: %v", err)
+	}
+	if _, err := os.Stat("capture_buffer_tmpfs.dat"); !os.IsNotExist(err) {
+		t.Errorf("expected no buffer in the working directory, got %v", err)
+	}
+
+	SetCaptureBufferDir(filepath.Join(dir, "missing"))
+	if err := cm.StartSimulatedCapture(writeTestLog(t, []string{"a"})); err == nil || !strings.Contains(err.Error(), "not writable") {
+		cm.StopSimulatedCapture()
+		t.Errorf("expected an unwritable buffer dir to be rejected, got %v", err)
+	}
+}
+
+func TestCaptureFraming(t *testing.T) {
+	db := useTestCaptureDB(t)
+	SetCaptureBufferDir(t.TempDir())
+	defer SetCaptureBufferDir("")
+	// HDLC-style frames: 0x7E opens and closes each frame, and frames may
+	// contain newlines
+	fixture := []byte("\x7e01:02\n03\x7e\x7e04:05\x7e\x7e\x7e06\x7e07")
+	logPath := filepath.Join(t.TempDir(), "serial.bin")
+	os.WriteFile(logPath, fixture, 0644)
+
+	capture := func(framing CaptureFraming, want int) []string {
+		t.Helper()
+		db.Exec("DELETE FROM timeseries_event")
+		cm := NewCaptureManager("framed")
+		if err := cm.StartCapture(CaptureConfig{LogPath: logPath, Framing: &framing}); err != nil {
+			t.Fatalf("failed to start capture: %v", err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for cm.GetCaptureStatus().Ingested < want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cm.StopSimulatedCapture()
+		rows, err := db.Query("SELECT payload FROM timeseries_event ORDER BY id")
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		defer rows.Close()
+		var got []string
+		for rows.Next() {
+			var p string
+			rows.Scan(&p)
+			got = append(got, p)
+		}
+		return got
+	}
+
+	got := capture(CaptureFraming{Mode: FrameDelimited, Delimiter: 0x7e}, 4)
+	if want := []string{"01:02\n03", "04:05", "06", "07"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected frames %q, got %q", want, got)
+	}
+	got = capture(CaptureFraming{Mode: FrameFixed, Length: 8}, 3)
+	if want := []string{string(fixture[:8]), string(fixture[8:16]), string(fixture[16:])}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected fixed frames %q, got %q", want, got)
+	}
+
+	if err := NewCaptureManager("framed").SetFraming(CaptureFraming{Mode: FrameFixed}); !errors.Is(err, ErrInvalidFraming) {
+		t.Errorf("expected ErrInvalidFraming for a zero frame length, got %v", err)
+	}
+}
+
+func TestCaptureLifetimeStatsAccumulate(t *testing.T) {
+	db := useTestCaptureDB(t)
+	SetCaptureBufferDir(t.TempDir())
+	defer SetCaptureBufferDir("")
+
+	run := func(lines []string) CaptureStatus {
+		t.Helper()
+		// A new manager per session, as after a process restart
+		cm := NewCaptureManager("lifetime")
+		if err := cm.StartSimulatedCapture(writeTestLog(t, lines)); err != nil {
+			t.Fatalf("failed to start capture: %v", err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for cm.GetCaptureStatus().Ingested < len(lines) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cm.StopSimulatedCapture()
+		return cm.GetCaptureStatus()
+	}
+
+	first := run([]string{"alpha", "beta", "gamma"})
+	second := run([]string{"delta", "epsilon"})
+	if second.Ingested != 2 {
+		t.Fatalf("expected the session count to restart, got %d", second.Ingested)
+	}
+	if second.LifetimeIngested != 5 || second.LifetimeBytes != first.BytesIngested+second.BytesIngested {
+		t.Errorf("expected lifetime totals across both sessions, got %d events / %d bytes", second.LifetimeIngested, second.LifetimeBytes)
+	}
+	stats, err := CaptureLifetimeStats(db, "lifetime")
+	if err != nil {
+		t.Fatalf("CaptureLifetimeStats failed: %v", err)
+	}
+	if stats.Ingested != 5 || stats.Bytes != int64(len("alphabetagammadeltaepsilon")) || stats.Errors != 0 {
+		t.Errorf("unexpected persisted totals: %+v", stats)
+	}
+	if other, _ := CaptureLifetimeStats(db, "default"); other.Ingested != 0 {
+		t.Errorf("expected totals to be per capture id, got %+v", other)
+	}
+}
+
+func TestIngestLatencyPercentiles(t *testing.T) {
+	useTestCaptureDB(t)
+	status := runCapture(t, writeTestLog(t, []string{"a", "b", "c", "d"}), 4)
+	if status.IngestLatencyP50 <= 0 || status.IngestLatencyP50 > status.IngestLatencyP95 || status.IngestLatencyP95 > status.IngestLatencyP99 {
+		t.Errorf("expected populated, ordered percentiles, got p50=%s p95=%s p99=%s", status.IngestLatencyP50, status.IngestLatencyP95, status.IngestLatencyP99)
+	}
+
+	// Mostly fast commits with a slow tail, as when the DB stalls
+	cm := NewCaptureManager("latency")
+	now := time.Now()
+	var meta []pendingRecord
+	for i := 0; i < 100; i++ {
+		d := time.Millisecond
+		switch {
+		case i >= 95:
+			d = 2 * time.Second
+		case i >= 80:
+			d = 50 * time.Millisecond
+		}
+		meta = append(meta, pendingRecord{readAt: now.Add(-d)})
+	}
+	meta = append(meta, pendingRecord{offset: -1}) // left from an earlier run; no read time
+	cm.mu.Lock()
+	cm.recordLatency(meta, now)
+	cm.mu.Unlock()
+	status = cm.GetCaptureStatus()
+	within := func(got, want time.Duration) bool { return got >= want && got < 2*want }
+	if !within(status.IngestLatencyP50, time.Millisecond) || !within(status.IngestLatencyP95, 50*time.Millisecond) || !within(status.IngestLatencyP99, 2*time.Second) {
+		t.Errorf("unexpected percentiles p50=%s p95=%s p99=%s", status.IngestLatencyP50, status.IngestLatencyP95, status.IngestLatencyP99)
+	}
+}
+
+func TestPayloadCompression(t *testing.T) {
+	payload := func(i int) string {
+		return fmt.Sprintf(`{"seq":%d,"channels":[%s]}`, i, strings.TrimSuffix(strings.Repeat(`{"name":"Zone 1 Ch","rx":"446.00625","tx":"446.00625","cc":1,"slot":1},`, 40), ","))
+	}
+	dbSize := func(db *sql.DB) int64 {
+		var pages, pageSize int64
+		db.QueryRow("PRAGMA page_count").Scan(&pages)
+		db.QueryRow("PRAGMA page_size").Scan(&pageSize)
+		return pages * pageSize
+	}
+	fill := func(threshold int) (*sql.DB, []TimeseriesEvent) {
+		SetPayloadCompression(threshold)
+		defer SetPayloadCompression(0)
+		db := utils.InitDB(filepath.Join(t.TempDir(), "events.db"))
+		CreateTimeseriesTable(db)
+		var want []TimeseriesEvent
+		base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 200; i++ {
+			e := TimeseriesEvent{Timestamp: base.Add(time.Duration(i) * time.Second), Source: "cps", Type: "read", Payload: payload(i)}
+			if i%10 == 0 {
+				e.Payload = "short" // below the threshold, stored as-is
+			}
+			InsertTimeseriesEvent(db, e)
+			want = append(want, e)
+		}
+		return db, want
+	}
+
+	plain, _ := fill(0)
+	defer plain.Close()
+	compressed, want := fill(256)
+	defer compressed.Close()
+	plainSize, compressedSize := dbSize(plain), dbSize(compressed)
+	t.Logf("DB size: %d bytes uncompressed, %d bytes compressed", plainSize, compressedSize)
+	if compressedSize*4 > plainSize {
+		t.Errorf("expected compression to shrink the DB at least 4x, got %d -> %d bytes", plainSize, compressedSize)
+	}
+
+	var flagged, unflagged int
+	compressed.QueryRow("SELECT COUNT(*) FROM timeseries_event WHERE compressed = 1").Scan(&flagged)
+	compressed.QueryRow("SELECT COUNT(*) FROM timeseries_event WHERE compressed = 0").Scan(&unflagged)
+	if flagged != 180 || unflagged != 20 {
+		t.Errorf("expected 180 compressed and 20 plain rows, got %d and %d", flagged, unflagged)
+	}
+	got, err := QueryTimeseriesEvents(compressed, "cps", "read", want[0].Timestamp, want[len(want)-1].Timestamp)
+	if err != nil || len(got) != len(want) {
+		t.Fatalf("expected %d events, got %d (%v)", len(want), len(got), err)
+	}
+	for i := range want {
+		if got[i].Payload != want[i].Payload {
+			t.Fatalf("event %d did not decompress to its original payload", i)
+		}
+	}
+
+	// Merging copies stored payloads as-is, flag included
+	dst := utils.InitDB(filepath.Join(t.TempDir(), "merged.db"))
+	defer dst.Close()
+	if _, err := MergeTimeseriesDBs(dst, compressed); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	merged, _ := QueryTimeseriesEvents(dst, "cps", "read", want[0].Timestamp, want[len(want)-1].Timestamp)
+	if len(merged) != len(want) || merged[1].Payload != want[1].Payload {
+		t.Errorf("expected merged events to decompress to the originals")
+	}
+}
+
+// Handler for recording a timeseries event (could be used in an HTTP API or CLI)
+// (Removed: use the implementation in handlers.go)
+
+func TestCancelBackup(t *testing.T) {
+	if _, err := CancelBackup(); !errors.Is(err, ErrNoBackupInProgress) {
+		t.Fatalf("expected nothing to cancel, got %v", err)
+	}
+	ctx, done, err := beginBackupOp("backup", "b.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	if _, _, err := RunBackup(nil, "dewey.db", utils.FullBackupType, "other.db"); !errors.Is(err, ErrBackupInProgress) {
+		t.Errorf("expected a second backup to be refused, got %v", err)
+	}
+	if err := RunRestore("b.db", "dewey.db", utils.FullBackupType, utils.RestoreOptions{}); !errors.Is(err, ErrBackupInProgress) {
+		t.Errorf("expected a restore to be refused during a backup, got %v", err)
+	}
+	op, err := CancelBackup()
+	if err != nil || op.Kind != "backup" || op.Path != "b.db" {
+		t.Fatalf("unexpected canceled operation %+v (%v)", op, err)
+	}
+	select {
+	case <-ctx.Done():
+	default:
+		t.Error("expected the operation's context to be canceled")
+	}
+	done()
+	if _, err := CancelBackup(); !errors.Is(err, ErrNoBackupInProgress) {
+		t.Errorf("expected the finished operation to be cleared, got %v", err)
+	}
+}
+
+func TestEventRate(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	if err := CreateTimeseriesTable(db); err != nil {
+		t.Fatalf("failed to create timeseries_event table: %v", err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	// 30 events over the last 10s, 5 older ones and another source's
+	for i := 0; i < 30; i++ {
+		InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: now.Add(-time.Duration(i) * time.Second / 3), Source: "serial", Type: "read", Payload: "x"})
+	}
+	for i := 0; i < 5; i++ {
+		InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: now.Add(-time.Minute), Source: "serial", Type: "read", Payload: "old"})
+	}
+	InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: now, Source: "usb", Type: "read", Payload: "y"})
+
+	for _, tc := range []struct {
+		window time.Duration
+		want   float64
+	}{
+		{10 * time.Second, 3},
+		{2 * time.Minute, 35.0 / 120},
+	} {
+		if rate, err := eventRateAt(db, "serial", tc.window, now); err != nil || rate != tc.want {
+			t.Errorf("rate over %s: expected %v, got %v (%v)", tc.window, tc.want, rate, err)
+		}
+	}
+	if rate, err := eventRateAt(db, "missing", time.Minute, now); err != nil || rate != 0 {
+		t.Errorf("expected no events from an unknown source, got %v (%v)", rate, err)
+	}
+
+	var alerts []RateAlert
+	w := &rateWatcher{db: db, states: []RateState{RateOK, RateOK}, opts: RateWatchOptions{
+		Window: 10 * time.Second,
+		Thresholds: []RateThreshold{
+			{Source: "serial", Min: 0.1, Max: 2},
+			{Source: "usb", Min: 0.01},
+		},
+		OnAlert: func(a RateAlert) { alerts = append(alerts, a) },
+	}}
+	w.check(now)
+	w.check(now) // no change, no alert
+	w.check(now.Add(time.Hour))
+	want := []string{"serial high", "serial low", "usb low"}
+	var got []string
+	for _, a := range alerts {
+		got = append(got, a.Threshold.Source+" "+string(a.State))
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected alerts %v, got %v", want, got)
+	}
+}
+
+func TestFIFOBufferLenDoesNotLoadRecords(t *testing.T) {
+	buf, err := NewFIFOBuffer(filepath.Join(t.TempDir(), "large_buffer.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buf.Close()
+	payload := bytes.Repeat([]byte("x"), 200)
+	const records = 50000 // about 10MB
+	for i := 0; i < records; i++ {
+		if err := buf.Append(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := buf.Len(); n != records {
+		t.Fatalf("expected %d records, got %d", records, n)
+	}
+	// Loading the payloads would take one allocation per record
+	if allocs := testing.AllocsPerRun(3, func() { buf.Len() }); allocs > 20 {
+		t.Errorf("expected Len to allocate a constant amount, got %.0f allocations", allocs)
+	}
+	if batch, err := buf.ReadBatch(records); err != nil || len(batch) != records {
+		t.Errorf("expected a batch of %d records, got %d (%v)", records, len(batch), err)
+	}
+	if batch, _ := buf.ReadBatch(MaxReadBatch + 1); len(batch) > MaxReadBatch {
+		t.Errorf("expected ReadBatch to be capped at %d, got %d", MaxReadBatch, len(batch))
+	}
+}
+
+// recordingSink is a SecondarySink keeping what it receives
+type recordingSink struct {
+	mu     sync.Mutex
+	events []TimeseriesEvent
+	err    error
+}
+
+func (s *recordingSink) WriteBatch(events []TimeseriesEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func TestCaptureMirrorsToSecondarySink(t *testing.T) {
+	db := useTestCaptureDB(t)
+	sink := &recordingSink{}
+	SetSecondarySink(sink)
+	defer SetSecondarySink(nil)
+	status := runCapture(t, writeTestLog(t, []string{"a", "b", "c", "d", "e"}), 5)
+
+	rows, err := db.Query("SELECT payload, seq FROM timeseries_event ORDER BY seq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var primary []string
+	for rows.Next() {
+		var payload string
+		var seq int64
+		rows.Scan(&payload, &seq)
+		primary = append(primary, fmt.Sprintf("%d:%s", seq, payload))
+	}
+	rows.Close()
+	var mirrored []string
+	for _, e := range sink.events {
+		if e.SessionID != status.SessionID {
+			t.Errorf("expected session %q on mirrored events, got %q", status.SessionID, e.SessionID)
+		}
+		mirrored = append(mirrored, fmt.Sprintf("%d:%s", e.Seq, e.Payload))
+	}
+	if len(primary) != 5 || strings.Join(primary, ",") != strings.Join(mirrored, ",") {
+		t.Errorf("expected the sink to receive %v, got %v", primary, mirrored)
+	}
+
+	// A failing sink doesn't hold up the primary
+	sink.err = errors.New("secondary unavailable")
+	runCapture(t, writeTestLog(t, []string{"f", "g"}), 2)
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM timeseries_event").Scan(&n)
+	if n != 7 {
+		t.Errorf("expected 7 events in the primary, got %d", n)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirror.jsonl")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []TimeseriesEvent{{Source: "serial", Type: "read", Payload: "a", Seq: 1}, {Source: "serial", Type: "read", Payload: "b", Seq: 2}}
+	if err := sink.WriteBatch(events); err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var last TimeseriesEvent
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), &last) != nil || last.Payload != "b" || last.Seq != 2 {
+		t.Errorf("unexpected sink file %q", data)
+	}
+}
+
+func TestCaptureStoresRawRecords(t *testing.T) {
+	db := useTestCaptureDB(t)
+	SetCapturePrefixParser(&LinePrefixParser{Sources: []string{"serial"}})
+	defer SetCapturePrefixParser(nil)
+	lines := []string{"serial read 0a 0b", "serial write 7e 01", "serial read ff"}
+	if err := captureManager.startCapture(CaptureConfig{LogPath: writeTestLog(t, lines), StoreRaw: true}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for captureManager.GetCaptureStatus().Ingested < len(lines) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	captureManager.StopSimulatedCapture()
+
+	events, err := QueryEventsWithRaw(db, "serial", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(lines) {
+		t.Fatalf("expected %d events, got %d", len(lines), len(events))
+	}
+	for i, e := range events {
+		if string(e.Raw) != lines[i] || e.Type+" "+e.Payload != strings.TrimPrefix(lines[i], "serial ") {
+			t.Errorf("event %d: parsed %q %q not linked to raw %q", i, e.Type, e.Payload, e.Raw)
+		}
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM raw_capture WHERE event_table = 'timeseries_event'").Scan(&n)
+	if n != len(lines) {
+		t.Errorf("expected %d raw rows, got %d", len(lines), n)
+	}
+
+	// Without the option only parsed events are kept
+	runCapture(t, writeTestLog(t, []string{"serial read 01"}), 1)
+	events, _ = QueryEventsWithRaw(db, "serial", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if last := events[len(events)-1]; last.Payload != "01" || last.Raw != nil {
+		t.Errorf("expected no raw bytes for a capture without StoreRaw, got %+v", last)
+	}
+}
+
+func TestCaptureTeeWithoutDB(t *testing.T) {
+	prev := captureDB
+	SetCaptureDB(nil)
+	defer SetCaptureDB(prev)
+	dir := t.TempDir()
+	SetCaptureBufferDir(dir)
+	defer SetCaptureBufferDir("")
+	cm := NewCaptureManager("tee")
+	teePath := filepath.Join(dir, "raw.log")
+	cm.SetTee(&CaptureTee{Path: teePath, MaxSize: 40})
+	// The tee gets records as read, before redaction
+	cm.redactions = []RedactionRule{{Pattern: regexp.MustCompile(`read`), Replacement: "[REDACTED]"}}
+
+	var lines []string
+	for i := 0; i < 12; i++ {
+		lines = append(lines, fmt.Sprintf("serial read %02x", i))
+	}
+	if err := cm.StartSimulatedCapture(writeTestLog(t, lines)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !cm.GetCaptureStatus().SourceDone && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cm.StopSimulatedCapture()
+	if status := cm.GetCaptureStatus(); status.Ingested != 0 {
+		t.Fatalf("expected nothing ingested without a DB, got %d", status.Ingested)
+	}
+
+	// Rotated files sort by their timestamp suffix, before the current one
+	files, _ := filepath.Glob(teePath + ".*")
+	if len(files) < 2 {
+		t.Errorf("expected the tee to rotate at 40 bytes, got %d rotated files", len(files))
+	}
+	sort.Strings(files)
+	var got []byte
+	for _, f := range append(files, teePath) {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 40 {
+			t.Errorf("%s is %d bytes, over the 40 byte limit", f, len(data))
+		}
+		got = append(got, data...)
+	}
+	if want := strings.Join(lines, "\n") + "\n"; string(got) != want {
+		t.Errorf("expected the tee to hold every raw record:\n%s\ngot:\n%s", want, got)
+	}
+	if status := cm.GetCaptureStatus(); status.Redactions != len(lines) {
+		t.Errorf("expected %d redactions after the tee, got %d", len(lines), status.Redactions)
+	}
+	if fi, err := os.Stat(teePath); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected the tee file readable by its owner only, got %v", fi.Mode().Perm())
+	}
+}
+
+func TestCaptureIngestsIntoStraceSchema(t *testing.T) {
+	db := useTestCaptureDB(t)
+	SetCapturePrefixParser(&LinePrefixParser{Sources: []string{"strace", "serial"}})
+	defer SetCapturePrefixParser(nil)
+	if err := SetIngestTarget("strace", "vt100"); !errors.Is(err, ErrInvalidIngestTarget) {
+		t.Errorf("expected ErrInvalidIngestTarget, got %v", err)
+	}
+	if err := SetIngestTarget("strace", StraceTarget); err != nil {
+		t.Fatal(err)
+	}
+	defer SetIngestTarget("strace", GenericTarget)
+	runCapture(t, writeTestLog(t, []string{
+		`strace syscall 1234 openat(AT_FDCWD, "/dev/ttyUSB0", O_RDWR) = 3`,
+		`strace syscall [pid 1234] write(3, "\x7e\x01", 2) = 2`,
+		`serial read 0a 0b`,
+		`strace syscall garbled`,
+	}), 4)
+	InsertTimeseriesEvent(db, TimeseriesEvent{Timestamp: time.Now().UTC(), Source: "strace", Type: "syscall", Payload: `{"pid":"99","syscall":"read","result":"-1 EAGAIN"}`})
+
+	start, end := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	events, err := QueryStraceEvents(db, "", start, end)
+	if err != nil {
+		t.Fatalf("QueryStraceEvents failed: %v", err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("expected 4 strace events, got %d", len(events))
+	}
+	want := []StraceEvent{
+		{PID: 1234, Syscall: "openat", Args: `AT_FDCWD, "/dev/ttyUSB0", O_RDWR`, Result: "3"},
+		{PID: 1234, Syscall: "write", Args: `3, "\x7e\x01", 2`, Result: "2"},
+		{}, // unparsed payloads leave the typed columns empty
+		{PID: 99, Syscall: "read", Result: "-1 EAGAIN"},
+	}
+	for i, e := range events {
+		if e.PID != want[i].PID || e.Syscall != want[i].Syscall || e.Args != want[i].Args || e.Result != want[i].Result {
+			t.Errorf("event %d: expected %+v, got pid %d syscall %q args %q result %q", i, want[i], e.PID, e.Syscall, e.Args, e.Result)
+		}
+	}
+	if writes, _ := QueryStraceEvents(db, "write", start, end); len(writes) != 1 || writes[0].Payload != `[pid 1234] write(3, "\x7e\x01", 2) = 2` {
+		t.Errorf("expected the write syscall only, got %+v", writes)
+	}
+
+	var generic, typed int
+	db.QueryRow("SELECT COUNT(*) FROM timeseries_event").Scan(&generic)
+	db.QueryRow("SELECT COUNT(*) FROM strace_event WHERE pid = 1234").Scan(&typed)
+	if generic != 1 || typed != 2 {
+		t.Errorf("expected 1 generic row and 2 strace rows for pid 1234, got %d and %d", generic, typed)
+	}
+	// Generic queries still see typed rows
+	if all, _ := QueryTimeseriesEvents(db, "strace", "syscall", start, end); len(all) != 4 {
+		t.Errorf("expected 4 strace events from the generic query, got %d", len(all))
+	}
+	if serial, _ := QuerySerialEvents(db, "", start, end); len(serial) != 0 {
+		t.Errorf("expected no serial_event rows, got %d", len(serial))
+	}
+}
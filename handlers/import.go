@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ImportOptions controls ImportTimeseriesStreamWithOptions
+type ImportOptions struct {
+	BatchSize int                         // records per transaction; 1000 if zero
+	Progress  func(imported, skipped int) // called after each committed batch
+	OnSkip    func(record int, err error) // called for each invalid record (1-based)
+	// Bulk trades per-batch durability for speed: the import runs on its own
+	// connection with synchronous=OFF, then restores the setting and
+	// checkpoints once at the end. Other connections are unaffected.
+	Bulk bool
+}
+
+// importRecord is the NDJSON form of an event; CSV uses the same column names
+type importRecord struct {
+	Timestamp string            `json:"timestamp"`
+	Source    string            `json:"source"`
+	Type      string            `json:"type"`
+	Payload   string            `json:"payload"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// event validates the record and converts it to a TimeseriesEvent
+func (r importRecord) event() (TimeseriesEvent, error) {
+	ts, err := time.Parse(time.RFC3339Nano, r.Timestamp)
+	if err != nil {
+		return TimeseriesEvent{}, fmt.Errorf("invalid timestamp %q", r.Timestamp)
+	}
+	if r.Source == "" || r.Type == "" {
+		return TimeseriesEvent{}, errors.New("source and type are required")
+	}
+	return TimeseriesEvent{Timestamp: ts.UTC(), Source: r.Source, Type: r.Type, Payload: r.Payload, Labels: r.Labels}, nil
+}
+
+// ImportTimeseriesStream imports events from r in "ndjson" or "csv" format.
+// See ImportTimeseriesStreamWithOptions.
+func ImportTimeseriesStream(db *sql.DB, r io.Reader, format string) (int, error) {
+	return ImportTimeseriesStreamWithOptions(db, r, format, ImportOptions{})
+}
+
+// ImportTimeseriesStreamWithOptions reads events from r incrementally and
+// inserts them in batched transactions, so memory stays flat regardless of
+// the stream's size. NDJSON has one object per line; CSV needs a header row
+// naming timestamp, source, type and payload columns (labels is optional, as
+// a JSON object). Invalid records are skipped and reported through OnSkip.
+// It returns the number of events imported, including those committed before
+// a read or write error stopped the import.
+func ImportTimeseriesStreamWithOptions(db *sql.DB, r io.Reader, format string, opts ImportOptions) (int, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	var next func() (importRecord, error)
+	switch strings.ToLower(format) {
+	case "ndjson", "jsonl", "json":
+		next = ndjsonRecords(r)
+	case "csv":
+		var err error
+		if next, err = csvRecords(r); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("unsupported import format %q", format)
+	}
+	if opts.Bulk {
+		return bulkImport(db, func(b txBeginner) (int, error) {
+			return importRecords(db, b, next, opts)
+		})
+	}
+	return importRecords(db, db, next, opts)
+}
+
+// importRecords inserts the records from next in batches begun on b
+func importRecords(db *sql.DB, b txBeginner, next func() (importRecord, error), opts ImportOptions) (int, error) {
+	imported, skipped, recordNum := 0, 0, 0
+	batch := make([]TimeseriesEvent, 0, opts.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := insertEventBatch(db, b, batch); err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		if opts.Progress != nil {
+			opts.Progress(imported, skipped)
+		}
+		return nil
+	}
+	for {
+		rec, err := next()
+		if err == io.EOF {
+			break
+		}
+		recordNum++
+		var e TimeseriesEvent
+		if err == nil {
+			e, err = rec.event()
+		}
+		var se *streamError
+		if errors.As(err, &se) {
+			if ferr := flush(); ferr != nil {
+				return imported, ferr
+			}
+			return imported, se.err
+		}
+		if err != nil {
+			skipped++
+			if opts.OnSkip != nil {
+				opts.OnSkip(recordNum, err)
+			}
+			continue
+		}
+		batch = append(batch, e)
+		if len(batch) == opts.BatchSize {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	return imported, flush()
+}
+
+// streamError marks a failure reading the underlying stream, as opposed to a
+// single bad record
+type streamError struct{ err error }
+
+func (e *streamError) Error() string { return e.err.Error() }
+func (e *streamError) Unwrap() error { return e.err }
+
+// ndjsonRecords returns an iterator over the JSON objects in r, one per line
+func ndjsonRecords(r io.Reader) func() (importRecord, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return func() (importRecord, error) {
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var rec importRecord
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				return rec, err
+			}
+			return rec, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return importRecord{}, &streamError{err}
+		}
+		return importRecord{}, io.EOF
+	}
+}
+
+// csvRecords reads the header row from r and returns an iterator over the rows
+func csvRecords(r io.Reader) (func() (importRecord, error), error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	cols := make(map[string]int)
+	for i, name := range header {
+		cols[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, required := range []string{"timestamp", "source", "type", "payload"} {
+		if _, ok := cols[required]; !ok {
+			return nil, fmt.Errorf("CSV header is missing the %q column", required)
+		}
+	}
+	field := func(row []string, name string) string {
+		if i, ok := cols[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+	return func() (importRecord, error) {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return importRecord{}, io.EOF
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return importRecord{}, err
+		}
+		if err != nil {
+			return importRecord{}, &streamError{err}
+		}
+		rec := importRecord{
+			Timestamp: field(row, "timestamp"),
+			Source:    field(row, "source"),
+			Type:      field(row, "type"),
+			Payload:   field(row, "payload"),
+		}
+		if labels := field(row, "labels"); labels != "" {
+			if err := json.Unmarshal([]byte(labels), &rec.Labels); err != nil {
+				return rec, fmt.Errorf("invalid labels: %w", err)
+			}
+		}
+		return rec, nil
+	}, nil
+}
+
+// txBeginner starts transactions; a *sql.DB or a dedicated *sql.Conn
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// bulkImport runs import on a dedicated connection with synchronous=OFF. The
+// connection's setting is restored afterwards, even on error, and the data is
+// checkpointed and synced before it returns.
+func bulkImport(db *sql.DB, run func(txBeginner) (int, error)) (int, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	var synchronous int
+	if err := conn.QueryRowContext(ctx, "PRAGMA synchronous;").Scan(&synchronous); err != nil {
+		return 0, err
+	}
+	if _, err := conn.ExecContext(ctx, "PRAGMA synchronous = OFF;"); err != nil {
+		return 0, err
+	}
+	n, err := run(conn)
+	if rerr := finishBulkImport(ctx, conn, synchronous); rerr != nil && err == nil {
+		err = rerr
+	}
+	return n, err
+}
+
+// finishBulkImport restores conn's synchronous setting, then checkpoints the
+// WAL and fsyncs the main file. If the setting cannot be restored the
+// connection is discarded rather than returned to the pool.
+func finishBulkImport(ctx context.Context, conn *sql.Conn, synchronous int) error {
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("PRAGMA synchronous = %d;", synchronous)); err != nil {
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE);"); err != nil {
+		return err
+	}
+	var seq int
+	var name, file string
+	if err := conn.QueryRowContext(ctx, "PRAGMA database_list;").Scan(&seq, &name, &file); err != nil {
+		return err
+	}
+	if file == "" {
+		return nil // in-memory
+	}
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// insertEventBatch inserts events in a single transaction begun on b.
+// Partition and typed tables are created inside it, so b may be the only connection.
+func insertEventBatch(db *sql.DB, b txBeginner, events []TimeseriesEvent) error {
+	tx, err := b.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	targets := make(map[string]eventTarget)
+	state := timeseriesState(db)
+	var created []string
+	for _, e := range events {
+		if _, ok := targets[e.Source]; ok {
+			continue
+		}
+		target := sourceTarget(db, e.Source)
+		if target.table != timeseriesBaseTable {
+			if _, ok := state.created.Load(target.table); !ok {
+				if err := target.create(tx); err != nil {
+					tx.Rollback()
+					return err
+				}
+				created = append(created, target.table)
+			}
+		}
+		targets[e.Source] = target
+	}
+	stmts := make(map[string]*sql.Stmt)
+	for _, e := range events {
+		target := targets[e.Source]
+		stmt, ok := stmts[target.table]
+		if !ok {
+			if stmt, err = tx.Prepare(target.insertSQL()); err != nil {
+				tx.Rollback()
+				return err
+			}
+			stmts[target.table] = stmt
+		}
+		labels, err := encodeLabels(e.Labels)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		payload, compressed := encodePayload(e.Payload)
+		if _, err := stmt.Exec(target.args(e.Payload, e.Timestamp, e.Source, e.Type, payload, labels, compressed, seqValue(e.Seq), sessionValue(e.SessionID))...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, table := range created {
+		state.created.Store(table, struct{}{})
+	}
+	return nil
+}
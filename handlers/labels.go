@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"github.com/unklstewy/redbug_dewey/utils"
+)
+
+// encodeLabels returns the labels column value: a JSON object, or NULL when
+// there are no labels.
+func encodeLabels(labels map[string]string) (interface{}, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// SetCaptureLabels sets labels stamped on every event ingested by the next
+// capture, e.g. a session name or ticket id. Pass nil for no labels.
+func SetCaptureLabels(labels map[string]string) {
+	captureManager.SetLabels(labels)
+}
+
+// SetLabels sets labels stamped on every event this manager ingests
+func (cm *CaptureManager) SetLabels(labels map[string]string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.labels = nil
+	if len(labels) > 0 {
+		cm.labels = make(map[string]string, len(labels))
+		for k, v := range labels {
+			cm.labels[k] = v
+		}
+	}
+}
+
+// labelPath returns the JSON1 path selecting key from a labels object
+func labelPath(key string) string {
+	return `$."` + strings.ReplaceAll(key, `"`, `\"`) + `"`
+}
+
+// requireSQLiteFeature returns utils.ErrFeatureUnavailable unless db's SQLite
+// library has feature (see utils.Capabilities.Require). The capabilities are
+// looked up once per database, until CloseTimeseriesDB.
+func requireSQLiteFeature(db *sql.DB, feature string) error {
+	st := timeseriesState(db)
+	caps := st.caps.Load()
+	if caps == nil {
+		c, err := utils.SQLiteCapabilities(db)
+		if err != nil {
+			return err
+		}
+		st.caps.CompareAndSwap(nil, &c)
+		caps = st.caps.Load()
+	}
+	return caps.Require(feature)
+}
+
+// QueryByLabel returns the events, across all partitions, whose label key is
+// set to value, ordered by timestamp. It needs SQLite's JSON1 functions.
+func QueryByLabel(db *sql.DB, key, value string) ([]TimeseriesEvent, error) {
+	if err := requireSQLiteFeature(db, "json1"); err != nil {
+		return nil, err
+	}
+	tables, err := allTimeseriesTables(db)
+	if err != nil || len(tables) == 0 {
+		return nil, err
+	}
+	query, args := unionSelect(tables, eventColumns, "labels IS NOT NULL AND json_extract(labels, ?) = ?", labelPath(key), value)
+	return queryEvents(db, query+" ORDER BY timestamp", args...)
+}
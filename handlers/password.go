@@ -0,0 +1,32 @@
+package handlers
+
+import "github.com/unklstewy/redbug_dewey/models"
+
+// PasswordHasher hashes and verifies user passwords for the user handlers
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Compare(password, hash string) bool
+}
+
+// BcryptHasher is the default PasswordHasher
+type BcryptHasher struct{}
+
+func (BcryptHasher) Hash(password string) (string, error) {
+	return models.HashPassword(password)
+}
+
+func (BcryptHasher) Compare(password, hash string) bool {
+	return models.CheckPasswordHash(password, hash)
+}
+
+var passwordHasher PasswordHasher = BcryptHasher{}
+
+// SetPasswordHasher replaces the hasher used by CreateUser, ResetUserPassword
+// and authentication, e.g. with a fast stub in tests. Hashes are not portable
+// between hashers. Pass nil to restore bcrypt.
+func SetPasswordHasher(h PasswordHasher) {
+	if h == nil {
+		h = BcryptHasher{}
+	}
+	passwordHasher = h
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"sync/atomic"
+)
+
+// payloadCompressThreshold is the payload size compression applies from; 0 disables it
+var payloadCompressThreshold atomic.Int64
+
+// SetPayloadCompression stores payloads of at least threshold bytes gzipped
+// and base64-encoded, with the row's compressed flag set. Queries decompress
+// them transparently, and rows written either way coexist. Pass 0 to store
+// payloads as-is (the default).
+func SetPayloadCompression(threshold int) {
+	payloadCompressThreshold.Store(int64(threshold))
+}
+
+// encodePayload returns the stored form of payload and whether it is
+// compressed. Payloads that don't shrink are stored as-is.
+func encodePayload(payload string) (string, bool) {
+	threshold := payloadCompressThreshold.Load()
+	if threshold <= 0 || int64(len(payload)) < threshold {
+		return payload, false
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(payload))
+	if err := zw.Close(); err != nil {
+		return payload, false
+	}
+	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+	if len(encoded) >= len(payload) {
+		return payload, false
+	}
+	return encoded, true
+}
+
+// decodePayload reverses encodePayload
+func decodePayload(stored string, compressed bool) (string, error) {
+	if !compressed {
+		return stored, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return "", err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import "strings"
+
+// Defaults for captured events whose source/type are not parsed from the line
+const (
+	defaultCaptureSource = "capture"
+	defaultCaptureType   = "stream"
+)
+
+// LinePrefixParser extracts a leading "<source> <type> " prefix from captured
+// lines such as "serial read 0a 0b", storing the rest as the payload. Lines
+// without a well-formed prefix keep the defaults and their full text.
+type LinePrefixParser struct {
+	Sources       []string // accepted source names; any lowercase identifier when empty
+	DefaultSource string   // "capture" when empty
+	DefaultType   string   // "stream" when empty
+}
+
+// SetCapturePrefixParser enables prefix parsing for the next capture. Pass
+// nil to store every line as source "capture", type "stream" (the default).
+func SetCapturePrefixParser(p *LinePrefixParser) {
+	captureManager.mu.Lock()
+	captureManager.prefixParser = p
+	captureManager.mu.Unlock()
+}
+
+// isPrefixToken reports whether s looks like a source or type name
+func isPrefixToken(s string) bool {
+	if s == "" || s[0] < 'a' || s[0] > 'z' {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse returns the source, type and payload for line
+func (p *LinePrefixParser) Parse(line string) (source, eventType, payload string) {
+	source, eventType, payload = p.DefaultSource, p.DefaultType, line
+	if source == "" {
+		source = defaultCaptureSource
+	}
+	if eventType == "" {
+		eventType = defaultCaptureType
+	}
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 || !isPrefixToken(fields[0]) || !isPrefixToken(fields[1]) {
+		return
+	}
+	if len(p.Sources) > 0 && !containsString(p.Sources, fields[0]) {
+		return
+	}
+	source, eventType, payload = fields[0], fields[1], ""
+	if len(fields) == 3 {
+		payload = fields[2]
+	}
+	return
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import "regexp"
+
+// RedactionRule replaces every match of Pattern in a captured record with
+// Replacement before the record is buffered, so the raw value never reaches
+// the disk buffer or the DB. A CaptureTee still gets the raw record.
+type RedactionRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// SetCaptureRedactions sets the redaction rules applied by the next capture.
+// Redaction is off when rules is empty (the default).
+func SetCaptureRedactions(rules []RedactionRule) {
+	captureManager.mu.Lock()
+	captureManager.redactions = rules
+	captureManager.mu.Unlock()
+}
+
+// redact applies rules to line in order and returns the result along with the
+// number of matches replaced. line is returned unchanged if nothing matched.
+func redact(rules []RedactionRule, line []byte) ([]byte, int) {
+	count := 0
+	for _, r := range rules {
+		matches := len(r.Pattern.FindAllIndex(line, -1))
+		if matches == 0 {
+			continue
+		}
+		count += matches
+		line = r.Pattern.ReplaceAll(line, []byte(r.Replacement))
+	}
+	return line, count
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/unklstewy/redbug_dewey/utils"
+)
+
+var (
+	// ErrUnknownRole is returned when granting permissions to a role that
+	// doesn't exist
+	ErrUnknownRole = errors.New("unknown role")
+	// ErrUnknownPermission is returned when granting permissions that don't
+	// exist
+	ErrUnknownPermission = errors.New("unknown permission")
+)
+
+// GrantPermissionToRole grants one permission to a role, like
+// GrantPermissionsToRole
+func GrantPermissionToRole(db *sql.DB, roleID, permissionID int) error {
+	return GrantPermissionsToRole(db, roleID, []int{permissionID})
+}
+
+// GrantPermissionsToRole grants each of permissionIDs to a role in one
+// transaction. Permissions the role already has are left as they are. If
+// the role or any permission doesn't exist nothing is granted, and the error
+// wraps ErrUnknownRole or ErrUnknownPermission, naming every unknown id.
+func GrantPermissionsToRole(db *sql.DB, roleID int, permissionIDs []int) error {
+	return utils.RetryOnBusy(func() error { return grantPermissionsToRole(db, roleID, permissionIDs) })
+}
+
+func grantPermissionsToRole(db *sql.DB, roleID int, permissionIDs []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var exists int
+	if err := tx.QueryRow("SELECT 1 FROM role WHERE id = ?", roleID).Scan(&exists); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("role %d: %w", roleID, ErrUnknownRole)
+		}
+		return err
+	}
+	var unknown []int
+	for _, id := range permissionIDs {
+		if err := tx.QueryRow("SELECT 1 FROM permission WHERE id = ?", id).Scan(&exists); err != nil {
+			if err != sql.ErrNoRows {
+				return err
+			}
+			unknown = append(unknown, id)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("permissions %v: %w", unknown, ErrUnknownPermission)
+	}
+	for _, id := range permissionIDs {
+		if err := utils.InsertRolePermission(tx, roleID, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RolePermissionIDs returns the ids of the permissions granted to a role, in
+// ascending order
+func RolePermissionIDs(db *sql.DB, roleID int) ([]int, error) {
+	rows, err := db.Query("SELECT permission_id FROM role_permission WHERE role_id = ? ORDER BY permission_id", roleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
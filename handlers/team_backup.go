@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/unklstewy/redbug_dewey/models"
+	"github.com/unklstewy/redbug_dewey/utils"
+)
+
+// BackupTablePermissionPrefix prefixes the name of a permission that lets
+// the teams granted it export a whole table, e.g. "backup:pulitzer"
+const BackupTablePermissionPrefix = "backup:"
+
+// PartialBackupType is the backup_type recorded for team-scoped backups
+const PartialBackupType = "partial"
+
+// ErrNoTeamScope is returned when a user leads no team, so has nothing to
+// back up
+var ErrNoTeamScope = errors.New("user leads no team")
+
+// teamBackupRedact are the columns a team backup never exports
+var teamBackupRedact = map[string][]string{
+	"user":           {"password_hash"},
+	"authentication": {"password"},
+}
+
+// TeamBackupScope returns what the leader of user id leaderID may export:
+// the teams they lead with their member, permission and metadata rows, the
+// users, roles and permissions those rows refer to, and every table named
+// by a granted BackupTablePermissionPrefix permission. Password columns are
+// redacted.
+func TeamBackupScope(db *sql.DB, leaderID int) (utils.BackupScope, error) {
+	scope := utils.BackupScope{Rows: make(map[string][]int64), Redact: teamBackupRedact}
+	// The referenced rows are listed explicitly, as tables created by gorm
+	// declare no foreign keys to follow
+	queries := map[string]string{
+		"team":            "SELECT id FROM team WHERE leader_id = ?",
+		"team_member":     "SELECT id FROM team_member WHERE team_id IN (SELECT id FROM team WHERE leader_id = ?)",
+		"team_permission": "SELECT id FROM team_permission WHERE team_id IN (SELECT id FROM team WHERE leader_id = ?)",
+		"team_metadata":   "SELECT id FROM team_metadata WHERE team_id IN (SELECT id FROM team WHERE leader_id = ?)",
+		"user": `SELECT id FROM user WHERE id = ?1 OR id IN (SELECT user_id FROM team_member
+			WHERE team_id IN (SELECT id FROM team WHERE leader_id = ?1))`,
+		"role": `SELECT id FROM role WHERE id IN (SELECT role_id FROM team_member
+			WHERE team_id IN (SELECT id FROM team WHERE leader_id = ?))`,
+		"permission": `SELECT id FROM permission WHERE id IN (SELECT permission_id FROM team_permission
+			WHERE team_id IN (SELECT id FROM team WHERE leader_id = ?))`,
+	}
+	for table, query := range queries {
+		ids, err := queryIDs(db, query, leaderID)
+		if err != nil {
+			return utils.BackupScope{}, err
+		}
+		scope.Rows[table] = ids
+	}
+	if len(scope.Rows["team"]) == 0 {
+		return utils.BackupScope{}, ErrNoTeamScope
+	}
+	rows, err := db.Query(`SELECT DISTINCT p.name FROM permission p
+		JOIN team_permission tp ON tp.permission_id = p.id
+		JOIN team t ON t.id = tp.team_id
+		WHERE t.leader_id = ? AND p.name LIKE ?`, leaderID, BackupTablePermissionPrefix+"%")
+	if err != nil {
+		return utils.BackupScope{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return utils.BackupScope{}, err
+		}
+		table := strings.TrimPrefix(name, BackupTablePermissionPrefix)
+		var exists int
+		if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&exists); err != nil {
+			return utils.BackupScope{}, err
+		}
+		// A whole-table grant overrides the rows listed above
+		if exists > 0 {
+			delete(scope.Rows, table)
+			scope.Tables = append(scope.Tables, table)
+		}
+	}
+	return scope, rows.Err()
+}
+
+// queryIDs runs a query selecting one integer column
+func queryIDs(db *sql.DB, query string, args ...interface{}) ([]int64, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// RunPartialBackup writes the team scope of leaderID to backupPath as a SQL
+// dump and records it as a PartialBackupType backup, like RunBackup. It fails
+// with context.Canceled if CancelBackup stops it.
+func RunPartialBackup(db *sql.DB, leaderID int, backupPath string) (utils.BackupResult, *models.BackupMetadata, error) {
+	ctx, done, err := beginBackupOp("backup", backupPath)
+	if err != nil {
+		return utils.BackupResult{}, nil, err
+	}
+	defer done()
+	start := time.Now()
+	scope, err := TeamBackupScope(db, leaderID)
+	if err != nil {
+		return utils.BackupResult{}, nil, err
+	}
+	result, err := utils.PartialBackupScopedContext(ctx, db, backupPath, scope)
+	if err != nil {
+		return result, nil, err
+	}
+	meta := &models.BackupMetadata{
+		BackupType: PartialBackupType,
+		Timestamp:  start.UTC().Format(time.RFC3339),
+		FilePath:   result.Path,
+		Size:       result.Size,
+		Duration:   result.Duration.Milliseconds(),
+		Status:     "completed",
+		Checksum:   result.Checksum,
+	}
+	if _, err := RecordBackup(db, meta); err != nil {
+		return result, nil, err
+	}
+	return result, meta, nil
+}
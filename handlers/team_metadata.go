@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/unklstewy/redbug_dewey/models"
+)
+
+// ErrInvalidTeamMetadata is returned for a team metadata key or value, or a
+// description, that fails validation
+var ErrInvalidTeamMetadata = errors.New("invalid team metadata")
+
+const (
+	// MaxTeamMetadataKeyLen caps the length of a team metadata key
+	MaxTeamMetadataKeyLen = 64
+	// MaxTeamMetadataValueLen caps the size in bytes of a metadata value
+	MaxTeamMetadataValueLen = 1024
+	// MaxTeamDescriptionLen caps the size in bytes of a team description
+	MaxTeamDescriptionLen = 4096
+)
+
+// teamMetadataKey is the form of a metadata key, e.g. "region" or
+// "contact.email"
+var teamMetadataKey = regexp.MustCompile(`^[a-z][a-z0-9_.-]*$`)
+
+// validateTeamMetadata checks a metadata key and value against the limits
+func validateTeamMetadata(key, value string) error {
+	switch {
+	case len(key) > MaxTeamMetadataKeyLen:
+		return fmt.Errorf("%w: key %q is longer than %d characters", ErrInvalidTeamMetadata, key, MaxTeamMetadataKeyLen)
+	case !teamMetadataKey.MatchString(key):
+		return fmt.Errorf("%w: key %q must be lowercase letters, digits, '_', '.' or '-', starting with a letter", ErrInvalidTeamMetadata, key)
+	case len(value) > MaxTeamMetadataValueLen:
+		return fmt.Errorf("%w: value of %q is longer than %d bytes", ErrInvalidTeamMetadata, key, MaxTeamMetadataValueLen)
+	}
+	return nil
+}
+
+// teamExists returns sql.ErrNoRows if there is no team teamID
+func teamExists(db *sql.DB, teamID int) error {
+	var id int
+	return db.QueryRow("SELECT id FROM team WHERE id = ?", teamID).Scan(&id)
+}
+
+// SetTeamDescription sets a team's description, or returns sql.ErrNoRows if
+// the team doesn't exist
+func SetTeamDescription(db *sql.DB, teamID int, description string) error {
+	if len(description) > MaxTeamDescriptionLen {
+		return fmt.Errorf("%w: description is longer than %d bytes", ErrInvalidTeamMetadata, MaxTeamDescriptionLen)
+	}
+	res, err := execRetry(db, "UPDATE team SET description = ? WHERE id = ?", description, teamID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetTeamMetadata sets the metadata key of a team to value, replacing any
+// value it had. It returns sql.ErrNoRows if the team doesn't exist.
+func SetTeamMetadata(db *sql.DB, teamID int, key, value string) error {
+	if err := validateTeamMetadata(key, value); err != nil {
+		return err
+	}
+	if err := teamExists(db, teamID); err != nil {
+		return err
+	}
+	_, err := execRetry(db,
+		`INSERT INTO team_metadata (team_id, key, value) VALUES (?, ?, ?)
+		 ON CONFLICT(team_id, key) DO UPDATE SET value = excluded.value`,
+		teamID, key, value)
+	return err
+}
+
+// DeleteTeamMetadata removes the metadata key of a team; removing a key the
+// team doesn't have is a no-op
+func DeleteTeamMetadata(db *sql.DB, teamID int, key string) error {
+	_, err := execRetry(db, "DELETE FROM team_metadata WHERE team_id = ? AND key = ?", teamID, key)
+	return err
+}
+
+// GetTeamMetadata returns a team's metadata by key; empty if it has none
+func GetTeamMetadata(db *sql.DB, teamID int) (map[string]string, error) {
+	rows, err := db.Query("SELECT key, value FROM team_metadata WHERE team_id = ?", teamID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	metadata := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		metadata[key] = value
+	}
+	return metadata, rows.Err()
+}
+
+// TeamDetail is a team with everything the team directory shows about it
+type TeamDetail struct {
+	models.Team
+	Leader      string              `json:"leader"` // the leader's username; empty if the user is gone
+	Members     []models.TeamMember `json:"members"`
+	Permissions []models.Permission `json:"permissions"`
+	Metadata    map[string]string   `json:"metadata"`
+}
+
+// GetTeamDetail returns team teamID with its leader, members, permissions
+// and metadata, or sql.ErrNoRows if the team doesn't exist
+func GetTeamDetail(db *sql.DB, teamID int) (*TeamDetail, error) {
+	d := &TeamDetail{Members: []models.TeamMember{}, Permissions: []models.Permission{}}
+	var description, leader sql.NullString
+	err := db.QueryRow(`SELECT t.id, COALESCE(t.name, ''), COALESCE(t.leader_id, 0), t.description, u.username
+		FROM team t LEFT JOIN user u ON u.id = t.leader_id WHERE t.id = ?`, teamID).
+		Scan(&d.ID, &d.Name, &d.LeaderID, &description, &leader)
+	if err != nil {
+		return nil, err
+	}
+	d.Description = description.String
+	d.Leader = leader.String
+
+	rows, err := db.Query("SELECT id, team_id, user_id, COALESCE(role_id, 0) FROM team_member WHERE team_id = ? ORDER BY id", teamID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var m models.TeamMember
+		if err := rows.Scan(&m.ID, &m.TeamID, &m.UserID, &m.RoleID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d.Members = append(d.Members, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`SELECT p.id, COALESCE(p.name, '') FROM permission p
+		JOIN team_permission tp ON tp.permission_id = p.id WHERE tp.team_id = ? ORDER BY p.id`, teamID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var p models.Permission
+		if err := rows.Scan(&p.ID, &p.Name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d.Permissions = append(d.Permissions, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if d.Metadata, err = GetTeamMetadata(db, teamID); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
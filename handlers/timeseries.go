@@ -0,0 +1,482 @@
+package handlers
+
+import (
+	"container/heap"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// MergeTimeseriesDBs copies the events of src into dst's timeseries_event
+// table in a single transaction, so the merge is all-or-nothing. Every table
+// of src that holds events is read: timeseries_event, its partitions and
+// typed tables, found by name whether or not partitioning is enabled.
+// Source ids are not preserved; dst assigns fresh ids to avoid collisions
+// with existing rows. Rows are streamed, so src may be larger than memory.
+// It returns the number of rows merged.
+func MergeTimeseriesDBs(dst, src *sql.DB) (int, error) {
+	if err := CreateTimeseriesTable(dst); err != nil {
+		return 0, err
+	}
+	tables, err := storedTimeseriesTables(src)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := dst.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(insertEventSQL(timeseriesBaseTable))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	merged := 0
+	for _, table := range tables {
+		n, err := mergeStoredTable(stmt, src, table)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", table, err)
+		}
+		merged += n
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return merged, nil
+}
+
+// mergeStoredTable inserts every event of table in src with stmt, a
+// prepared insertEventSQL, and returns how many it inserted
+func mergeStoredTable(stmt *sql.Stmt, src *sql.DB, table string) (int, error) {
+	query, err := storedEventQuery(src, table)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := src.Query(query + ` ORDER BY id`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	merged := 0
+	for rows.Next() {
+		var e storedEvent
+		if err := e.scan(rows); err != nil {
+			return 0, err
+		}
+		if _, err := stmt.Exec(e.args()...); err != nil {
+			return 0, err
+		}
+		merged++
+	}
+	return merged, rows.Err()
+}
+
+// MergeTimeseriesOrdered copies the events of every source into dst's
+// timeseries_event table as one time-ordered stream, like
+// MergeTimeseriesDBs: each table of each source (timeseries_event, its
+// partitions and typed tables, found by name whether or not partitioning is
+// enabled) is read in time order and they are all merged, so dst assigns its
+// fresh ids in chronological order. Timestamps are compared as times, so
+// rows stored in different formats or at different UTC offsets still
+// interleave correctly; within a table SQLite orders them to the
+// millisecond. Events at the same time keep their order within a table and
+// otherwise go in the order of srcs, then of tables. Only one row per table
+// is held at a time, so sources may be larger than memory. Rows already in
+// dst are left as they are. It returns the number of rows merged.
+func MergeTimeseriesOrdered(dst *sql.DB, srcs []*sql.DB) (int, error) {
+	if err := CreateTimeseriesTable(dst); err != nil {
+		return 0, err
+	}
+	var cursors eventCursors
+	defer func() {
+		for _, c := range cursors {
+			c.rows.Close()
+		}
+	}()
+	for i, src := range srcs {
+		tables, err := storedTimeseriesTables(src)
+		if err != nil {
+			return 0, fmt.Errorf("source %d: %w", i, err)
+		}
+		for j, table := range tables {
+			query, err := storedEventQuery(src, table)
+			if err != nil {
+				return 0, fmt.Errorf("source %d: %s: %w", i, table, err)
+			}
+			// julianday() reads every format SQLite knows, offsets included
+			rows, err := src.Query(query + ` ORDER BY julianday(timestamp), timestamp, id`)
+			if err != nil {
+				return 0, fmt.Errorf("source %d: %s: %w", i, table, err)
+			}
+			c := &eventCursor{rows: rows, src: i, table: j}
+			ok, err := c.next()
+			if err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("source %d: %s: %w", i, table, err)
+			}
+			if ok {
+				cursors = append(cursors, c)
+			} else {
+				rows.Close()
+			}
+		}
+	}
+	heap.Init(&cursors)
+
+	tx, err := dst.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(insertEventSQL(timeseriesBaseTable))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	merged := 0
+	for cursors.Len() > 0 {
+		c := cursors[0]
+		if _, err := stmt.Exec(c.event.args()...); err != nil {
+			return 0, err
+		}
+		merged++
+		ok, err := c.next()
+		if err != nil {
+			return 0, fmt.Errorf("source %d: %w", c.src, err)
+		}
+		if ok {
+			heap.Fix(&cursors, 0)
+		} else {
+			c.rows.Close()
+			heap.Pop(&cursors)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return merged, nil
+}
+
+// storedEvent is a timeseries_event row as stored, for copying between DBs
+type storedEvent struct {
+	// The timestamp is scanned generically so it is written back exactly
+	// as stored
+	ts                         interface{}
+	source, eventType, payload string
+	labels                     sql.NullString
+	compressed                 bool
+	seq                        sql.NullInt64
+	sessionID                  sql.NullString
+}
+
+// storedEventQuery returns the query selecting the rows of one of src's
+// timeseries tables for storedEvent.scan. The table may predate the labels
+// column and later ones; it is only read, never upgraded.
+func storedEventQuery(src *sql.DB, table string) (string, error) {
+	srcCols, err := tableColumns(src, table)
+	if err != nil {
+		return "", err
+	}
+	labelsCol, compressedCol, seqCol, sessionCol := "NULL", "0", "NULL", "NULL"
+	if srcCols["labels"] {
+		labelsCol = "labels"
+	}
+	if srcCols["compressed"] {
+		compressedCol = "compressed"
+	}
+	if srcCols["seq"] {
+		seqCol = "seq"
+	}
+	if srcCols["session_id"] {
+		sessionCol = "session_id"
+	}
+	// Payloads are copied in their stored form, compressed or not
+	return `SELECT timestamp, source, type, payload, ` + labelsCol + `, ` + compressedCol + `, ` + seqCol + `, ` + sessionCol + ` FROM "` + table + `"`, nil
+}
+
+// storedTimeseriesTables returns the tables of src that hold events:
+// timeseries_event if present, every partition and every typed table. It
+// goes by the tables src has, not by this process's partitioning setting.
+func storedTimeseriesTables(src *sql.DB) ([]string, error) {
+	tables, err := existingTables(src, []string{timeseriesBaseTable})
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := TimeseriesPartitions(src)
+	if err != nil {
+		return nil, err
+	}
+	typed, err := typedTables(src)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(tables, partitions...), typed...), nil
+}
+
+func (e *storedEvent) scan(rows *sql.Rows) error {
+	return rows.Scan(&e.ts, &e.source, &e.eventType, &e.payload, &e.labels, &e.compressed, &e.seq, &e.sessionID)
+}
+
+// args returns the arguments inserting e with insertEventSQL
+func (e *storedEvent) args() []interface{} {
+	return []interface{}{e.ts, e.source, e.eventType, e.payload, e.labels, e.compressed, e.seq, e.sessionID}
+}
+
+// time returns e's timestamp, or the zero time if it can't be parsed
+func (e *storedEvent) time() time.Time {
+	var s string
+	switch v := e.ts.(type) {
+	case time.Time:
+		return v
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return time.Time{}
+	}
+	for _, layout := range append([]string{time.RFC3339Nano}, sqlite3.SQLiteTimestampFormats...) {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// eventCursor is a source being merged by MergeTimeseriesOrdered, positioned
+// on its next row
+type eventCursor struct {
+	rows  *sql.Rows
+	src   int // index in srcs
+	table int // index in the source's storedTimeseriesTables
+	event storedEvent
+	at    time.Time
+}
+
+// next moves c to its next row, returning false at the end of the source
+func (c *eventCursor) next() (bool, error) {
+	if !c.rows.Next() {
+		return false, c.rows.Err()
+	}
+	if err := c.event.scan(c.rows); err != nil {
+		return false, err
+	}
+	c.at = c.event.time()
+	return true, nil
+}
+
+// eventCursors is a heap of cursors, earliest next row first
+type eventCursors []*eventCursor
+
+func (h eventCursors) Len() int { return len(h) }
+func (h eventCursors) Less(i, j int) bool {
+	if !h[i].at.Equal(h[j].at) {
+		return h[i].at.Before(h[j].at)
+	}
+	if h[i].src != h[j].src {
+		return h[i].src < h[j].src
+	}
+	return h[i].table < h[j].table
+}
+func (h eventCursors) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *eventCursors) Push(x interface{}) { *h = append(*h, x.(*eventCursor)) }
+func (h *eventCursors) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// ReprocessEvents streams the events from source in [start, end] through
+// transform and inserts the events it returns, leaving the originals intact.
+// Derived events with a zero Timestamp or nil Labels inherit the original's. The
+// run is a single transaction, so a transform error inserts nothing. It
+// returns the number of derived events inserted.
+func ReprocessEvents(db *sql.DB, source string, transform func(TimeseriesEvent) ([]TimeseriesEvent, error), start, end time.Time) (int, error) {
+	tables, err := sourceTables(db, source)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	inserted := 0
+	created := make(map[string]bool)
+	for _, table := range tables {
+		n, err := reprocessTable(db, tx, table, source, transform, start, end, created)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		inserted += n
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return inserted, nil
+}
+
+func reprocessTable(db *sql.DB, tx *sql.Tx, table, source string, transform func(TimeseriesEvent) ([]TimeseriesEvent, error), start, end time.Time, created map[string]bool) (int, error) {
+	// Rows derived into the same table must not be fed back through transform
+	var maxID int64
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM "` + table + `"`).Scan(&maxID); err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(`SELECT `+eventColumns+` FROM "`+table+`" WHERE source = ? AND timestamp BETWEEN ? AND ? AND id <= ? ORDER BY timestamp, id`,
+		source, start, end, maxID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	inserted := 0
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return 0, err
+		}
+		derived, err := transform(e)
+		if err != nil {
+			return 0, fmt.Errorf("transform event %d: %w", e.ID, err)
+		}
+		for _, d := range derived {
+			if d.Timestamp.IsZero() {
+				d.Timestamp = e.Timestamp
+			}
+			if d.Labels == nil {
+				d.Labels = e.Labels
+			}
+			if d.SessionID == "" {
+				d.SessionID = e.SessionID
+			}
+			labels, err := encodeLabels(d.Labels)
+			if err != nil {
+				return 0, err
+			}
+			out := sourceTarget(db, d.Source)
+			if out.table != timeseriesBaseTable && !created[out.table] {
+				if err := out.create(tx); err != nil {
+					return 0, err
+				}
+				created[out.table] = true
+			}
+			payload, compressed := encodePayload(d.Payload)
+			if _, err := tx.Exec(out.insertSQL(), out.args(d.Payload, d.Timestamp, d.Source, d.Type, payload, labels, compressed, nil, sessionValue(d.SessionID))...); err != nil {
+				return 0, err
+			}
+			inserted++
+		}
+	}
+	return inserted, rows.Err()
+}
+
+// ErrRowCapExceeded is returned by QueryGroupedByType when the range holds
+// more events than the grouped query row cap
+var ErrRowCapExceeded = errors.New("query matches more events than the row cap")
+
+// groupedQueryRowCap bounds the events QueryGroupedByType loads into memory
+var groupedQueryRowCap atomic.Int64
+
+func init() {
+	groupedQueryRowCap.Store(100000)
+}
+
+// SetGroupedQueryRowCap sets the most events QueryGroupedByType returns in
+// total before failing with ErrRowCapExceeded. The default is 100000.
+func SetGroupedQueryRowCap(n int) {
+	groupedQueryRowCap.Store(int64(n))
+}
+
+// QueryGroupedByType retrieves a source's events of several types in one
+// query and returns them bucketed by type, each in timestamp order. Every
+// requested type has an entry, empty if it had no events.
+func QueryGroupedByType(db *sql.DB, source string, types []string, start, end time.Time) (map[string][]TimeseriesEvent, error) {
+	grouped := make(map[string][]TimeseriesEvent, len(types))
+	for _, t := range types {
+		grouped[t] = []TimeseriesEvent{}
+	}
+	if len(types) == 0 {
+		return grouped, nil
+	}
+	tables, err := sourceTables(db, source)
+	if err != nil || len(tables) == 0 {
+		return grouped, err
+	}
+	where := "source = ? AND type IN (?" + strings.Repeat(", ?", len(types)-1) + ") AND timestamp BETWEEN ? AND ?"
+	args := []interface{}{source}
+	for _, t := range types {
+		args = append(args, t)
+	}
+	args = append(args, start, end)
+	query, all := unionSelect(tables, eventColumns, where, args...)
+	limit := groupedQueryRowCap.Load()
+	// Fetch one past the cap to tell a full result from a truncated one
+	events, err := queryEvents(db, fmt.Sprintf("%s ORDER BY timestamp LIMIT %d", query, limit+1), all...)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(events)) > limit {
+		return nil, fmt.Errorf("%w (%d)", ErrRowCapExceeded, limit)
+	}
+	for _, e := range events {
+		grouped[e.Type] = append(grouped[e.Type], e)
+	}
+	return grouped, nil
+}
+
+// likeEscaper escapes LIKE wildcards for use with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// QueryTimeseriesEventsMatching retrieves events in [start, end] whose payload
+// contains the substring contains, matched case-insensitively for ASCII like
+// SQL LIKE. Wildcards in contains match literally. Compressed payloads are
+// checked after decompression. A limit of zero or less returns every match.
+func QueryTimeseriesEventsMatching(db *sql.DB, source, eventType, contains string, start, end time.Time, limit int) ([]TimeseriesEvent, error) {
+	tables, err := sourceTables(db, source)
+	if err != nil || len(tables) == 0 {
+		return nil, err
+	}
+	pattern := "%" + likeEscaper.Replace(contains) + "%"
+	query, args := unionSelect(tables, eventColumns,
+		`source = ? AND type = ? AND timestamp BETWEEN ? AND ? AND (compressed = 1 OR payload LIKE ? ESCAPE '\')`,
+		source, eventType, start, end, pattern)
+	rows, err := db.Query(query+" ORDER BY timestamp", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	needle := asciiLower(contains)
+	var events []TimeseriesEvent
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		// Compressed rows pass the SQL filter unchecked
+		if !strings.Contains(asciiLower(e.Payload), needle) {
+			continue
+		}
+		events = append(events, e)
+		if limit > 0 && len(events) == limit {
+			break
+		}
+	}
+	return events, rows.Err()
+}
+
+// asciiLower lowercases ASCII letters only, as SQLite's LIKE folds case
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PayloadEncodingLabel is the event label naming how its payload is encoded:
+// one of the PayloadEncoding values. Payloads without it, such as rows stored
+// before the label existed, are displayed as DetectPayloadEncoding guesses.
+const PayloadEncodingLabel = "encoding"
+
+// PayloadEncoding is how a payload's bytes are written in the payload column
+type PayloadEncoding string
+
+const (
+	EncodingText   PayloadEncoding = "text"
+	EncodingBase64 PayloadEncoding = "base64"
+	EncodingHex    PayloadEncoding = "hex"
+	EncodingJSON   PayloadEncoding = "json"
+)
+
+// DecodedEvent is an event with its payload decoded for display
+type DecodedEvent struct {
+	TimeseriesEvent
+	Decoded     string          `json:"decoded"`      // the payload as displayable text
+	Encoding    PayloadEncoding `json:"encoding"`     // the payload's encoding as stored
+	Detected    bool            `json:"detected"`     // Encoding was guessed, the payload having no encoding label
+	Compressed  bool            `json:"compressed"`   // stored gzip-compressed
+	Binary      bool            `json:"binary"`       // Decoded is a hex dump of non-text bytes
+	DecodeError string          `json:"decode_error"` // why Decoded is the raw payload, if decoding failed
+}
+
+// QueryDecodedEvents is QueryTimeseriesEventsWithOptions with each payload
+// decoded for display: decompressed, then decoded as its encoding label
+// says (or DetectPayloadEncoding guesses, without one), then shown as text if it is printable UTF-8 or as a hex dump if not.
+// A payload that fails to decode is shown as stored, with DecodeError set.
+func QueryDecodedEvents(db *sql.DB, source, eventType string, start, end time.Time, opts QueryOptions) ([]DecodedEvent, error) {
+	if _, err := ParseSortOrder(string(opts.Order)); err != nil {
+		return nil, err
+	}
+	tables, err := sourceTables(db, source)
+	if err != nil || len(tables) == 0 {
+		return nil, err
+	}
+	query, args := unionSelect(tables, eventColumns+", compressed AS stored_compressed", "source = ? AND type = ? AND timestamp BETWEEN ? AND ?", source, eventType, start, end)
+	query += opts.Order.orderBy()
+	if opts.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", opts.Limit)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []DecodedEvent
+	for rows.Next() {
+		var d DecodedEvent
+		// scanEvent has already undone compression
+		if d.TimeseriesEvent, err = scanEvent(rows, &d.Compressed); err != nil {
+			return nil, err
+		}
+		d.decode()
+		events = append(events, d)
+	}
+	return events, rows.Err()
+}
+
+// decode sets the decoded fields from the event's payload
+func (d *DecodedEvent) decode() {
+	if enc := d.Labels[PayloadEncodingLabel]; enc != "" {
+		d.Encoding = PayloadEncoding(strings.ToLower(enc))
+	} else {
+		d.Encoding, d.Detected = DetectPayloadEncoding(d.Payload), true
+	}
+	var raw []byte
+	var err error
+	switch d.Encoding {
+	case EncodingText, EncodingJSON:
+		raw = []byte(d.Payload)
+	case EncodingBase64:
+		raw, err = base64.StdEncoding.DecodeString(strings.TrimSpace(d.Payload))
+	case EncodingHex:
+		raw, err = hex.DecodeString(strings.TrimSpace(d.Payload))
+	default:
+		err = fmt.Errorf("unknown payload encoding %q", d.Encoding)
+	}
+	if err != nil {
+		d.Decoded = d.Payload
+		d.DecodeError = err.Error()
+		return
+	}
+	d.Decoded, d.Binary = displayPayload(raw)
+}
+
+// DetectPayloadEncoding guesses the encoding of a payload stored without an
+// encoding label: a JSON object or array, then base64 that decodes to
+// printable text, then an even number of hex digits, and otherwise text. It
+// is a best guess for display only; stored rows are never relabeled.
+func DetectPayloadEncoding(payload string) PayloadEncoding {
+	p := strings.TrimSpace(payload)
+	if p == "" {
+		return EncodingText
+	}
+	// Bare JSON numbers, strings and literals are more likely plain text
+	if (p[0] == '{' || p[0] == '[') && json.Valid([]byte(p)) {
+		return EncodingJSON
+	}
+	if raw, err := base64.StdEncoding.DecodeString(p); err == nil && len(raw) > 0 {
+		if _, binary := displayPayload(raw); !binary {
+			return EncodingBase64
+		}
+	}
+	if len(p)%2 == 0 {
+		if _, err := hex.DecodeString(p); err == nil {
+			return EncodingHex
+		}
+	}
+	return EncodingText
+}
+
+// displayPayload returns raw as text if it is printable UTF-8, otherwise as
+// space-separated hex bytes with binary set
+func displayPayload(raw []byte) (text string, binary bool) {
+	if utf8.Valid(raw) {
+		printable := true
+		for _, r := range string(raw) {
+			if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+				printable = false
+				break
+			}
+		}
+		if printable {
+			return string(raw), false
+		}
+	}
+	var b strings.Builder
+	for i, c := range raw {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%02x", c)
+	}
+	return b.String(), true
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SortOrder is the time order of query results
+type SortOrder string
+
+const (
+	Ascending  SortOrder = "asc" // oldest first, the default
+	Descending SortOrder = "desc"
+)
+
+// ErrInvalidOrder is returned for a sort order other than asc or desc
+var ErrInvalidOrder = errors.New("invalid sort order")
+
+// ParseSortOrder parses "asc" or "desc"; empty means Ascending
+func ParseSortOrder(s string) (SortOrder, error) {
+	switch o := SortOrder(strings.ToLower(s)); o {
+	case "", Ascending:
+		return Ascending, nil
+	case Descending:
+		return o, nil
+	}
+	return "", fmt.Errorf("%w %q: must be %s or %s", ErrInvalidOrder, s, Ascending, Descending)
+}
+
+// orderBy returns the ORDER BY clause for o over the union of timeseries
+// tables. Ties, such as events inserted in one batch, keep insertion order.
+func (o SortOrder) orderBy() string {
+	if o == Descending {
+		return " ORDER BY timestamp DESC, id DESC"
+	}
+	return " ORDER BY timestamp, id"
+}
+
+// QueryOptions controls QueryTimeseriesEventsWithOptions
+type QueryOptions struct {
+	Order SortOrder // Ascending if empty
+	Limit int       // at most this many events, from the start of the order; all if zero
+}
+
+// QueryTimeseriesEventsWithOptions is QueryTimeseriesEvents with a sort
+// order and limit, e.g. Descending with a limit for the newest events
+func QueryTimeseriesEventsWithOptions(db *sql.DB, source, eventType string, start, end time.Time, opts QueryOptions) ([]TimeseriesEvent, error) {
+	if _, err := ParseSortOrder(string(opts.Order)); err != nil {
+		return nil, err
+	}
+	tables, err := sourceTables(db, source)
+	if err != nil || len(tables) == 0 {
+		return nil, err
+	}
+	query, args := unionSelect(tables, eventColumns, "source = ? AND type = ? AND timestamp BETWEEN ? AND ?", source, eventType, start, end)
+	query += opts.Order.orderBy()
+	if opts.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", opts.Limit)
+	}
+	return queryEvents(db, query, args...)
+}
+
+// LatestPerType returns the most recent event of each of a source's types,
+// keyed by type. Types without events are absent. Of events sharing the
+// latest timestamp, the last inserted wins.
+func LatestPerType(db *sql.DB, source string, types []string) (map[string]TimeseriesEvent, error) {
+	latest := make(map[string]TimeseriesEvent, len(types))
+	if len(types) == 0 {
+		return latest, nil
+	}
+	tables, err := sourceTables(db, source)
+	if err != nil || len(tables) == 0 {
+		return latest, err
+	}
+	where := "source = ? AND type IN (?" + strings.Repeat(", ?", len(types)-1) + ")"
+	args := []interface{}{source}
+	for _, t := range types {
+		args = append(args, t)
+	}
+	inner, all := unionSelect(tables, eventColumns, where, args...)
+	query := `WITH e AS (` + inner + `)
+		SELECT ` + eventColumns + ` FROM e
+		JOIN (SELECT type AS latest_type, MAX(timestamp) AS latest_ts FROM e GROUP BY type) m
+		ON e.type = m.latest_type AND e.timestamp = m.latest_ts
+		ORDER BY e.id`
+	events, err := queryEvents(db, query, all...)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		latest[e.Type] = e
+	}
+	return latest, nil
+}
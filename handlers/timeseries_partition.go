@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unklstewy/redbug_dewey/utils"
+)
+
+const timeseriesBaseTable = "timeseries_event"
+
+// timeseriesDBs holds the timeseries state of each database handle, until
+// CloseTimeseriesDB
+var timeseriesDBs sync.Map
+
+// timeseriesDBState is one database's partitioning setting, the partition
+// tables already created in it and its SQLite capabilities, once looked up
+type timeseriesDBState struct {
+	partitioned atomic.Bool
+	created     sync.Map
+	caps        atomic.Pointer[utils.Capabilities]
+}
+
+// timeseriesState returns db's partitioning state, adding it on first use
+func timeseriesState(db *sql.DB) *timeseriesDBState {
+	if st, ok := timeseriesDBs.Load(db); ok {
+		return st.(*timeseriesDBState)
+	}
+	st, _ := timeseriesDBs.LoadOrStore(db, &timeseriesDBState{})
+	return st.(*timeseriesDBState)
+}
+
+// timeseriesPartitioned reports whether db routes each source to its own table
+func timeseriesPartitioned(db *sql.DB) bool {
+	st, ok := timeseriesDBs.Load(db)
+	return ok && st.(*timeseriesDBState).partitioned.Load()
+}
+
+// SetTimeseriesPartitioning enables or disables per-source partitioning of
+// db. When enabled, events are written to a table per source, created on
+// first use, and queries union the partitions with any rows still in the
+// shared timeseries_event table. Ids are only unique within one table.
+// Disabled (single-table mode) is the default.
+func SetTimeseriesPartitioning(db *sql.DB, enabled bool) {
+	timeseriesState(db).partitioned.Store(enabled)
+}
+
+// CloseTimeseriesDB closes db and forgets its partitioning setting and the
+// other state cached for it
+func CloseTimeseriesDB(db *sql.DB) error {
+	timeseriesDBs.Delete(db)
+	return db.Close()
+}
+
+// partitionTable returns the partition table name for source:
+// timeseries_event_<source>_<hash>. Characters that are not valid in a bare
+// identifier are replaced with '_', and the hash of the untouched source
+// keeps sources that sanitize alike in separate tables.
+func partitionTable(source string) string {
+	var b strings.Builder
+	b.WriteString(timeseriesBaseTable + "_")
+	for _, r := range strings.ToLower(source) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	sum := sha256.Sum256([]byte(source))
+	fmt.Fprintf(&b, "_%x", sum[:4])
+	return b.String()
+}
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func createTimeseriesTableNamed(db dbtx, table string) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "` + table + `" (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp DATETIME NOT NULL,
+			source TEXT NOT NULL,
+			type TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			labels TEXT,
+			compressed INTEGER NOT NULL DEFAULT 0,
+			seq INTEGER,
+			session_id TEXT
+		);
+	`)
+	if err != nil {
+		return err
+	}
+	return addMissingTimeseriesColumns(db, table)
+}
+
+// addMissingTimeseriesColumns upgrades tables created before optional
+// columns were added to the timeseries schema
+func addMissingTimeseriesColumns(db dbtx, table string) error {
+	cols, err := tableColumns(db, table)
+	if err != nil {
+		return err
+	}
+	if !cols["labels"] {
+		if _, err := db.Exec(`ALTER TABLE "` + table + `" ADD COLUMN labels TEXT`); err != nil {
+			return err
+		}
+	}
+	if !cols["compressed"] {
+		if _, err := db.Exec(`ALTER TABLE "` + table + `" ADD COLUMN compressed INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+	}
+	if !cols["seq"] {
+		if _, err := db.Exec(`ALTER TABLE "` + table + `" ADD COLUMN seq INTEGER`); err != nil {
+			return err
+		}
+	}
+	if !cols["session_id"] {
+		if _, err := db.Exec(`ALTER TABLE "` + table + `" ADD COLUMN session_id TEXT`); err != nil {
+			return err
+		}
+	}
+	return createSessionIndex(db, table)
+}
+
+// createSessionIndex indexes session_id for QueryBySession
+func createSessionIndex(db dbtx, table string) error {
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS "idx_` + table + `_session" ON "` + table + `" (session_id)`)
+	return err
+}
+
+// insertEventSQL returns the INSERT statement for a timeseries table, taking
+// timestamp, source, type, payload, labels, compressed, seq and session_id
+func insertEventSQL(table string) string {
+	return `INSERT INTO "` + table + `" (timestamp, source, type, payload, labels, compressed, seq, session_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+}
+
+// seqValue returns the seq column value: NULL for events without a sequence
+func seqValue(seq int64) interface{} {
+	if seq == 0 {
+		return nil
+	}
+	return seq
+}
+
+// sessionValue returns the session_id column value: NULL for events not
+// ingested by a recorded capture session
+func sessionValue(sessionID string) interface{} {
+	if sessionID == "" {
+		return nil
+	}
+	return sessionID
+}
+
+// tableColumns returns the set of column names in table
+func tableColumns(db dbtx, table string) (map[string]bool, error) {
+	rows, err := db.Query(`PRAGMA table_info("` + table + `")`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
+
+// timeseriesTable returns the target events from source are written to,
+// creating its partition or typed table on first use.
+func timeseriesTable(db *sql.DB, source string) (eventTarget, error) {
+	target := sourceTarget(db, source)
+	if target.table == timeseriesBaseTable {
+		return target, nil
+	}
+	created := &timeseriesState(db).created
+	if _, ok := created.Load(target.table); ok {
+		return target, nil
+	}
+	if err := target.create(db); err != nil {
+		return eventTarget{}, err
+	}
+	created.Store(target.table, struct{}{})
+	return target, nil
+}
+
+// TimeseriesPartitions lists the per-source partition tables present in db
+func TimeseriesPartitions(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE 'timeseries\_event\_%' ESCAPE '\' ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+// existingTables filters names down to the tables present in db
+func existingTables(db *sql.DB, names []string) ([]string, error) {
+	var tables []string
+	for _, name := range names {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			tables = append(tables, name)
+		}
+	}
+	return tables, nil
+}
+
+// sourceTables returns the tables that may hold events for source
+func sourceTables(db *sql.DB, source string) ([]string, error) {
+	tables := []string{timeseriesBaseTable}
+	if timeseriesPartitioned(db) {
+		var err error
+		if tables, err = existingTables(db, []string{timeseriesBaseTable, partitionTable(source)}); err != nil {
+			return nil, err
+		}
+	}
+	typed, err := typedTables(db)
+	if err != nil {
+		return nil, err
+	}
+	return append(tables, typed...), nil
+}
+
+// allTimeseriesTables returns the shared table (if present), every partition
+// and every typed table
+func allTimeseriesTables(db *sql.DB) ([]string, error) {
+	typed, err := typedTables(db)
+	if err != nil {
+		return nil, err
+	}
+	if !timeseriesPartitioned(db) {
+		return append([]string{timeseriesBaseTable}, typed...), nil
+	}
+	tables, err := existingTables(db, []string{timeseriesBaseTable})
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := TimeseriesPartitions(db)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(tables, partitions...), typed...), nil
+}
+
+// unionSelect builds "SELECT cols FROM t WHERE where" for each table joined
+// with UNION ALL, and repeats args once per table.
+func unionSelect(tables []string, cols, where string, args ...interface{}) (string, []interface{}) {
+	parts := make([]string, len(tables))
+	all := make([]interface{}, 0, len(args)*len(tables))
+	for i, t := range tables {
+		parts[i] = `SELECT ` + cols + ` FROM "` + t + `" WHERE ` + where
+		all = append(all, args...)
+	}
+	return strings.Join(parts, " UNION ALL "), all
+}
+
+// eventColumns is the column list scanned by scanEvent
+const eventColumns = "id, timestamp, source, type, payload, labels, compressed, seq, session_id"
+
+// scanEvent scans a row selected with eventColumns, followed by any extra
+// columns into extra
+func scanEvent(rows *sql.Rows, extra ...interface{}) (TimeseriesEvent, error) {
+	var e TimeseriesEvent
+	var ts string
+	var labels sql.NullString
+	var compressed bool
+	var seq sql.NullInt64
+	var sessionID sql.NullString
+	dest := append([]interface{}{&e.ID, &ts, &e.Source, &e.Type, &e.Payload, &labels, &compressed, &seq, &sessionID}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return e, err
+	}
+	e.Seq = seq.Int64
+	e.SessionID = sessionID.String
+	payload, err := decodePayload(e.Payload, compressed)
+	if err != nil {
+		return e, fmt.Errorf("event %d: decompress payload: %w", e.ID, err)
+	}
+	e.Payload = payload
+	e.Timestamp, _ = time.Parse(time.RFC3339Nano, ts)
+	if labels.Valid && labels.String != "" {
+		if err := json.Unmarshal([]byte(labels.String), &e.Labels); err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// queryEvents runs a query selecting eventColumns and scans the events
+func queryEvents(db *sql.DB, query string, args ...interface{}) ([]TimeseriesEvent, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []TimeseriesEvent
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// QueryTimeseriesEventsAllSources retrieves events of eventType in a time
+// range from every source, across all partitions.
+func QueryTimeseriesEventsAllSources(db *sql.DB, eventType string, start, end time.Time) ([]TimeseriesEvent, error) {
+	tables, err := allTimeseriesTables(db)
+	if err != nil || len(tables) == 0 {
+		return nil, err
+	}
+	query, args := unionSelect(tables, eventColumns, "type = ? AND timestamp BETWEEN ? AND ?", eventType, start, end)
+	return queryEvents(db, query+" ORDER BY timestamp", args...)
+}
+
+// CountTimeseriesEvents returns the number of events of source and
+// eventType in a time range, across all partitions.
+func CountTimeseriesEvents(db *sql.DB, source, eventType string, start, end time.Time) (int, error) {
+	tables, err := sourceTables(db, source)
+	if err != nil || len(tables) == 0 {
+		return 0, err
+	}
+	inner, args := unionSelect(tables, "id", "source = ? AND type = ? AND timestamp BETWEEN ? AND ?", source, eventType, start, end)
+	var n int
+	err = db.QueryRow(`SELECT COUNT(*) FROM (`+inner+`)`, args...).Scan(&n)
+	return n, err
+}
+
+// CountTimeseriesEventsBySource returns the number of events per source in a
+// time range, across all partitions.
+func CountTimeseriesEventsBySource(db *sql.DB, start, end time.Time) (map[string]int, error) {
+	tables, err := allTimeseriesTables(db)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	if len(tables) == 0 {
+		return counts, nil
+	}
+	inner, args := unionSelect(tables, "source", "timestamp BETWEEN ? AND ?", start, end)
+	rows, err := db.Query(`SELECT source, COUNT(*) FROM (`+inner+`) GROUP BY source`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var source string
+		var n int
+		if err := rows.Scan(&source, &n); err != nil {
+			return nil, err
+		}
+		counts[source] = n
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EventFields lists the fields QueryTimeseriesEventFields can project, in
+// output order
+var EventFields = []string{"id", "timestamp", "source", "type", "payload", "labels", "seq", "session_id"}
+
+// ErrUnknownField is returned for a projection naming a field not in EventFields
+var ErrUnknownField = errors.New("unknown event field")
+
+// EventProjection is a timeseries event restricted to the projected fields.
+// Fields that were not projected are zero and omitted from its JSON.
+type EventProjection struct {
+	ID        int64             `json:"id,omitempty"`
+	Timestamp *time.Time        `json:"timestamp,omitempty"`
+	Source    string            `json:"source,omitempty"`
+	Type      string            `json:"type,omitempty"`
+	Payload   *string           `json:"payload,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Seq       int64             `json:"seq,omitempty"`
+	SessionID string            `json:"session_id,omitempty"`
+}
+
+// QueryTimeseriesEventFields is QueryTimeseriesEvents loading only fields,
+// so dashboards that need timestamps and types skip reading payloads. No
+// fields means all of them.
+func QueryTimeseriesEventFields(db *sql.DB, source, eventType string, start, end time.Time, fields []string) ([]EventProjection, error) {
+	return queryTimeseriesEventFields(db, source, eventType, start, end, fields, Ascending)
+}
+
+// queryTimeseriesEventFields is QueryTimeseriesEventFields in order
+func queryTimeseriesEventFields(db *sql.DB, source, eventType string, start, end time.Time, fields []string, order SortOrder) ([]EventProjection, error) {
+	if len(fields) == 0 {
+		fields = EventFields
+	}
+	want := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if !isEventField(f) {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownField, f)
+		}
+		want[f] = true
+	}
+	// Always select the sort keys; compressed goes with payload
+	var cols []string
+	for _, f := range EventFields {
+		if want[f] || f == "timestamp" || f == "id" {
+			cols = append(cols, f)
+		}
+	}
+	if want["payload"] {
+		cols = append(cols, "compressed")
+	}
+	tables, err := sourceTables(db, source)
+	if err != nil || len(tables) == 0 {
+		return nil, err
+	}
+	query, args := unionSelect(tables, strings.Join(cols, ", "), "source = ? AND type = ? AND timestamp BETWEEN ? AND ?", source, eventType, start, end)
+	rows, err := db.Query(query+order.orderBy(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []EventProjection
+	for rows.Next() {
+		e, err := scanProjection(rows, cols, want)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func isEventField(name string) bool {
+	for _, f := range EventFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// scanProjection scans a row selected with cols, keeping the wanted fields
+func scanProjection(rows *sql.Rows, cols []string, want map[string]bool) (EventProjection, error) {
+	var e EventProjection
+	var ts string
+	var payload, labels, sessionID sql.NullString
+	var seq sql.NullInt64
+	var compressed bool
+	dest := make([]interface{}, len(cols))
+	for i, c := range cols {
+		switch c {
+		case "id":
+			dest[i] = &e.ID
+		case "timestamp":
+			dest[i] = &ts
+		case "source":
+			dest[i] = &e.Source
+		case "type":
+			dest[i] = &e.Type
+		case "payload":
+			dest[i] = &payload
+		case "labels":
+			dest[i] = &labels
+		case "seq":
+			dest[i] = &seq
+		case "session_id":
+			dest[i] = &sessionID
+		case "compressed":
+			dest[i] = &compressed
+		}
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return e, err
+	}
+	if want["timestamp"] {
+		t, _ := time.Parse(time.RFC3339Nano, ts)
+		e.Timestamp = &t
+	}
+	if want["payload"] {
+		p, err := decodePayload(payload.String, compressed)
+		if err != nil {
+			return e, fmt.Errorf("decompress payload: %w", err)
+		}
+		e.Payload = &p
+	}
+	if labels.Valid && labels.String != "" {
+		if err := json.Unmarshal([]byte(labels.String), &e.Labels); err != nil {
+			return e, err
+		}
+	}
+	e.Seq = seq.Int64
+	e.SessionID = sessionID.String
+	return e, nil
+}
+
+// TimeseriesQueryHandler returns a source's events of one type as JSON:
+// source and type (required), start and end (RFC 3339, default unbounded),
+// fields (comma-separated, default all) and order (asc or desc, default asc).
+func TimeseriesQueryHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	source, eventType := q.Get("source"), q.Get("type")
+	if source == "" || eventType == "" {
+		http.Error(w, "missing required parameter: source and type", http.StatusBadRequest)
+		return
+	}
+	start, end := time.Time{}, time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	for name, dst := range map[string]*time.Time{"start": &start, "end": &end} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
+	var fields []string
+	if v := q.Get("fields"); v != "" {
+		for _, f := range strings.Split(v, ",") {
+			fields = append(fields, strings.TrimSpace(f))
+		}
+	}
+	order, err := ParseSortOrder(q.Get("order"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if captureDB == nil {
+		http.Error(w, "captureDB not set", http.StatusServiceUnavailable)
+		return
+	}
+	events, err := queryTimeseriesEventFields(captureDB, source, eventType, start, end, fields, order)
+	if errors.Is(err, ErrUnknownField) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []EventProjection{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,340 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IngestTarget names the schema events from a source are written to
+type IngestTarget string
+
+const (
+	GenericTarget IngestTarget = "generic" // timeseries_event or the source's partition, the default
+	StraceTarget  IngestTarget = "strace"  // strace_event, with pid, syscall, args and result
+	SerialTarget  IngestTarget = "serial"  // serial_event, with port, direction and data
+	DFUTarget     IngestTarget = "dfu"     // dfu_event, with device, state and block
+)
+
+// ErrInvalidIngestTarget is returned for an unknown ingest target
+var ErrInvalidIngestTarget = errors.New("invalid ingest target")
+
+// typedColumn is a column a typed schema adds to the timeseries columns
+type typedColumn struct {
+	name, sqlType string // sqlType is TEXT or INTEGER
+}
+
+// typedSchema is a source-specific table: the timeseries columns, so generic
+// queries can union it with the other tables, plus typed columns parsed from
+// each payload.
+type typedSchema struct {
+	table   string
+	columns []typedColumn
+	// parse returns the typed column values for a payload, or nil if it
+	// doesn't parse, leaving them NULL
+	parse func(payload string) []interface{}
+}
+
+// typedSchemas holds the schema of each target other than GenericTarget
+var typedSchemas = map[IngestTarget]*typedSchema{
+	StraceTarget: {
+		table:   "strace_event",
+		columns: []typedColumn{{"pid", "INTEGER"}, {"syscall", "TEXT"}, {"args", "TEXT"}, {"result", "TEXT"}},
+		parse:   parseStracePayload,
+	},
+	SerialTarget: {
+		table:   "serial_event",
+		columns: []typedColumn{{"port", "TEXT"}, {"direction", "TEXT"}, {"data", "TEXT"}},
+	},
+	DFUTarget: {
+		table:   "dfu_event",
+		columns: []typedColumn{{"device", "TEXT"}, {"state", "TEXT"}, {"block", "INTEGER"}},
+	},
+}
+
+var (
+	ingestTargetsMu sync.RWMutex
+	ingestTargets   = map[string]IngestTarget{}
+)
+
+// ParseIngestTarget parses a target name; empty means GenericTarget
+func ParseIngestTarget(s string) (IngestTarget, error) {
+	t := IngestTarget(strings.ToLower(strings.TrimSpace(s)))
+	if t == "" || t == GenericTarget {
+		return GenericTarget, nil
+	}
+	if _, ok := typedSchemas[t]; !ok {
+		return "", fmt.Errorf("%w %q", ErrInvalidIngestTarget, s)
+	}
+	return t, nil
+}
+
+// SetIngestTarget writes events from source to target's table from now on.
+// Typed tables are created on first use; events already stored stay where
+// they are, and queries by source read both. GenericTarget restores the
+// default.
+func SetIngestTarget(source string, target IngestTarget) error {
+	t, err := ParseIngestTarget(string(target))
+	if err != nil {
+		return err
+	}
+	ingestTargetsMu.Lock()
+	defer ingestTargetsMu.Unlock()
+	if t == GenericTarget {
+		delete(ingestTargets, source)
+	} else {
+		ingestTargets[source] = t
+	}
+	return nil
+}
+
+// sourceSchema returns the typed schema for source, or nil for the generic one
+func sourceSchema(source string) *typedSchema {
+	ingestTargetsMu.RLock()
+	defer ingestTargetsMu.RUnlock()
+	return typedSchemas[ingestTargets[source]]
+}
+
+// eventTarget is the table events from a source are written to and, for a
+// typed table, its schema
+type eventTarget struct {
+	table  string
+	schema *typedSchema
+}
+
+// sourceTarget returns where events from source are written in db, without
+// creating the table
+func sourceTarget(db *sql.DB, source string) eventTarget {
+	if s := sourceSchema(source); s != nil {
+		return eventTarget{table: s.table, schema: s}
+	}
+	if timeseriesPartitioned(db) {
+		return eventTarget{table: partitionTable(source)}
+	}
+	return eventTarget{table: timeseriesBaseTable}
+}
+
+// create creates the target's table, or adds columns it is missing
+func (t eventTarget) create(db dbtx) error {
+	if err := createTimeseriesTableNamed(db, t.table); err != nil || t.schema == nil {
+		return err
+	}
+	cols, err := tableColumns(db, t.table)
+	if err != nil {
+		return err
+	}
+	for _, c := range t.schema.columns {
+		if !cols[c.name] {
+			if _, err := db.Exec(`ALTER TABLE "` + t.table + `" ADD COLUMN ` + c.name + ` ` + c.sqlType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// insertSQL returns the INSERT statement for the target, taking the
+// insertEventSQL arguments followed by the typed column values
+func (t eventTarget) insertSQL() string {
+	if t.schema == nil {
+		return insertEventSQL(t.table)
+	}
+	cols := "timestamp, source, type, payload, labels, compressed, seq, session_id"
+	for _, c := range t.schema.columns {
+		cols += ", " + c.name
+	}
+	n := 8 + len(t.schema.columns)
+	return `INSERT INTO "` + t.table + `" (` + cols + `) VALUES (?` + strings.Repeat(", ?", n-1) + `)`
+}
+
+// args appends the typed column values parsed from the uncompressed payload
+// to the insertEventSQL arguments in base
+func (t eventTarget) args(payload string, base ...interface{}) []interface{} {
+	if t.schema == nil {
+		return base
+	}
+	values := t.schema.values(payload)
+	if values == nil {
+		values = make([]interface{}, len(t.schema.columns))
+	}
+	return append(base, values...)
+}
+
+// values parses payload into the schema's column values, or returns nil
+func (s *typedSchema) values(payload string) []interface{} {
+	if s.parse != nil {
+		if v := s.parse(payload); v != nil {
+			return v
+		}
+	}
+	return s.jsonValues(payload)
+}
+
+// jsonValues reads each column from the key of the same name in a JSON
+// object payload. Missing keys and values of the wrong type are NULL.
+func (s *typedSchema) jsonValues(payload string) []interface{} {
+	var obj map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return nil
+	}
+	values := make([]interface{}, len(s.columns))
+	for i, c := range s.columns {
+		switch v := obj[c.name].(type) {
+		case nil:
+		case string:
+			if c.sqlType != "INTEGER" {
+				values[i] = v
+			} else if n, err := strconv.ParseInt(v, 0, 64); err == nil {
+				values[i] = n
+			}
+		case json.Number:
+			if c.sqlType != "INTEGER" {
+				values[i] = v.String()
+			} else if n, err := v.Int64(); err == nil {
+				values[i] = n
+			}
+		default:
+			if c.sqlType != "INTEGER" {
+				raw, _ := json.Marshal(v)
+				values[i] = string(raw)
+			}
+		}
+	}
+	return values
+}
+
+// straceLine matches a strace output line, with or without a pid prefix:
+// "1234 read(3, "hi", 2) = 2" or "[pid 1234] read(3, "hi", 2) = 2"
+var straceLine = regexp.MustCompile(`^(?:\[pid\s+(\d+)\]\s+|(\d+)\s+)?(\w+)\((.*)\)\s+=\s+(.+)$`)
+
+// parseStracePayload returns pid, syscall, args and result from a strace
+// line, or nil so a JSON payload is tried instead
+func parseStracePayload(payload string) []interface{} {
+	m := straceLine.FindStringSubmatch(strings.TrimSpace(payload))
+	if m == nil {
+		return nil
+	}
+	var pid interface{}
+	if p := m[1] + m[2]; p != "" {
+		pid, _ = strconv.ParseInt(p, 10, 64)
+	}
+	return []interface{}{pid, m[3], m[4], m[5]}
+}
+
+// typedTables returns the typed tables present in db, sorted by name
+func typedTables(db *sql.DB) ([]string, error) {
+	names := make([]string, 0, len(typedSchemas))
+	for _, s := range typedSchemas {
+		names = append(names, s.table)
+	}
+	sort.Strings(names)
+	return existingTables(db, names)
+}
+
+// queryTyped runs add for each event in target's table in a time range,
+// oldest first, optionally only where column equals value. Each row's typed
+// columns are scanned into dest before add runs.
+func queryTyped(db *sql.DB, target IngestTarget, column, value string, start, end time.Time, dest []interface{}, add func(TimeseriesEvent)) error {
+	s := typedSchemas[target]
+	if tables, err := existingTables(db, []string{s.table}); err != nil || len(tables) == 0 {
+		return err
+	}
+	cols := eventColumns
+	for _, c := range s.columns {
+		cols += ", " + c.name
+	}
+	query := `SELECT ` + cols + ` FROM "` + s.table + `" WHERE timestamp BETWEEN ? AND ?`
+	args := []interface{}{start, end}
+	if value != "" {
+		query += ` AND ` + column + ` = ?`
+		args = append(args, value)
+	}
+	rows, err := db.Query(query+Ascending.orderBy(), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e, err := scanEvent(rows, dest...)
+		if err != nil {
+			return err
+		}
+		add(e)
+	}
+	return rows.Err()
+}
+
+// StraceEvent is an event from the strace_event table
+type StraceEvent struct {
+	TimeseriesEvent
+	PID     int64 // 0 if the line had no pid
+	Syscall string
+	Args    string
+	Result  string
+}
+
+// QueryStraceEvents returns strace_event rows in a time range, oldest first,
+// of one syscall or all of them if syscall is empty
+func QueryStraceEvents(db *sql.DB, syscall string, start, end time.Time) ([]StraceEvent, error) {
+	var events []StraceEvent
+	var pid sql.NullInt64
+	var name, args, result sql.NullString
+	err := queryTyped(db, StraceTarget, "syscall", syscall, start, end,
+		[]interface{}{&pid, &name, &args, &result},
+		func(e TimeseriesEvent) {
+			events = append(events, StraceEvent{e, pid.Int64, name.String, args.String, result.String})
+		})
+	return events, err
+}
+
+// SerialEvent is an event from the serial_event table
+type SerialEvent struct {
+	TimeseriesEvent
+	Port      string
+	Direction string // e.g. "rx" or "tx"
+	Data      string
+}
+
+// QuerySerialEvents returns serial_event rows in a time range, oldest first,
+// from one port or all of them if port is empty
+func QuerySerialEvents(db *sql.DB, port string, start, end time.Time) ([]SerialEvent, error) {
+	var events []SerialEvent
+	var p, direction, data sql.NullString
+	err := queryTyped(db, SerialTarget, "port", port, start, end,
+		[]interface{}{&p, &direction, &data},
+		func(e TimeseriesEvent) {
+			events = append(events, SerialEvent{e, p.String, direction.String, data.String})
+		})
+	return events, err
+}
+
+// DFUEvent is an event from the dfu_event table
+type DFUEvent struct {
+	TimeseriesEvent
+	Device string
+	State  string
+	Block  int64
+}
+
+// QueryDFUEvents returns dfu_event rows in a time range, oldest first, from
+// one device or all of them if device is empty
+func QueryDFUEvents(db *sql.DB, device string, start, end time.Time) ([]DFUEvent, error) {
+	var events []DFUEvent
+	var d, state sql.NullString
+	var block sql.NullInt64
+	err := queryTyped(db, DFUTarget, "device", device, start, end,
+		[]interface{}{&d, &state, &block},
+		func(e TimeseriesEvent) {
+			events = append(events, DFUEvent{e, d.String, state.String, block.Int64})
+		})
+	return events, err
+}
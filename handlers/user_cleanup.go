@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/unklstewy/redbug_dewey/utils"
+)
+
+// adminRoleID is the admin role of DefaultRoles
+const adminRoleID = 1
+
+// ErrEmptyUserFilter is returned by RemoveUsersByFilter for a filter that
+// would match every user
+var ErrEmptyUserFilter = errors.New("user filter has no criteria")
+
+// UserFilter selects users for RemoveUsersByFilter. Criteria combine with
+// AND; at least one is required. Users already removed never match.
+type UserFilter struct {
+	Revoked       bool      // only revoked users
+	Locked        bool      // only locked users
+	NeverLoggedIn bool      // only users who have never logged in
+	InactiveSince time.Time // only users without a login since, including those never logged in
+	RoleID        int       // only users with this role
+	IncludeAdmins bool      // admins are left alone unless set
+	Actor         string    // recorded in the audit entry; "system" if empty
+}
+
+// where returns the SQL condition and arguments for the filter
+func (f UserFilter) where() (string, []interface{}, error) {
+	conds := []string{"deleted_at IS NULL"}
+	var args []interface{}
+	if f.Revoked {
+		conds = append(conds, "revoked")
+	}
+	if f.Locked {
+		conds = append(conds, "locked")
+	}
+	if f.NeverLoggedIn {
+		conds = append(conds, "(last_login IS NULL OR last_login = '')")
+	}
+	if !f.InactiveSince.IsZero() {
+		conds = append(conds, "(last_login IS NULL OR last_login = '' OR last_login < ?)")
+		args = append(args, f.InactiveSince.UTC().Format(time.RFC3339))
+	}
+	if f.RoleID != 0 {
+		conds = append(conds, "role_id = ?")
+		args = append(args, f.RoleID)
+	}
+	if len(conds) == 1 {
+		return "", nil, ErrEmptyUserFilter
+	}
+	if !f.IncludeAdmins {
+		conds = append(conds, "role_id IS NOT ?")
+		args = append(args, adminRoleID)
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+// describe summarizes the filter for the audit log
+func (f UserFilter) describe() string {
+	var parts []string
+	if f.Revoked {
+		parts = append(parts, "revoked")
+	}
+	if f.Locked {
+		parts = append(parts, "locked")
+	}
+	if f.NeverLoggedIn {
+		parts = append(parts, "never logged in")
+	}
+	if !f.InactiveSince.IsZero() {
+		parts = append(parts, "inactive since "+f.InactiveSince.UTC().Format(time.RFC3339))
+	}
+	if f.RoleID != 0 {
+		parts = append(parts, fmt.Sprintf("role %d", f.RoleID))
+	}
+	if f.IncludeAdmins {
+		parts = append(parts, "including admins")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// RemoveUsersByFilter soft-deletes the users matching filter in one
+// transaction: each gets deleted_at set and is revoked, so it can no longer
+// authenticate. One audit entry lists the batch. It returns the number of
+// users removed; none is not an error and writes no audit entry.
+func RemoveUsersByFilter(db *sql.DB, filter UserFilter) (int, error) {
+	where, args, err := filter.where()
+	if err != nil {
+		return 0, err
+	}
+	var removed int
+	err = utils.RetryOnBusy(func() error {
+		var err error
+		removed, err = removeUsers(db, filter, where, args)
+		return err
+	})
+	return removed, err
+}
+
+func removeUsers(db *sql.DB, filter UserFilter, where string, args []interface{}) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT username FROM user WHERE "+where+" ORDER BY username", args...)
+	if err != nil {
+		return 0, err
+	}
+	var usernames []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		usernames = append(usernames, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(usernames) == 0 {
+		return 0, nil
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	if _, err := tx.Exec("UPDATE user SET deleted_at = ?, revoked = 1 WHERE "+where, append([]interface{}{now}, args...)...); err != nil {
+		return 0, err
+	}
+	actor := filter.Actor
+	if actor == "" {
+		actor = "system"
+	}
+	detail := fmt.Sprintf("%d users (%s): %s", len(usernames), filter.describe(), strings.Join(usernames, ", "))
+	if _, err := tx.Exec("INSERT INTO audit_log (timestamp, actor, action, detail) VALUES (?, ?, ?, ?)", now, actor, "remove_users", detail); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(usernames), nil
+}
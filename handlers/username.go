@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ErrInvalidUsername is returned by CreateUser for usernames the policy rejects
+var ErrInvalidUsername = errors.New("invalid username")
+
+// UsernamePolicy controls how CreateUser normalizes and validates usernames
+type UsernamePolicy struct {
+	Lowercase bool           // fold to lower case, so case variants are one user
+	MinLen    int            // in characters, after trimming
+	MaxLen    int            // in characters; unlimited if zero
+	Pattern   *regexp.Regexp // the normalized name must match; any if nil
+}
+
+// DefaultUsernamePolicy allows 3 to 64 lower-case letters, digits, dots,
+// dashes and underscores, starting with a letter or digit
+var DefaultUsernamePolicy = UsernamePolicy{
+	Lowercase: true,
+	MinLen:    3,
+	MaxLen:    64,
+	Pattern:   regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`),
+}
+
+var (
+	usernamePolicyMu sync.RWMutex
+	usernamePolicy   = DefaultUsernamePolicy
+)
+
+// SetUsernamePolicy sets the policy applied by CreateUser. Existing users are
+// not renamed; lookups normalize with the current policy.
+func SetUsernamePolicy(p UsernamePolicy) {
+	usernamePolicyMu.Lock()
+	usernamePolicy = p
+	usernamePolicyMu.Unlock()
+}
+
+// normalizeUsername trims username and folds its case if the policy says so
+func normalizeUsername(username string) string {
+	usernamePolicyMu.RLock()
+	lower := usernamePolicy.Lowercase
+	usernamePolicyMu.RUnlock()
+	username = strings.TrimSpace(username)
+	if lower {
+		username = strings.ToLower(username)
+	}
+	return username
+}
+
+// NormalizeUsername returns the form of username CreateUser stores, or an
+// ErrInvalidUsername error describing why the policy rejects it
+func NormalizeUsername(username string) (string, error) {
+	usernamePolicyMu.RLock()
+	p := usernamePolicy
+	usernamePolicyMu.RUnlock()
+	name := normalizeUsername(username)
+	n := utf8.RuneCountInString(name)
+	switch {
+	case n == 0:
+		return "", fmt.Errorf("%w: username is empty", ErrInvalidUsername)
+	case n < p.MinLen:
+		return "", fmt.Errorf("%w: %q is shorter than %d characters", ErrInvalidUsername, name, p.MinLen)
+	case p.MaxLen > 0 && n > p.MaxLen:
+		return "", fmt.Errorf("%w: %q is longer than %d characters", ErrInvalidUsername, name, p.MaxLen)
+	case p.Pattern != nil && !p.Pattern.MatchString(name):
+		return "", fmt.Errorf("%w: %q must match %s", ErrInvalidUsername, name, p.Pattern)
+	}
+	return name, nil
+}
@@ -1,27 +1,24 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/unklstewy/redbug_dewey/handlers"
+	"github.com/unklstewy/redbug_dewey/models"
 	"github.com/unklstewy/redbug_dewey/utils"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
 )
 
-// User is a Gorm model for demonstration (expand as needed)
-type User struct {
-	ID           uint   `gorm:"primaryKey" json:"id"`
-	Username     string `gorm:"unique" json:"username"`
-	PasswordHash string `json:"password_hash"`
-	RoleID       uint   `json:"role_id"`
-	Locked       bool   `json:"locked"`
-	Revoked      bool   `json:"revoked"`
-	LastLogin    string `json:"last_login"`
-}
-
 // UserRole type for clarity
 const (
 	RoleAdmin      = 1
@@ -53,37 +50,284 @@ func RequireRole(allowed ...string) gin.HandlerFunc {
 	}
 }
 
+// backupExt is the file extension for each backup type
+var backupExt = map[utils.BackupType]string{
+	utils.FullBackupType:  ".db",
+	utils.SQLBackupType:   ".sql",
+	utils.DeltaBackupType: ".wal",
+}
+
+// backupHandler serves POST /backup?type=full|sql|delta (full by default).
+// Admins get the requested backup of dbPath, taken synchronously into dir;
+// team leaders a SQL dump of their team scope (handlers.TeamBackupScope).
+func backupHandler(dbs *DBState, dbPath, dir string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.GetString("role_id") {
+		case "1":
+		case "2": // Team leader: partial backup only
+			teamBackup(c, dbs, dir)
+			return
+		default:
+			c.JSON(http.StatusForbidden, gin.H{"error": "insufficient privileges for backup"})
+			return
+		}
+		btype, err := utils.ParseBackupType(c.DefaultQuery("type", string(utils.FullBackupType)))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		backupPath, err := utils.ReserveBackupPath(filepath.Join(dir, "backup_"+time.Now().Format("20060102_150405")+backupExt[btype]))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		sqldb, _ := dbs.DB().DB()
+		result, meta, err := handlers.RunBackup(sqldb, dbPath, btype, backupPath)
+		if err != nil {
+			os.Remove(backupPath)
+		}
+		if errors.Is(err, utils.ErrDeltaBackupNotImplemented) {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, handlers.ErrBackupInProgress) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, context.Canceled) {
+			c.JSON(http.StatusConflict, gin.H{"error": "backup canceled"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		handlers.RecordAudit(sqldb, c.GetString("username"), "backup", backupPath)
+		c.JSON(http.StatusOK, gin.H{"backup": backupPath, "id": meta.ID, "type": btype, "result": result})
+	}
+}
+
+// teamBackup takes a partial backup of the calling team leader's team scope
+// into dir, answering 403 if they lead no team
+func teamBackup(c *gin.Context, dbs *DBState, dir string) {
+	sqldb, _ := dbs.DB().DB()
+	var leaderID int
+	err := sqldb.QueryRow("SELECT id FROM user WHERE username = ?", c.GetString("username")).Scan(&leaderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusForbidden, gin.H{"error": handlers.ErrNoTeamScope.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	name := fmt.Sprintf("backup_%s_team%d.sql", time.Now().Format("20060102_150405"), leaderID)
+	backupPath, err := utils.ReserveBackupPath(filepath.Join(dir, name))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	result, meta, err := handlers.RunPartialBackup(sqldb, leaderID, backupPath)
+	if err != nil {
+		os.Remove(backupPath)
+	}
+	if errors.Is(err, handlers.ErrNoTeamScope) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, handlers.ErrBackupInProgress) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		c.JSON(http.StatusConflict, gin.H{"error": "backup canceled"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	handlers.RecordAudit(sqldb, c.GetString("username"), "backup", backupPath)
+	c.JSON(http.StatusOK, gin.H{"backup": backupPath, "id": meta.ID, "type": handlers.PartialBackupType, "result": result})
+}
+
+// grantRolePermissionsHandler serves POST /roles/:id/permissions with a body
+// of {"permission_ids": [...]}, granting them all or, if the role or any
+// permission is unknown, none
+func grantRolePermissionsHandler(dbs *DBState) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		roleID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role id"})
+			return
+		}
+		var req struct {
+			PermissionIDs []int `json:"permission_ids" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		sqldb, _ := dbs.DB().DB()
+		err = handlers.GrantPermissionsToRole(sqldb, roleID, req.PermissionIDs)
+		if errors.Is(err, handlers.ErrUnknownRole) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, handlers.ErrUnknownPermission) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		handlers.RecordAudit(sqldb, c.GetString("username"), "grant_permissions", fmt.Sprintf("role %d: %v", roleID, req.PermissionIDs))
+		granted, err := handlers.RolePermissionIDs(sqldb, roleID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"role_id": roleID, "permission_ids": granted})
+	}
+}
+
+// captureHandler serves the capture endpoints (/capture/*, /timeseries/query)
+// against the app database. They are registered on first use, as the
+// database may only come up after the router is built.
+func captureHandler(dbs *DBState) gin.HandlerFunc {
+	var (
+		mu  sync.Mutex
+		mux *http.ServeMux
+	)
+	return func(c *gin.Context) {
+		mu.Lock()
+		if mux == nil {
+			sqldb, _ := dbs.DB().DB()
+			m := http.NewServeMux()
+			if err := handlers.RegisterCaptureEndpointsWithDB(m, sqldb); err != nil {
+				mu.Unlock()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			mux = m
+		}
+		mu.Unlock()
+		mux.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// cancelBackupHandler serves POST /backup/cancel, stopping the running backup
+// or restore. It answers 404 when none is running.
+func cancelBackupHandler(c *gin.Context) {
+	op, err := handlers.CancelBackup()
+	if errors.Is(err, handlers.ErrNoBackupInProgress) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"canceled": op})
+}
+
 func main() {
-	db, err := gorm.Open(sqlite.Open("dewey.db"), &gorm.Config{})
+	cfg, err := LoadConfig(os.Getenv("DEWEY_CONFIG"))
 	if err != nil {
-		log.Fatal("failed to connect database: ", err)
+		log.Fatal("invalid config: ", err)
+	}
+	// A locked or not-yet-mounted database starts the server degraded
+	// rather than exiting; it keeps retrying in the background.
+	dbs := &DBState{}
+	stopCh := make(chan struct{})
+	if !dbs.TryOpen(openAppDB(cfg.DBPath)) {
+		log.Printf("database unavailable, starting degraded: %v", dbs.Err())
+		go dbs.Connect(openAppDB(cfg.DBPath), cfg.ReconnectMin.Duration, cfg.ReconnectMax.Duration, stopCh)
+	}
+	if key := os.Getenv("DEWEY_REPORT_KEY"); key != "" {
+		handlers.SetReportSigningKey([]byte(key))
+	}
+	handlers.SetCaptureBufferDir(cfg.CaptureBufferDir)
+	for source, target := range cfg.IngestTargets {
+		handlers.SetIngestTarget(source, handlers.IngestTarget(target))
 	}
-	// Auto-migrate the User model (add more as needed)
-	db.AutoMigrate(&User{})
 
+	if err := utils.ScheduleBackups(cfg.BackupConfig(time.Now()), stopCh); err != nil {
+		log.Fatal("invalid backup config: ", err)
+	}
+	log.Fatal(newServer(cfg, newRouter(cfg, dbs)).ListenAndServe())
+}
+
+// newServer returns the HTTP server for cfg
+func newServer(cfg Config, h http.Handler) *http.Server {
+	return &http.Server{Addr: cfg.ListenAddr, Handler: h}
+}
+
+// newRouter returns the API routes, serving the database in dbs
+func newRouter(cfg Config, dbs *DBState) *gin.Engine {
 	r := gin.Default()
 
 	r.Use(AuthMiddleware())
+	// Registered before RequireDB so it answers while degraded
+	r.GET("/livez", dbs.Livez)
+	r.Use(dbs.RequireDB())
+	limiter := NewRateLimiter(cfg.RateLimits)
+	limiter.TrustUsers(func(username string) bool {
+		db := dbs.DB()
+		if db == nil {
+			return false
+		}
+		var n int64
+		db.Model(&models.User{}).Where("username = ?", username).Count(&n)
+		return n > 0
+	})
 
 	r.GET("/users", func(c *gin.Context) {
-		var users []User
+		db := dbs.DB()
+		var users []models.User
 		db.Find(&users)
 		c.JSON(http.StatusOK, users)
 	})
 
 	r.POST("/users", func(c *gin.Context) {
-		var user User
+		db := dbs.DB()
+		var user models.User
 		if err := c.ShouldBindJSON(&user); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		username, err := handlers.NormalizeUsername(user.Username)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user.Username = username
 		db.Create(&user)
 		c.JSON(http.StatusCreated, user)
 	})
 
 	r.GET("/healthz", func(c *gin.Context) {
+		db := dbs.DB()
 		sqldb, _ := db.DB()
-		stats, err := utils.HealthCheck(sqldb)
+		// ?tables=all (default), used (no stub/internal tables) or nonempty;
+		// ?check=quick runs quick_check in place of integrity_check
+		var opts utils.HealthCheckOptions
+		switch c.Query("tables") {
+		case "", "all":
+		case "used":
+			opts.ExcludeInternal = true
+		case "nonempty":
+			opts.NonEmptyOnly = true
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "tables must be all, used or nonempty"})
+			return
+		}
+		switch c.Query("check") {
+		case "", "full":
+		case "quick":
+			opts.Quick = true
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "check must be full or quick"})
+			return
+		}
+		stats, err := utils.HealthReport(sqldb, opts)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -91,38 +335,54 @@ func main() {
 		c.JSON(http.StatusOK, stats)
 	})
 
-	// Backup endpoint with access control
-	r.POST("/backup", func(c *gin.Context) {
-		roleID := c.GetString("role_id")
-		if roleID == "1" { // Admin: full backup
-			backupPath := "backup_" + time.Now().Format("20060102_150405") + ".db"
-			err := utils.FullBackup("dewey.db", backupPath)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-			c.JSON(http.StatusOK, gin.H{"backup": backupPath})
+	// Which optional SQLite features (FTS5, JSON1, VACUUM INTO) are built in
+	r.GET("/diagnostics/sqlite", func(c *gin.Context) {
+		sqldb, _ := dbs.DB().DB()
+		caps, err := utils.SQLiteCapabilities(sqldb)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
-		} else if roleID == "2" { // Team leader: partial backup only
-			// For demo, just return a message (implement partial backup logic as needed)
-			c.JSON(http.StatusOK, gin.H{"backup": "partial backup for your team only (not implemented)"})
+		}
+		c.JSON(http.StatusOK, caps)
+	})
+
+	// What changed between the two most recent db_stats snapshots
+	r.GET("/diagnostics/dbstats/diff", func(c *gin.Context) {
+		sqldb, _ := dbs.DB().DB()
+		diff, err := utils.LatestDBStatsDiff(sqldb)
+		if errors.Is(err, utils.ErrNotEnoughDBStats) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusForbidden, gin.H{"error": "insufficient privileges for backup"})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, diff)
 	})
 
-	// Start backup scheduler (example config)
-	stopCh := make(chan struct{})
-	cfg := utils.BackupConfig{
-		DBPath:           "dewey.db",
-		BackupRoot:       "backups",
-		Interval:         24 * time.Hour,
-		MaintenanceStart: time.Date(time.Now().Year(), time.Now().Month(), time.Now().Day(), 2, 0, 0, 0, time.Local),
-		MaintenanceEnd:   time.Date(time.Now().Year(), time.Now().Month(), time.Now().Day(), 4, 0, 0, 0, time.Local),
-		BackupTypes:      []utils.BackupType{utils.FullBackupType, utils.SQLBackupType},
-		PartialTables:    []string{}, // or specify tables for partial backup
-	}
-	utils.ScheduleBackups(cfg, stopCh)
-
-	r.Run(":8080")
+	r.POST("/roles/:id/permissions", RequireRole("1"), grantRolePermissionsHandler(dbs))
+
+	// Backup endpoint with access control
+	// Captures ingest into the app database, so their data can be queried
+	// alongside everything else
+	capture := captureHandler(dbs)
+	r.Any("/capture/*action", capture)
+	r.Any("/timeseries/query", capture)
+
+	r.POST("/backup", limiter.Limit("backup"), backupHandler(dbs, cfg.DBPath, cfg.BackupDir))
+	r.POST("/backup/cancel", RequireRole("1"), cancelBackupHandler)
+
+	r.GET("/backups/:id/download", RequireRole("1"), limiter.Limit("export"), func(c *gin.Context) {
+		db := dbs.DB()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid backup id"})
+			return
+		}
+		sqldb, _ := db.DB()
+		handlers.ServeBackupDownload(c.Writer, c.Request, sqldb, id)
+	})
+
+	return r
 }
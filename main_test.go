@@ -3,31 +3,38 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/unklstewy/redbug_dewey/handlers"
+	"github.com/unklstewy/redbug_dewey/models"
+	"github.com/unklstewy/redbug_dewey/utils"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-// Use the User struct from main.go, do not redeclare it here
-
 func setupTestRouter() (*gin.Engine, *gorm.DB) {
 	db, _ := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-	db.AutoMigrate(&User{})
+	models.AutoMigrate(db)
 	r := gin.Default()
 
 	r.GET("/users", func(c *gin.Context) {
-		var users []User
+		var users []models.User
 		db.Find(&users)
 		c.JSON(http.StatusOK, users)
 	})
 
 	r.POST("/users", func(c *gin.Context) {
-		var user User
+		var user models.User
 		if err := c.ShouldBindJSON(&user); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
@@ -47,7 +54,7 @@ func TestGinGormIntegration(t *testing.T) {
 	r, _ := setupTestRouter()
 
 	// Test POST /users
-	user := User{Username: "testuser", PasswordHash: "hash", RoleID: 1}
+	user := models.User{Username: "testuser", PasswordHash: "hash", RoleID: 1}
 	jsonValue, _ := json.Marshal(user)
 	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer(jsonValue))
 	req.Header.Set("Content-Type", "application/json")
@@ -65,7 +72,7 @@ func TestGinGormIntegration(t *testing.T) {
 		t.Fatalf("expected status 200, got %d", w.Code)
 	}
 	body, _ := ioutil.ReadAll(w.Body)
-	var users []User
+	var users []models.User
 	if err := json.Unmarshal(body, &users); err != nil {
 		t.Fatalf("failed to unmarshal users: %v", err)
 	}
@@ -73,3 +80,495 @@ func TestGinGormIntegration(t *testing.T) {
 		t.Fatalf("expected user 'testuser', got %+v", users)
 	}
 }
+
+func TestRateLimiterPerUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limiter := NewRateLimiter(map[string]RateLimit{"backup": {Rate: 1, Burst: 3}})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	limiter.TrustUsers(func(username string) bool { return username == "alice" || username == "bob" })
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.POST("/backup", limiter.Limit("backup"), func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/cheap", limiter.Limit("unlimited"), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	doFrom := func(addr, method, path, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = addr
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	do := func(method, path, user string) *httptest.ResponseRecorder {
+		return doFrom("192.0.2.1:1234", method, path, user)
+	}
+
+	throttled := 0
+	for i := 0; i < 10; i++ {
+		w := do("POST", "/backup", "alice")
+		if w.Code == http.StatusTooManyRequests {
+			throttled++
+			if w.Header().Get("Retry-After") != "1" {
+				t.Errorf("expected Retry-After 1, got %q", w.Header().Get("Retry-After"))
+			}
+		}
+	}
+	if throttled != 7 {
+		t.Errorf("expected 7 of 10 requests throttled after a burst of 3, got %d", throttled)
+	}
+	if w := do("POST", "/backup", "bob"); w.Code != http.StatusOK {
+		t.Errorf("expected a second user to be unaffected, got %d", w.Code)
+	}
+	if w := do("GET", "/cheap", "alice"); w.Code != http.StatusOK {
+		t.Errorf("expected an unlimited class to pass, got %d", w.Code)
+	}
+
+	now = now.Add(time.Second)
+	if w := do("POST", "/backup", "alice"); w.Code != http.StatusOK {
+		t.Errorf("expected a token to refill after 1s, got %d", w.Code)
+	}
+	if w := do("POST", "/backup", "alice"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected throttling to resume, got %d", w.Code)
+	}
+
+	// Claiming alice from another address doesn't drain her bucket
+	for i := 0; i < 3; i++ {
+		if w := doFrom("198.51.100.7:1234", "POST", "/backup", "alice"); w.Code != http.StatusOK {
+			t.Errorf("expected another address to get its own bucket, got %d", w.Code)
+		}
+	}
+	now = now.Add(time.Second)
+	if w := do("POST", "/backup", "alice"); w.Code != http.StatusOK {
+		t.Errorf("expected alice's bucket untouched by another address, got %d", w.Code)
+	}
+
+	// Unknown names share their client IP's bucket
+	throttled = 0
+	for i := 0; i < 10; i++ {
+		if w := do("POST", "/backup", fmt.Sprintf("mallory-%d", i)); w.Code == http.StatusTooManyRequests {
+			throttled++
+		}
+	}
+	if throttled != 7 {
+		t.Errorf("expected 7 of 10 requests under made-up names throttled, got %d", throttled)
+	}
+
+	// Buckets idle long enough to refill are dropped
+	now = now.Add(time.Hour)
+	do("POST", "/backup", "bob")
+	if n := len(limiter.buckets); n != 1 {
+		t.Errorf("expected only the active bucket to be kept, got %d", n)
+	}
+}
+
+func TestDegradedStartRecoversWhenDBAppears(t *testing.T) {
+	// The database directory doesn't exist yet, like an unmounted volume
+	dir := filepath.Join(t.TempDir(), "mnt")
+	dbs := &DBState{}
+	open := openAppDB(filepath.Join(dir, "dewey.db"))
+	if dbs.TryOpen(open) {
+		t.Fatal("expected the first open to fail")
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go dbs.Connect(open, 10*time.Millisecond, 50*time.Millisecond, stop)
+
+	r := gin.New()
+	r.GET("/livez", dbs.Livez)
+	r.Use(dbs.RequireDB())
+	r.GET("/users", func(c *gin.Context) {
+		var users []models.User
+		dbs.DB().Find(&users)
+		c.JSON(http.StatusOK, users)
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	if w := get("/livez"); w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"degraded"`)) {
+		t.Fatalf("expected a degraded /livez, got %d %s", w.Code, w.Body)
+	}
+	if w := get("/users"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while the database is unavailable, got %d", w.Code)
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for dbs.DB() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w := get("/users"); w.Code != http.StatusOK {
+		t.Fatalf("expected data routes to recover without a restart, got %d %s", w.Code, w.Body)
+	}
+	if w := get("/livez"); !bytes.Contains(w.Body.Bytes(), []byte(`"available"`)) {
+		t.Errorf("expected /livez to report the database available, got %s", w.Body)
+	}
+}
+
+func TestBackupEndpointTypes(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "dewey.db")
+	dbs := &DBState{}
+	if !dbs.TryOpen(openAppDB(dbPath)) {
+		t.Fatalf("failed to open db: %v", dbs.Err())
+	}
+	dbs.DB().Create(&models.User{Username: "admin", PasswordHash: "hash", RoleID: 1})
+	backups := filepath.Join(dir, "backups")
+	os.Mkdir(backups, 0755)
+
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.POST("/backup", backupHandler(dbs, dbPath, backups))
+	post := func(query, role string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/backup"+query, nil)
+		req.Header.Set("X-User", "admin")
+		req.Header.Set("X-Role", role)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	paths := map[string]bool{}
+	for _, tc := range []struct {
+		query, ext, contains string
+	}{
+		{"", ".db", "SQLite format 3"},
+		{"?type=full", ".db", "SQLite format 3"},
+		{"?type=sql", ".sql", "CREATE TABLE"},
+	} {
+		w := post(tc.query, "1")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: expected 200, got %d %s", tc.query, w.Code, w.Body)
+		}
+		var resp struct {
+			ID     int `json:"id"`
+			Result struct {
+				Path     string `json:"path"`
+				Size     int64  `json:"size"`
+				Checksum string `json:"checksum"`
+			} `json:"result"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		data, err := os.ReadFile(resp.Result.Path)
+		if err != nil || filepath.Ext(resp.Result.Path) != tc.ext {
+			t.Fatalf("%q: expected a %s backup, got %q (%v)", tc.query, tc.ext, resp.Result.Path, err)
+		}
+		if int64(len(data)) != resp.Result.Size || !bytes.Contains(data, []byte(tc.contains)) || resp.Result.Checksum == "" || resp.ID == 0 {
+			t.Errorf("%q: unexpected result %+v", tc.query, resp)
+		}
+		paths[resp.Result.Path] = true
+	}
+	if len(paths) != 3 {
+		t.Errorf("expected each backup in its own file, got %v", paths)
+	}
+	var recorded int64
+	dbs.DB().Model(&models.BackupMetadata{}).Count(&recorded)
+	if recorded != 3 {
+		t.Errorf("expected 3 recorded backups, got %d", recorded)
+	}
+
+	if w := post("?type=delta", "1"); w.Code != http.StatusNotImplemented {
+		t.Errorf("expected 501 for delta backups, got %d", w.Code)
+	}
+	if w := post("?type=bogus", "1"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown type, got %d", w.Code)
+	}
+	if w := post("?type=sql", "3"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-admin, got %d", w.Code)
+	}
+
+	// Team leaders get a SQL dump of their team, if they lead one
+	if w := post("", "2"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a leader without a team, got %d", w.Code)
+	}
+	lead := models.User{Username: "lead", PasswordHash: "hash", RoleID: 2}
+	dbs.DB().Create(&lead)
+	dbs.DB().Create(&models.Team{Name: "ops", LeaderID: lead.ID})
+	req := httptest.NewRequest("POST", "/backup", nil)
+	req.Header.Set("X-User", "lead")
+	req.Header.Set("X-Role", "2")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var resp struct {
+		Backup string `json:"backup"`
+		Type   string `json:"type"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	data, _ := os.ReadFile(resp.Backup)
+	if w.Code != http.StatusOK || resp.Type != "partial" || !bytes.Contains(data, []byte("'ops'")) {
+		t.Errorf("unexpected team backup response %d %s", w.Code, w.Body)
+	}
+	if want := fmt.Sprintf("_team%d.sql", lead.ID); !strings.HasSuffix(resp.Backup, want) {
+		t.Errorf("expected the leader's id in the backup name, got %s", resp.Backup)
+	}
+}
+
+func TestLoadConfigPropagates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dewey.json")
+	os.WriteFile(path, []byte(`{
+		"db_path": "`+filepath.Join(dir, "app.db")+`",
+		"backup_dir": "`+filepath.Join(dir, "manual")+`",
+		"backup_root": "`+filepath.Join(dir, "scheduled")+`",
+		"backup_interval": "6h",
+		"maintenance_start": "01:30",
+		"backup_types": ["full"],
+		"backup_retention": {"full": {"max_age": "720h", "max_count": 10}},
+		"backup_compress": true,
+		"rate_limits": {"backup": {"rate": 0, "burst": 1}}
+	}`), 0644)
+	t.Setenv("DEWEY_LISTEN_ADDR", "127.0.0.1:9090")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 5, 6, 12, 0, 0, 0, time.Local)
+	bc := cfg.BackupConfig(now)
+	if bc.DBPath != cfg.DBPath || bc.BackupRoot != filepath.Join(dir, "scheduled") || bc.Interval != 6*time.Hour ||
+		len(bc.BackupTypes) != 1 || bc.BackupTypes[0] != "full" || !bc.Compress {
+		t.Errorf("unexpected scheduler config %+v", bc)
+	}
+	if r := bc.Retention[utils.FullBackupType]; r.MaxAge != 720*time.Hour || r.MaxCount != 10 {
+		t.Errorf("unexpected retention %+v", bc.Retention)
+	}
+	if want := time.Date(2024, 5, 6, 1, 30, 0, 0, time.Local); !bc.MaintenanceStart.Equal(want) {
+		t.Errorf("expected the window to start at %s, got %s", want, bc.MaintenanceStart)
+	}
+	if end := bc.MaintenanceEnd; end.Hour() != 4 {
+		t.Errorf("expected the default window end, got %s", end)
+	}
+	if srv := newServer(cfg, nil); srv.Addr != "127.0.0.1:9090" {
+		t.Errorf("expected the env listen address, got %q", srv.Addr)
+	}
+
+	// POST /backup writes the configured DB into the configured directory
+	os.Mkdir(cfg.BackupDir, 0755)
+	dbs := &DBState{}
+	if !dbs.TryOpen(openAppDB(cfg.DBPath)) {
+		t.Fatalf("failed to open db: %v", dbs.Err())
+	}
+	r := newRouter(cfg, dbs)
+	backup := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/backup", nil)
+		req.Header.Set("X-User", "admin")
+		req.Header.Set("X-Role", "1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w := backup()
+	var resp struct {
+		Backup string `json:"backup"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || filepath.Dir(resp.Backup) != cfg.BackupDir {
+		t.Errorf("expected a backup in %s, got %d %s", cfg.BackupDir, w.Code, w.Body)
+	}
+	// The configured limit replaces the default burst of 2; export keeps its default
+	if w := backup(); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the configured backup limit, got %d %s", w.Code, w.Body)
+	}
+	if l := cfg.RateLimits["export"]; l != DefaultRateLimits["export"] {
+		t.Errorf("expected the default export limit, got %+v", l)
+	}
+
+	// The capture endpoints are served against the app database
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/capture/history", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the capture history, got %d %s", w.Code, w.Body)
+	}
+	sqldb, _ := dbs.DB().DB()
+	var n int
+	if err := sqldb.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'timeseries_event'").Scan(&n); err != nil || n != 1 {
+		t.Errorf("expected the timeseries table in the app database, got %d (%v)", n, err)
+	}
+}
+
+func TestLoadConfigYAMLAndValidation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dewey.yaml")
+	os.WriteFile(path, []byte("listen_addr: \":9000\"\nreconnect_max: 30s\n"), 0644)
+	cfg, err := LoadConfig(path)
+	if err != nil || cfg.ListenAddr != ":9000" || cfg.ReconnectMax.Duration != 30*time.Second || cfg.DBPath != "dewey.db" {
+		t.Errorf("unexpected YAML config %+v (%v)", cfg, err)
+	}
+	for _, env := range [][2]string{
+		{"DEWEY_BACKUP_INTERVAL", "soon"},
+		{"DEWEY_BACKUP_TYPES", "full,weekly"},
+		{"DEWEY_MAINTENANCE_END", "4am"},
+	} {
+		t.Run(env[0], func(t *testing.T) {
+			t.Setenv(env[0], env[1])
+			if _, err := LoadConfig(""); err == nil {
+				t.Errorf("expected %s=%s to be rejected", env[0], env[1])
+			}
+		})
+	}
+	cfg = DefaultConfig()
+	cfg.IngestTargets = map[string]string{"strace": "strace", "uart": "vt100"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an unknown ingest target to be rejected")
+	}
+	cfg = DefaultConfig()
+	cfg.RateLimits = map[string]RateLimit{"restore": {Rate: 1, Burst: 1}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an unknown rate limit class to be rejected")
+	}
+	cfg = DefaultConfig()
+	cfg.BackupOnDuplicate = "overwrite"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an unknown duplicate backup policy to be rejected")
+	}
+}
+
+func TestSQLiteDiagnosticsEndpoint(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DBPath = filepath.Join(t.TempDir(), "dewey.db")
+	dbs := &DBState{}
+	if !dbs.TryOpen(openAppDB(cfg.DBPath)) {
+		t.Fatalf("failed to open db: %v", dbs.Err())
+	}
+	w := httptest.NewRecorder()
+	newRouter(cfg, dbs).ServeHTTP(w, httptest.NewRequest("GET", "/diagnostics/sqlite", nil))
+	var caps utils.Capabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &caps); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected capabilities, got %d %s", w.Code, w.Body)
+	}
+	if caps.Version == "" || !caps.HasOption("THREADSAFE") {
+		t.Errorf("expected the version and compile options, got %+v", caps)
+	}
+}
+
+func TestGrantRolePermissionsEndpoint(t *testing.T) {
+	dbs := &DBState{}
+	if !dbs.TryOpen(openAppDB(filepath.Join(t.TempDir(), "dewey.db"))) {
+		t.Fatalf("failed to open db: %v", dbs.Err())
+	}
+	dbs.DB().Create(&models.Role{ID: 2, Name: "leader"})
+	dbs.DB().Create(&[]models.Permission{{ID: 1, Name: "view"}, {ID: 2, Name: "edit"}})
+
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.POST("/roles/:id/permissions", RequireRole("1"), grantRolePermissionsHandler(dbs))
+	post := func(path, body, role string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("X-User", "admin")
+		req.Header.Set("X-Role", role)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("/roles/2/permissions", `{"permission_ids": [1, 7]}`, "1"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown permission, got %d %s", w.Code, w.Body)
+	}
+	var granted int64
+	dbs.DB().Model(&models.RolePermission{}).Count(&granted)
+	if granted != 0 {
+		t.Errorf("expected no grants after a rejected request, got %d", granted)
+	}
+	if w := post("/roles/9/permissions", `{"permission_ids": [1]}`, "1"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown role, got %d", w.Code)
+	}
+	if w := post("/roles/2/permissions", `{"permission_ids": [1]}`, "2"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-admin, got %d", w.Code)
+	}
+	w := post("/roles/2/permissions", `{"permission_ids": [1, 2]}`, "1")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"permission_ids":[1,2]`) {
+		t.Errorf("expected both permissions granted, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestHealthzEndpoint(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DBPath = filepath.Join(t.TempDir(), "dewey.db")
+	dbs := &DBState{}
+	if !dbs.TryOpen(openAppDB(cfg.DBPath)) {
+		t.Fatalf("failed to open db: %v", dbs.Err())
+	}
+	w := httptest.NewRecorder()
+	newRouter(cfg, dbs).ServeHTTP(w, httptest.NewRequest("GET", "/healthz?tables=used", nil))
+	var resp struct {
+		IntegrityOK bool     `json:"integrity_ok"`
+		DBSize      int64    `json:"db_size"`
+		TableCounts string   `json:"table_counts"`
+		StaleLoops  []string `json:"stale_loops"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected a JSON health report, got %d %s", w.Code, w.Body)
+	}
+	info, _ := os.Stat(cfg.DBPath)
+	if !resp.IntegrityOK || resp.DBSize != info.Size() || !strings.Contains(resp.TableCounts, `"user"`) || resp.StaleLoops == nil {
+		t.Errorf("unexpected health report %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	newRouter(cfg, dbs).ServeHTTP(w, httptest.NewRequest("GET", "/healthz?check=quick", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"foreign_key_violations"`) {
+		t.Errorf("expected a quick health report, got %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	newRouter(cfg, dbs).ServeHTTP(w, httptest.NewRequest("GET", "/healthz?check=deep", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown check, got %d", w.Code)
+	}
+}
+
+func TestCreateUserNormalizesUsername(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DBPath = filepath.Join(t.TempDir(), "dewey.db")
+	dbs := &DBState{}
+	if !dbs.TryOpen(openAppDB(cfg.DBPath)) {
+		t.Fatalf("failed to open db: %v", dbs.Err())
+	}
+	r := newRouter(cfg, dbs)
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/users", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	if w := post(`{"username": " Alice "}`); w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"username":"alice"`) {
+		t.Errorf("expected the username stored normalized, got %d %s", w.Code, w.Body)
+	}
+	if w := post(`{"username": "a!"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid username, got %d", w.Code)
+	}
+}
+
+func TestGeneratedAdminPasswordKeptOutOfLog(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	dbPath := filepath.Join(t.TempDir(), "dewey.db")
+	dbs := &DBState{}
+	if !dbs.TryOpen(openAppDB(dbPath)) {
+		t.Fatalf("failed to open db: %v", dbs.Err())
+	}
+	sqldb, _ := dbs.DB().DB()
+	defer sqldb.Close()
+
+	fi, err := os.Stat(dbPath + adminPasswordSuffix)
+	if err != nil {
+		t.Fatalf("expected the generated password in a file: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected the password file readable by its owner only, got %v", fi.Mode().Perm())
+	}
+	raw, _ := os.ReadFile(dbPath + adminPasswordSuffix)
+	password := strings.TrimSpace(string(raw))
+	if ok, err := handlers.AuthenticateUser(sqldb, "admin", password); err != nil || !ok {
+		t.Errorf("expected the written password to authenticate the admin, got %v (err %v)", ok, err)
+	}
+	if strings.Contains(logged.String(), password) {
+		t.Errorf("expected the password kept out of the log, got %q", logged.String())
+	}
+}
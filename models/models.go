@@ -3,16 +3,29 @@ package models
 
 import (
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 // Core system stubs
 
-type Pulitzer struct{}
-type SADIST struct{}
-type DASM struct{}
-type REDBUG struct{}
-type DOMINO struct{}
-type DeweyStats struct{}
+type Pulitzer struct {
+	ID int `gorm:"primaryKey" json:"id"`
+}
+type SADIST struct {
+	ID int `gorm:"primaryKey" json:"id"`
+}
+type DASM struct {
+	ID int `gorm:"primaryKey" json:"id"`
+}
+type REDBUG struct {
+	ID int `gorm:"primaryKey" json:"id"`
+}
+type DOMINO struct {
+	ID int `gorm:"primaryKey" json:"id"`
+}
+type DeweyStats struct {
+	ID int `gorm:"primaryKey" json:"id"`
+}
 
 type Authentication struct {
 	ID       int    `json:"id"`
@@ -60,7 +73,13 @@ type CodeplugSupportedSetting struct {
 	ID           int    `json:"id"`
 	RadioModelID int    `json:"radio_model_id"`
 	Feature      string `json:"feature"`
-	Supported    bool   `json:"supported"`
+	Supported    bool   `gorm:"type:boolean" json:"supported"`
+}
+
+type CodeplugChecksum struct {
+	RadioModel int    `gorm:"primaryKey;autoIncrement:false" json:"radio_model"`
+	Checksum   string `json:"checksum"`
+	ComputedAt string `json:"computed_at"`
 }
 
 type Role struct {
@@ -69,13 +88,14 @@ type Role struct {
 }
 
 type User struct {
-	ID           int    `json:"id"`
-	Username     string `json:"username"`
+	ID           int    `gorm:"primaryKey" json:"id"`
+	Username     string `gorm:"unique" json:"username"`
 	PasswordHash string `json:"password_hash"`
 	RoleID       int    `json:"role_id"`
-	Locked       bool   `json:"locked"`
-	Revoked      bool   `json:"revoked"`
+	Locked       bool   `gorm:"type:boolean" json:"locked"`
+	Revoked      bool   `gorm:"type:boolean" json:"revoked"`
 	LastLogin    string `json:"last_login"`
+	DeletedAt    string `json:"deleted_at,omitempty"` // RFC 3339 time of a soft delete; empty if active
 }
 
 // HashPassword hashes a plaintext password using bcrypt
@@ -97,10 +117,17 @@ type Permission struct {
 	Name string `json:"name"`
 }
 
+type RolePermission struct {
+	ID           int `json:"id"`
+	RoleID       int `gorm:"uniqueIndex:idx_role_permission_unique" json:"role_id"`
+	PermissionID int `gorm:"uniqueIndex:idx_role_permission_unique" json:"permission_id"`
+}
+
 type Team struct {
-	ID       int    `json:"id"`
-	Name     string `json:"name"`
-	LeaderID int    `json:"leader_id"`
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	LeaderID    int    `json:"leader_id"`
+	Description string `json:"description"`
 }
 
 type TeamMember struct {
@@ -112,8 +139,16 @@ type TeamMember struct {
 
 type TeamPermission struct {
 	ID           int `json:"id"`
-	TeamID       int `json:"team_id"`
-	PermissionID int `json:"permission_id"`
+	TeamID       int `gorm:"uniqueIndex:idx_team_permission_unique" json:"team_id"`
+	PermissionID int `gorm:"uniqueIndex:idx_team_permission_unique" json:"permission_id"`
+}
+
+// TeamMetadata is one key/value entry of a team's directory metadata
+type TeamMetadata struct {
+	ID     int    `json:"id"`
+	TeamID int    `gorm:"uniqueIndex:idx_team_metadata_key" json:"team_id"`
+	Key    string `gorm:"uniqueIndex:idx_team_metadata_key" json:"key"`
+	Value  string `json:"value"`
 }
 
 type BackupMetadata struct {
@@ -124,14 +159,76 @@ type BackupMetadata struct {
 	Size       int64  `json:"size"`
 	Duration   int64  `json:"duration"`
 	Status     string `json:"status"`
+	Checksum   string `json:"checksum"` // sha256 of the backup file, hex encoded
+	// Fingerprint is utils.LiveDBFingerprint of the DB when it was backed up
+	Fingerprint string `json:"fingerprint"`
+}
+
+type AuditEntry struct {
+	ID        int    `json:"id"`
+	Timestamp string `json:"timestamp"`
+	Actor     string `json:"actor"`
+	Action    string `json:"action"`
+	Detail    string `json:"detail"`
 }
 
 type DBStats struct {
 	ID          int    `json:"id"`
 	Timestamp   string `json:"timestamp"`
-	IntegrityOK bool   `json:"integrity_ok"`
+	IntegrityOK bool   `gorm:"type:boolean" json:"integrity_ok"`
 	DBSize      int64  `json:"db_size"`
 	LastVacuum  string `json:"last_vacuum"`
 	WALStatus   string `json:"wal_status"`
 	TableCounts string `json:"table_counts"`
+	// ForeignKeyViolations is the number of rows found referring to missing
+	// parent rows; nil if a quick check skipped looking
+	ForeignKeyViolations *int `json:"foreign_key_violations,omitempty"`
+}
+
+// Table names match the schema created by utils.CreateTables, which the
+// handlers query directly, rather than GORM's pluralized defaults.
+func (Pulitzer) TableName() string                 { return "pulitzer" }
+func (SADIST) TableName() string                   { return "sadist" }
+func (DASM) TableName() string                     { return "dasm" }
+func (REDBUG) TableName() string                   { return "redbug" }
+func (DOMINO) TableName() string                   { return "domino" }
+func (DeweyStats) TableName() string               { return "dewey_stats" }
+func (Authentication) TableName() string           { return "authentication" }
+func (Manufacturer) TableName() string             { return "manufacturer" }
+func (RadioModel) TableName() string               { return "radio_model" }
+func (CodeplugAnalysis) TableName() string         { return "codeplug_analysis" }
+func (CodeplugValidation) TableName() string       { return "codeplug_validation" }
+func (CodeplugSkeleton) TableName() string         { return "codeplug_skeleton" }
+func (CodeplugSetting) TableName() string          { return "codeplug_setting" }
+func (CodeplugSupportedSetting) TableName() string { return "codeplug_supported_setting" }
+func (CodeplugChecksum) TableName() string         { return "codeplug_checksum" }
+func (Role) TableName() string                     { return "role" }
+func (User) TableName() string                     { return "user" }
+func (Permission) TableName() string               { return "permission" }
+func (RolePermission) TableName() string           { return "role_permission" }
+func (Team) TableName() string                     { return "team" }
+func (TeamMember) TableName() string               { return "team_member" }
+func (TeamPermission) TableName() string           { return "team_permission" }
+func (TeamMetadata) TableName() string             { return "team_metadata" }
+func (BackupMetadata) TableName() string           { return "backup_metadata" }
+func (AuditEntry) TableName() string               { return "audit_log" }
+func (DBStats) TableName() string                  { return "db_stats" }
+
+// All returns every domain model, in dependency order, for AutoMigrate
+func All() []interface{} {
+	return []interface{}{
+		&Pulitzer{}, &SADIST{}, &DASM{}, &REDBUG{}, &DOMINO{}, &DeweyStats{},
+		&Authentication{},
+		&Manufacturer{}, &RadioModel{},
+		&CodeplugAnalysis{}, &CodeplugValidation{}, &CodeplugSkeleton{},
+		&CodeplugSetting{}, &CodeplugSupportedSetting{}, &CodeplugChecksum{},
+		&Role{}, &Permission{}, &RolePermission{}, &User{},
+		&Team{}, &TeamMember{}, &TeamPermission{}, &TeamMetadata{},
+		&BackupMetadata{}, &AuditEntry{}, &DBStats{},
+	}
+}
+
+// AutoMigrate creates or updates the tables for all domain models
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(All()...)
 }
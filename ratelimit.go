@@ -0,0 +1,144 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit is a token bucket: Burst requests at once, refilled at Rate per second
+type RateLimit struct {
+	Rate  float64 `json:"rate" yaml:"rate"`
+	Burst int     `json:"burst" yaml:"burst"`
+}
+
+// DefaultRateLimits are the per-user limits for each class of expensive endpoint
+var DefaultRateLimits = map[string]RateLimit{
+	"backup": {Rate: 1.0 / 60, Burst: 2},
+	"export": {Rate: 0.2, Burst: 5},
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type bucketKey struct {
+	class, user string
+}
+
+// sweepInterval is how often idle buckets are looked for
+const sweepInterval = time.Minute
+
+// RateLimiter throttles requests per user and endpoint class
+type RateLimiter struct {
+	mu        sync.Mutex
+	limits    map[string]RateLimit
+	buckets   map[bucketKey]*tokenBucket
+	now       func() time.Time
+	lastSweep time.Time
+	// knownUser reports whether a username names an account; nil trusts none
+	knownUser func(username string) bool
+}
+
+// NewRateLimiter returns a limiter enforcing limits, keyed by endpoint class
+func NewRateLimiter(limits map[string]RateLimit) *RateLimiter {
+	rl := &RateLimiter{limits: make(map[string]RateLimit), buckets: make(map[bucketKey]*tokenBucket), now: time.Now}
+	for class, l := range limits {
+		rl.limits[class] = l
+	}
+	return rl
+}
+
+// SetLimit changes the limit for an endpoint class; existing buckets keep
+// their current tokens.
+func (rl *RateLimiter) SetLimit(class string, l RateLimit) {
+	rl.mu.Lock()
+	rl.limits[class] = l
+	rl.mu.Unlock()
+}
+
+// TrustUsers keys the buckets of requests whose X-User known reports as an
+// account on that user and the client IP together. X-User isn't verified, so
+// a client naming someone else's account gets a bucket of its own rather than
+// draining theirs. Other requests are keyed on the client IP alone, so a
+// client can't dodge its limit or grow the limiter by inventing names.
+func (rl *RateLimiter) TrustUsers(known func(username string) bool) {
+	rl.mu.Lock()
+	rl.knownUser = known
+	rl.mu.Unlock()
+}
+
+// allow takes a token for user in class, or returns how long until one is available
+func (rl *RateLimiter) allow(class, user string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	if now.Sub(rl.lastSweep) >= sweepInterval {
+		rl.sweep(now)
+	}
+	l, ok := rl.limits[class]
+	if !ok || l.Burst <= 0 {
+		return true, 0
+	}
+	key := bucketKey{class, user}
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.Burst), last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.Rate <= 0 {
+		return false, time.Hour
+	}
+	return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// sweep drops the buckets that have refilled, which are no different from a
+// new one, and those of classes no longer limited. Called with rl.mu held.
+func (rl *RateLimiter) sweep(now time.Time) {
+	rl.lastSweep = now
+	for key, b := range rl.buckets {
+		l, ok := rl.limits[key.class]
+		if !ok || l.Burst <= 0 || (l.Rate > 0 && now.Sub(b.last).Seconds()*l.Rate >= float64(l.Burst)) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// identity returns the key of the request's buckets: the user and client
+// IP, if TrustUsers knows the user, otherwise the client IP alone
+func (rl *RateLimiter) identity(c *gin.Context) string {
+	rl.mu.Lock()
+	known := rl.knownUser
+	rl.mu.Unlock()
+	ip := "ip:" + c.ClientIP()
+	if user := c.GetString("username"); user != "" && known != nil && known(user) {
+		return "user:" + user + "@" + ip
+	}
+	return ip
+}
+
+// Limit returns middleware applying the class limit to each identity, as
+// described on TrustUsers. Throttled
+// requests get 429 with a Retry-After header.
+func (rl *RateLimiter) Limit(class string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ok, wait := rl.allow(class, rl.identity(c))
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -1,34 +1,232 @@
 package utils
 
 import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
-// FullBackup copies the SQLite DB file to a backup location
-func FullBackup(dbPath, backupPath string) error {
-	src, err := os.Open(dbPath)
+// BackupResult describes a written backup file
+type BackupResult struct {
+	Path     string        `json:"path"`
+	Size     int64         `json:"size"`
+	Duration time.Duration `json:"duration"` // nanoseconds in JSON
+	Checksum string        `json:"checksum"` // hex-encoded sha256 of the file
+	// WAL is the log position a full backup includes; see BackupManifest
+	WAL *WALPosition `json:"wal_position,omitempty"`
+}
+
+// newBackupResult builds the result for a backup of size bytes written to
+// path since start, hashed by h
+func newBackupResult(path string, size int64, start time.Time, h hash.Hash) BackupResult {
+	return BackupResult{
+		Path:     path,
+		Size:     size,
+		Duration: time.Since(start),
+		Checksum: hex.EncodeToString(h.Sum(nil)),
+	}
+}
+
+// FullBackup copies the SQLite DB file to a backup location and writes its
+// manifest, gzip-compressing the copy if backupPath ends in
+// CompressedBackupExt. A WAL-mode DB is checkpointed first, and the WAL position the
+// copy includes is recorded so later WAL frames can be chained onto it.
+// Transient I/O errors are retried according to the backup retry policy.
+func FullBackup(dbPath, backupPath string) (BackupResult, error) {
+	return FullBackupContext(context.Background(), dbPath, backupPath)
+}
+
+// FullBackupContext is FullBackup, stopping early if ctx is canceled. A
+// canceled backup leaves no file at backupPath.
+func FullBackupContext(ctx context.Context, dbPath, backupPath string) (BackupResult, error) {
+	start := time.Now()
+	if _, err := os.Stat(dbPath); err != nil {
+		return BackupResult{}, err
+	}
+	if err := checkBackupSpace(dbPath, backupPath); err != nil {
+		return BackupResult{}, err
+	}
+	pos, err := checkpointedWALPosition(dbPath)
 	if err != nil {
+		return BackupResult{}, fmt.Errorf("read WAL position: %w", err)
+	}
+	var result BackupResult
+	err = retryBackup(func() error {
+		var err error
+		result, err = copyBackup(ctx, dbPath, backupPath, start)
+		if err != nil {
+			os.Remove(backupPath)
+		}
 		return err
+	})
+	if err != nil {
+		return result, err
+	}
+	result.WAL = &pos
+	manifest := BackupManifest{Source: dbPath, Taken: start.UTC(), Checksum: result.Checksum, WAL: pos}
+	if err := writeBackupManifest(backupPath, manifest); err != nil {
+		return result, fmt.Errorf("write backup manifest: %w", err)
+	}
+	return result, nil
+}
+
+// FullBackupDB is FullBackup for the DB db has open. It first runs
+// PRAGMA wal_checkpoint(TRUNCATE) through db, so that everything committed
+// through it is in the main file, and fails if readers kept the checkpoint
+// from finishing.
+func FullBackupDB(db *sql.DB, backupPath string) error {
+	dbPath, err := mainDBFile(db)
+	if err != nil {
+		return err
+	}
+	if dbPath == "" {
+		return errors.New("database has no file to back up")
+	}
+	var busy, logFrames, checkpointed int
+	if err := db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE);").Scan(&busy, &logFrames, &checkpointed); err != nil {
+		return fmt.Errorf("checkpoint %s: %w", dbPath, err)
+	}
+	if busy != 0 {
+		return fmt.Errorf("checkpoint %s: blocked by readers, %d of %d WAL frames checkpointed", dbPath, checkpointed, logFrames)
+	}
+	_, err = FullBackup(dbPath, backupPath)
+	return err
+}
+
+// mainDBFile returns the file of db's main database, or "" for an in-memory
+// or temporary one
+func mainDBFile(db *sql.DB) (string, error) {
+	rows, err := db.Query("PRAGMA database_list;")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var seq int
+		var name, file string
+		if err := rows.Scan(&seq, &name, &file); err != nil {
+			return "", err
+		}
+		if name == "main" {
+			return file, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("database has no main schema")
+}
+
+// ReserveBackupPath creates an empty file at backupPath or, if something is
+// already there, at the first free numbered variant of it (backup-1.db,
+// backup-2.db, ...), and returns the path it created. The file is created
+// exclusively, so concurrent callers never get the same path; the backup
+// then overwrites it.
+func ReserveBackupPath(backupPath string) (string, error) {
+	ext := filepath.Ext(strings.TrimSuffix(backupPath, CompressedBackupExt))
+	if IsCompressedBackup(backupPath) {
+		ext += CompressedBackupExt
+	}
+	base := strings.TrimSuffix(backupPath, ext)
+	return reservePath(backupPath, func(n int) string { return fmt.Sprintf("%s-%d%s", base, n, ext) })
+}
+
+// reservePath exclusively creates an empty file at path or, if something is
+// already there, at the first of numbered(1), numbered(2), ... that is free,
+// and returns the path it created
+func reservePath(path string, numbered func(n int) string) (string, error) {
+	for n := 1; ; n++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return path, f.Close()
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		path = numbered(n)
+	}
+}
+
+// copyBackup makes one attempt at copying dbPath to backupPath
+func copyBackup(ctx context.Context, dbPath, backupPath string, start time.Time) (BackupResult, error) {
+	src, err := os.Open(dbPath)
+	if err != nil {
+		return BackupResult{}, err
 	}
 	defer src.Close()
 
 	dst, err := os.Create(backupPath)
 	if err != nil {
-		return err
+		return BackupResult{}, err
 	}
 	defer dst.Close()
 
-	_, err = io.Copy(dst, src)
-	return err
+	// The size and checksum are of the file written, compressed or not
+	h := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(dst, h)}
+	w := backupWriter(backupPath, counter)
+	if _, err := backupCopy(w, contextReader{ctx, src}); err != nil {
+		return BackupResult{}, err
+	}
+	if err := w.Close(); err != nil {
+		return BackupResult{}, err
+	}
+	if err := dst.Sync(); err != nil {
+		return BackupResult{}, err
+	}
+	if err := dst.Close(); err != nil {
+		return BackupResult{}, err
+	}
+	return newBackupResult(backupPath, counter.n, start, h), nil
+}
+
+// backupCopy copies a backup's data; tests may replace it
+var backupCopy = io.Copy
+
+// contextReader fails reads with ctx's error once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
 }
 
-// DeltaBackup is a stub for future WAL/delta backup support
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// FileChecksum returns the hex-encoded sha256 of the file at path
+func FileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ErrDeltaBackupNotImplemented is returned by DeltaBackup
+var ErrDeltaBackupNotImplemented = errors.New("delta backup not yet implemented")
+
+// DeltaBackup is a stub for future WAL/delta backup support. A delta only
+// needs the WAL frames after the position in its full backup's manifest.
 func DeltaBackup(dbPath, walPath, backupPath string) error {
 	// Implement WAL or .changes backup logic here
-	return fmt.Errorf("Delta backup not yet implemented")
+	return ErrDeltaBackupNotImplemented
 }
 
 // ScheduleBackup runs backups at the given interval (in minutes)
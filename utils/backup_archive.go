@@ -0,0 +1,228 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// BackupArchive describes one monthly archive written by ArchiveOldBackups
+type BackupArchive struct {
+	Path  string   // the .tar.gz file
+	Month string   // YYYY-MM
+	Days  []string // day directories added by this run, relative to the backup root
+	Size  int64
+}
+
+// ArchiveOptions controls ArchiveOldBackupsWithOptions
+type ArchiveOptions struct {
+	Now time.Time // reference time for olderThan; time.Now() if zero
+	// OnArchive is called once each archive is written, before its day
+	// directories are removed; an error leaves them in place
+	OnArchive func(BackupArchive) error
+}
+
+var (
+	yearDir  = regexp.MustCompile(`^\d{4}$`)
+	monthDir = regexp.MustCompile(`^\d{2}$`)
+)
+
+// ArchiveOldBackups moves the YYYY/MM/DD day directories under root that are
+// older than olderThan into one backups_YYYY-MM.tar.gz per month in
+// archivePath. See ArchiveOldBackupsWithOptions.
+func ArchiveOldBackups(root string, olderThan time.Duration, archivePath string) error {
+	return ArchiveOldBackupsWithOptions(root, olderThan, archivePath, ArchiveOptions{})
+}
+
+// ArchiveOldBackupsWithOptions archives whole days that ended before
+// Now-olderThan. A month already archived by an earlier run has the new days
+// added to its existing archive. Day directories are removed only once their
+// archive is safely written, and emptied month and year directories go too.
+func ArchiveOldBackupsWithOptions(root string, olderThan time.Duration, archivePath string, opts ArchiveOptions) error {
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	cutoff := now.Add(-olderThan)
+	months, err := oldBackupDays(root, cutoff)
+	if err != nil {
+		return err
+	}
+	if len(months) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(archivePath, 0755); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(months))
+	for m := range months {
+		keys = append(keys, m)
+	}
+	sort.Strings(keys)
+	for _, month := range keys {
+		days := months[month]
+		path := filepath.Join(archivePath, "backups_"+month+".tar.gz")
+		size, err := writeMonthArchive(root, path, days)
+		if err != nil {
+			return fmt.Errorf("archive %s: %w", month, err)
+		}
+		if opts.OnArchive != nil {
+			if err := opts.OnArchive(BackupArchive{Path: path, Month: month, Days: days, Size: size}); err != nil {
+				return err
+			}
+		}
+		for _, day := range days {
+			if err := os.RemoveAll(filepath.Join(root, day)); err != nil {
+				return err
+			}
+		}
+		// Drop the month and year directories if that emptied them
+		monthPath := filepath.Join(root, filepath.Dir(days[0]))
+		if os.Remove(monthPath) == nil {
+			os.Remove(filepath.Dir(monthPath))
+		}
+	}
+	return nil
+}
+
+// oldBackupDays returns the day directories under root that ended before
+// cutoff, relative to root and grouped by YYYY-MM
+func oldBackupDays(root string, cutoff time.Time) (map[string][]string, error) {
+	months := make(map[string][]string)
+	matches, err := filepath.Glob(filepath.Join(root, "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range matches {
+		rel, err := filepath.Rel(root, m)
+		if err != nil {
+			return nil, err
+		}
+		y, mo, d := filepath.Dir(filepath.Dir(rel)), filepath.Base(filepath.Dir(rel)), filepath.Base(rel)
+		if !yearDir.MatchString(y) || !monthDir.MatchString(mo) || !monthDir.MatchString(d) {
+			continue
+		}
+		day, err := time.ParseInLocation("2006/01/02", y+"/"+mo+"/"+d, cutoff.Location())
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(m); err != nil || !info.IsDir() {
+			continue
+		}
+		if day.AddDate(0, 0, 1).After(cutoff) {
+			continue
+		}
+		key := y + "-" + mo
+		months[key] = append(months[key], filepath.ToSlash(rel))
+	}
+	for _, days := range months {
+		sort.Strings(days)
+	}
+	return months, nil
+}
+
+// writeMonthArchive writes days into the archive at path, keeping the
+// entries of an existing archive there. The archive is replaced atomically.
+func writeMonthArchive(root, path string, days []string) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".archive-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+	if err := copyArchiveEntries(tw, path); err != nil {
+		return 0, err
+	}
+	for _, day := range days {
+		if err := addTree(tw, root, filepath.Join(root, filepath.FromSlash(day))); err != nil {
+			return 0, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return 0, err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return info.Size(), os.Rename(tmp.Name(), path)
+}
+
+// copyArchiveEntries copies every entry of the .tar.gz at path into tw; a
+// missing archive copies nothing
+func copyArchiveEntries(tw *tar.Writer, path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// addTree writes the regular files under dir to tw, named relative to root
+func addTree(tw *tar.Writer, root, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
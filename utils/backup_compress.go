@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+)
+
+// CompressedBackupExt marks a gzip-compressed backup, e.g. backup.db.gz or
+// backup.sql.gz. FullBackup and SQLDump compress their output when the
+// backup path ends in it, and restores decompress such files.
+const CompressedBackupExt = ".gz"
+
+// IsCompressedBackup reports whether the backup at path is gzip-compressed,
+// going by its extension
+func IsCompressedBackup(path string) bool {
+	return strings.HasSuffix(path, CompressedBackupExt)
+}
+
+// nopWriteCloser is a writer whose Close does nothing
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// backupWriter returns the writer a backup to path is written through:
+// a gzip.Writer over w for a compressed backup, w itself otherwise. Closing
+// it flushes the compressed stream but doesn't close w.
+func backupWriter(path string, w io.Writer) io.WriteCloser {
+	if IsCompressedBackup(path) {
+		return gzip.NewWriter(w)
+	}
+	return nopWriteCloser{w}
+}
+
+// openBackup opens the backup at path for reading, decompressing it if its
+// extension says it is compressed
+func openBackup(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !IsCompressedBackup(path) {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return gzipReadCloser{gz, f}, nil
+}
+
+// gzipReadCloser reads a gzip stream from a file, closing both together
+type gzipReadCloser struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy limits how many scheduled backups of one type are kept.
+// The most recent backup of a type is always kept, whatever its age.
+type RetentionPolicy struct {
+	MaxAge   time.Duration // remove backups taken longer ago than this; 0 for no limit
+	MaxCount int           // keep at most this many backups; 0 for no limit
+}
+
+// scheduledBackupExt is the suffix runScheduledBackup adds to the rendered
+// path of each backup type
+var scheduledBackupExt = map[BackupType]string{
+	FullBackupType:  "",
+	SQLBackupType:   ".sql",
+	DeltaBackupType: ".wal",
+}
+
+// templateTokenPatterns matches the value of each path template token
+// other than {type}
+var templateTokenPatterns = map[string]string{
+	"date":  `\d{8}`,
+	"time":  `\d{6}`,
+	"year":  `\d{4}`,
+	"month": `\d{2}`,
+	"day":   `\d{2}`,
+	"host":  `[^/]+`,
+}
+
+// backupPathPattern returns a pattern matching the slash-separated paths,
+// relative to the backup root, of the scheduled backups of btype, compressed
+// or not and numbered by reserveScheduledBackup or not. The first use of each
+// timestamp token is captured in a group named after it, and the number in
+// one named seq.
+func backupPathPattern(tmpl string, btype BackupType) (*regexp.Regexp, error) {
+	if tmpl == "" {
+		tmpl = DefaultBackupPathTemplate
+	}
+	if err := ValidateBackupPathTemplate(tmpl); err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	captured := make(map[string]bool)
+	last := 0
+	tmpl = filepath.ToSlash(tmpl)
+	for _, m := range templateToken.FindAllStringSubmatchIndex(tmpl, -1) {
+		b.WriteString(regexp.QuoteMeta(tmpl[last:m[0]]))
+		name := tmpl[m[2]:m[3]]
+		switch {
+		case name == "type":
+			b.WriteString(regexp.QuoteMeta(string(btype)))
+		case name == "host" || captured[name]:
+			b.WriteString(templateTokenPatterns[name])
+		default:
+			fmt.Fprintf(&b, "(?P<%s>%s)", name, templateTokenPatterns[name])
+			captured[name] = true
+		}
+		last = m[1]
+	}
+	ext := templateExt(tmpl)
+	b.WriteString(regexp.QuoteMeta(strings.TrimSuffix(tmpl[last:], ext)))
+	b.WriteString(`(?:-(?P<seq>\d+))?`)
+	b.WriteString(regexp.QuoteMeta(ext))
+	b.WriteString(regexp.QuoteMeta(scheduledBackupExt[btype]))
+	b.WriteString("(?:" + regexp.QuoteMeta(CompressedBackupExt) + ")?$")
+	return regexp.Compile(b.String())
+}
+
+// scheduledBackup is a backup file found under the backup root
+type scheduledBackup struct {
+	path  string
+	taken time.Time
+	seq   int // the number of a duplicate taken in the same second
+}
+
+// findScheduledBackups returns the backups of btype under cfg.BackupRoot,
+// newest first, dated by the timestamp in their path
+func findScheduledBackups(cfg BackupConfig, btype BackupType, loc *time.Location) ([]scheduledBackup, error) {
+	pattern, err := backupPathPattern(cfg.PathTemplate, btype)
+	if err != nil {
+		return nil, err
+	}
+	var found []scheduledBackup
+	err = filepath.WalkDir(cfg.BackupRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == cfg.BackupRoot {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(cfg.BackupRoot, path)
+		if err != nil {
+			return err
+		}
+		m := pattern.FindStringSubmatch(filepath.ToSlash(rel))
+		if m == nil {
+			return nil
+		}
+		tokens := make(map[string]string)
+		for i, name := range pattern.SubexpNames() {
+			if name != "" {
+				tokens[name] = m[i]
+			}
+		}
+		date := tokens["date"]
+		if date == "" {
+			date = tokens["year"] + tokens["month"] + tokens["day"]
+		}
+		taken, err := time.ParseInLocation("20060102150405", date+tokens["time"], loc)
+		if err != nil {
+			return nil
+		}
+		seq, _ := strconv.Atoi(tokens["seq"])
+		found = append(found, scheduledBackup{path: path, taken: taken, seq: seq})
+		return nil
+	})
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].taken.Equal(found[j].taken) {
+			return found[i].taken.After(found[j].taken)
+		}
+		if found[i].seq != found[j].seq {
+			return found[i].seq > found[j].seq
+		}
+		return found[i].path > found[j].path
+	})
+	return found, err
+}
+
+// PruneBackups removes the scheduled backups under cfg.BackupRoot that
+// cfg.Retention no longer keeps, with their manifests, and any directories
+// that leaves empty. Backups are dated by the timestamp in their path, in
+// now's location. It returns the removed backup paths.
+func PruneBackups(cfg BackupConfig, now time.Time) ([]string, error) {
+	var removed []string
+	for btype, policy := range cfg.Retention {
+		if policy.MaxAge <= 0 && policy.MaxCount <= 0 {
+			continue
+		}
+		backups, err := findScheduledBackups(cfg, btype, now.Location())
+		if err != nil {
+			return removed, fmt.Errorf("prune %s backups: %w", btype, err)
+		}
+		// backups[0] is the newest, which is always kept
+		for i := 1; i < len(backups); i++ {
+			b := backups[i]
+			tooOld := policy.MaxAge > 0 && now.Sub(b.taken) > policy.MaxAge
+			tooMany := policy.MaxCount > 0 && i >= policy.MaxCount
+			if !tooOld && !tooMany {
+				continue
+			}
+			if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+				return removed, err
+			}
+			os.Remove(ManifestPath(b.path))
+			removeEmptyDirs(filepath.Dir(b.path), cfg.BackupRoot)
+			removed = append(removed, b.path)
+		}
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// removeEmptyDirs removes dir and its parents while they are empty, up to
+// but not including root
+func removeEmptyDirs(dir, root string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
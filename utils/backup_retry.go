@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// BackupRetryPolicy bounds retries of backups that fail with transient I/O
+// errors, such as timeouts on a network mount
+type BackupRetryPolicy struct {
+	Attempts int           // total attempts; 1 or less disables retries
+	Backoff  time.Duration // delay before the first retry, doubled for each one after
+}
+
+// DefaultBackupRetryPolicy makes three attempts, one second apart at first
+var DefaultBackupRetryPolicy = BackupRetryPolicy{Attempts: 3, Backoff: time.Second}
+
+var (
+	backupRetryMu sync.RWMutex
+	backupRetry   = DefaultBackupRetryPolicy
+)
+
+// SetBackupRetryPolicy sets the retry policy used by FullBackup
+func SetBackupRetryPolicy(p BackupRetryPolicy) {
+	backupRetryMu.Lock()
+	backupRetry = p
+	backupRetryMu.Unlock()
+}
+
+// isRetryableBackupError reports whether err is a transient I/O failure worth
+// another attempt. Missing files, permissions, low disk space and
+// cancellation are not.
+func isRetryableBackupError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.EAGAIN, syscall.EINTR, syscall.ETIMEDOUT, syscall.ESTALE, syscall.ECONNRESET} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryBackup runs attempt until it succeeds, fails with a non-retryable
+// error or the policy's attempts run out
+func retryBackup(attempt func() error) error {
+	backupRetryMu.RLock()
+	p := backupRetry
+	backupRetryMu.RUnlock()
+	n, err := backoff{attempts: p.Attempts, first: p.Backoff}.retry(attempt, isRetryableBackupError, func(n int, delay time.Duration, err error) {
+		log.Printf("backup attempt %d failed, retrying in %s: %v", n, delay, err)
+	})
+	if err != nil && isRetryableBackupError(err) {
+		return fmt.Errorf("backup failed after %d attempts: %w", n, err)
+	}
+	return err
+}
@@ -2,9 +2,12 @@ package utils
 
 import (
 	"fmt"
+	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,51 +28,290 @@ type BackupConfig struct {
 	MaintenanceEnd   time.Time
 	BackupTypes      []BackupType
 	PartialTables    []string // for partial/module backups
+	PathTemplate     string   // backup path under BackupRoot; DefaultBackupPathTemplate if empty
+	// SkipUnchanged skips a scheduled run when LiveDBFingerprint is the same
+	// as at the last run in which every backup succeeded. That fingerprint
+	// is cheap but misses updates that leave row counts and rowids alone.
+	SkipUnchanged bool
+	// FullFingerprint makes SkipUnchanged use FullDBFingerprint, which
+	// catches every change but reads every row of the DB on each run
+	FullFingerprint bool
+	// Retention is applied by PruneBackups after each scheduled run; types
+	// without a policy are kept forever
+	Retention map[BackupType]RetentionPolicy
+	// Compress gzips full and SQL backups, adding CompressedBackupExt to
+	// their paths
+	Compress bool
+	// OnDuplicate is what a backup does when one is already at its path, as
+	// when two runs start within the same second; DuplicateSuffix if empty
+	OnDuplicate DuplicateBackupPolicy
 }
 
-// ScheduleBackups runs backups at the configured interval and window
-func ScheduleBackups(cfg BackupConfig, stopCh <-chan struct{}) {
+// DuplicateBackupPolicy is what a scheduled backup does when a backup of its
+// type already exists at its path. Neither policy overwrites the existing
+// backup.
+type DuplicateBackupPolicy string
+
+const (
+	// DuplicateSuffix numbers the new backup before the template's
+	// extension: backup_HHMMSS-1.db, backup_HHMMSS-2.db and so on
+	DuplicateSuffix DuplicateBackupPolicy = "suffix"
+	// DuplicateSkip skips the new backup, keeping the existing one
+	DuplicateSkip DuplicateBackupPolicy = "skip"
+)
+
+// ParseDuplicateBackupPolicy validates a duplicate backup policy name; empty
+// is DuplicateSuffix
+func ParseDuplicateBackupPolicy(s string) (DuplicateBackupPolicy, error) {
+	switch p := DuplicateBackupPolicy(s); p {
+	case "":
+		return DuplicateSuffix, nil
+	case DuplicateSuffix, DuplicateSkip:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown duplicate backup policy %q: must be %s or %s", s, DuplicateSuffix, DuplicateSkip)
+}
+
+// DefaultBackupPathTemplate is the YYYY/MM/DD/<type>/backup_HHMMSS.db layout
+const DefaultBackupPathTemplate = "{year}/{month}/{day}/{type}/backup_{time}.db"
+
+// backupTemplateTokens maps each path template token to its value
+func backupTemplateTokens(btype BackupType, t time.Time) map[string]string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+	return map[string]string{
+		"type":  string(btype),
+		"date":  t.Format("20060102"),
+		"time":  t.Format("150405"),
+		"year":  t.Format("2006"),
+		"month": t.Format("01"),
+		"day":   t.Format("02"),
+		"host":  strings.NewReplacer("/", "_", `\`, "_").Replace(host),
+	}
+}
+
+var templateToken = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// ValidateBackupPathTemplate checks that tmpl only uses known tokens, stays
+// under the backup root, and includes enough of the timestamp ({time} plus
+// {date} or {year}/{month}/{day}) that successive backups never collide.
+func ValidateBackupPathTemplate(tmpl string) error {
+	if tmpl == "" {
+		return fmt.Errorf("backup path template is empty")
+	}
+	if filepath.IsAbs(tmpl) {
+		return fmt.Errorf("backup path template %q must be relative to the backup root", tmpl)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(tmpl), "/") {
+		if part == ".." {
+			return fmt.Errorf("backup path template %q escapes the backup root", tmpl)
+		}
+	}
+	known := backupTemplateTokens("", time.Time{})
+	used := make(map[string]bool)
+	for _, m := range templateToken.FindAllStringSubmatch(tmpl, -1) {
+		if _, ok := known[m[1]]; !ok {
+			return fmt.Errorf("backup path template %q uses unknown token {%s}", tmpl, m[1])
+		}
+		used[m[1]] = true
+	}
+	if !used["time"] || !(used["date"] || (used["year"] && used["month"] && used["day"])) {
+		return fmt.Errorf("backup path template %q must include {time} and {date} (or {year}, {month} and {day}) to keep paths unique", tmpl)
+	}
+	return nil
+}
+
+// RenderBackupPath returns the path for a backup of btype taken at t
+func RenderBackupPath(cfg BackupConfig, btype BackupType, t time.Time) (string, error) {
+	tmpl := cfg.PathTemplate
+	if tmpl == "" {
+		tmpl = DefaultBackupPathTemplate
+	}
+	if err := ValidateBackupPathTemplate(tmpl); err != nil {
+		return "", err
+	}
+	tokens := backupTemplateTokens(btype, t)
+	rendered := templateToken.ReplaceAllStringFunc(tmpl, func(tok string) string {
+		return tokens[tok[1:len(tok)-1]]
+	})
+	return filepath.Join(cfg.BackupRoot, filepath.FromSlash(rendered)), nil
+}
+
+// templateExt returns the extension in the literal text that ends tmpl, e.g.
+// ".db" for DefaultBackupPathTemplate. Duplicate backups are numbered just
+// before it.
+func templateExt(tmpl string) string {
+	if tmpl == "" {
+		tmpl = DefaultBackupPathTemplate
+	}
+	tail := tmpl
+	if locs := templateToken.FindAllStringIndex(tmpl, -1); len(locs) > 0 {
+		tail = tmpl[locs[len(locs)-1][1]:]
+	}
+	return filepath.Ext(tail)
+}
+
+// scheduledBackupFile returns the file a backup of btype rendered at
+// backupPath is written to
+func scheduledBackupFile(cfg BackupConfig, btype BackupType, backupPath string) string {
+	path := backupPath + scheduledBackupExt[btype]
+	if cfg.Compress && btype != DeltaBackupType {
+		path += CompressedBackupExt
+	}
+	return path
+}
+
+// reserveScheduledBackup exclusively creates the file a backup of btype
+// rendered at backupPath is written to, or if a backup is already there, that
+// of the first numbered variant of backupPath that is free, and returns the
+// path it reserved. ok is false if the backup should be skipped instead,
+// under DuplicateSkip.
+func reserveScheduledBackup(cfg BackupConfig, btype BackupType, backupPath string) (path string, ok bool, err error) {
+	file := scheduledBackupFile(cfg, btype, backupPath)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return "", false, err
+	}
+	if cfg.OnDuplicate == DuplicateSkip {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return backupPath, true, f.Close()
+	}
+	ext := templateExt(cfg.PathTemplate)
+	base := strings.TrimSuffix(backupPath, ext)
+	path = backupPath
+	_, err = reservePath(file, func(n int) string {
+		path = fmt.Sprintf("%s-%d%s", base, n, ext)
+		return scheduledBackupFile(cfg, btype, path)
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return path, true, nil
+}
+
+// ParseBackupType validates a backup type name
+func ParseBackupType(s string) (BackupType, error) {
+	switch t := BackupType(s); t {
+	case FullBackupType, SQLBackupType, DeltaBackupType:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown backup type %q: must be %s, %s or %s", s, FullBackupType, SQLBackupType, DeltaBackupType)
+}
+
+// backupsRunning holds the DB paths with a scheduled backup in progress
+var backupsRunning sync.Map
+
+// runScheduledBackup takes one backup of btype; tests may replace it
+var runScheduledBackup = func(cfg BackupConfig, btype BackupType, backupPath string) error {
+	path := scheduledBackupFile(cfg, btype, backupPath)
+	switch btype {
+	case FullBackupType:
+		_, err := FullBackup(cfg.DBPath, path)
+		return err
+	case SQLBackupType:
+		_, err := SQLDump(cfg.DBPath, path, cfg.PartialTables)
+		return err
+	case DeltaBackupType:
+		return DeltaBackup(cfg.DBPath, cfg.DBPath+"-wal", path)
+	}
+	return fmt.Errorf("unknown backup type %q", btype)
+}
+
+// runBackups takes each configured backup type in turn
+func runBackups(cfg BackupConfig, now time.Time) {
+	var fingerprint string
+	if cfg.SkipUnchanged {
+		fp, err := dbPathFingerprint(cfg.DBPath, cfg.FullFingerprint)
+		if err != nil {
+			log.Printf("fingerprint of %s failed, backing up anyway: %v", cfg.DBPath, err)
+		} else if last, ok := lastBackupFingerprints.Load(cfg.DBPath); ok && last == fp {
+			log.Printf("scheduled backup of %s skipped: unchanged since the last backup", cfg.DBPath)
+			return
+		}
+		fingerprint = fp
+	}
+	failed := false
+	for _, btype := range cfg.BackupTypes {
+		backupPath, err := RenderBackupPath(cfg, btype, now)
+		if err != nil {
+			failed = true
+			continue
+		}
+		backupPath, ok, err := reserveScheduledBackup(cfg, btype, backupPath)
+		if err != nil {
+			log.Printf("scheduled %s backup of %s failed: %v", btype, cfg.DBPath, err)
+			failed = true
+			continue
+		}
+		if !ok {
+			log.Printf("scheduled %s backup of %s skipped: a backup taken at %s already exists", btype, cfg.DBPath, now.Format(time.TimeOnly))
+			continue
+		}
+		if err := runScheduledBackup(cfg, btype, backupPath); err != nil {
+			log.Printf("scheduled %s backup of %s failed: %v", btype, cfg.DBPath, err)
+			// Don't leave the reserved name behind as an empty backup
+			os.Remove(scheduledBackupFile(cfg, btype, backupPath))
+			failed = true
+		}
+	}
+	if fingerprint != "" && !failed {
+		lastBackupFingerprints.Store(cfg.DBPath, fingerprint)
+	}
+	if len(cfg.Retention) > 0 {
+		removed, err := PruneBackups(cfg, now)
+		if err != nil {
+			log.Printf("pruning backups of %s failed: %v", cfg.DBPath, err)
+		}
+		if len(removed) > 0 {
+			log.Printf("pruned %d backups of %s", len(removed), cfg.DBPath)
+		}
+	}
+}
+
+// ScheduleBackups runs backups at the configured interval and window. It
+// returns an error without scheduling anything if cfg.PathTemplate is invalid.
+// A tick that arrives while a backup of the same DB is still running (from
+// this or another schedule) is skipped rather than queued.
+func ScheduleBackups(cfg BackupConfig, stopCh <-chan struct{}) error {
+	if cfg.PathTemplate != "" {
+		if err := ValidateBackupPathTemplate(cfg.PathTemplate); err != nil {
+			return err
+		}
+	}
+	// A tick is due every Interval; allow one to be late before flagging it
+	heartbeat := "backup_scheduler:" + cfg.DBPath
+	StartHeartbeat(heartbeat, 2*cfg.Interval)
 	go func() {
 		ticker := time.NewTicker(cfg.Interval)
 		defer ticker.Stop()
+		defer StopHeartbeat(heartbeat)
 		for {
 			select {
 			case <-ticker.C:
+				Beat(heartbeat)
 				now := time.Now()
-				if now.After(cfg.MaintenanceStart) && now.Before(cfg.MaintenanceEnd) {
-					for _, btype := range cfg.BackupTypes {
-						backupDir := filepath.Join(cfg.BackupRoot, now.Format("2006/01/02"), string(btype))
-						os.MkdirAll(backupDir, 0755)
-						backupPath := filepath.Join(backupDir, fmt.Sprintf("backup_%s.db", now.Format("150405")))
-						switch btype {
-						case FullBackupType:
-							FullBackup(cfg.DBPath, backupPath)
-						case SQLBackupType:
-							SQLDump(cfg.DBPath, backupPath+".sql", cfg.PartialTables)
-						case DeltaBackupType:
-							DeltaBackup(cfg.DBPath, cfg.DBPath+"-wal", backupPath+".wal")
-						}
-					}
+				if !(now.After(cfg.MaintenanceStart) && now.Before(cfg.MaintenanceEnd)) {
+					continue
+				}
+				if _, busy := backupsRunning.LoadOrStore(cfg.DBPath, struct{}{}); busy {
+					log.Printf("scheduled backup of %s skipped: previous backup still running", cfg.DBPath)
+					continue
 				}
+				go func() {
+					defer backupsRunning.Delete(cfg.DBPath)
+					runBackups(cfg, now)
+				}()
 			case <-stopCh:
 				return
 			}
 		}
 	}()
-}
-
-// SQLDump creates a SQL dump of the whole DB or specific tables
-func SQLDump(dbPath, outPath string, tables []string) error {
-	args := []string{dbPath, ".dump"}
-	if len(tables) > 0 {
-		args = append(args, tables...)
-	}
-	cmd := exec.Command("sqlite3", args...)
-	out, err := os.Create(outPath)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-	cmd.Stdout = out
-	return cmd.Run()
+	return nil
 }
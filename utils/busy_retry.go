@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// BusyRetryPolicy bounds retries of writes that fail because another
+// connection holds the database lock
+type BusyRetryPolicy struct {
+	Attempts   int           // total attempts; 1 or less disables retries
+	Backoff    time.Duration // delay before the first retry, doubled for each one after
+	MaxBackoff time.Duration // cap on a single delay; uncapped if zero
+}
+
+// DefaultBusyRetryPolicy makes up to eight attempts over about a second
+var DefaultBusyRetryPolicy = BusyRetryPolicy{Attempts: 8, Backoff: 10 * time.Millisecond, MaxBackoff: 250 * time.Millisecond}
+
+var (
+	busyRetryMu sync.RWMutex
+	busyRetry   = DefaultBusyRetryPolicy
+)
+
+// SetBusyRetryPolicy sets the retry policy used by RetryOnBusy
+func SetBusyRetryPolicy(p BusyRetryPolicy) {
+	busyRetryMu.Lock()
+	busyRetry = p
+	busyRetryMu.Unlock()
+}
+
+// IsBusy reports whether err is SQLITE_BUSY or SQLITE_LOCKED
+func IsBusy(err error) bool {
+	var serr sqlite3.Error
+	if errors.As(err, &serr) {
+		return serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// RetryOnBusy runs fn, retrying with backoff while it fails with a busy
+// error. fn must be safe to repeat: a single statement or a whole
+// transaction. The last error is returned once the attempts run out.
+func RetryOnBusy(fn func() error) error {
+	busyRetryMu.RLock()
+	p := busyRetry
+	busyRetryMu.RUnlock()
+	_, err := backoff{attempts: p.Attempts, first: p.Backoff, max: p.MaxBackoff}.retry(fn, IsBusy, nil)
+	return err
+}
+
+// backoff is a retry schedule: attempts in all, the first retry after
+// first, each delay after that doubled up to max (uncapped if zero)
+type backoff struct {
+	attempts   int
+	first, max time.Duration
+}
+
+// retry runs fn until it succeeds, fails with an error retryable rejects or
+// the attempts run out, returning the attempts made and the last error.
+// onRetry, if set, is called before each delay.
+func (b backoff) retry(fn func() error, retryable func(error) bool, onRetry func(n int, delay time.Duration, err error)) (int, error) {
+	delay := b.first
+	for n := 1; ; n++ {
+		err := fn()
+		if err == nil || !retryable(err) || n >= b.attempts {
+			return n, err
+		}
+		if onRetry != nil {
+			onRetry(n, delay, err)
+		}
+		time.Sleep(delay)
+		if delay *= 2; b.max > 0 && delay > b.max {
+			delay = b.max
+		}
+	}
+}
@@ -6,8 +6,20 @@ import (
 	"log"
 )
 
-// CreateTables creates the initial tables for Dewey's models
+// CreateTables creates the initial tables for Dewey's models and stamps the
+// database with SchemaVersion
 func CreateTables(db *sql.DB) {
+	if err := createTables(db); err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	if err := setSchemaVersion(db, SchemaVersion); err != nil {
+		log.Fatalf("Failed to set schema version: %v", err)
+	}
+	fmt.Println("All tables created or already exist.")
+}
+
+// createTables runs the CREATE TABLE statements; it is idempotent
+func createTables(db *sql.DB) error {
 	queries := []string{
 		`CREATE TABLE IF NOT EXISTS manufacturer (id INTEGER PRIMARY KEY, name TEXT);`,
 		`CREATE TABLE IF NOT EXISTS radio_model (id INTEGER PRIMARY KEY, manufacturer_id INTEGER, name TEXT);`,
@@ -16,8 +28,9 @@ func CreateTables(db *sql.DB) {
 		`CREATE TABLE IF NOT EXISTS codeplug_skeleton (id INTEGER PRIMARY KEY, radio_model INTEGER, skeleton TEXT);`,
 		`CREATE TABLE IF NOT EXISTS codeplug_setting (id INTEGER PRIMARY KEY, radio_model INTEGER, setting TEXT, value TEXT);`,
 		`CREATE TABLE IF NOT EXISTS codeplug_supported_setting (id INTEGER PRIMARY KEY, radio_model_id INTEGER, feature TEXT, supported BOOLEAN);`,
+		`CREATE TABLE IF NOT EXISTS codeplug_checksum (radio_model INTEGER PRIMARY KEY, checksum TEXT, computed_at TEXT);`,
 		`CREATE TABLE IF NOT EXISTS role (id INTEGER PRIMARY KEY, name TEXT);`,
-		`CREATE TABLE IF NOT EXISTS user (id INTEGER PRIMARY KEY, username TEXT, password TEXT, role_id INTEGER);`,
+		`CREATE TABLE IF NOT EXISTS user (id INTEGER PRIMARY KEY, username TEXT UNIQUE, password_hash TEXT, role_id INTEGER, locked BOOLEAN, revoked BOOLEAN, last_login TEXT, deleted_at TEXT);`,
 		`CREATE TABLE IF NOT EXISTS permission (id INTEGER PRIMARY KEY, name TEXT);`,
 		`CREATE TABLE IF NOT EXISTS authentication (id INTEGER PRIMARY KEY, username TEXT, password TEXT);`,
 		`CREATE TABLE IF NOT EXISTS dewey_stats (id INTEGER PRIMARY KEY);`,
@@ -27,17 +40,49 @@ func CreateTables(db *sql.DB) {
 		`CREATE TABLE IF NOT EXISTS redbug (id INTEGER PRIMARY KEY);`,
 		`CREATE TABLE IF NOT EXISTS domino (id INTEGER PRIMARY KEY);`,
 		`CREATE TABLE IF NOT EXISTS role_permission (id INTEGER PRIMARY KEY, role_id INTEGER REFERENCES role(id), permission_id INTEGER REFERENCES permission(id));`,
-		`CREATE TABLE IF NOT EXISTS team (id INTEGER PRIMARY KEY, name TEXT, leader_id INTEGER REFERENCES user(id));`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_role_permission_unique ON role_permission (role_id, permission_id);`,
+		`CREATE TABLE IF NOT EXISTS team (id INTEGER PRIMARY KEY, name TEXT, leader_id INTEGER REFERENCES user(id), description TEXT);`,
 		`CREATE TABLE IF NOT EXISTS team_member (id INTEGER PRIMARY KEY, team_id INTEGER REFERENCES team(id), user_id INTEGER REFERENCES user(id), role_id INTEGER REFERENCES role(id));`,
 		`CREATE TABLE IF NOT EXISTS team_permission (id INTEGER PRIMARY KEY, team_id INTEGER REFERENCES team(id), permission_id INTEGER REFERENCES permission(id));`,
-		`CREATE TABLE IF NOT EXISTS backup_metadata (id INTEGER PRIMARY KEY, backup_type TEXT, timestamp TEXT, file_path TEXT, size INTEGER, duration INTEGER, status TEXT);`,
-		`CREATE TABLE IF NOT EXISTS db_stats (id INTEGER PRIMARY KEY, timestamp TEXT, integrity_ok BOOLEAN, db_size INTEGER, last_vacuum TEXT, wal_status TEXT, table_counts TEXT);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_team_permission_unique ON team_permission (team_id, permission_id);`,
+		`CREATE TABLE IF NOT EXISTS team_metadata (id INTEGER PRIMARY KEY, team_id INTEGER REFERENCES team(id), key TEXT, value TEXT);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_team_metadata_key ON team_metadata (team_id, key);`,
+		`CREATE TABLE IF NOT EXISTS backup_metadata (id INTEGER PRIMARY KEY, backup_type TEXT, timestamp TEXT, file_path TEXT, size INTEGER, duration INTEGER, status TEXT, checksum TEXT, fingerprint TEXT);`,
+		`CREATE TABLE IF NOT EXISTS audit_log (id INTEGER PRIMARY KEY, timestamp TEXT, actor TEXT, action TEXT, detail TEXT);`,
+		`CREATE TABLE IF NOT EXISTS db_stats (id INTEGER PRIMARY KEY, timestamp TEXT, integrity_ok BOOLEAN, db_size INTEGER, last_vacuum TEXT, wal_status TEXT, table_counts TEXT, foreign_key_violations INTEGER);`,
 	}
 	for _, q := range queries {
-		_, err := db.Exec(q)
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grantIndexes are the unique indexes that keep a grant from being recorded
+// twice, which older versions created their tables without
+var grantIndexes = []struct{ table, index, cols string }{
+	{"role_permission", "idx_role_permission_unique", "role_id, permission_id"},
+	{"team_permission", "idx_team_permission_unique", "team_id, permission_id"},
+}
+
+// RemoveDuplicateGrants deletes all but the first row of each grant recorded
+// more than once, in the grant tables that don't have their unique index
+// yet, so that it can be created. Once every index exists it does nothing.
+func RemoveDuplicateGrants(db *sql.DB) error {
+	for _, g := range grantIndexes {
+		var tables, indexes int
+		err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?), (SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?)`,
+			g.table, g.index).Scan(&tables, &indexes)
 		if err != nil {
-			log.Fatalf("Failed to create table: %v", err)
+			return err
+		}
+		if tables == 0 || indexes > 0 {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("DELETE FROM %[1]s WHERE id NOT IN (SELECT MIN(id) FROM %[1]s GROUP BY %[2]s);", g.table, g.cols)); err != nil {
+			return err
 		}
 	}
-	fmt.Println("All tables created or already exist.")
+	return nil
 }
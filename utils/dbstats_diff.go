@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/unklstewy/redbug_dewey/models"
+)
+
+// ErrNotEnoughDBStats is returned when there are fewer than two db_stats
+// snapshots to compare
+var ErrNotEnoughDBStats = errors.New("need at least two db_stats snapshots")
+
+// Change is a setting that differs between two snapshots
+type Change struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DBStatsDiff is what changed from one DBStats snapshot to a later one.
+// Unchanged settings are nil, and tables whose row count didn't change are
+// left out of TableCountDeltas.
+type DBStatsDiff struct {
+	FromID           int            `json:"from_id"`
+	ToID             int            `json:"to_id"`
+	From             string         `json:"from"` // snapshot timestamps
+	To               string         `json:"to"`
+	SizeDelta        int64          `json:"size_delta"`
+	IntegrityBefore  bool           `json:"integrity_before"`
+	IntegrityAfter   bool           `json:"integrity_after"`
+	IntegrityChanged bool           `json:"integrity_changed"`
+	LastVacuum       *Change        `json:"last_vacuum,omitempty"`
+	WALStatus        *Change        `json:"wal_status,omitempty"`
+	TableCountDeltas map[string]int `json:"table_count_deltas"`
+	AddedTables      []string       `json:"added_tables"`   // counted in b but not a
+	RemovedTables    []string       `json:"removed_tables"` // counted in a but not b
+}
+
+// DiffDBStats returns the changes from snapshot a to snapshot b. Table counts
+// that aren't valid JSON are treated as empty.
+func DiffDBStats(a, b models.DBStats) DBStatsDiff {
+	d := DBStatsDiff{
+		FromID:           a.ID,
+		ToID:             b.ID,
+		From:             a.Timestamp,
+		To:               b.Timestamp,
+		SizeDelta:        b.DBSize - a.DBSize,
+		IntegrityBefore:  a.IntegrityOK,
+		IntegrityAfter:   b.IntegrityOK,
+		IntegrityChanged: a.IntegrityOK != b.IntegrityOK,
+		LastVacuum:       diffSetting(a.LastVacuum, b.LastVacuum),
+		WALStatus:        diffSetting(a.WALStatus, b.WALStatus),
+		TableCountDeltas: make(map[string]int),
+		AddedTables:      []string{},
+		RemovedTables:    []string{},
+	}
+	before, after := parseTableCounts(a.TableCounts), parseTableCounts(b.TableCounts)
+	for table, n := range after {
+		old, ok := before[table]
+		if !ok {
+			d.AddedTables = append(d.AddedTables, table)
+		}
+		if n != old {
+			d.TableCountDeltas[table] = n - old
+		}
+	}
+	for table, old := range before {
+		if _, ok := after[table]; !ok {
+			d.RemovedTables = append(d.RemovedTables, table)
+			if old != 0 {
+				d.TableCountDeltas[table] = -old
+			}
+		}
+	}
+	sort.Strings(d.AddedTables)
+	sort.Strings(d.RemovedTables)
+	return d
+}
+
+// diffSetting returns the change from a to b, or nil if they are equal
+func diffSetting(a, b string) *Change {
+	if a == b {
+		return nil
+	}
+	return &Change{From: a, To: b}
+}
+
+// parseTableCounts decodes the table_counts JSON of a snapshot
+func parseTableCounts(s string) map[string]int {
+	counts := make(map[string]int)
+	json.Unmarshal([]byte(s), &counts)
+	return counts
+}
+
+// LatestDBStatsDiff diffs the two most recent db_stats snapshots, older to
+// newer
+func LatestDBStatsDiff(db *sql.DB) (DBStatsDiff, error) {
+	rows, err := db.Query(`SELECT id, COALESCE(timestamp, ''), COALESCE(integrity_ok, 0), COALESCE(db_size, 0),
+		COALESCE(last_vacuum, ''), COALESCE(wal_status, ''), COALESCE(table_counts, '')
+		FROM db_stats ORDER BY timestamp DESC, id DESC LIMIT 2`)
+	if err != nil {
+		return DBStatsDiff{}, err
+	}
+	defer rows.Close()
+	var snaps []models.DBStats
+	for rows.Next() {
+		var s models.DBStats
+		if err := rows.Scan(&s.ID, &s.Timestamp, &s.IntegrityOK, &s.DBSize, &s.LastVacuum, &s.WALStatus, &s.TableCounts); err != nil {
+			return DBStatsDiff{}, err
+		}
+		snaps = append(snaps, s)
+	}
+	if err := rows.Err(); err != nil {
+		return DBStatsDiff{}, err
+	}
+	if len(snaps) < 2 {
+		return DBStatsDiff{}, ErrNotEnoughDBStats
+	}
+	return DiffDBStats(snaps[1], snaps[0]), nil
+}
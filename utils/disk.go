@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrInsufficientDiskSpace is returned when an operation is refused because
+// it would leave less than MinFreeDiskBytes free.
+var ErrInsufficientDiskSpace = errors.New("insufficient disk space")
+
+// MinFreeDiskBytes is the free space that must remain after a capture or
+// backup has written its estimated size.
+var MinFreeDiskBytes uint64 = 64 << 20
+
+// DiskFree reports free space for CheckDiskSpace; tests may replace it.
+var DiskFree = FreeDiskBytes
+
+// CheckDiskSpace refuses an operation expected to write need bytes into dir
+// unless at least MinFreeDiskBytes would remain free afterwards. Where free
+// space can't be measured on this platform the operation is allowed.
+func CheckDiskSpace(dir string, need uint64) error {
+	free, err := DiskFree(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if free < MinFreeDiskBytes+need {
+		return fmt.Errorf("%w in %s: %d bytes free, need %d plus %d reserved", ErrInsufficientDiskSpace, dir, free, need, MinFreeDiskBytes)
+	}
+	return nil
+}
+
+// dbFileSize estimates the on-disk size of a SQLite DB, including its WAL
+func dbFileSize(dbPath string) uint64 {
+	var size uint64
+	for _, p := range []string{dbPath, dbPath + "-wal"} {
+		if info, err := os.Stat(p); err == nil {
+			size += uint64(info.Size())
+		}
+	}
+	return size
+}
+
+// checkBackupSpace checks there is room to write a backup of dbPath to outPath
+func checkBackupSpace(dbPath, outPath string) error {
+	return CheckDiskSpace(filepath.Dir(outPath), dbFileSize(dbPath))
+}
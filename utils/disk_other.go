@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || dragonfly)
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// FreeDiskBytes can't measure free space on this platform; it always returns
+// an error wrapping errors.ErrUnsupported, which CheckDiskSpace lets pass.
+func FreeDiskBytes(path string) (uint64, error) {
+	return 0, fmt.Errorf("free disk space of %s on %s: %w", path, runtime.GOOS, errors.ErrUnsupported)
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package utils
+
+import "syscall"
+
+// FreeDiskBytes returns the bytes available to unprivileged users on the
+// filesystem holding path.
+func FreeDiskBytes(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
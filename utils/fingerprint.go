@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FingerprintExcludedTables are left out of LiveDBFingerprint and
+// FullDBFingerprint because taking a backup writes to them
+var FingerprintExcludedTables = []string{"backup_metadata"}
+
+// LiveDBFingerprint returns a cheap fingerprint of db's contents: a hash of
+// its schema and of each table's row count and largest rowid. Committed
+// inserts, deletes and schema changes change it; an update that leaves every
+// count and rowid alone does not, for which see FullDBFingerprint. It reads
+// no rows, only each table's b-tree.
+func LiveDBFingerprint(db *sql.DB) (string, error) {
+	return fingerprint(db, hashTableShape)
+}
+
+// FullDBFingerprint is LiveDBFingerprint over every row of every table, so
+// updates change it too and an unchanged fingerprint means an unchanged DB.
+// It reads the whole DB, so it costs as much I/O as a backup.
+func FullDBFingerprint(db *sql.DB) (string, error) {
+	return fingerprint(db, hashTableRows)
+}
+
+// fingerprint hashes db's schema, then each table not excluded with hashTable
+func fingerprint(db *sql.DB, hashTable func(db *sql.DB, h io.Writer, table string) error) (string, error) {
+	rows, err := db.Query("SELECT type, name, COALESCE(sql, '') FROM sqlite_master WHERE name NOT LIKE 'sqlite_%' ORDER BY type, name")
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	var tables []string
+	for rows.Next() {
+		var typ, name, ddl string
+		if err := rows.Scan(&typ, &name, &ddl); err != nil {
+			rows.Close()
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %s %s\n", typ, name, ddl)
+		if typ == "table" && !fingerprintExcluded(name) {
+			tables = append(tables, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	for _, table := range tables {
+		if err := hashTable(db, h, table); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashTableShape writes table's row count and largest rowid to h
+func hashTableShape(db *sql.DB, h io.Writer, table string) error {
+	var count int64
+	var maxRowid sql.NullInt64
+	err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*), MAX(rowid) FROM %s", quoteIdent(table))).Scan(&count, &maxRowid)
+	if err != nil {
+		// WITHOUT ROWID tables have no rowid
+		if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", quoteIdent(table))).Scan(&count); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(h, "table %s %d %d\n", table, count, maxRowid.Int64)
+	return nil
+}
+
+// hashTableRows writes each row of table to h, in rowid order (primary key
+// order for WITHOUT ROWID tables). Values are written through quote(), so a
+// value's type counts as well as its text.
+func hashTableRows(db *sql.DB, h io.Writer, table string) error {
+	cols, err := columnAffinities(db, table)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(cols))
+	for name := range cols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = "quote(" + quoteIdent(name) + ")"
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(quoted, " || ',' || "), quoteIdent(table))
+	rows, err := db.Query(query + " ORDER BY rowid")
+	if err != nil {
+		// WITHOUT ROWID tables have no rowid and are stored in key order
+		if rows, err = db.Query(query); err != nil {
+			return err
+		}
+	}
+	defer rows.Close()
+	fmt.Fprintf(h, "table %s\n", table)
+	for rows.Next() {
+		var row sql.RawBytes
+		if err := rows.Scan(&row); err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%d:%s\n", len(row), row)
+	}
+	return rows.Err()
+}
+
+// fingerprintExcluded reports whether table is in FingerprintExcludedTables
+func fingerprintExcluded(table string) bool {
+	for _, t := range FingerprintExcludedTables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// lastBackupFingerprints holds the fingerprint of each DB path as of its
+// last scheduled backup, for BackupConfig.SkipUnchanged
+var lastBackupFingerprints sync.Map
+
+// dbPathFingerprint opens the DB at path read-only and fingerprints it, with
+// FullDBFingerprint if full is set and LiveDBFingerprint otherwise
+func dbPathFingerprint(path string, full bool) (string, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	if full {
+		return FullDBFingerprint(db)
+	}
+	return LiveDBFingerprint(db)
+}
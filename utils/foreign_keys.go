@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// maxReportedViolations caps the foreign key violations HealthReport lists
+const maxReportedViolations = 100
+
+// ForeignKeyViolation is a row referring to a missing parent row
+type ForeignKeyViolation struct {
+	Table  string `json:"table"`
+	RowID  int64  `json:"rowid"` // 0 for a WITHOUT ROWID table
+	Parent string `json:"parent"`
+	// FKID is the foreign key's id in PRAGMA foreign_key_list(Table), or -1
+	// for a modelReferences entry the table doesn't declare
+	FKID int `json:"fkid"`
+	// Column is the referring column, for modelReferences entries
+	Column string `json:"column,omitempty"`
+}
+
+// modelReference is a column of table holding the id of a parent row
+type modelReference struct {
+	table, column, parent string
+}
+
+// modelReferences are the references between Dewey's tables, as
+// createTables declares them. Tables created by GORM's AutoMigrate declare
+// none, so each one a table doesn't declare is checked by a query of its
+// own. There, as GORM writes 0 for an unset id, 0 counts as no reference.
+var modelReferences = []modelReference{
+	{"role_permission", "role_id", "role"},
+	{"role_permission", "permission_id", "permission"},
+	{"team", "leader_id", "user"},
+	{"team_member", "team_id", "team"},
+	{"team_member", "user_id", "user"},
+	{"team_member", "role_id", "role"},
+	{"team_permission", "team_id", "team"},
+	{"team_permission", "permission_id", "permission"},
+	{"team_metadata", "team_id", "team"},
+}
+
+// orphanWhere selects the rows of ref.table whose parent is missing
+func (ref modelReference) orphanWhere() string {
+	return fmt.Sprintf("c.%[1]s IS NOT NULL AND c.%[1]s != 0 AND NOT EXISTS (SELECT 1 FROM %[2]s p WHERE p.id = c.%[1]s)",
+		quoteIdent(ref.column), quoteIdent(ref.parent))
+}
+
+// undeclaredReferences returns the modelReferences whose tables and columns
+// exist but which PRAGMA foreign_key_check can't see, for lack of a
+// declared foreign key
+func undeclaredReferences(tx *sql.Tx) ([]modelReference, error) {
+	var refs []modelReference
+	for _, ref := range modelReferences {
+		var n int
+		err := tx.QueryRow(`SELECT (SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?) + (SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = 'id')`,
+			ref.table, ref.column, ref.parent).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		if n != 2 {
+			continue
+		}
+		fks, err := foreignKeys(tx, ref.table)
+		if err != nil {
+			return nil, err
+		}
+		declared := false
+		for _, fk := range fks {
+			declared = declared || fk.from == ref.column
+		}
+		if !declared {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// CountForeignKeyViolations counts the rows referring to missing parent
+// rows: those PRAGMA foreign_key_check finds, whether or not foreign key
+// enforcement is on, and those breaking a modelReferences entry the table
+// doesn't declare. It scans every referring table.
+func CountForeignKeyViolations(db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var total int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM pragma_foreign_key_check").Scan(&total); err != nil {
+		return 0, err
+	}
+	refs, err := undeclaredReferences(tx)
+	if err != nil {
+		return 0, err
+	}
+	for _, ref := range refs {
+		var n int
+		if err := tx.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s c WHERE %s", quoteIdent(ref.table), ref.orphanWhere())).Scan(&n); err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// ForeignKeyViolations returns the rows CountForeignKeyViolations counts,
+// stopping after limit of them; all of them if limit is 0
+func ForeignKeyViolations(db *sql.DB, limit int) ([]ForeignKeyViolation, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// LIMIT -1 is no limit
+	remaining := func(found []ForeignKeyViolation) int {
+		if limit <= 0 {
+			return -1
+		}
+		return limit - len(found)
+	}
+	violations := []ForeignKeyViolation{}
+	rows, err := tx.Query(`SELECT "table", rowid, parent, fkid FROM pragma_foreign_key_check LIMIT ?`, remaining(violations))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var v ForeignKeyViolation
+		var rowid sql.NullInt64
+		if err := rows.Scan(&v.Table, &rowid, &v.Parent, &v.FKID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		v.RowID = rowid.Int64
+		violations = append(violations, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	refs, err := undeclaredReferences(tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		n := remaining(violations)
+		if n == 0 {
+			break
+		}
+		ids, err := queryRowids(tx, fmt.Sprintf("SELECT c.rowid FROM %s c WHERE %s ORDER BY c.rowid LIMIT %d", quoteIdent(ref.table), ref.orphanWhere(), n))
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			violations = append(violations, ForeignKeyViolation{Table: ref.table, RowID: id, Parent: ref.parent, FKID: -1, Column: ref.column})
+		}
+	}
+	return violations, nil
+}
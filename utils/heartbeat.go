@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultHeartbeatStaleAfter is how long a running loop may go without a
+// heartbeat before it is reported stale, unless registered otherwise
+const DefaultHeartbeatStaleAfter = 30 * time.Second
+
+// Heartbeat is the liveness of a background loop
+type Heartbeat struct {
+	Name       string        `json:"name"`
+	LastBeat   time.Time     `json:"last_beat"`
+	StaleAfter time.Duration `json:"stale_after"`
+	Running    bool          `json:"running"` // the loop is expected to be beating
+	Stale      bool          `json:"stale"`   // running, but silent for longer than StaleAfter
+}
+
+var heartbeats = struct {
+	sync.Mutex
+	m map[string]*Heartbeat
+}{m: make(map[string]*Heartbeat)}
+
+// heartbeatNow is the clock for heartbeats; tests may replace it
+var heartbeatNow = time.Now
+
+// StartHeartbeat marks the loop name as running. It is reported stale if
+// Beat is not called at least every staleAfter (DefaultHeartbeatStaleAfter
+// when zero) until StopHeartbeat.
+func StartHeartbeat(name string, staleAfter time.Duration) {
+	if staleAfter <= 0 {
+		staleAfter = DefaultHeartbeatStaleAfter
+	}
+	heartbeats.Lock()
+	heartbeats.m[name] = &Heartbeat{Name: name, LastBeat: heartbeatNow(), StaleAfter: staleAfter, Running: true}
+	heartbeats.Unlock()
+}
+
+// Beat records activity for the loop name
+func Beat(name string) {
+	heartbeats.Lock()
+	if hb, ok := heartbeats.m[name]; ok {
+		hb.LastBeat = heartbeatNow()
+	}
+	heartbeats.Unlock()
+}
+
+// StopHeartbeat marks the loop name as exited normally, so its silence is not
+// reported as stale
+func StopHeartbeat(name string) {
+	heartbeats.Lock()
+	if hb, ok := heartbeats.m[name]; ok {
+		hb.Running = false
+	}
+	heartbeats.Unlock()
+}
+
+// Heartbeats returns the liveness of every registered loop, sorted by name
+func Heartbeats() []Heartbeat {
+	now := heartbeatNow()
+	heartbeats.Lock()
+	defer heartbeats.Unlock()
+	out := make([]Heartbeat, 0, len(heartbeats.m))
+	for _, hb := range heartbeats.m {
+		h := *hb
+		h.Stale = h.Running && now.Sub(h.LastBeat) > h.StaleAfter
+		out = append(out, h)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// StaleLoops returns the names of running loops whose heartbeat is stale
+func StaleLoops() []string {
+	var stale []string
+	for _, hb := range Heartbeats() {
+		if hb.Stale {
+			stale = append(stale, hb.Name)
+		}
+	}
+	return stale
+}
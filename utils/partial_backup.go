@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackupScope selects what PartialBackupScoped dumps
+type BackupScope struct {
+	// Tables are dumped with every row, unless Rows limits them
+	Tables []string
+	// Rows limits a table to the rowids given; a table only listed here is
+	// dumped with just those rows
+	Rows map[string][]int64
+	// Redact lists columns of a table written as NULL, e.g. password hashes
+	Redact map[string][]string
+}
+
+// PartialBackup writes a SQL script recreating tables with all their rows,
+// plus the rows of other tables those rows reference through foreign keys
+func PartialBackup(db *sql.DB, outPath string, tables []string) error {
+	_, err := PartialBackupScoped(db, outPath, BackupScope{Tables: tables})
+	return err
+}
+
+// PartialBackupScoped writes a SQL script recreating the tables and rows in
+// scope, plus the rows they reference through foreign keys, transitively.
+// Tables are written in schema order from one read transaction. A failed
+// backup leaves no file at outPath.
+func PartialBackupScoped(db *sql.DB, outPath string, scope BackupScope) (BackupResult, error) {
+	return PartialBackupScopedContext(context.Background(), db, outPath, scope)
+}
+
+// PartialBackupScopedContext is PartialBackupScoped, stopping between tables
+// and rows if ctx is canceled. A canceled backup leaves no file at outPath.
+func PartialBackupScopedContext(ctx context.Context, db *sql.DB, outPath string, scope BackupScope) (BackupResult, error) {
+	start := time.Now()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return BackupResult{}, err
+	}
+	defer tx.Rollback()
+	rows, err := scopeRows(tx, scope)
+	if err != nil {
+		return BackupResult{}, err
+	}
+	out, err := os.Create(outPath)
+	if err != nil {
+		return BackupResult{}, err
+	}
+	defer out.Close()
+	h := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, h)}
+	w := bufio.NewWriter(counter)
+	err = writePartialDump(ctx, tx, w, rows, scope.Redact)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(outPath)
+		return BackupResult{}, err
+	}
+	return newBackupResult(outPath, counter.n, start, h), nil
+}
+
+// scopeRows returns the rowids to dump per table: the scope's rows, then
+// every row they reference, until nothing new is added
+func scopeRows(tx *sql.Tx, scope BackupScope) (map[string]map[int64]bool, error) {
+	selected := make(map[string]map[int64]bool)
+	var queue []string
+	add := func(table string, ids []int64) {
+		set, ok := selected[table]
+		if !ok {
+			set = make(map[int64]bool)
+			selected[table] = set
+		}
+		grew := !ok
+		for _, id := range ids {
+			if !set[id] {
+				set[id] = true
+				grew = true
+			}
+		}
+		if grew {
+			queue = append(queue, table)
+		}
+	}
+	for _, table := range scope.Tables {
+		if _, limited := scope.Rows[table]; limited {
+			continue
+		}
+		ids, err := queryRowids(tx, fmt.Sprintf("SELECT rowid FROM %s", quoteIdent(table)))
+		if err != nil {
+			return nil, err
+		}
+		add(table, ids)
+	}
+	for table, ids := range scope.Rows {
+		add(table, ids)
+	}
+	for len(queue) > 0 {
+		table := queue[0]
+		queue = queue[1:]
+		fks, err := foreignKeys(tx, table)
+		if err != nil {
+			return nil, err
+		}
+		for _, fk := range fks {
+			ids, err := queryRowids(tx, fmt.Sprintf("SELECT rowid FROM %s WHERE %s IN (SELECT %s FROM %s WHERE rowid IN (%s))",
+				quoteIdent(fk.table), quoteIdent(fk.to), quoteIdent(fk.from), quoteIdent(table), rowidList(selected[table])))
+			if err != nil {
+				return nil, err
+			}
+			if len(ids) > 0 {
+				add(fk.table, ids)
+			}
+		}
+	}
+	return selected, nil
+}
+
+// foreignKey is one column reference from PRAGMA foreign_key_list
+type foreignKey struct {
+	table, from, to string
+}
+
+// foreignKeys returns table's foreign keys. References without a target
+// column point at the referenced table's rowid.
+func foreignKeys(tx *sql.Tx, table string) ([]foreignKey, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA foreign_key_list(%s);", quoteIdent(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var fks []foreignKey
+	for rows.Next() {
+		var id, seq int
+		var fk foreignKey
+		var to sql.NullString
+		var onUpdate, onDelete, match string
+		if err := rows.Scan(&id, &seq, &fk.table, &fk.from, &to, &onUpdate, &onDelete, &match); err != nil {
+			return nil, err
+		}
+		fk.to = "rowid"
+		if to.Valid && to.String != "" {
+			fk.to = to.String
+		}
+		fks = append(fks, fk)
+	}
+	return fks, rows.Err()
+}
+
+// queryRowids runs a query selecting one integer column
+func queryRowids(tx *sql.Tx, query string) ([]int64, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// rowidList returns the ids as a sorted SQL list
+func rowidList(ids map[int64]bool) string {
+	sorted := make([]int64, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	parts := make([]string, len(sorted))
+	for i, id := range sorted {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// writePartialDump writes the DDL of each selected table, in schema order,
+// followed by its selected rows, then the tables' indexes and triggers
+func writePartialDump(ctx context.Context, tx *sql.Tx, w *bufio.Writer, selected map[string]map[int64]bool, redact map[string][]string) error {
+	objects, err := schemaObjects(tx)
+	if err != nil {
+		return err
+	}
+	if err := writeDumpHeader(tx, w); err != nil {
+		return err
+	}
+	for _, o := range objects {
+		ids, ok := selected[o.name]
+		if o.kind != "table" || !ok {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s;\n", o.sql)
+		if len(ids) == 0 {
+			continue
+		}
+		if err := dumpTableRowsWhere(ctx, tx, w, o.name, "rowid IN ("+rowidList(ids)+")", redact[o.name]); err != nil {
+			return err
+		}
+	}
+	for _, o := range objects {
+		if _, ok := selected[o.table]; o.kind == "table" || !ok {
+			continue
+		}
+		fmt.Fprintf(w, "%s;\n", o.sql)
+	}
+	fmt.Fprintln(w, "COMMIT;")
+	return nil
+}
@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"database/sql"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHashCostStats returns how many stored password hashes use each
+// bcrypt cost, so a raised cost can be tracked until every user has logged in
+// and been rehashed. Hashes that aren't bcrypt are counted under cost 0.
+func PasswordHashCostStats(db *sql.DB) (map[int]int, error) {
+	rows, err := db.Query("SELECT password_hash FROM user")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	costs := make(map[int]int)
+	for rows.Next() {
+		var hash sql.NullString
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		cost, err := bcrypt.Cost([]byte(hash.String))
+		if err != nil {
+			cost = 0
+		}
+		costs[cost]++
+	}
+	return costs, rows.Err()
+}
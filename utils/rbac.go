@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/unklstewy/redbug_dewey/models"
+)
+
+// EnsureRBAC makes the role and permission tables contain roles and perms,
+// inserting missing rows and renaming existing ones by id, and grants each
+// {role id, permission id} pair in grants that isn't already granted. It runs
+// in one transaction and is safe to call on every startup. Every role and
+// permission needs an id, and grants must refer to rows that exist.
+func EnsureRBAC(db *sql.DB, roles []models.Role, perms []models.Permission, grants [][2]int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range roles {
+		if r.ID == 0 {
+			return fmt.Errorf("role %q has no id", r.Name)
+		}
+		if _, err := tx.Exec("INSERT INTO role (id, name) VALUES (?, ?) ON CONFLICT(id) DO UPDATE SET name = excluded.name", r.ID, r.Name); err != nil {
+			return err
+		}
+	}
+	for _, p := range perms {
+		if p.ID == 0 {
+			return fmt.Errorf("permission %q has no id", p.Name)
+		}
+		if _, err := tx.Exec("INSERT INTO permission (id, name) VALUES (?, ?) ON CONFLICT(id) DO UPDATE SET name = excluded.name", p.ID, p.Name); err != nil {
+			return err
+		}
+	}
+	for _, g := range grants {
+		var roles, perms int
+		if err := tx.QueryRow("SELECT (SELECT COUNT(*) FROM role WHERE id = ?), (SELECT COUNT(*) FROM permission WHERE id = ?)", g[0], g[1]).Scan(&roles, &perms); err != nil {
+			return err
+		}
+		if roles == 0 || perms == 0 {
+			return fmt.Errorf("grant of permission %d to role %d refers to a missing role or permission", g[1], g[0])
+		}
+		if err := InsertRolePermission(tx, g[0], g[1]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// InsertRolePermission grants a permission to a role within tx, doing
+// nothing if the role already has it. It relies on role_permission's unique
+// index and doesn't check that the role or permission exists.
+func InsertRolePermission(tx *sql.Tx, roleID, permissionID int) error {
+	_, err := tx.Exec("INSERT OR IGNORE INTO role_permission (role_id, permission_id) VALUES (?, ?)", roleID, permissionID)
+	return err
+}
@@ -0,0 +1,347 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RestoreOptions controls RestoreBackupWithOptions
+type RestoreOptions struct {
+	// MigrateSchema upgrades a restored database whose schema version is
+	// older than SchemaVersion instead of refusing it
+	MigrateSchema bool
+	// Force replaces the live DB even while it is open
+	Force bool
+}
+
+// ErrDBInUse is returned when restoring over a DB that is open, unless
+// RestoreOptions.Force is set
+var ErrDBInUse = errors.New("database is in use")
+
+// preRestoreSuffix names the safety copy of a DB taken before a restore
+// replaces it: <db>.pre-restore-YYYYMMDD_HHMMSS, numbered -1, -2, ... if
+// that is taken
+const preRestoreSuffix = ".pre-restore-"
+
+// RestoreBackup restores dbPath from a backup file, refusing backups whose
+// schema version doesn't match this build. See RestoreBackupWithOptions.
+func RestoreBackup(backupPath, dbPath string, backupType BackupType) error {
+	return RestoreBackupWithOptions(backupPath, dbPath, backupType, RestoreOptions{})
+}
+
+// RestoreFromSQLDump restores dbPath from a script written by SQLDump
+func RestoreFromSQLDump(dumpPath, dbPath string) error {
+	return RestoreBackup(dumpPath, dbPath, SQLBackupType)
+}
+
+// RestoreBackupWithOptions restores dbPath from a backup file. Full backups
+// may be a plain DB copy, gzip-compressed (.db.gz), or a .tar.gz snapshot
+// holding the DB and its -wal file; the format is sniffed from the content.
+// SQL backups, plain or .sql.gz, are loaded into a fresh database. The result
+// is built in a temporary file beside dbPath and checked with PRAGMA
+// integrity_check and CheckSchemaVersion before it replaces the live file. A
+// DB that is open is refused with ErrDBInUse unless opts.Force is set, and an
+// existing DB is copied to <dbPath>.pre-restore-<time> before it is replaced.
+func RestoreBackupWithOptions(backupPath, dbPath string, backupType BackupType, opts RestoreOptions) error {
+	return RestoreBackupContext(context.Background(), backupPath, dbPath, backupType, opts)
+}
+
+// RestoreBackupContext is RestoreBackupWithOptions, stopping early if ctx is
+// canceled. Cancellation before the restored file replaces the live one
+// leaves dbPath untouched and removes the temporary files.
+func RestoreBackupContext(ctx context.Context, backupPath, dbPath string, backupType BackupType, opts RestoreOptions) error {
+	tmpPath := dbPath + ".restore"
+	var load func(ctx context.Context, src, dst string) error
+	switch backupType {
+	case FullBackupType:
+		load = extractBackup
+	case SQLBackupType:
+		load = loadSQLDump
+	default:
+		return fmt.Errorf("restore of %s backups is not supported", backupType)
+	}
+	if !opts.Force && dbInUse(dbPath) {
+		return fmt.Errorf("refusing to restore over %s: %w (restore with Force to replace it anyway)", dbPath, ErrDBInUse)
+	}
+	removeDBFiles(tmpPath)
+	err := load(ctx, backupPath, tmpPath)
+	if err == nil {
+		err = checkIntegrity(tmpPath)
+	}
+	if err == nil {
+		err = checkRestoredSchema(tmpPath, opts.MigrateSchema)
+	}
+	if err == nil {
+		// The last point at which the live DB can be left as it was
+		err = ctx.Err()
+	}
+	var copyPath string
+	if err == nil {
+		copyPath, err = copyBeforeRestore(dbPath, time.Now())
+	}
+	if err == nil {
+		err = moveOldWAL(dbPath, copyPath)
+	}
+	if err != nil {
+		removeDBFiles(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		removeDBFiles(tmpPath)
+		return err
+	}
+	if _, err := os.Stat(tmpPath + "-wal"); err == nil {
+		if err := os.Rename(tmpPath+"-wal", dbPath+"-wal"); err != nil {
+			return err
+		}
+	}
+	os.Remove(tmpPath + "-shm")
+	return nil
+}
+
+// moveOldWAL moves the WAL of the DB at dbPath into its safety copy at
+// copyPath before the restored DB replaces it: left in place it would be
+// replayed into the restored DB, and removed, a crash before the replacement
+// would leave the old DB without its committed frames. The -shm index is
+// rebuilt from the WAL, so it is removed. With no safety copy there is no old
+// DB to keep a WAL for.
+func moveOldWAL(dbPath, copyPath string) error {
+	if copyPath == "" {
+		os.Remove(dbPath + "-wal")
+	} else if err := os.Rename(dbPath+"-wal", copyPath+"-wal"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("moving WAL to safety copy before restore: %w", err)
+	}
+	os.Remove(dbPath + "-shm")
+	return nil
+}
+
+// copyBeforeRestore copies the DB at dbPath to a new pre-restore safety copy
+// and returns its path; earlier copies are never overwritten. Its WAL joins
+// the copy through moveOldWAL. A missing DB needs no copy, and returns "".
+func copyBeforeRestore(dbPath string, now time.Time) (string, error) {
+	src, err := os.Open(dbPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	// Restores within the same second get numbered copies
+	base := dbPath + preRestoreSuffix + now.Format("20060102_150405")
+	copyPath, err := reservePath(base, func(n int) string { return fmt.Sprintf("%s-%d", base, n) })
+	if err != nil {
+		return "", fmt.Errorf("safety copy before restore: %w", err)
+	}
+	if err := writeFile(copyPath, src); err != nil {
+		os.Remove(copyPath)
+		return "", fmt.Errorf("safety copy before restore: %w", err)
+	}
+	log.Printf("restore: copied %s to %s", dbPath, copyPath)
+	return copyPath, nil
+}
+
+// dbInUse reports whether any process has the DB at path open, by looking
+// for it among the open files in /proc. Without /proc it falls back to the
+// files SQLite keeps beside a DB in use: -shm while open in WAL mode and
+// -journal during a write.
+func dbInUse(path string) bool {
+	target, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	if real, err := filepath.EvalSymlinks(target); err == nil {
+		target = real
+	} else if os.IsNotExist(err) {
+		return false
+	}
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		for _, suffix := range []string{"-shm", "-journal"} {
+			if _, err := os.Stat(path + suffix); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+	for _, p := range procs {
+		if _, err := strconv.Atoi(p.Name()); err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", p.Name(), "fd")
+		// Other users' processes can't be inspected and are skipped
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && link == target {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadSQLDump runs the dump script at src, decompressed if its extension
+// says so, against a new database at dst
+func loadSQLDump(ctx context.Context, src, dst string) error {
+	r, err := openBackup(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	script, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read SQL dump: %w", err)
+	}
+	db, err := sql.Open("sqlite3", dst)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, string(script)); err != nil {
+		return fmt.Errorf("load SQL dump: %w", err)
+	}
+	return db.Close()
+}
+
+// checkRestoredSchema checks the schema version of the database at path,
+// migrating it first if migrate is set
+func checkRestoredSchema(path string, migrate bool) error {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if migrate {
+		if err := MigrateSchema(db); err != nil {
+			return err
+		}
+	}
+	if _, _, err := CheckSchemaVersion(db); err != nil {
+		if errors.Is(err, ErrSchemaVersionMismatch) && !migrate {
+			return fmt.Errorf("refusing to restore: %w (restore with MigrateSchema to upgrade it)", err)
+		}
+		return err
+	}
+	return db.Close()
+}
+
+// removeDBFiles removes a DB file and its WAL/shared-memory companions
+func removeDBFiles(path string) {
+	os.Remove(path)
+	os.Remove(path + "-wal")
+	os.Remove(path + "-shm")
+}
+
+// isTar reports whether r starts with a POSIX tar header
+func isTar(r *bufio.Reader) bool {
+	hdr, err := r.Peek(262)
+	return err == nil && string(hdr[257:262]) == "ustar"
+}
+
+// extractBackup streams the backup at src into dst (and dst-wal for
+// snapshots), decompressing as needed without buffering the whole file.
+func extractBackup(ctx context.Context, src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(contextReader{ctx, f})
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = bufio.NewReaderSize(gz, 512)
+	}
+	if isTar(r) {
+		return extractSnapshot(tar.NewReader(r), dst)
+	}
+	return writeFile(dst, r)
+}
+
+// extractSnapshot restores the DB and -wal members of a tar snapshot
+func extractSnapshot(tr *tar.Reader, dst string) error {
+	foundDB := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(hdr.Name, "-wal"):
+			err = writeFile(dst+"-wal", tr)
+		case strings.HasSuffix(hdr.Name, "-shm"):
+			// Shared memory is rebuilt by SQLite on open
+			continue
+		default:
+			if foundDB {
+				return fmt.Errorf("snapshot contains more than one database: %s", hdr.Name)
+			}
+			foundDB = true
+			err = writeFile(dst, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !foundDB {
+		return errors.New("snapshot contains no database file")
+	}
+	return nil
+}
+
+// writeFile streams r into a new file at path and syncs it to disk
+func writeFile(path string, r io.Reader) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, r); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// checkIntegrity opens the DB at path and runs PRAGMA integrity_check
+func checkIntegrity(path string) error {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check;").Scan(&result); err != nil {
+		return fmt.Errorf("backup integrity check failed: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("backup integrity check failed: %s", result)
+	}
+	return nil
+}
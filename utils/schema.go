@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// SchemaVersion is the schema version this build expects, stored in the
+// database's PRAGMA user_version. Version 0 databases predate versioning;
+// version 2 added user.deleted_at, version 3 backup_metadata.fingerprint,
+// version 4 team.description and team_metadata, version 5
+// db_stats.foreign_key_violations, version 6 folded usernames to lower
+// case, and version 7 made role_permission and team_permission grants
+// unique.
+const SchemaVersion = 7
+
+// ErrSchemaVersionMismatch is returned when a database's schema version is not SchemaVersion
+var ErrSchemaVersionMismatch = errors.New("schema version mismatch")
+
+// CheckSchemaVersion returns db's schema version and the one this build
+// expects, with an ErrSchemaVersionMismatch error if they differ.
+func CheckSchemaVersion(db *sql.DB) (current, expected int, err error) {
+	if err := db.QueryRow("PRAGMA user_version;").Scan(&current); err != nil {
+		return 0, SchemaVersion, err
+	}
+	if current != SchemaVersion {
+		return current, SchemaVersion, fmt.Errorf("%w: database is at version %d, expected %d", ErrSchemaVersionMismatch, current, SchemaVersion)
+	}
+	return current, SchemaVersion, nil
+}
+
+// MigrateSchema upgrades db to SchemaVersion. Unversioned databases get any
+// missing tables created. Databases newer than this build are refused.
+func MigrateSchema(db *sql.DB) error {
+	current, expected, err := CheckSchemaVersion(db)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, ErrSchemaVersionMismatch) {
+		return err
+	}
+	if current > expected {
+		return fmt.Errorf("%w: database version %d is newer than this build (%d)", ErrSchemaVersionMismatch, current, expected)
+	}
+	if current < 7 {
+		// Runs first: createTables, in the steps below, creates the grant
+		// indexes, which duplicates left by older versions would fail
+		if err := RemoveDuplicateGrants(db); err != nil {
+			return err
+		}
+	}
+	if current < 1 {
+		if err := createTables(db); err != nil {
+			return err
+		}
+	}
+	if current < 2 {
+		if err := addColumnIfMissing(db, "user", "deleted_at", "TEXT"); err != nil {
+			return err
+		}
+	}
+	if current < 3 {
+		// Version 1 databases may predate backup_metadata itself
+		if err := createTables(db); err != nil {
+			return err
+		}
+		if err := addColumnIfMissing(db, "backup_metadata", "fingerprint", "TEXT"); err != nil {
+			return err
+		}
+	}
+	if current < 4 {
+		if err := createTables(db); err != nil {
+			return err
+		}
+		if err := addColumnIfMissing(db, "team", "description", "TEXT"); err != nil {
+			return err
+		}
+	}
+	if current < 5 {
+		if err := addColumnIfMissing(db, "db_stats", "foreign_key_violations", "INTEGER"); err != nil {
+			return err
+		}
+	}
+	if current < 6 {
+		if err := FoldUsernames(db); err != nil {
+			return err
+		}
+	}
+	if current < 7 {
+		if err := createTables(db); err != nil {
+			return err
+		}
+	}
+	return setSchemaVersion(db, expected)
+}
+
+// addColumnIfMissing adds a column to table unless it already has one of
+// that name
+func addColumnIfMissing(db *sql.DB, table, column, declType string) error {
+	cols, err := columnAffinities(db, table)
+	if err != nil {
+		return err
+	}
+	if _, ok := cols[column]; ok {
+		return nil
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", quoteIdent(table), quoteIdent(column), declType))
+	return err
+}
+
+// setSchemaVersion stores version in PRAGMA user_version
+func setSchemaVersion(db *sql.DB, version int) error {
+	_, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d;", version))
+	return err
+}
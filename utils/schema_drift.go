@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/unklstewy/redbug_dewey/models"
+	"gorm.io/gorm/schema"
+)
+
+// DriftKind classifies a DriftIssue
+type DriftKind string
+
+const (
+	DriftMissingTable  DriftKind = "missing_table"
+	DriftMissingColumn DriftKind = "missing_column"
+	DriftExtraColumn   DriftKind = "extra_column"
+	DriftTypeMismatch  DriftKind = "type_mismatch"
+)
+
+// DriftIssue is one difference between a table and its model. Expected and
+// Actual are SQLite type affinities, set for type mismatches.
+type DriftIssue struct {
+	Table    string    `json:"table"`
+	Column   string    `json:"column,omitempty"`
+	Kind     DriftKind `json:"kind"`
+	Expected string    `json:"expected,omitempty"`
+	Actual   string    `json:"actual,omitempty"`
+}
+
+func (i DriftIssue) String() string {
+	switch i.Kind {
+	case DriftMissingTable:
+		return fmt.Sprintf("table %s is missing", i.Table)
+	case DriftTypeMismatch:
+		return fmt.Sprintf("%s.%s has type %s, model expects %s", i.Table, i.Column, i.Actual, i.Expected)
+	}
+	return fmt.Sprintf("%s.%s: %s", i.Table, i.Column, i.Kind)
+}
+
+// DetectSchemaDrift compares the columns of each models table in db with the
+// model's fields. Types are compared by SQLite affinity, so INT and INTEGER
+// match. Tables without a model are not checked.
+func DetectSchemaDrift(db *sql.DB) ([]DriftIssue, error) {
+	var issues []DriftIssue
+	cache := &sync.Map{}
+	for _, m := range models.All() {
+		s, err := schema.Parse(m, cache, schema.NamingStrategy{})
+		if err != nil {
+			return nil, err
+		}
+		actual, err := columnAffinities(db, s.Table)
+		if err != nil {
+			return nil, err
+		}
+		if len(actual) == 0 {
+			issues = append(issues, DriftIssue{Table: s.Table, Kind: DriftMissingTable})
+			continue
+		}
+		expected := make(map[string]bool)
+		for _, f := range s.Fields {
+			if f.DBName == "" {
+				continue
+			}
+			expected[f.DBName] = true
+			got, ok := actual[f.DBName]
+			if !ok {
+				issues = append(issues, DriftIssue{Table: s.Table, Column: f.DBName, Kind: DriftMissingColumn})
+				continue
+			}
+			if want := fieldAffinity(f); got != want {
+				issues = append(issues, DriftIssue{Table: s.Table, Column: f.DBName, Kind: DriftTypeMismatch, Expected: want, Actual: got})
+			}
+		}
+		var extra []string
+		for col := range actual {
+			if !expected[col] {
+				extra = append(extra, col)
+			}
+		}
+		sort.Strings(extra)
+		for _, col := range extra {
+			issues = append(issues, DriftIssue{Table: s.Table, Column: col, Kind: DriftExtraColumn})
+		}
+	}
+	return issues, nil
+}
+
+// columnAffinities returns the type affinity of each column of table; empty
+// if the table does not exist
+func columnAffinities(db *sql.DB, table string) (map[string]string, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s);", quoteIdent(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols := make(map[string]string)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, declType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &declType, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		cols[name] = typeAffinity(declType)
+	}
+	return cols, rows.Err()
+}
+
+// fieldAffinity returns the affinity of the column GORM declares for f
+func fieldAffinity(f *schema.Field) string {
+	switch f.DataType {
+	case schema.Int, schema.Uint:
+		return "INTEGER"
+	case schema.Float:
+		return "REAL"
+	case schema.String:
+		return "TEXT"
+	case schema.Bytes:
+		return "BLOB"
+	case schema.Bool, schema.Time:
+		return "NUMERIC"
+	}
+	return typeAffinity(string(f.DataType))
+}
+
+// typeAffinity applies SQLite's column affinity rules to a declared type
+func typeAffinity(declType string) string {
+	t := strings.ToUpper(declType)
+	switch {
+	case strings.Contains(t, "INT"):
+		return "INTEGER"
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return "TEXT"
+	case t == "", strings.Contains(t, "BLOB"):
+		return "BLOB"
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		return "REAL"
+	}
+	return "NUMERIC"
+}
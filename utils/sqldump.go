@@ -0,0 +1,277 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// DumpOptions controls which tables SQLDumpWithOptions writes
+type DumpOptions struct {
+	Include    []string // only dump these tables (all tables when empty)
+	Exclude    []string // skip these tables, applied after Include
+	SchemaOnly bool     // write DDL without any INSERT statements
+}
+
+// selected reports whether a table passes the include/exclude filters
+func (o DumpOptions) selected(table string) bool {
+	if len(o.Include) > 0 && !containsString(o.Include, table) {
+		return false
+	}
+	return !containsString(o.Exclude, table)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// quoteIdent quotes an SQL identifier
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// SQLDump creates a SQL dump of the whole DB or specific tables
+func SQLDump(dbPath, outPath string, tables []string) (BackupResult, error) {
+	return SQLDumpWithOptions(dbPath, outPath, DumpOptions{Include: tables})
+}
+
+// SQLDumpWithOptions writes a SQL script that recreates the selected tables
+// (with their indexes and triggers) and, unless SchemaOnly is set, their rows.
+// The dump is produced in-process from a single read transaction, so it is a
+// consistent snapshot and does not need the sqlite3 CLI.
+func SQLDumpWithOptions(dbPath, outPath string, opts DumpOptions) (BackupResult, error) {
+	return SQLDumpContext(context.Background(), dbPath, outPath, opts)
+}
+
+// SQLDumpContext is SQLDumpWithOptions, stopping early if ctx is canceled.
+// A failed or canceled dump leaves no file at outPath. The dump is streamed
+// through gzip if outPath ends in CompressedBackupExt.
+func SQLDumpContext(ctx context.Context, dbPath, outPath string, opts DumpOptions) (BackupResult, error) {
+	start := time.Now()
+	if _, err := os.Stat(dbPath); err != nil {
+		return BackupResult{}, err
+	}
+	if err := checkBackupSpace(dbPath, outPath); err != nil {
+		return BackupResult{}, err
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return BackupResult{}, err
+	}
+	defer db.Close()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return BackupResult{}, err
+	}
+	defer tx.Rollback()
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return BackupResult{}, err
+	}
+	defer out.Close()
+	h := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, h)}
+	zw := backupWriter(outPath, counter)
+	w := bufio.NewWriter(zw)
+	err = writeDump(tx, w, opts)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(outPath)
+		return BackupResult{}, err
+	}
+	return newBackupResult(outPath, counter.n, start, h), nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type schemaObject struct {
+	kind, name, table, sql string
+}
+
+// schemaObjects returns the DB's tables, indexes, triggers and views in
+// creation order
+func schemaObjects(tx *sql.Tx) ([]schemaObject, error) {
+	rows, err := tx.Query(`SELECT type, name, tbl_name, sql FROM sqlite_master WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%' ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var objects []schemaObject
+	for rows.Next() {
+		var o schemaObject
+		if err := rows.Scan(&o.kind, &o.name, &o.table, &o.sql); err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+	}
+	return objects, rows.Err()
+}
+
+// writeDumpHeader starts a dump: foreign keys off, the schema version, and
+// the opening transaction
+func writeDumpHeader(tx *sql.Tx, w *bufio.Writer) error {
+	fmt.Fprintln(w, "PRAGMA foreign_keys=OFF;")
+	// Carry the schema version so a restored dump passes CheckSchemaVersion
+	var version int
+	if err := tx.QueryRow("PRAGMA user_version;").Scan(&version); err != nil {
+		return err
+	}
+	if version != 0 {
+		fmt.Fprintf(w, "PRAGMA user_version = %d;\n", version)
+	}
+	fmt.Fprintln(w, "BEGIN TRANSACTION;")
+	return nil
+}
+
+func writeDump(tx *sql.Tx, w *bufio.Writer, opts DumpOptions) error {
+	objects, err := schemaObjects(tx)
+	if err != nil {
+		return err
+	}
+	if err := writeDumpHeader(tx, w); err != nil {
+		return err
+	}
+	var dumped []string
+	for _, o := range objects {
+		if o.kind != "table" || !opts.selected(o.name) {
+			continue
+		}
+		fmt.Fprintf(w, "%s;\n", o.sql)
+		dumped = append(dumped, o.name)
+		if opts.SchemaOnly {
+			continue
+		}
+		if err := dumpTableRows(tx, w, o.name); err != nil {
+			return err
+		}
+	}
+	if !opts.SchemaOnly {
+		if err := dumpSequences(tx, w, dumped); err != nil {
+			return err
+		}
+	}
+	// Indexes, triggers and views go last so they apply to populated tables
+	for _, o := range objects {
+		if o.kind == "table" || !opts.selected(o.table) {
+			continue
+		}
+		fmt.Fprintf(w, "%s;\n", o.sql)
+	}
+	fmt.Fprintln(w, "COMMIT;")
+	return nil
+}
+
+// dumpTableRows writes an INSERT per row, using SQLite's quote() so values
+// round-trip exactly regardless of type affinity
+func dumpTableRows(tx *sql.Tx, w *bufio.Writer, table string) error {
+	return dumpTableRowsWhere(context.Background(), tx, w, table, "", nil)
+}
+
+// dumpTableRowsWhere is dumpTableRows for the rows matching where (all rows
+// when empty), writing the redact columns as NULL and stopping early if ctx
+// is canceled
+func dumpTableRowsWhere(ctx context.Context, tx *sql.Tx, w *bufio.Writer, table, where string, redact []string) error {
+	cols, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s);", quoteIdent(table)))
+	if err != nil {
+		return err
+	}
+	var quoted []string
+	for cols.Next() {
+		var cid, notNull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := cols.Scan(&cid, &name, &ctype, &notNull, &dflt, &pk); err != nil {
+			cols.Close()
+			return err
+		}
+		if containsString(redact, name) {
+			quoted = append(quoted, "'NULL'")
+			continue
+		}
+		quoted = append(quoted, "quote("+quoteIdent(name)+")")
+	}
+	cols.Close()
+	if len(quoted) == 0 {
+		return nil
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(quoted, " || ',' || "), quoteIdent(table))
+	if where != "" {
+		query += " WHERE " + where
+	}
+	rows, err := tx.QueryContext(ctx, query+";")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var values string
+		if err := rows.Scan(&values); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "INSERT INTO %s VALUES(%s);\n", quoteIdent(table), values)
+	}
+	return rows.Err()
+}
+
+// dumpSequences restores AUTOINCREMENT counters for the dumped tables
+func dumpSequences(tx *sql.Tx, w *bufio.Writer, tables []string) error {
+	var exists int
+	tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'sqlite_sequence';").Scan(&exists)
+	if exists == 0 {
+		return nil
+	}
+	rows, err := tx.Query("SELECT quote(name), quote(seq), name FROM sqlite_sequence;")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var qname, qseq, name string
+		if err := rows.Scan(&qname, &qseq, &name); err != nil {
+			return err
+		}
+		if !containsString(tables, name) {
+			continue
+		}
+		fmt.Fprintf(w, "DELETE FROM sqlite_sequence WHERE name = %s;\n", qname)
+		fmt.Fprintf(w, "INSERT INTO sqlite_sequence (name, seq) VALUES(%s, %s);\n", qname, qseq)
+	}
+	return rows.Err()
+}
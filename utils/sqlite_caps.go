@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrFeatureUnavailable is returned when an operation needs an SQLite
+// feature the linked library was built without.
+var ErrFeatureUnavailable = errors.New("SQLite feature unavailable")
+
+// Capabilities describes the SQLite library behind a database handle
+type Capabilities struct {
+	Version        string   `json:"version"`
+	CompileOptions []string `json:"compile_options"` // as reported by PRAGMA compile_options
+	FTS5           bool     `json:"fts5"`
+	JSON1          bool     `json:"json1"`
+	VacuumInto     bool     `json:"vacuum_into"` // VACUUM INTO, from 3.27.0
+}
+
+// SQLiteCapabilities reports the SQLite version, compile options and the
+// optional features callers check before relying on them.
+func SQLiteCapabilities(db *sql.DB) (Capabilities, error) {
+	var caps Capabilities
+	if err := db.QueryRow("SELECT sqlite_version()").Scan(&caps.Version); err != nil {
+		return caps, err
+	}
+	rows, err := db.Query("PRAGMA compile_options")
+	if err != nil {
+		return caps, err
+	}
+	defer rows.Close()
+	caps.CompileOptions = []string{}
+	for rows.Next() {
+		var opt string
+		if err := rows.Scan(&opt); err != nil {
+			return caps, err
+		}
+		caps.CompileOptions = append(caps.CompileOptions, opt)
+	}
+	if err := rows.Err(); err != nil {
+		return caps, err
+	}
+	caps.FTS5 = caps.HasOption("ENABLE_FTS5")
+	// JSON1 is built in from 3.38.0 unless omitted, so probe it directly
+	var valid int
+	caps.JSON1 = db.QueryRow(`SELECT json_valid('{}')`).Scan(&valid) == nil && valid == 1
+	caps.VacuumInto = versionAtLeast(caps.Version, 3, 27, 0)
+	return caps, nil
+}
+
+// HasOption reports whether SQLite was compiled with option, given without
+// the SQLITE_ prefix, e.g. "ENABLE_FTS5" or "THREADSAFE=1". An option without
+// a value matches any value.
+func (c Capabilities) HasOption(option string) bool {
+	option = strings.TrimPrefix(option, "SQLITE_")
+	for _, o := range c.CompileOptions {
+		if o == option || (!strings.Contains(option, "=") && strings.HasPrefix(o, option+"=")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Require returns ErrFeatureUnavailable unless the named feature ("fts5",
+// "json1" or "vacuum_into") is present
+func (c Capabilities) Require(feature string) error {
+	var ok bool
+	switch feature {
+	case "fts5":
+		ok = c.FTS5
+	case "json1":
+		ok = c.JSON1
+	case "vacuum_into":
+		ok = c.VacuumInto
+	default:
+		return fmt.Errorf("unknown SQLite feature %q", feature)
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s (SQLite %s)", ErrFeatureUnavailable, feature, c.Version)
+	}
+	return nil
+}
+
+// versionAtLeast reports whether a dotted version is at least major.minor.patch
+func versionAtLeast(version string, want ...int) bool {
+	parts := strings.Split(version, ".")
+	for i, w := range want {
+		n := 0
+		if i < len(parts) {
+			n, _ = strconv.Atoi(parts[i])
+		}
+		if n != w {
+			return n > w
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUsernameCollision is returned by FoldUsernames when two users' names
+// differ only in case or surrounding space
+var ErrUsernameCollision = errors.New("username collision")
+
+// FoldUsernames trims and lower-cases every stored username, the form
+// CreateUser has stored since usernames were normalized. If two users would
+// end up with the same name nothing is renamed, and the error wraps
+// ErrUsernameCollision naming them. It is a no-op once every name is folded.
+func FoldUsernames(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT id, username FROM user WHERE username IS NOT NULL ORDER BY id")
+	if err != nil {
+		return err
+	}
+	type rename struct {
+		id   int
+		name string
+	}
+	var renames []rename
+	owners := map[string]string{}
+	var collisions []string
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		folded := strings.ToLower(strings.TrimSpace(name))
+		if prev, ok := owners[folded]; ok {
+			collisions = append(collisions, fmt.Sprintf("%q and %q", prev, name))
+			continue
+		}
+		owners[folded] = name
+		if folded != name {
+			renames = append(renames, rename{id, folded})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(collisions) > 0 {
+		return fmt.Errorf("%w: %s", ErrUsernameCollision, strings.Join(collisions, ", "))
+	}
+	for _, r := range renames {
+		if _, err := tx.Exec("UPDATE user SET username = ? WHERE id = ?", r.name, r.id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -2,48 +2,166 @@
 package utils
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+	"github.com/unklstewy/redbug_dewey/models"
 )
 
+// DBOptions holds connection settings applied by InitDBWithOptions
+type DBOptions struct {
+	// WALAutocheckpoint sets PRAGMA wal_autocheckpoint (in pages) on every
+	// connection. Zero keeps SQLite's default of 1000; a negative value
+	// disables automatic checkpoints so the WAL is only folded back into the
+	// main file by explicit PRAGMA wal_checkpoint calls. Manual checkpoints
+	// work regardless of this threshold.
+	WALAutocheckpoint int
+}
+
+// pragmas returns the per-connection PRAGMA statements for the options
+func (o DBOptions) pragmas() []string {
+	var p []string
+	if o.WALAutocheckpoint != 0 {
+		p = append(p, fmt.Sprintf("PRAGMA wal_autocheckpoint = %d;", o.WALAutocheckpoint))
+	}
+	return p
+}
+
+// sqliteConnector opens go-sqlite3 connections and runs a set of PRAGMAs on
+// each, since connection-scoped PRAGMAs issued through *sql.DB only reach
+// whichever pooled connection happens to run them.
+type sqliteConnector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func (c sqliteConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c sqliteConnector) Driver() driver.Driver {
+	return c.driver
+}
+
 // InitDB initializes the SQLite3 database and returns the connection
 func InitDB(filepath string) *sql.DB {
-	db, err := sql.Open("sqlite3", filepath)
-	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+	return InitDBWithOptions(filepath, DBOptions{})
+}
+
+// InitDBWithOptions initializes the SQLite3 database applying opts to every connection
+func InitDBWithOptions(filepath string, opts DBOptions) *sql.DB {
+	pragmas := opts.pragmas()
+	if len(pragmas) == 0 {
+		db, err := sql.Open("sqlite3", filepath)
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		return db
+	}
+	drv := &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			for _, p := range pragmas {
+				if _, err := conn.Exec(p, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
 	}
-	return db
+	return sql.OpenDB(sqliteConnector{dsn: filepath, driver: drv})
 }
 
-// HealthCheck runs DB integrity and stats queries
-func HealthCheck(db *sql.DB) (map[string]interface{}, error) {
-	stats := make(map[string]interface{})
+// StubTables are placeholder tables created by CreateTables that never hold rows
+var StubTables = []string{"dewey_stats", "pulitzer", "sadist", "dasm", "redbug", "domino"}
+
+// HealthCheckOptions selects which tables HealthCheckWithOptions reports in
+// TableCounts. The zero value reports every table.
+type HealthCheckOptions struct {
+	// ExcludeInternal omits StubTables and SQLite's own sqlite_* tables
+	ExcludeInternal bool
+	// NonEmptyOnly omits tables without rows
+	NonEmptyOnly bool
+	// Quick runs PRAGMA quick_check in place of integrity_check, skipping
+	// the slow check that indexes match their tables, and skips the foreign
+	// key check, leaving ForeignKeyViolations nil
+	Quick bool
+}
+
+// includeTable reports whether a table with count rows belongs in TableCounts
+func (o HealthCheckOptions) includeTable(table string, count int) bool {
+	if o.NonEmptyOnly && count == 0 {
+		return false
+	}
+	if o.ExcludeInternal {
+		if strings.HasPrefix(table, "sqlite_") {
+			return false
+		}
+		for _, stub := range StubTables {
+			if table == stub {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// HealthCheck runs DB integrity, foreign key (CountForeignKeyViolations) and
+// stats queries. DBSize is the size of the file db has open as its main
+// database, 0 for an in-memory one.
+func HealthCheck(db *sql.DB) (models.DBStats, error) {
+	return HealthCheckWithOptions(db, HealthCheckOptions{})
+}
+
+// HealthCheckQuick is HealthCheck using PRAGMA quick_check and without the
+// foreign key check, for routine probes of large databases
+func HealthCheckQuick(db *sql.DB) (models.DBStats, error) {
+	return HealthCheckWithOptions(db, HealthCheckOptions{Quick: true})
+}
+
+// HealthCheckWithOptions runs HealthCheck, filtering TableCounts by opts
+func HealthCheckWithOptions(db *sql.DB, opts HealthCheckOptions) (models.DBStats, error) {
+	stats := models.DBStats{Timestamp: time.Now().UTC().Format(time.RFC3339)}
+	check := "PRAGMA integrity_check;"
+	if opts.Quick {
+		check = "PRAGMA quick_check;"
+	}
 	var integrity string
-	err := db.QueryRow("PRAGMA integrity_check;").Scan(&integrity)
-	if err != nil {
-		return nil, err
+	if err := db.QueryRow(check).Scan(&integrity); err != nil {
+		return models.DBStats{}, err
 	}
-	stats["integrity_ok"] = (integrity == "ok")
+	stats.IntegrityOK = integrity == "ok"
 
-	var dbSize int64
-	fileInfo, err := os.Stat("dewey.db")
-	if err == nil {
-		dbSize = fileInfo.Size()
+	// Finding orphans means scanning every referring table, too slow for
+	// a quick check
+	if !opts.Quick {
+		violations, err := CountForeignKeyViolations(db)
+		if err != nil {
+			return models.DBStats{}, err
+		}
+		stats.ForeignKeyViolations = &violations
 	}
-	stats["db_size"] = dbSize
 
-	var lastVacuum string
-	db.QueryRow("PRAGMA auto_vacuum;").Scan(&lastVacuum)
-	stats["last_vacuum"] = lastVacuum
+	dbFile, err := mainDBFile(db)
+	if err != nil {
+		return models.DBStats{}, err
+	}
+	if dbFile != "" {
+		if fileInfo, err := os.Stat(dbFile); err == nil {
+			stats.DBSize = fileInfo.Size()
+		}
+	}
 
-	var walStatus string
-	db.QueryRow("PRAGMA journal_mode;").Scan(&walStatus)
-	stats["wal_status"] = walStatus
+	db.QueryRow("PRAGMA auto_vacuum;").Scan(&stats.LastVacuum)
+	db.QueryRow("PRAGMA journal_mode;").Scan(&stats.WALStatus)
 
 	tableCounts := make(map[string]int)
 	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type='table';")
@@ -54,12 +172,86 @@ func HealthCheck(db *sql.DB) (map[string]interface{}, error) {
 			var count int
 			q := fmt.Sprintf("SELECT COUNT(*) FROM %s;", table)
 			db.QueryRow(q).Scan(&count)
-			tableCounts[table] = count
+			if opts.includeTable(table, count) {
+				tableCounts[table] = count
+			}
 		}
 		rows.Close()
 	}
 	jsonCounts, _ := json.Marshal(tableCounts)
-	stats["table_counts"] = string(jsonCounts)
+	stats.TableCounts = string(jsonCounts)
+	return stats, nil
+}
+
+// RecordDBStats runs HealthCheck and saves the result as a db_stats
+// snapshot, returning it with its new ID
+func RecordDBStats(db *sql.DB) (models.DBStats, error) {
+	stats, err := HealthCheck(db)
+	if err != nil {
+		return stats, err
+	}
+	res, err := db.Exec(`INSERT INTO db_stats (timestamp, integrity_ok, db_size, last_vacuum, wal_status, table_counts, foreign_key_violations) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		stats.Timestamp, stats.IntegrityOK, stats.DBSize, stats.LastVacuum, stats.WALStatus, stats.TableCounts, stats.ForeignKeyViolations)
+	if err != nil {
+		return stats, err
+	}
+	id, err := res.LastInsertId()
+	stats.ID = int(id)
+	return stats, err
+}
+
+// HealthReport is HealthCheckWithOptions as the map served by /healthz, with
+// the DBStats fields under their JSON names (less id) alongside the first
+// maxReportedViolations foreign key violations, the free disk space where
+// the DB lives, wal_autocheckpoint, password_hash_costs, heartbeats and
+// stale_loops
+func HealthReport(db *sql.DB, opts HealthCheckOptions) (map[string]interface{}, error) {
+	dbStats, err := HealthCheckWithOptions(db, opts)
+	if err != nil {
+		return nil, err
+	}
+	stats := map[string]interface{}{
+		"timestamp":    dbStats.Timestamp,
+		"integrity_ok": dbStats.IntegrityOK,
+		"db_size":      dbStats.DBSize,
+		"last_vacuum":  dbStats.LastVacuum,
+		"wal_status":   dbStats.WALStatus,
+		"table_counts": dbStats.TableCounts,
+	}
+	if n := dbStats.ForeignKeyViolations; n != nil {
+		stats["foreign_key_violations"] = *n
+		if *n > 0 {
+			violations, err := ForeignKeyViolations(db, maxReportedViolations)
+			if err != nil {
+				return nil, err
+			}
+			stats["foreign_key_violation_rows"] = violations
+		}
+	}
+
+	diskDir := "."
+	if dbFile, err := mainDBFile(db); err == nil && dbFile != "" {
+		diskDir = filepath.Dir(dbFile)
+	}
+	if free, err := DiskFree(diskDir); err == nil {
+		stats["free_disk_bytes"] = free
+		stats["disk_low"] = free < MinFreeDiskBytes
+	}
+
+	var walAutocheckpoint int
+	db.QueryRow("PRAGMA wal_autocheckpoint;").Scan(&walAutocheckpoint)
+	stats["wal_autocheckpoint"] = walAutocheckpoint
+
+	if costs, err := PasswordHashCostStats(db); err == nil {
+		stats["password_hash_costs"] = costs
+	}
+
+	stats["heartbeats"] = Heartbeats()
+	stale := StaleLoops()
+	if stale == nil {
+		stale = []string{}
+	}
+	stats["stale_loops"] = stale
 
 	return stats, nil
 }
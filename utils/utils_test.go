@@ -0,0 +1,1704 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/unklstewy/redbug_dewey/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestInitDBWALAutocheckpoint(t *testing.T) {
+	db := InitDBWithOptions(filepath.Join(t.TempDir(), "wal.db"), DBOptions{WALAutocheckpoint: 250})
+	defer db.Close()
+	if _, err := db.Exec("PRAGMA journal_mode=WAL;"); err != nil {
+		t.Fatalf("failed to enable WAL mode: %v", err)
+	}
+
+	// Hold two connections at once so the pragma is checked on more than one
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatalf("failed to get connection: %v", err)
+		}
+		defer conn.Close()
+		var pages int
+		if err := conn.QueryRowContext(ctx, "PRAGMA wal_autocheckpoint;").Scan(&pages); err != nil {
+			t.Fatalf("failed to read wal_autocheckpoint: %v", err)
+		}
+		if pages != 250 {
+			t.Errorf("connection %d: expected wal_autocheckpoint 250, got %d", i, pages)
+		}
+	}
+
+	stats, err := HealthReport(db, HealthCheckOptions{})
+	if err != nil {
+		t.Fatalf("HealthReport failed: %v", err)
+	}
+	if stats["wal_autocheckpoint"] != 250 {
+		t.Errorf("expected health wal_autocheckpoint 250, got %v", stats["wal_autocheckpoint"])
+	}
+}
+
+// newDumpFixture creates a DB with a small catalog table and a timeseries table
+func newDumpFixture(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dump_src.db")
+	db := InitDB(path)
+	defer db.Close()
+	stmts := []string{
+		`CREATE TABLE manufacturer (id INTEGER PRIMARY KEY, name TEXT);`,
+		`CREATE TABLE timeseries_event (id INTEGER PRIMARY KEY AUTOINCREMENT, timestamp DATETIME NOT NULL, source TEXT NOT NULL, type TEXT NOT NULL, payload TEXT NOT NULL);`,
+		`CREATE INDEX idx_event_source ON timeseries_event (source);`,
+		`INSERT INTO manufacturer (name) VALUES ('Motorola'), ('O''Brien Radio');`,
+		`INSERT INTO timeseries_event (timestamp, source, type, payload) VALUES ('2025-06-13 17:57:48', 'strace', 'read', 'x');`,
+		fmt.Sprintf("PRAGMA user_version = %d;", SchemaVersion),
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("fixture statement failed: %v", err)
+		}
+	}
+	return path
+}
+
+// restoreDump loads a dump script into a fresh DB
+func restoreDump(t *testing.T, dumpPath string) *sql.DB {
+	t.Helper()
+	script, err := os.ReadFile(dumpPath)
+	if err != nil {
+		t.Fatalf("failed to read dump: %v", err)
+	}
+	db := InitDB(filepath.Join(t.TempDir(), "restored.db"))
+	if _, err := db.Exec(string(script)); err != nil {
+		t.Fatalf("failed to load dump: %v", err)
+	}
+	return db
+}
+
+func TestBackupResultMatchesFile(t *testing.T) {
+	src := newDumpFixture(t)
+	dir := t.TempDir()
+	full, err := FullBackup(src, filepath.Join(dir, "full.db"))
+	if err != nil {
+		t.Fatalf("FullBackup failed: %v", err)
+	}
+	dump, err := SQLDump(src, filepath.Join(dir, "full.sql"), nil)
+	if err != nil {
+		t.Fatalf("SQLDump failed: %v", err)
+	}
+	for _, r := range []BackupResult{full, dump} {
+		info, err := os.Stat(r.Path)
+		if err != nil {
+			t.Fatalf("result path %q not written: %v", r.Path, err)
+		}
+		sum, _ := FileChecksum(r.Path)
+		if r.Size != info.Size() || r.Checksum != sum || r.Duration <= 0 {
+			t.Errorf("result %+v does not match file (size %d, checksum %s)", r, info.Size(), sum)
+		}
+	}
+}
+
+func TestSQLDumpRoundTrip(t *testing.T) {
+	src := newDumpFixture(t)
+	out := filepath.Join(t.TempDir(), "full.sql")
+	if _, err := SQLDump(src, out, nil); err != nil {
+		t.Fatalf("SQLDump failed: %v", err)
+	}
+	db := restoreDump(t, out)
+	defer db.Close()
+	var name string
+	if err := db.QueryRow("SELECT name FROM manufacturer WHERE id = 2").Scan(&name); err != nil || name != "O'Brien Radio" {
+		t.Errorf("unexpected restored manufacturer %q (err %v)", name, err)
+	}
+	var ts string
+	db.QueryRow("SELECT CAST(timestamp AS TEXT) FROM timeseries_event").Scan(&ts)
+	if ts != "2025-06-13 17:57:48" {
+		t.Errorf("timestamp did not round-trip exactly: %q", ts)
+	}
+}
+
+func TestSQLDumpSchemaOnly(t *testing.T) {
+	src := newDumpFixture(t)
+	out := filepath.Join(t.TempDir(), "schema.sql")
+	if _, err := SQLDumpWithOptions(src, out, DumpOptions{SchemaOnly: true}); err != nil {
+		t.Fatalf("SQLDumpWithOptions failed: %v", err)
+	}
+	dump, _ := os.ReadFile(out)
+	if strings.Contains(string(dump), "INSERT INTO") {
+		t.Error("schema-only dump contains data")
+	}
+	if !strings.Contains(string(dump), "CREATE TABLE timeseries_event") || !strings.Contains(string(dump), "CREATE INDEX idx_event_source") {
+		t.Errorf("schema-only dump is missing DDL:\n%s", dump)
+	}
+	db := restoreDump(t, out)
+	defer db.Close()
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM manufacturer").Scan(&count)
+	if count != 0 {
+		t.Errorf("expected empty manufacturer table, got %d rows", count)
+	}
+}
+
+func TestSQLDumpExclude(t *testing.T) {
+	src := newDumpFixture(t)
+	out := filepath.Join(t.TempDir(), "exclude.sql")
+	if _, err := SQLDumpWithOptions(src, out, DumpOptions{Exclude: []string{"timeseries_event"}}); err != nil {
+		t.Fatalf("SQLDumpWithOptions failed: %v", err)
+	}
+	dump, _ := os.ReadFile(out)
+	if strings.Contains(string(dump), "timeseries_event") {
+		t.Errorf("excluded table (or its index) present in dump:\n%s", dump)
+	}
+	db := restoreDump(t, out)
+	defer db.Close()
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM manufacturer").Scan(&count)
+	if count != 2 {
+		t.Errorf("expected 2 manufacturers, got %d", count)
+	}
+}
+
+// newWALFixture creates a WAL-mode DB whose latest rows live only in the
+// -wal file. The returned DB must stay open to keep the WAL populated.
+func newWALFixture(t *testing.T) (*sql.DB, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "live.db")
+	db := InitDB(path)
+	db.SetMaxOpenConns(1)
+	stmts := []string{
+		"PRAGMA journal_mode=WAL;",
+		"CREATE TABLE manufacturer (id INTEGER PRIMARY KEY, name TEXT);",
+		"INSERT INTO manufacturer (name) VALUES ('Motorola'), ('Kenwood');",
+		fmt.Sprintf("PRAGMA user_version = %d;", SchemaVersion),
+	}
+	for _, q := range stmts {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("fixture %q: %v", q, err)
+		}
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, path
+}
+
+func gzipFile(t *testing.T, src, dst string) {
+	t.Helper()
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tarGzFiles(t *testing.T, dst string, files ...string) {
+	t.Helper()
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := &tar.Header{Name: filepath.Base(f), Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countManufacturers(t *testing.T, path string) int {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM manufacturer").Scan(&n); err != nil {
+		t.Fatalf("restored DB unreadable: %v", err)
+	}
+	return n
+}
+
+func TestRestoreBackupFormats(t *testing.T) {
+	dir := t.TempDir()
+	src := newDumpFixture(t)
+	gzPath := filepath.Join(dir, "src.db.gz")
+	gzipFile(t, src, gzPath)
+
+	// Snapshot whose rows are only in the WAL
+	_, live := newWALFixture(t)
+	if _, err := os.Stat(live + "-wal"); err != nil {
+		t.Fatalf("fixture has no WAL file: %v", err)
+	}
+	tgzPath := filepath.Join(dir, "snapshot.tar.gz")
+	tarGzFiles(t, tgzPath, live, live+"-wal")
+
+	for name, backup := range map[string]string{"plain": src, "gzip": gzPath, "tar.gz": tgzPath} {
+		t.Run(name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "dewey.db")
+			// A stale WAL from the old DB must not survive the restore
+			if err := os.WriteFile(target+"-wal", []byte("stale"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := RestoreBackup(backup, target, FullBackupType); err != nil {
+				t.Fatalf("RestoreBackup failed: %v", err)
+			}
+			if n := countManufacturers(t, target); n != 2 {
+				t.Errorf("expected 2 manufacturers, got %d", n)
+			}
+			if _, err := os.Stat(target + ".restore"); !os.IsNotExist(err) {
+				t.Errorf("temporary restore file left behind")
+			}
+		})
+	}
+}
+
+func TestCompressedBackupsRestore(t *testing.T) {
+	src := newDumpFixture(t)
+	db := InitDB(src)
+	for i := 0; i < 2000; i++ {
+		db.Exec("INSERT INTO timeseries_event (timestamp, source, type, payload) VALUES (?, 'strace', 'read', ?)",
+			"2025-06-13 17:57:48", fmt.Sprintf("read(3, buf, %d) = %d", i, i))
+	}
+	db.Close()
+	now := time.Date(2025, 6, 13, 3, 0, 0, 0, time.UTC)
+	cfg := BackupConfig{DBPath: src, BackupRoot: t.TempDir(), BackupTypes: []BackupType{FullBackupType, SQLBackupType}}
+	runBackups(cfg, now)
+	cfg.Compress = true
+	runBackups(cfg, now.Add(time.Second))
+
+	// backups returns the compressed and plain backups of btype
+	backups := func(btype BackupType) (compressed, plain string) {
+		found, err := findScheduledBackups(cfg, btype, time.UTC)
+		if err != nil || len(found) != 2 {
+			t.Fatalf("expected 2 %s backups, got %v (%v)", btype, found, err)
+		}
+		return found[0].path, found[1].path
+	}
+	for _, btype := range []BackupType{FullBackupType, SQLBackupType} {
+		gz, plain := backups(btype)
+		if !IsCompressedBackup(gz) || IsCompressedBackup(plain) {
+			t.Fatalf("expected one %s backup compressed, got %s and %s", btype, gz, plain)
+		}
+		gzInfo, _ := os.Stat(gz)
+		plainInfo, _ := os.Stat(plain)
+		if gzInfo.Size() >= plainInfo.Size() {
+			t.Errorf("expected %s to be smaller than %s: %d >= %d bytes", gz, plain, gzInfo.Size(), plainInfo.Size())
+		}
+	}
+
+	// A compressed full backup restores the source byte for byte
+	gz, _ := backups(FullBackupType)
+	target := filepath.Join(t.TempDir(), "dewey.db")
+	if err := RestoreBackup(gz, target, FullBackupType); err != nil {
+		t.Fatalf("restore of %s failed: %v", gz, err)
+	}
+	want, _ := os.ReadFile(src)
+	if got, _ := os.ReadFile(target); !bytes.Equal(got, want) {
+		t.Errorf("expected the restored DB to match the source byte for byte")
+	}
+	// A compressed dump restores the same DB as the plain one
+	gz, plain := backups(SQLBackupType)
+	var restored [][]byte
+	for _, backup := range []string{gz, plain} {
+		target := filepath.Join(t.TempDir(), "dewey.db")
+		if err := RestoreFromSQLDump(backup, target); err != nil {
+			t.Fatalf("restore of %s failed: %v", backup, err)
+		}
+		data, _ := os.ReadFile(target)
+		restored = append(restored, data)
+	}
+	if !bytes.Equal(restored[0], restored[1]) {
+		t.Errorf("expected %s and %s to restore identical DBs", gz, plain)
+	}
+	if n := countManufacturers(t, target); n != 2 {
+		t.Errorf("expected 2 manufacturers, got %d", n)
+	}
+}
+
+func TestRestoreBackupRefusesOpenDBAndKeepsSafetyCopy(t *testing.T) {
+	src := newDumpFixture(t)
+	full := filepath.Join(t.TempDir(), "full.db")
+	if _, err := FullBackup(src, full); err != nil {
+		t.Fatalf("FullBackup failed: %v", err)
+	}
+	dump := filepath.Join(t.TempDir(), "dump.sql")
+	if _, err := SQLDump(src, dump, nil); err != nil {
+		t.Fatalf("SQLDump failed: %v", err)
+	}
+
+	for btype, backup := range map[BackupType]string{FullBackupType: full, SQLBackupType: dump} {
+		t.Run(string(btype), func(t *testing.T) {
+			dir := t.TempDir()
+			target := filepath.Join(dir, "dewey.db")
+			live := InitDB(target)
+			defer live.Close()
+			if _, err := live.Exec(`CREATE TABLE manufacturer (id INTEGER PRIMARY KEY, name TEXT); INSERT INTO manufacturer (name) VALUES ('Live');`); err != nil {
+				t.Fatal(err)
+			}
+			if err := RestoreBackup(backup, target, btype); !errors.Is(err, ErrDBInUse) {
+				t.Fatalf("expected ErrDBInUse while the DB is open, got %v", err)
+			}
+			if n := countManufacturers(t, target); n != 1 {
+				t.Fatalf("expected the refused restore to leave the live DB, got %d rows", n)
+			}
+
+			if err := RestoreBackupWithOptions(backup, target, btype, RestoreOptions{Force: true}); err != nil {
+				t.Fatalf("forced restore failed: %v", err)
+			}
+			live.Close()
+			if n := countManufacturers(t, target); n != 2 {
+				t.Errorf("expected 2 restored manufacturers, got %d", n)
+			}
+			copies, _ := filepath.Glob(target + preRestoreSuffix + "*")
+			if len(copies) != 1 {
+				t.Fatalf("expected one safety copy, got %v", copies)
+			}
+			if n := countManufacturers(t, copies[0]); n != 1 {
+				t.Errorf("expected the safety copy to hold the old DB, got %d rows", n)
+			}
+
+			// Once closed, the DB restores without Force, keeping the first
+			// safety copy even within the same second
+			if err := RestoreBackup(backup, target, btype); err != nil {
+				t.Errorf("restore of a closed DB failed: %v", err)
+			}
+			if n := countManufacturers(t, copies[0]); n != 1 {
+				t.Errorf("expected the first safety copy kept, got %d rows", n)
+			}
+			if again, _ := filepath.Glob(target + preRestoreSuffix + "*"); len(again) != 2 {
+				t.Errorf("expected two safety copies, got %v", again)
+			}
+		})
+	}
+}
+
+func TestRestoreMovesOldWALIntoSafetyCopy(t *testing.T) {
+	src := newDumpFixture(t)
+	backup := filepath.Join(t.TempDir(), "full.db")
+	if _, err := FullBackup(src, backup); err != nil {
+		t.Fatalf("FullBackup failed: %v", err)
+	}
+	// A DB whose last commit is only in its WAL, as left by a crash
+	live := filepath.Join(t.TempDir(), "live.db")
+	db, err := sql.Open("sqlite3", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`PRAGMA journal_mode=WAL; PRAGMA wal_autocheckpoint=0;
+		CREATE TABLE manufacturer (id INTEGER PRIMARY KEY, name TEXT); INSERT INTO manufacturer (name) VALUES ('Live');`); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(t.TempDir(), "dewey.db")
+	for _, suffix := range []string{"", "-wal"} {
+		raw, err := os.ReadFile(live + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target+suffix, raw, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RestoreBackup(backup, target, FullBackupType); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	if n := countManufacturers(t, target); n != 2 {
+		t.Errorf("expected 2 restored manufacturers, got %d", n)
+	}
+	copies, _ := filepath.Glob(target + preRestoreSuffix + "*-wal")
+	if len(copies) != 1 {
+		t.Fatalf("expected the old WAL beside the safety copy, got %v", copies)
+	}
+	if n := countManufacturers(t, strings.TrimSuffix(copies[0], "-wal")); n != 1 {
+		t.Errorf("expected the safety copy to hold the commit from the old WAL, got %d rows", n)
+	}
+}
+
+func TestRestoreBackupRejectsCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.db")
+	if err := os.WriteFile(bad, []byte(strings.Repeat("not a database", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	badGz := filepath.Join(dir, "bad.db.gz")
+	gzipFile(t, bad, badGz)
+
+	target := filepath.Join(dir, "dewey.db")
+	if err := os.WriteFile(target, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreBackup(badGz, target, FullBackupType); err == nil {
+		t.Fatal("expected restore of a corrupt backup to fail")
+	}
+	data, err := os.ReadFile(target)
+	if err != nil || string(data) != "original" {
+		t.Errorf("live DB was modified by a failed restore")
+	}
+}
+
+func TestFreeDiskBytes(t *testing.T) {
+	free, err := FreeDiskBytes(t.TempDir())
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("FreeDiskBytes failed: %v", err)
+	}
+	if free == 0 {
+		t.Error("expected some free space in the temp dir")
+	}
+}
+
+func TestBackupRefusedWhenDiskLow(t *testing.T) {
+	src := newDumpFixture(t)
+	prevFree, prevMin := DiskFree, MinFreeDiskBytes
+	defer func() { DiskFree, MinFreeDiskBytes = prevFree, prevMin }()
+	// Enough for the reserve but not for the DB copy on top of it
+	MinFreeDiskBytes = 1024
+	DiskFree = func(string) (uint64, error) { return 2048, nil }
+
+	dir := t.TempDir()
+	full := filepath.Join(dir, "full.db")
+	if _, err := FullBackup(src, full); !errors.Is(err, ErrInsufficientDiskSpace) {
+		t.Fatalf("expected ErrInsufficientDiskSpace from FullBackup, got %v", err)
+	}
+	dump := filepath.Join(dir, "dump.sql")
+	if _, err := SQLDump(src, dump, nil); !errors.Is(err, ErrInsufficientDiskSpace) {
+		t.Fatalf("expected ErrInsufficientDiskSpace from SQLDump, got %v", err)
+	}
+	for _, p := range []string{full, dump} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("refused backup left a file at %s", p)
+		}
+	}
+
+	DiskFree = func(string) (uint64, error) { return 1 << 40, nil }
+	if _, err := FullBackup(src, full); err != nil {
+		t.Errorf("expected backup to succeed with enough space: %v", err)
+	}
+
+	// Platforms that can't measure free space don't refuse anything
+	DiskFree = func(string) (uint64, error) { return 0, errors.ErrUnsupported }
+	if err := CheckDiskSpace(dir, 1<<50); err != nil {
+		t.Errorf("expected the check to pass where free space is unknown: %v", err)
+	}
+}
+
+func TestRenderBackupPath(t *testing.T) {
+	host, _ := os.Hostname()
+	at := time.Date(2025, 6, 13, 17, 57, 48, 0, time.UTC)
+	cfg := BackupConfig{BackupRoot: "backups", PathTemplate: "{host}/{type}-{date}T{time}.db"}
+	got, err := RenderBackupPath(cfg, SQLBackupType, at)
+	if err != nil {
+		t.Fatalf("RenderBackupPath failed: %v", err)
+	}
+	want := filepath.Join("backups", host, "sql-20250613T175748.db")
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	def, err := RenderBackupPath(BackupConfig{BackupRoot: "backups"}, FullBackupType, at)
+	if err != nil || def != filepath.Join("backups", "2025", "06", "13", "full", "backup_175748.db") {
+		t.Errorf("unexpected default path %s (err %v)", def, err)
+	}
+	next, _ := RenderBackupPath(cfg, SQLBackupType, at.Add(time.Second))
+	if next == got {
+		t.Errorf("backups a second apart collided at %s", got)
+	}
+
+	for _, bad := range []string{
+		"{type}/backup.db",             // no timestamp: every backup collides
+		"{type}/backup_{time}.db",      // collides across days
+		"{date}/{time}_{unknown}.db",   // unknown token
+		"../{date}_{time}.db",          // escapes the root
+		"/var/backups/{date}{time}.db", // absolute
+	} {
+		if err := ValidateBackupPathTemplate(bad); err == nil {
+			t.Errorf("expected template %q to be rejected", bad)
+		}
+	}
+	if err := ScheduleBackups(BackupConfig{PathTemplate: "{type}.db", Interval: time.Hour}, nil); err == nil {
+		t.Error("expected ScheduleBackups to reject an invalid template")
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2025, 6, 13, 3, 0, 0, 0, time.UTC)
+	cfg := BackupConfig{
+		BackupRoot: root,
+		Retention: map[BackupType]RetentionPolicy{
+			FullBackupType: {MaxCount: 2},
+			SQLBackupType:  {MaxAge: 48 * time.Hour},
+		},
+	}
+	create := func(btype BackupType, age time.Duration) string {
+		path, err := RenderBackupPath(cfg, btype, now.Add(-age))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path += scheduledBackupExt[btype]
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte("backup"), 0644)
+		return path
+	}
+	var full, dumps, delta []string
+	for _, age := range []time.Duration{time.Hour, 25 * time.Hour, 49 * time.Hour, 240 * time.Hour} {
+		full = append(full, create(FullBackupType, age))
+		delta = append(delta, create(DeltaBackupType, age))
+	}
+	os.WriteFile(ManifestPath(full[3]), []byte("{}"), 0644)
+	// Every SQL backup is past MaxAge, but the newest must survive
+	for _, age := range []time.Duration{72 * time.Hour, 96 * time.Hour} {
+		dumps = append(dumps, create(SQLBackupType, age))
+	}
+	other := filepath.Join(root, "notes.txt")
+	os.WriteFile(other, []byte("keep"), 0644)
+
+	removed, err := PruneBackups(cfg, now)
+	if err != nil {
+		t.Fatalf("PruneBackups failed: %v", err)
+	}
+	wantRemoved := []string{full[2], full[3], dumps[1]}
+	sort.Strings(wantRemoved)
+	if !reflect.DeepEqual(removed, wantRemoved) {
+		t.Errorf("expected %v removed, got %v", wantRemoved, removed)
+	}
+	survivors := append([]string{full[0], full[1], dumps[0], other}, delta...)
+	for _, p := range survivors {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("expected %s to survive: %v", p, err)
+		}
+	}
+	for _, p := range append(wantRemoved, ManifestPath(full[3])) {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", p)
+		}
+	}
+	// The full directory of the 10-day-old backup's day is now empty
+	if _, err := os.Stat(filepath.Dir(full[3])); !os.IsNotExist(err) {
+		t.Errorf("expected the emptied directory %s to be removed", filepath.Dir(full[3]))
+	}
+
+	// Custom templates are matched too
+	cfg = BackupConfig{BackupRoot: t.TempDir(), PathTemplate: "{host}/{type}-{date}-{time}.db", Retention: map[BackupType]RetentionPolicy{FullBackupType: {MaxCount: 1}}}
+	older, newer := create(FullBackupType, 2*time.Hour), create(FullBackupType, time.Hour)
+	if removed, err := PruneBackups(cfg, now); err != nil || len(removed) != 1 || removed[0] != older {
+		t.Errorf("expected only %s removed, got %v (%v)", older, removed, err)
+	}
+	if _, err := os.Stat(newer); err != nil {
+		t.Errorf("expected the newest backup to survive: %v", err)
+	}
+}
+
+func TestReserveBackupPath(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct{ path, want string }{
+		{"backup.db", "backup.db"},
+		{"backup.db", "backup-1.db"},
+		{"backup.db", "backup-2.db"},
+		{"backup.sql.gz", "backup.sql.gz"},
+		{"backup.sql.gz", "backup-1.sql.gz"},
+	} {
+		got, err := ReserveBackupPath(filepath.Join(dir, tc.path))
+		if err != nil || got != filepath.Join(dir, tc.want) {
+			t.Errorf("%s: expected %s, got %s (%v)", tc.path, tc.want, got, err)
+		}
+	}
+}
+
+func TestScheduledBackupsInTheSameSecond(t *testing.T) {
+	src := newDumpFixture(t)
+	now := time.Date(2025, 6, 13, 3, 0, 0, 0, time.UTC)
+	cfg := BackupConfig{DBPath: src, BackupRoot: t.TempDir(), BackupTypes: []BackupType{FullBackupType, SQLBackupType}}
+	runBackups(cfg, now)
+	// A catch-up run in the same second must not overwrite the first
+	db := InitDB(src)
+	db.Exec("INSERT INTO manufacturer (name) VALUES ('Icom')")
+	db.Close()
+	runBackups(cfg, now)
+
+	for _, btype := range cfg.BackupTypes {
+		found, err := findScheduledBackups(cfg, btype, time.UTC)
+		if err != nil || len(found) != 2 {
+			t.Fatalf("expected 2 %s backups, got %v (%v)", btype, found, err)
+		}
+		first, _ := RenderBackupPath(cfg, btype, now)
+		if want := scheduledBackupFile(cfg, btype, first); found[1].path != want {
+			t.Errorf("expected the first %s backup at %s, got %s", btype, want, found[1].path)
+		}
+		if want := scheduledBackupFile(cfg, btype, strings.TrimSuffix(first, ".db")+"-1.db"); found[0].path != want {
+			t.Errorf("expected the second %s backup numbered at %s, got %s", btype, want, found[0].path)
+		}
+	}
+	found, _ := findScheduledBackups(cfg, FullBackupType, time.UTC)
+	if n := countManufacturers(t, found[1].path); n != 2 {
+		t.Errorf("expected the first backup kept as it was, got %d manufacturers", n)
+	}
+	if n := countManufacturers(t, found[0].path); n != 3 {
+		t.Errorf("expected the second backup to have the new row, got %d manufacturers", n)
+	}
+
+	// Retention counts the numbered backup as the newer one
+	cfg.Retention = map[BackupType]RetentionPolicy{FullBackupType: {MaxCount: 1}}
+	if removed, err := PruneBackups(cfg, now); err != nil || len(removed) != 1 || removed[0] != found[1].path {
+		t.Errorf("expected only %s pruned, got %v (%v)", found[1].path, removed, err)
+	}
+	cfg.Retention = nil
+
+	// Under DuplicateSkip the existing backup is kept and no new one taken
+	cfg.OnDuplicate = DuplicateSkip
+	cfg.BackupTypes = []BackupType{SQLBackupType}
+	runBackups(cfg, now)
+	if dumps, _ := findScheduledBackups(cfg, SQLBackupType, time.UTC); len(dumps) != 2 {
+		t.Errorf("expected the duplicate skipped, got %d SQL backups", len(dumps))
+	}
+	if _, err := ParseDuplicateBackupPolicy("overwrite"); err == nil {
+		t.Error("expected an unknown policy to be rejected")
+	}
+}
+
+func TestReserveScheduledBackupConcurrently(t *testing.T) {
+	cfg := BackupConfig{BackupRoot: t.TempDir(), Compress: true}
+	backupPath, err := RenderBackupPath(cfg, SQLBackupType, time.Date(2025, 6, 13, 3, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Runs racing for the same second each get a name of their own
+	const runs = 8
+	paths := make(chan string, runs)
+	var wg sync.WaitGroup
+	for i := 0; i < runs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path, ok, err := reserveScheduledBackup(cfg, SQLBackupType, backupPath)
+			if err != nil || !ok {
+				t.Errorf("reserve failed: ok=%v, %v", ok, err)
+			}
+			paths <- path
+		}()
+	}
+	wg.Wait()
+	close(paths)
+	seen := map[string]bool{}
+	for path := range paths {
+		if seen[path] {
+			t.Errorf("%s reserved twice", path)
+		}
+		seen[path] = true
+		if _, err := os.Stat(scheduledBackupFile(cfg, SQLBackupType, path)); err != nil {
+			t.Errorf("expected %s reserved on disk: %v", path, err)
+		}
+	}
+
+	// Under DuplicateSkip a taken name is not reserved again
+	cfg.OnDuplicate = DuplicateSkip
+	if _, ok, err := reserveScheduledBackup(cfg, SQLBackupType, backupPath); ok || err != nil {
+		t.Errorf("expected the taken name skipped, got ok=%v, %v", ok, err)
+	}
+}
+
+func TestScheduleBackupsSkipsOverlappingRuns(t *testing.T) {
+	var calls, running, maxRunning int32
+	prev := runScheduledBackup
+	defer func() { runScheduledBackup = prev }()
+	runScheduledBackup = func(BackupConfig, BackupType, string) error {
+		atomic.AddInt32(&calls, 1)
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(150 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	}
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+
+	stop := make(chan struct{})
+	cfg := BackupConfig{
+		DBPath:           filepath.Join(t.TempDir(), "dewey.db"),
+		BackupRoot:       t.TempDir(),
+		Interval:         10 * time.Millisecond,
+		MaintenanceStart: time.Now().Add(-time.Hour),
+		MaintenanceEnd:   time.Now().Add(time.Hour),
+		BackupTypes:      []BackupType{FullBackupType},
+	}
+	if err := ScheduleBackups(cfg, stop); err != nil {
+		t.Fatalf("ScheduleBackups failed: %v", err)
+	}
+	// A second schedule on the same DB must not overlap the first either
+	if err := ScheduleBackups(cfg, stop); err != nil {
+		t.Fatalf("ScheduleBackups failed: %v", err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	close(stop)
+	time.Sleep(200 * time.Millisecond)
+	// Swapping the output takes the logger's lock, so logs is safe to read after
+	log.SetOutput(os.Stderr)
+
+	if m := atomic.LoadInt32(&maxRunning); m != 1 {
+		t.Errorf("expected backups never to overlap, saw %d at once", m)
+	}
+	if calls := atomic.LoadInt32(&calls); calls == 0 || calls > 4 {
+		t.Errorf("expected a few non-overlapping runs, got %d", calls)
+	}
+	if !strings.Contains(logs.String(), "skipped: previous backup still running") {
+		t.Error("expected skipped ticks to be logged")
+	}
+}
+
+func TestHeartbeatStale(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	heartbeatNow = func() time.Time { return now }
+	defer func() { heartbeatNow = time.Now }()
+
+	StartHeartbeat("test:wedged", time.Second)
+	StartHeartbeat("test:healthy", time.Second)
+	StartHeartbeat("test:finished", time.Second)
+	defer StopHeartbeat("test:wedged")
+	defer StopHeartbeat("test:healthy")
+	StopHeartbeat("test:finished")
+
+	now = now.Add(2 * time.Second)
+	Beat("test:healthy")
+	stale := StaleLoops()
+	if len(stale) != 1 || stale[0] != "test:wedged" {
+		t.Fatalf("expected only the wedged loop to be stale, got %v", stale)
+	}
+
+	db := InitDB(filepath.Join(t.TempDir(), "health.db"))
+	defer db.Close()
+	stats, err := HealthReport(db, HealthCheckOptions{})
+	if err != nil {
+		t.Fatalf("HealthReport failed: %v", err)
+	}
+	if loops, _ := stats["stale_loops"].([]string); len(loops) != 1 || loops[0] != "test:wedged" {
+		t.Errorf("expected HealthReport to report the wedged loop, got %v", stats["stale_loops"])
+	}
+
+	Beat("test:wedged")
+	if stale := StaleLoops(); len(stale) != 0 {
+		t.Errorf("expected no stale loops after a beat, got %v", stale)
+	}
+}
+
+func TestPasswordHashCostStats(t *testing.T) {
+	db := InitDB(filepath.Join(t.TempDir(), "costs.db"))
+	defer db.Close()
+	CreateTables(db)
+	insert := func(name, hash string) {
+		if _, err := db.Exec("INSERT INTO user (username, password_hash) VALUES (?, ?)", name, hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, cost := range []int{bcrypt.MinCost, bcrypt.MinCost, bcrypt.MinCost + 1} {
+		hash, err := bcrypt.GenerateFromPassword([]byte("secret"), cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		insert(fmt.Sprintf("user%d", i), string(hash))
+	}
+	insert("legacy", "not-a-bcrypt-hash")
+
+	want := map[int]int{bcrypt.MinCost: 2, bcrypt.MinCost + 1: 1, 0: 1}
+	costs, err := PasswordHashCostStats(db)
+	if err != nil || fmt.Sprint(costs) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v (%v)", want, costs, err)
+	}
+	stats, err := HealthReport(db, HealthCheckOptions{})
+	if err != nil || fmt.Sprint(stats["password_hash_costs"]) != fmt.Sprint(want) {
+		t.Errorf("expected the health output to include %v, got %v", want, stats["password_hash_costs"])
+	}
+}
+
+func TestEnsureRBACIsIdempotent(t *testing.T) {
+	db := InitDB(filepath.Join(t.TempDir(), "rbac.db"))
+	defer db.Close()
+	CreateTables(db)
+	roles := []models.Role{{ID: 1, Name: "admin"}, {ID: 2, Name: "member"}}
+	perms := []models.Permission{{ID: 10, Name: "backup"}, {ID: 11, Name: "capture"}}
+	grants := [][2]int{{1, 10}, {1, 11}, {2, 11}}
+	for i := 0; i < 2; i++ {
+		if err := EnsureRBAC(db, roles, perms, grants); err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+	}
+	count := func(table string) int {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n)
+		return n
+	}
+	if count("role") != 2 || count("permission") != 2 || count("role_permission") != 3 {
+		t.Errorf("expected 2 roles, 2 permissions and 3 grants, got %d, %d and %d", count("role"), count("permission"), count("role_permission"))
+	}
+	rows, err := db.Query("SELECT role_id, permission_id FROM role_permission ORDER BY role_id, permission_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][2]int
+	for rows.Next() {
+		var g [2]int
+		rows.Scan(&g[0], &g[1])
+		got = append(got, g)
+	}
+	rows.Close()
+	if fmt.Sprint(got) != fmt.Sprint(grants) {
+		t.Errorf("expected grants %v, got %v", grants, got)
+	}
+
+	// Renames apply; bad grants are rejected without partial changes
+	roles[1].Name = "viewer"
+	if err := EnsureRBAC(db, roles, nil, [][2]int{{2, 10}, {3, 10}}); err == nil {
+		t.Error("expected a grant to an unknown role to fail")
+	}
+	var name string
+	if db.QueryRow("SELECT name FROM role WHERE id = 2").Scan(&name); name != "member" || count("role_permission") != 3 {
+		t.Errorf("expected the failed call to change nothing, got role %q and %d grants", name, count("role_permission"))
+	}
+	if err := EnsureRBAC(db, roles, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if db.QueryRow("SELECT name FROM role WHERE id = 2").Scan(&name); name != "viewer" {
+		t.Errorf("expected role 2 to be renamed, got %q", name)
+	}
+}
+
+func TestHealthCheckReportsDBFileSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "elsewhere", "radios.db")
+	os.Mkdir(filepath.Dir(path), 0755)
+	db := InitDB(path)
+	defer db.Close()
+	CreateTables(db)
+	for i := 0; i < 200; i++ {
+		db.Exec("INSERT INTO manufacturer (name) VALUES (?)", fmt.Sprintf("maker %03d", i))
+	}
+	stats, err := HealthCheck(db)
+	if err != nil {
+		t.Fatalf("HealthCheck failed: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.DBSize != info.Size() || info.Size() == 0 {
+		t.Errorf("expected db_size %d, got %d", info.Size(), stats.DBSize)
+	}
+
+	mem := InitDB(":memory:")
+	defer mem.Close()
+	if stats, err := HealthCheck(mem); err != nil || stats.DBSize != 0 {
+		t.Errorf("expected db_size 0 for an in-memory DB, got %d (%v)", stats.DBSize, err)
+	}
+}
+
+func TestHealthCheckReturnsDBStats(t *testing.T) {
+	db := InitDB(filepath.Join(t.TempDir(), "health.db"))
+	defer db.Close()
+	CreateTables(db)
+	db.Exec("INSERT INTO manufacturer (name) VALUES ('Motorola'), ('Kenwood')")
+	before := time.Now().UTC().Add(-time.Second)
+	stats, err := HealthCheck(db)
+	if err != nil {
+		t.Fatalf("HealthCheck failed: %v", err)
+	}
+	var counts map[string]int
+	if err := json.Unmarshal([]byte(stats.TableCounts), &counts); err != nil || counts["manufacturer"] != 2 {
+		t.Errorf("expected 2 manufacturers counted, got %q (%v)", stats.TableCounts, err)
+	}
+	taken, err := time.Parse(time.RFC3339, stats.Timestamp)
+	if err != nil || taken.Before(before.Truncate(time.Second)) {
+		t.Errorf("expected a current RFC3339 timestamp, got %q", stats.Timestamp)
+	}
+	if !stats.IntegrityOK || stats.DBSize == 0 || stats.WALStatus != "delete" || stats.LastVacuum != "0" || stats.ID != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Results are saved as db_stats snapshots as they are
+	first, err := RecordDBStats(db)
+	if err != nil || first.ID == 0 {
+		t.Fatalf("RecordDBStats failed: %+v (%v)", first, err)
+	}
+	db.Exec("INSERT INTO manufacturer (name) VALUES ('Icom')")
+	if _, err := RecordDBStats(db); err != nil {
+		t.Fatalf("RecordDBStats failed: %v", err)
+	}
+	diff, err := LatestDBStatsDiff(db)
+	if err != nil || diff.FromID != first.ID || diff.TableCountDeltas["manufacturer"] != 1 {
+		t.Errorf("expected one more manufacturer since snapshot %d, got %+v (%v)", first.ID, diff, err)
+	}
+}
+
+func TestHealthCheckFindsForeignKeyViolations(t *testing.T) {
+	db := InitDB(filepath.Join(t.TempDir(), "health.db"))
+	defer db.Close()
+	CreateTables(db)
+	db.Exec("INSERT INTO team (id, name) VALUES (1, 'ops')")
+	db.Exec("INSERT INTO team_member (id, team_id) VALUES (1, 1)")
+	if stats, err := HealthCheck(db); err != nil || !stats.IntegrityOK || stats.ForeignKeyViolations == nil || *stats.ForeignKeyViolations != 0 {
+		t.Fatalf("expected a clean DB, got %+v (%v)", stats, err)
+	}
+
+	// A member of a team that doesn't exist
+	if _, err := db.Exec("INSERT INTO team_member (id, team_id) VALUES (7, 99)"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := HealthCheck(db)
+	if err != nil || !stats.IntegrityOK || stats.ForeignKeyViolations == nil || *stats.ForeignKeyViolations != 1 {
+		t.Errorf("expected one foreign key violation, got %+v (%v)", stats, err)
+	}
+	// The quick check doesn't look
+	if stats, err := HealthCheckQuick(db); err != nil || !stats.IntegrityOK || stats.ForeignKeyViolations != nil {
+		t.Errorf("expected a quick check without foreign keys, got %+v (%v)", stats, err)
+	}
+	report, err := HealthReport(db, HealthCheckOptions{})
+	if err != nil {
+		t.Fatalf("HealthReport failed: %v", err)
+	}
+	rows, _ := report["foreign_key_violation_rows"].([]ForeignKeyViolation)
+	if report["foreign_key_violations"] != 1 || len(rows) != 1 || rows[0] != (ForeignKeyViolation{Table: "team_member", RowID: 7, Parent: "team", FKID: rows[0].FKID}) {
+		t.Errorf("expected the orphaned team_member row reported, got %v", report["foreign_key_violation_rows"])
+	}
+	if report, _ := HealthReport(db, HealthCheckOptions{Quick: true}); report["foreign_key_violations"] != nil {
+		t.Errorf("expected no foreign key count from a quick report, got %v", report["foreign_key_violations"])
+	}
+	saved, err := RecordDBStats(db)
+	if err != nil {
+		t.Fatalf("RecordDBStats failed: %v", err)
+	}
+	var count int
+	db.QueryRow("SELECT foreign_key_violations FROM db_stats WHERE id = ?", saved.ID).Scan(&count)
+	if count != 1 {
+		t.Errorf("expected the violation count saved, got %d", count)
+	}
+}
+
+func TestForeignKeyViolationsWithoutDeclaredKeys(t *testing.T) {
+	// Tables as AutoMigrate creates them, with no REFERENCES clauses
+	db := InitDB(filepath.Join(t.TempDir(), "health.db"))
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE team (id INTEGER PRIMARY KEY, name TEXT, leader_id INTEGER);
+		CREATE TABLE user (id INTEGER PRIMARY KEY, username TEXT);
+		CREATE TABLE team_member (id INTEGER PRIMARY KEY, team_id INTEGER, user_id INTEGER, role_id INTEGER);
+		INSERT INTO user (id, username) VALUES (1, 'lead');
+		INSERT INTO team (id, name, leader_id) VALUES (1, 'ops', 1), (2, 'dev', 0);
+		INSERT INTO team_member (id, team_id, user_id) VALUES (1, 1, 1), (2, 9, 1), (3, 8, 7);`); err != nil {
+		t.Fatal(err)
+	}
+	n, err := CountForeignKeyViolations(db)
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 violations, got %d (%v)", n, err)
+	}
+	all, err := ForeignKeyViolations(db, 0)
+	if err != nil || len(all) != 3 {
+		t.Fatalf("expected 3 violations listed, got %v (%v)", all, err)
+	}
+	if want := (ForeignKeyViolation{Table: "team_member", RowID: 2, Parent: "team", FKID: -1, Column: "team_id"}); all[0] != want {
+		t.Errorf("expected %+v first, got %+v", want, all[0])
+	}
+	if some, err := ForeignKeyViolations(db, 2); err != nil || len(some) != 2 {
+		t.Errorf("expected the list capped at 2, got %v (%v)", some, err)
+	}
+}
+
+func TestHealthCheckTableFilters(t *testing.T) {
+	db := InitDB(filepath.Join(t.TempDir(), "health.db"))
+	defer db.Close()
+	CreateTables(db)
+	if _, err := db.Exec(`INSERT INTO role (name) VALUES ('admin')`); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := func(opts HealthCheckOptions) map[string]int {
+		stats, err := HealthCheckWithOptions(db, opts)
+		if err != nil {
+			t.Fatalf("HealthCheck failed: %v", err)
+		}
+		var m map[string]int
+		json.Unmarshal([]byte(stats.TableCounts), &m)
+		return m
+	}
+
+	full := counts(HealthCheckOptions{})
+	for _, stub := range StubTables {
+		if _, ok := full[stub]; !ok {
+			t.Errorf("expected full output to include %s", stub)
+		}
+	}
+
+	used := counts(HealthCheckOptions{ExcludeInternal: true})
+	for _, stub := range StubTables {
+		if _, ok := used[stub]; ok {
+			t.Errorf("expected %s to be excluded", stub)
+		}
+	}
+	if _, ok := used["user"]; !ok {
+		t.Error("expected empty non-stub tables to remain without NonEmptyOnly")
+	}
+
+	nonEmpty := counts(HealthCheckOptions{NonEmptyOnly: true})
+	if len(nonEmpty) != 1 || nonEmpty["role"] != 1 {
+		t.Errorf("expected only the role table, got %v", nonEmpty)
+	}
+}
+
+func TestRestoreChecksSchemaVersion(t *testing.T) {
+	// A dump of a database from before schema versioning
+	old := filepath.Join(t.TempDir(), "old.db")
+	db := InitDB(old)
+	if _, err := db.Exec(`CREATE TABLE manufacturer (id INTEGER PRIMARY KEY, name TEXT); INSERT INTO manufacturer (name) VALUES ('Motorola');`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	dump := filepath.Join(t.TempDir(), "old.sql")
+	if _, err := SQLDump(old, dump, nil); err != nil {
+		t.Fatalf("SQLDump failed: %v", err)
+	}
+
+	target := filepath.Join(t.TempDir(), "dewey.db")
+	os.WriteFile(target, []byte("original"), 0644)
+	if err := RestoreFromSQLDump(dump, target); !errors.Is(err, ErrSchemaVersionMismatch) {
+		t.Fatalf("expected ErrSchemaVersionMismatch, got %v", err)
+	}
+	if data, _ := os.ReadFile(target); string(data) != "original" {
+		t.Error("live DB was replaced despite the version mismatch")
+	}
+
+	if err := RestoreBackupWithOptions(dump, target, SQLBackupType, RestoreOptions{MigrateSchema: true}); err != nil {
+		t.Fatalf("restore with migration failed: %v", err)
+	}
+	restored := InitDB(target)
+	defer restored.Close()
+	current, expected, err := CheckSchemaVersion(restored)
+	if err != nil || current != expected {
+		t.Errorf("expected a migrated DB at version %d, got %d (%v)", expected, current, err)
+	}
+	if n := countManufacturers(t, target); n != 1 {
+		t.Errorf("expected the dump's rows to survive migration, got %d", n)
+	}
+	var users int
+	if err := restored.QueryRow("SELECT COUNT(*) FROM user").Scan(&users); err != nil {
+		t.Errorf("expected migration to create missing tables: %v", err)
+	}
+
+	// A current dump restores without migration
+	fresh := filepath.Join(t.TempDir(), "current.sql")
+	if _, err := SQLDump(target, fresh, nil); err != nil {
+		t.Fatalf("SQLDump failed: %v", err)
+	}
+	if err := RestoreFromSQLDump(fresh, filepath.Join(t.TempDir(), "again.db")); err != nil {
+		t.Errorf("expected a current-version dump to restore, got %v", err)
+	}
+}
+
+func TestFullBackupRetriesTransientErrors(t *testing.T) {
+	SetBackupRetryPolicy(BackupRetryPolicy{Attempts: 3, Backoff: time.Millisecond})
+	defer SetBackupRetryPolicy(DefaultBackupRetryPolicy)
+	defer func() { backupCopy = io.Copy }()
+	src := newDumpFixture(t)
+	dst := filepath.Join(t.TempDir(), "backup.db")
+
+	// failing returns a backupCopy that fails with err for the first n calls
+	calls := 0
+	failing := func(n int, err error) func(io.Writer, io.Reader) (int64, error) {
+		calls = 0
+		return func(w io.Writer, r io.Reader) (int64, error) {
+			calls++
+			if calls <= n {
+				io.CopyN(w, r, 10) // leave a partial file behind
+				return 10, err
+			}
+			return io.Copy(w, r)
+		}
+	}
+
+	backupCopy = failing(1, &os.PathError{Op: "write", Path: dst, Err: os.ErrDeadlineExceeded})
+	result, err := FullBackup(src, dst)
+	if err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	if sum, _ := FileChecksum(dst); calls != 2 || sum != result.Checksum {
+		t.Errorf("expected a complete backup on the second attempt, got %d calls", calls)
+	}
+
+	backupCopy = failing(10, syscall.EIO)
+	if _, err := FullBackup(src, dst); err == nil || !errors.Is(err, syscall.EIO) || calls != 3 {
+		t.Errorf("expected to give up after 3 attempts, got %d calls (%v)", calls, err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Error("expected the partial backup to be removed after the final failure")
+	}
+
+	backupCopy = failing(10, syscall.EACCES)
+	if _, err := FullBackup(src, dst); err == nil || calls != 1 {
+		t.Errorf("expected no retry for a permission error, got %d calls", calls)
+	}
+	backupCopy = io.Copy
+	if _, err := FullBackup(filepath.Join(t.TempDir(), "missing.db"), dst); !os.IsNotExist(err) {
+		t.Errorf("expected a missing source to fail immediately, got %v", err)
+	}
+}
+
+func TestCanceledBackupLeavesNoFiles(t *testing.T) {
+	defer func() { backupCopy = io.Copy }()
+	src := newDumpFixture(t)
+	dst := filepath.Join(t.TempDir(), "backup.db")
+
+	// A throttled copy that only moves a few bytes at a time
+	calls := 0
+	backupCopy = func(w io.Writer, r io.Reader) (int64, error) {
+		calls++
+		buf := make([]byte, 64)
+		var n int64
+		for {
+			time.Sleep(time.Millisecond)
+			m, err := r.Read(buf)
+			if m > 0 {
+				w.Write(buf[:m])
+				n += int64(m)
+			}
+			if err == io.EOF {
+				return n, nil
+			}
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := FullBackupContext(ctx, src, dst); !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Fatalf("expected the backup to be canceled without retries, got %d calls (%v)", calls, err)
+	}
+	for _, p := range []string{dst, ManifestPath(dst)} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("expected no %s after cancellation", p)
+		}
+	}
+
+	dumpPath := filepath.Join(t.TempDir(), "dump.sql")
+	if _, err := SQLDumpContext(ctx, src, dumpPath, DumpOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the dump to be canceled, got %v", err)
+	}
+	if _, err := os.Stat(dumpPath); !os.IsNotExist(err) {
+		t.Error("expected no partial dump after cancellation")
+	}
+	db, err := sql.Open("sqlite3", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	partialPath := filepath.Join(t.TempDir(), "partial.sql")
+	if _, err := PartialBackupScopedContext(ctx, db, partialPath, BackupScope{Tables: []string{"manufacturer"}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the partial backup to be canceled, got %v", err)
+	}
+	if _, err := os.Stat(partialPath); !os.IsNotExist(err) {
+		t.Error("expected no partial backup file after cancellation")
+	}
+
+	// A canceled restore leaves the live DB as it was
+	backupCopy = io.Copy
+	if _, err := FullBackup(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	live := filepath.Join(t.TempDir(), "live.db")
+	os.WriteFile(live, []byte("live"), 0644)
+	if err := RestoreBackupContext(ctx, dst, live, FullBackupType, RestoreOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the restore to be canceled, got %v", err)
+	}
+	if data, _ := os.ReadFile(live); string(data) != "live" {
+		t.Error("expected the live DB to be untouched")
+	}
+	if _, err := os.Stat(live + ".restore"); !os.IsNotExist(err) {
+		t.Error("expected the temporary restore file to be removed")
+	}
+}
+
+func TestFullBackupDBCheckpointsFirst(t *testing.T) {
+	db, live := newWALFixture(t)
+	if _, err := db.Exec("INSERT INTO manufacturer (name) VALUES ('Icom');"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(live + "-wal"); err != nil || info.Size() == 0 {
+		t.Fatalf("expected the writes to be in the WAL: %v", err)
+	}
+	backup := filepath.Join(t.TempDir(), "backup.db")
+	if err := FullBackupDB(db, backup); err != nil {
+		t.Fatalf("FullBackupDB failed: %v", err)
+	}
+	if info, err := os.Stat(live + "-wal"); err == nil && info.Size() != 0 {
+		t.Errorf("expected the WAL truncated, got %d bytes", info.Size())
+	}
+	// The copy alone, without any WAL, holds every write
+	if _, err := os.Stat(backup + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("expected no WAL beside the backup")
+	}
+	if n := countManufacturers(t, backup); n != 3 {
+		t.Errorf("expected 3 manufacturers in the backup, got %d", n)
+	}
+
+	mem := InitDB(":memory:")
+	defer mem.Close()
+	if err := FullBackupDB(mem, backup); err == nil {
+		t.Error("expected an in-memory DB to be refused")
+	}
+}
+
+func TestFullBackupRecordsWALPosition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.db")
+	db := InitDB(path)
+	defer db.Close()
+	for _, q := range []string{
+		"PRAGMA journal_mode=WAL;",
+		"CREATE TABLE t (v TEXT);",
+		"INSERT INTO t VALUES ('a');",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := t.TempDir()
+
+	backup := func(name string) BackupManifest {
+		t.Helper()
+		result, err := FullBackup(path, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := ReadBackupManifest(result.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Checksum != result.Checksum || result.WAL == nil || *result.WAL != m.WAL {
+			t.Errorf("manifest %+v does not match result %+v", m, result)
+		}
+		return m
+	}
+	first := backup("first.db")
+	if first.WAL == (WALPosition{}) {
+		t.Error("expected a WAL-mode backup to record a position")
+	}
+	if _, err := db.Exec("INSERT INTO t VALUES ('b'), ('c');"); err != nil {
+		t.Fatal(err)
+	}
+	second := backup("second.db")
+	if !second.WAL.After(first.WAL) {
+		t.Errorf("expected the position to advance, got %+v then %+v", first.WAL, second.WAL)
+	}
+
+	// The backup includes the rows up to its position
+	copyDB := InitDB(filepath.Join(dir, "second.db"))
+	defer copyDB.Close()
+	var n int
+	if err := copyDB.QueryRow("SELECT COUNT(*) FROM t").Scan(&n); err != nil || n != 3 {
+		t.Errorf("expected 3 rows in the backup, got %d (%v)", n, err)
+	}
+}
+
+func TestDetectSchemaDrift(t *testing.T) {
+	db := InitDB(filepath.Join(t.TempDir(), "drift.db"))
+	defer db.Close()
+	if err := createTables(db); err != nil {
+		t.Fatalf("createTables failed: %v", err)
+	}
+	issues, err := DetectSchemaDrift(db)
+	if err != nil || len(issues) != 0 {
+		t.Fatalf("expected no drift for a fresh schema, got %v (%v)", issues, err)
+	}
+
+	// manufacturer: name typed INTEGER plus a stray column; role: name missing;
+	// team gone entirely
+	for _, q := range []string{
+		`DROP TABLE manufacturer`,
+		`CREATE TABLE manufacturer (id INTEGER PRIMARY KEY, name INTEGER, country TEXT)`,
+		`DROP TABLE role`,
+		`CREATE TABLE role (id INTEGER PRIMARY KEY)`,
+		`DROP TABLE team_member`,
+		`DROP TABLE team_permission`,
+		`DROP TABLE team`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	issues, err = DetectSchemaDrift(db)
+	if err != nil {
+		t.Fatalf("DetectSchemaDrift failed: %v", err)
+	}
+	want := []DriftIssue{
+		{Table: "manufacturer", Column: "name", Kind: DriftTypeMismatch, Expected: "TEXT", Actual: "INTEGER"},
+		{Table: "manufacturer", Column: "country", Kind: DriftExtraColumn},
+		{Table: "role", Column: "name", Kind: DriftMissingColumn},
+		{Table: "team", Kind: DriftMissingTable},
+		{Table: "team_member", Kind: DriftMissingTable},
+		{Table: "team_permission", Kind: DriftMissingTable},
+	}
+	if fmt.Sprint(issues) != fmt.Sprint(want) {
+		t.Errorf("unexpected drift report:\n got %v\nwant %v", issues, want)
+	}
+}
+
+func TestArchiveOldBackups(t *testing.T) {
+	root := t.TempDir()
+	archives := filepath.Join(root, "archive")
+	mkday := func(day string) {
+		dir := filepath.Join(root, filepath.FromSlash(day), "full")
+		os.MkdirAll(dir, 0755)
+		os.WriteFile(filepath.Join(dir, "backup_120000.db"), []byte("backup "+day), 0644)
+	}
+	for _, day := range []string{"2024/01/05", "2024/01/20", "2024/02/03", "2024/02/25"} {
+		mkday(day)
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	var written []BackupArchive
+	opts := ArchiveOptions{Now: now, OnArchive: func(a BackupArchive) error {
+		written = append(written, a)
+		return nil
+	}}
+	if err := ArchiveOldBackupsWithOptions(root, 10*24*time.Hour, archives, opts); err != nil {
+		t.Fatalf("ArchiveOldBackups failed: %v", err)
+	}
+
+	entries := func(path string) []string {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("missing archive: %v", err)
+		}
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("bad archive: %v", err)
+		}
+		var names []string
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return names
+			}
+			if err != nil {
+				t.Fatalf("bad archive: %v", err)
+			}
+			names = append(names, hdr.Name)
+		}
+	}
+	jan := filepath.Join(archives, "backups_2024-01.tar.gz")
+	if got := fmt.Sprint(entries(jan)); got != "[2024/01/05/full/backup_120000.db 2024/01/20/full/backup_120000.db]" {
+		t.Errorf("unexpected January archive: %s", got)
+	}
+	if got := fmt.Sprint(entries(filepath.Join(archives, "backups_2024-02.tar.gz"))); got != "[2024/02/03/full/backup_120000.db]" {
+		t.Errorf("unexpected February archive: %s", got)
+	}
+	if len(written) != 2 || written[0].Month != "2024-01" || fmt.Sprint(written[0].Days) != "[2024/01/05 2024/01/20]" {
+		t.Errorf("unexpected archives reported: %+v", written)
+	}
+	if _, err := os.Stat(filepath.Join(root, "2024", "01")); !os.IsNotExist(err) {
+		t.Errorf("expected the emptied January directory to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "2024", "02", "03")); !os.IsNotExist(err) {
+		t.Errorf("expected 2024/02/03 to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "2024", "02", "25", "full", "backup_120000.db")); err != nil {
+		t.Errorf("expected the recent day to be left alone: %v", err)
+	}
+
+	// A late day for an archived month is added to its existing archive
+	mkday("2024/01/28")
+	if err := ArchiveOldBackupsWithOptions(root, 10*24*time.Hour, archives, ArchiveOptions{Now: now}); err != nil {
+		t.Fatalf("second ArchiveOldBackups failed: %v", err)
+	}
+	if got := len(entries(jan)); got != 3 {
+		t.Errorf("expected 3 entries in the merged January archive, got %d", got)
+	}
+}
+
+func TestSQLiteCapabilities(t *testing.T) {
+	db := InitDB(":memory:")
+	defer db.Close()
+	var version string
+	db.QueryRow("SELECT sqlite_version()").Scan(&version)
+
+	caps, err := SQLiteCapabilities(db)
+	if err != nil {
+		t.Fatalf("SQLiteCapabilities failed: %v", err)
+	}
+	if caps.Version == "" || caps.Version != version {
+		t.Errorf("expected version %q, got %q", version, caps.Version)
+	}
+	if !caps.HasOption("THREADSAFE") || !caps.HasOption("SQLITE_THREADSAFE=1") {
+		t.Errorf("expected THREADSAFE=1 among %v", caps.CompileOptions)
+	}
+	if caps.HasOption("THREADSAFE=0") || caps.HasOption("THREAD") {
+		t.Error("expected options to match by name and value only")
+	}
+	if !caps.JSON1 || !caps.VacuumInto {
+		t.Errorf("expected JSON1 and VACUUM INTO in SQLite %s: %+v", caps.Version, caps)
+	}
+	if err := caps.Require("json1"); err != nil {
+		t.Errorf("expected json1 to be available: %v", err)
+	}
+	caps.FTS5 = false
+	if err := caps.Require("fts5"); !errors.Is(err, ErrFeatureUnavailable) {
+		t.Errorf("expected ErrFeatureUnavailable for fts5, got %v", err)
+	}
+	if !versionAtLeast("3.27.0", 3, 27, 0) || versionAtLeast("3.9.2", 3, 27, 0) || !versionAtLeast("3.100", 3, 27, 0) {
+		t.Error("versionAtLeast compared versions incorrectly")
+	}
+}
+
+func TestMigrateSchemaAddsUserDeletedAt(t *testing.T) {
+	db := InitDB(":memory:")
+	defer db.Close()
+	// A version 1 database, before users could be soft-deleted
+	if _, err := db.Exec(`CREATE TABLE user (id INTEGER PRIMARY KEY, username TEXT UNIQUE, password_hash TEXT, role_id INTEGER, locked BOOLEAN, revoked BOOLEAN, last_login TEXT); PRAGMA user_version = 1;`); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateSchema(db); err != nil {
+		t.Fatalf("MigrateSchema failed: %v", err)
+	}
+	if _, err := db.Exec("UPDATE user SET deleted_at = NULL"); err != nil {
+		t.Errorf("expected user.deleted_at after migration: %v", err)
+	}
+	if current, _, err := CheckSchemaVersion(db); err != nil || current != SchemaVersion {
+		t.Errorf("expected version %d, got %d (%v)", SchemaVersion, current, err)
+	}
+}
+
+func TestMigrateSchemaFoldsUsernames(t *testing.T) {
+	db := InitDB(":memory:")
+	defer db.Close()
+	if err := createTables(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO user (id, username) VALUES (1, 'Alice'), (2, ' bob '), (3, 'carol'); PRAGMA user_version = 5;`); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateSchema(db); err != nil {
+		t.Fatalf("MigrateSchema failed: %v", err)
+	}
+	var names []string
+	rows, _ := db.Query("SELECT username FROM user ORDER BY id")
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		names = append(names, name)
+	}
+	rows.Close()
+	if fmt.Sprint(names) != "[alice bob carol]" {
+		t.Errorf("expected folded usernames, got %q", names)
+	}
+
+	// Names that fold together are refused and left alone
+	if _, err := db.Exec(`INSERT INTO user (id, username) VALUES (4, 'ALICE'); PRAGMA user_version = 5;`); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateSchema(db); !errors.Is(err, ErrUsernameCollision) {
+		t.Fatalf("expected ErrUsernameCollision, got %v", err)
+	}
+	var name string
+	db.QueryRow("SELECT username FROM user WHERE id = 4").Scan(&name)
+	if name != "ALICE" {
+		t.Errorf("expected the colliding name untouched, got %q", name)
+	}
+}
+
+func TestMigrateSchemaMakesGrantsUnique(t *testing.T) {
+	db := InitDB(":memory:")
+	defer db.Close()
+	// A version 6 database, whose grant tables had no unique indexes
+	if _, err := db.Exec(`CREATE TABLE role_permission (id INTEGER PRIMARY KEY, role_id INTEGER, permission_id INTEGER);
+		INSERT INTO role_permission (role_id, permission_id) VALUES (1, 1), (1, 2), (1, 1), (2, 1), (1, 2);
+		CREATE TABLE team_permission (id INTEGER PRIMARY KEY, team_id INTEGER, permission_id INTEGER);
+		INSERT INTO team_permission (team_id, permission_id) VALUES (1, 7), (1, 7);
+		PRAGMA user_version = 6;`); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateSchema(db); err != nil {
+		t.Fatalf("MigrateSchema failed: %v", err)
+	}
+	var ids []int
+	rows, _ := db.Query("SELECT id FROM role_permission ORDER BY id")
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if fmt.Sprint(ids) != "[1 2 4]" {
+		t.Errorf("expected the first of each grant kept, got %v", ids)
+	}
+	var teamGrants int
+	db.QueryRow("SELECT COUNT(*) FROM team_permission").Scan(&teamGrants)
+	if teamGrants != 1 {
+		t.Errorf("expected one team grant left, got %d", teamGrants)
+	}
+	tx, _ := db.Begin()
+	defer tx.Rollback()
+	if err := InsertRolePermission(tx, 1, 2); err != nil {
+		t.Fatalf("InsertRolePermission failed: %v", err)
+	}
+	if _, err := tx.Exec("INSERT INTO role_permission (role_id, permission_id) VALUES (1, 2)"); err == nil {
+		t.Error("expected the unique index to reject a duplicate grant")
+	}
+}
+
+func TestDiffDBStats(t *testing.T) {
+	db := InitDB(filepath.Join(t.TempDir(), "stats.db"))
+	defer db.Close()
+	if err := createTables(db); err != nil {
+		t.Fatalf("createTables failed: %v", err)
+	}
+	if _, err := LatestDBStatsDiff(db); !errors.Is(err, ErrNotEnoughDBStats) {
+		t.Fatalf("expected ErrNotEnoughDBStats without snapshots, got %v", err)
+	}
+	for _, s := range []models.DBStats{
+		{Timestamp: "2026-10-01T00:00:00Z", IntegrityOK: true, DBSize: 4096, LastVacuum: "0", WALStatus: "delete", TableCounts: `{"user":3,"team":1,"old":2}`},
+		{Timestamp: "2026-10-02T00:00:00Z", IntegrityOK: false, DBSize: 10240, LastVacuum: "0", WALStatus: "wal", TableCounts: `{"user":5,"team":1,"backup_metadata":4}`},
+	} {
+		if _, err := db.Exec(`INSERT INTO db_stats (timestamp, integrity_ok, db_size, last_vacuum, wal_status, table_counts) VALUES (?, ?, ?, ?, ?, ?)`,
+			s.Timestamp, s.IntegrityOK, s.DBSize, s.LastVacuum, s.WALStatus, s.TableCounts); err != nil {
+			t.Fatalf("failed to insert snapshot: %v", err)
+		}
+	}
+	d, err := LatestDBStatsDiff(db)
+	if err != nil {
+		t.Fatalf("LatestDBStatsDiff failed: %v", err)
+	}
+	if d.From != "2026-10-01T00:00:00Z" || d.To != "2026-10-02T00:00:00Z" || d.SizeDelta != 6144 {
+		t.Errorf("expected a 6144 byte growth from the older snapshot, got %+v", d)
+	}
+	if !d.IntegrityChanged || !d.IntegrityBefore || d.IntegrityAfter {
+		t.Errorf("expected an ok -> failed integrity transition, got %+v", d)
+	}
+	if d.LastVacuum != nil || d.WALStatus == nil || *d.WALStatus != (Change{From: "delete", To: "wal"}) {
+		t.Errorf("expected only wal_status to change, got last_vacuum %v wal_status %v", d.LastVacuum, d.WALStatus)
+	}
+	want := map[string]int{"user": 2, "backup_metadata": 4, "old": -2}
+	if fmt.Sprint(d.TableCountDeltas) != fmt.Sprint(want) {
+		t.Errorf("expected table deltas %v, got %v", want, d.TableCountDeltas)
+	}
+	if fmt.Sprint(d.AddedTables, d.RemovedTables) != "[backup_metadata] [old]" {
+		t.Errorf("expected backup_metadata added and old removed, got %v %v", d.AddedTables, d.RemovedTables)
+	}
+}
+
+func TestLiveDBFingerprint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fingerprint.db")
+	db := InitDB(path)
+	defer db.Close()
+	if err := createTables(db); err != nil {
+		t.Fatalf("createTables failed: %v", err)
+	}
+	first, err := LiveDBFingerprint(db)
+	if err != nil {
+		t.Fatalf("LiveDBFingerprint failed: %v", err)
+	}
+	if again, _ := LiveDBFingerprint(db); again != first {
+		t.Errorf("expected a stable fingerprint without writes, got %s then %s", first, again)
+	}
+	// Backup bookkeeping doesn't count as a change
+	db.Exec("INSERT INTO backup_metadata (backup_type, file_path) VALUES ('full', 'b.db')")
+	if again, _ := LiveDBFingerprint(db); again != first {
+		t.Error("expected backup_metadata rows to leave the fingerprint alone")
+	}
+	if _, err := db.Exec("INSERT INTO manufacturer (name) VALUES ('Motorola')"); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := LiveDBFingerprint(db)
+	if after == first {
+		t.Fatal("expected the fingerprint to change after an insert")
+	}
+	// An update that leaves every count and rowid alone only shows in the
+	// full fingerprint
+	full, err := FullDBFingerprint(db)
+	if err != nil {
+		t.Fatalf("FullDBFingerprint failed: %v", err)
+	}
+	db.Exec("UPDATE manufacturer SET name = 'Kenwood'")
+	if updated, _ := LiveDBFingerprint(db); updated != after {
+		t.Error("expected the cheap fingerprint to ignore an in-place update")
+	}
+	if updated, _ := FullDBFingerprint(db); updated == full {
+		t.Fatal("expected the full fingerprint to change after an update")
+	}
+
+	// Scheduled runs are skipped until the DB changes
+	var calls int32
+	prev := runScheduledBackup
+	defer func() { runScheduledBackup = prev }()
+	runScheduledBackup = func(BackupConfig, BackupType, string) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}
+	cfg := BackupConfig{DBPath: path, BackupRoot: t.TempDir(), BackupTypes: []BackupType{FullBackupType}, SkipUnchanged: true}
+	runBackups(cfg, time.Now())
+	runBackups(cfg, time.Now())
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected the unchanged DB to be backed up once, got %d runs", n)
+	}
+	db.Exec("INSERT INTO manufacturer (name) VALUES ('Hytera')")
+	runBackups(cfg, time.Now())
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected an insert to trigger another backup, got %d runs", n)
+	}
+	cfg.FullFingerprint = true
+	runBackups(cfg, time.Now())
+	db.Exec("UPDATE manufacturer SET name = 'Icom'")
+	runBackups(cfg, time.Now())
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Errorf("expected an update to trigger a backup with FullFingerprint, got %d runs", n)
+	}
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// WALPosition identifies a point in a database's write-ahead log: the WAL
+// generation, which SQLite bumps each time it restarts the log after a full
+// checkpoint, and the number of frames of that generation included.
+type WALPosition struct {
+	Checkpoint uint32 `json:"checkpoint"`
+	Frames     int64  `json:"frames"`
+}
+
+// After reports whether p is later in the log than q
+func (p WALPosition) After(q WALPosition) bool {
+	if p.Checkpoint != q.Checkpoint {
+		return p.Checkpoint > q.Checkpoint
+	}
+	return p.Frames > q.Frames
+}
+
+// walCheckpointSeq reads the checkpoint sequence number from the header of
+// the WAL at path; ok is false if there is no WAL
+func walCheckpointSeq(path string) (seq uint32, ok bool, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	var hdr [32]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil {
+		// An empty WAL has no header yet
+		if err == io.EOF {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return binary.BigEndian.Uint32(hdr[12:16]), true, nil
+}
+
+// checkpointedWALPosition runs a passive checkpoint on the DB at dbPath and
+// returns the position it reached, which the main file now contains. A DB
+// without a WAL is at the zero position.
+func checkpointedWALPosition(dbPath string) (WALPosition, error) {
+	walPath := dbPath + "-wal"
+	before, ok, err := walCheckpointSeq(walPath)
+	if err != nil || !ok {
+		return WALPosition{}, err
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return WALPosition{}, err
+	}
+	defer db.Close()
+	var busy, logFrames, checkpointed int64
+	if err := db.QueryRow("PRAGMA wal_checkpoint(PASSIVE);").Scan(&busy, &logFrames, &checkpointed); err != nil {
+		return WALPosition{}, err
+	}
+	after, _, err := walCheckpointSeq(walPath)
+	if err != nil {
+		return WALPosition{}, err
+	}
+	// A writer restarted the log meanwhile; only its start is known to be in
+	if after != before || checkpointed < 0 {
+		return WALPosition{Checkpoint: after}, nil
+	}
+	return WALPosition{Checkpoint: after, Frames: checkpointed}, nil
+}
+
+// BackupManifest is written beside a full backup as <backup>.manifest.json.
+// WAL is a position the backup is known to include; frames from the WAL
+// after it bring the backup up to date, and replaying frames it already
+// includes is harmless.
+type BackupManifest struct {
+	Source   string      `json:"source"`
+	Taken    time.Time   `json:"taken"`
+	Checksum string      `json:"checksum"`
+	WAL      WALPosition `json:"wal"`
+}
+
+// ManifestPath returns the manifest path for the backup at backupPath
+func ManifestPath(backupPath string) string {
+	return backupPath + ".manifest.json"
+}
+
+// ReadBackupManifest reads the manifest written with the backup at backupPath
+func ReadBackupManifest(backupPath string) (BackupManifest, error) {
+	var m BackupManifest
+	data, err := os.ReadFile(ManifestPath(backupPath))
+	if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(data, &m)
+}
+
+// writeBackupManifest writes m beside backupPath and syncs it
+func writeBackupManifest(backupPath string, m BackupManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(ManifestPath(backupPath))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}